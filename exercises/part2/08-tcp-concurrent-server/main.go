@@ -1,26 +1,48 @@
 // tcp-concurrent-server: A TCP server handling each connection concurrently with goroutines
+//
+// Behind a proxy that sends the PROXY protocol (such as 15-tcp-proxy
+// with -proxy-protocol), run it with -proxy-protocol so RemoteAddr
+// reports the real client rather than the proxy; see proxyproto.go.
 package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
 	"net"
 )
 
 func handleConn(conn net.Conn) {
 	defer conn.Close()
+	fmt.Println("Client connected:", conn.RemoteAddr())
 	scanner := bufio.NewScanner(conn)
 	for scanner.Scan() {
 		text := scanner.Text()
 		fmt.Fprintf(conn, "Echo: %s\n", text)
 	}
+	if err := scanner.Err(); err != nil {
+		fmt.Println("Read error:", err)
+	}
 }
 
 func main() {
+	proxyProtocol := flag.Bool("proxy-protocol", false, "expect a PROXY protocol v1/v2 header naming the real client")
+	proxyFrom := flag.String("proxy-from", "", "comma-separated addresses/CIDRs allowed to send PROXY headers; others connect directly (default: every peer must)")
+	flag.Parse()
+
 	ln, err := net.Listen("tcp", ":9000")
 	if err != nil {
 		panic(err)
 	}
+	if *proxyProtocol {
+		var trusted []*net.IPNet
+		if *proxyFrom != "" {
+			if trusted, err = parseCIDRs(*proxyFrom); err != nil {
+				panic(err)
+			}
+		}
+		ln = newProxyListener(ln, trusted)
+	}
 	defer ln.Close()
 	fmt.Println("Concurrent TCP server listening on :9000")
 	for {
@@ -0,0 +1,278 @@
+package main
+
+// A listener wrapper for servers behind a proxy that speaks the PROXY
+// protocol (HAProxy's proxy-protocol.txt; 15-tcp-proxy sends it with
+// -proxy-protocol). Each accepted connection starts with a v1 or v2
+// header naming the real client; the wrapper consumes it, and the
+// connection's RemoteAddr and LocalAddr report the addresses it names.
+// Everything after the header reads as usual.
+//
+// The header is only trustworthy from the proxy itself, so
+// connections from addresses outside trusted skip parsing altogether
+// and keep their own addresses. With no trusted networks every
+// connection must carry a header, as the spec requires: guessing
+// would let any client claim to be anyone.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout bounds how long a connection may take to send its
+// header.
+const proxyHeaderTimeout = 5 * time.Second
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet // nil: every peer must send a header
+}
+
+func newProxyListener(ln net.Listener, trusted []*net.IPNet) net.Listener {
+	return &proxyListener{Listener: ln, trusted: trusted}
+}
+
+// Accept doesn't read the header itself, so one slow peer can't hold
+// up the accept loop; that happens on the connection's first Read,
+// RemoteAddr or LocalAddr.
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (l *proxyListener) isTrusted(addr net.Addr) bool {
+	if l.trusted == nil {
+		return true
+	}
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.trusted {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	once   sync.Once
+	err    error
+	remote net.Addr // nil: use the connection's own
+	local  net.Addr
+
+	mu           sync.Mutex
+	readDeadline time.Time // the caller's, put back once the header is read
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// SetDeadline and SetReadDeadline note the caller's read deadline, so
+// readHeader can restore it after applying its own.
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *proxyConn) readHeader() {
+	c.mu.Lock()
+	deadline := time.Now().Add(proxyHeaderTimeout)
+	if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+		deadline = c.readDeadline
+	}
+	c.Conn.SetReadDeadline(deadline)
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.Conn.SetReadDeadline(c.readDeadline)
+		c.mu.Unlock()
+	}()
+
+	start, err := c.r.Peek(len(proxyV2Signature))
+	switch {
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		c.err = c.readV1()
+	case err == nil && bytes.Equal(start, proxyV2Signature):
+		c.err = c.readV2()
+	case err != nil && err != io.EOF:
+		c.err = err
+	default:
+		c.err = errors.New("proxy protocol: missing header")
+	}
+	if c.err != nil {
+		c.err = fmt.Errorf("%w (from %v)", c.err, c.Conn.RemoteAddr())
+		c.Conn.Close()
+	}
+}
+
+// readV1 parses "PROXY TCP4|TCP6 src dst sport dport\r\n", or
+// "PROXY UNKNOWN ...\r\n", which keeps the connection's own addresses.
+func (c *proxyConn) readV1() error {
+	// The longest valid line is 107 bytes.
+	var line []byte
+	for len(line) < 107 {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	text, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return errors.New("proxy protocol: v1 header too long or not CRLF terminated")
+	}
+	fields := strings.Split(text, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return fmt.Errorf("proxy protocol: bad v1 header %q", text)
+	}
+	src, err := parseV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	dst, err := parseV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+	c.remote, c.local = src, dst
+	return nil
+}
+
+func parseV1Addr(family, host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || strings.Contains(host, ":") != (family == "TCP6") {
+		return nil, fmt.Errorf("proxy protocol: bad %s address %q", family, host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxy protocol: bad port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readV2 parses the binary header: signature, version and command,
+// address family and transport, length, then the addresses. Any TLVs
+// after the addresses are skipped.
+func (c *proxyConn) readV2() error {
+	var h [16]byte
+	if _, err := io.ReadFull(c.r, h[:]); err != nil {
+		return err
+	}
+	if h[12]>>4 != 2 {
+		return fmt.Errorf("proxy protocol: unsupported version %d", h[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(h[14:]))
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return err
+	}
+	switch h[12] & 0x0f {
+	case 0x0:
+		// LOCAL: the proxy's own connection, such as a health check.
+		return nil
+	case 0x1: // PROXY
+	default:
+		return fmt.Errorf("proxy protocol: unknown command %#x", h[12]&0x0f)
+	}
+
+	var ipLen int
+	switch h[13] >> 4 {
+	case 0x1:
+		ipLen = net.IPv4len
+	case 0x2:
+		ipLen = net.IPv6len
+	default:
+		// UNSPEC or AF_UNIX: nothing a TCP address can hold.
+		return nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return errors.New("proxy protocol: v2 address block too short")
+	}
+	ports := body[2*ipLen:]
+	src := &net.TCPAddr{IP: net.IP(body[:ipLen]), Port: int(binary.BigEndian.Uint16(ports))}
+	dst := &net.TCPAddr{IP: net.IP(body[ipLen : 2*ipLen]), Port: int(binary.BigEndian.Uint16(ports[2:]))}
+	if h[13]&0x0f == 0x2 {
+		// DGRAM: the proxy relays UDP, so report UDP addresses.
+		c.remote = &net.UDPAddr{IP: src.IP, Port: src.Port}
+		c.local = &net.UDPAddr{IP: dst.IP, Port: dst.Port}
+		return nil
+	}
+	c.remote, c.local = src, dst
+	return nil
+}
+
+// parseCIDRs parses a comma-separated list of networks; bare addresses
+// mean just that host.
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// acceptWith sends header and then "hello" to a wrapped listener and
+// returns the accepted connection.
+func acceptWith(t *testing.T, trusted []*net.IPNet, header string) net.Conn {
+	t.Helper()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := newProxyListener(inner, trusted)
+	t.Cleanup(func() { ln.Close() })
+	client, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	go io.WriteString(client, header+"hello")
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestProxyListenerReportsRealClient(t *testing.T) {
+	v2 := "\r\n\r\n\x00\r\nQUIT\n" + "\x21\x11\x00\x0c" +
+		"\xcb\x00\x71\x07" + "\xc0\x00\x02\x0a" + "\xc8\x22" + "\x01\xbb"
+	v2v6 := "\r\n\r\n\x00\r\nQUIT\n" + "\x21\x21\x00\x27" + // 36 address bytes + a 3-byte TLV
+		"\x20\x01\x0d\xb8" + strings.Repeat("\x00", 11) + "\x01" +
+		"\x20\x01\x0d\xb8" + strings.Repeat("\x00", 11) + "\x02" +
+		"\x04\xd2" + "\x00\x50" + "\x04\x00\x00"
+	for _, tc := range []struct {
+		name, header, remote, local string
+	}{
+		{"v1 tcp4", "PROXY TCP4 203.0.113.7 192.0.2.10 51234 443\r\n", "203.0.113.7:51234", "192.0.2.10:443"},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 1234 80\r\n", "[2001:db8::1]:1234", "[2001:db8::2]:80"},
+		{"v2 tcp4", v2, "203.0.113.7:51234", "192.0.2.10:443"},
+		{"v2 tcp6 with TLV", v2v6, "[2001:db8::1]:1234", "[2001:db8::2]:80"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := acceptWith(t, nil, tc.header)
+			if got := conn.RemoteAddr().String(); got != tc.remote {
+				t.Errorf("RemoteAddr = %s, want %s", got, tc.remote)
+			}
+			if got := conn.LocalAddr().String(); got != tc.local {
+				t.Errorf("LocalAddr = %s, want %s", got, tc.local)
+			}
+			buf := make([]byte, 5)
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+				t.Errorf("data after header: %q, %v", buf, err)
+			}
+		})
+	}
+}
+
+func TestProxyListenerKeepsOwnAddresses(t *testing.T) {
+	// UNKNOWN and LOCAL mean "use the connection's own addresses".
+	for _, header := range []string{
+		"PROXY UNKNOWN\r\n",
+		"\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00",
+	} {
+		conn := acceptWith(t, nil, header)
+		if ip := conn.RemoteAddr().(*net.TCPAddr).IP; !ip.IsLoopback() {
+			t.Errorf("%q: RemoteAddr = %v", header, ip)
+		}
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+			t.Errorf("%q: data after header: %q, %v", header, buf, err)
+		}
+	}
+}
+
+func TestProxyListenerRejectsMissingOrBadHeaders(t *testing.T) {
+	for _, header := range []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"PROXY TCP4 2001:db8::1 192.0.2.1 1 2\r\n",
+		"PROXY TCP4 203.0.113.7 192.0.2.10 51234 99999\r\n",
+		"PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n",
+	} {
+		conn := acceptWith(t, nil, header)
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Errorf("%q accepted", header)
+		}
+	}
+
+	// Outside the trusted networks a header is just data: a client
+	// can't use one to impersonate someone else.
+	_, elsewhere, _ := net.ParseCIDR("192.0.2.0/24")
+	conn := acceptWith(t, []*net.IPNet{elsewhere}, "PROXY TCP4 203.0.113.7 192.0.2.10 1 2\r\n")
+	if ip := conn.RemoteAddr().(*net.TCPAddr).IP; !ip.IsLoopback() {
+		t.Errorf("untrusted peer claimed %v", ip)
+	}
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "PROXY " {
+		t.Errorf("untrusted peer's bytes: %q, %v", buf, err)
+	}
+}
+
+// A deadline set before the first Read still applies once the header
+// has been read with its own timeout.
+func TestProxyListenerKeepsCallerDeadline(t *testing.T) {
+	conn := acceptWith(t, nil, "PROXY TCP4 203.0.113.7 192.0.2.10 56324 443\r\n")
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(buf)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("read after the deadline: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the caller's deadline was cleared")
+	}
+}
@@ -0,0 +1,7 @@
+module websocket-native-client
+
+go 1.24.4
+
+require websocket-native-server v0.0.0
+
+replace websocket-native-server => ../12-websocket-native-server
@@ -1,69 +1,210 @@
 // main.go
 // Minimal WebSocket client using only Go's standard library (no gorilla/websocket)
-// Note: This is for educational purposes and only supports simple text frames.
+// Note: The handshake and framing come from the ws package of the native server
+// exercise (../12-websocket-native-server/ws), which go.mod points at.
+// This is for educational purposes and not recommended for production.
 package main
 
 import (
 	"bufio"
-	"crypto/rand"
-	"encoding/base64"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"net"
+	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"time"
+
+	"websocket-native-server/ws"
 )
 
+// readEchoes prints every message from the server until the connection
+// ends, telling echoed about each one until stopping is closed.
+func readEchoes(c *ws.Conn, echoed chan<- struct{}, stopping <-chan struct{}) {
+	for {
+		opcode, msg, err := c.ReadMessage()
+		var ce *ws.CloseError
+		switch {
+		case errors.As(err, &ce) && ce.Code == ws.CloseNormal:
+			return
+		case err != nil:
+			fmt.Println("error:", err)
+			return
+		case opcode == ws.OpBinary:
+			fmt.Printf("Echo: %d bytes of binary\n", len(msg))
+		default:
+			fmt.Println("Echo:", string(msg))
+		}
+		select {
+		case echoed <- struct{}{}:
+		case <-stopping:
+		}
+	}
+}
+
+// sendFile streams a file as one binary message, a frame at a time, so
+// it never has to fit in memory. If reading the file fails partway the
+// connection is dropped: finishing the message would hand the server a
+// truncated file that looks complete.
+func sendFile(c *ws.Conn, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w, err := c.NextWriter(ws.OpBinary)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		c.Close()
+		return err
+	}
+	return w.Close()
+}
+
 func main() {
-	// Connect to the server
-	conn, err := net.Dial("tcp", "localhost:8082")
+	url := flag.String("url", "ws://localhost:8082/ws", "server URL, ws:// or wss://")
+	origin := flag.String("origin", "", "Origin header to send, as a browser page would")
+	subprotocols := flag.String("subprotocols", "", "comma-separated subprotocols to offer, in order of preference")
+	caFile := flag.String("ca", "", "CA bundle to verify a wss:// server's certificate with")
+	compress := flag.Bool("compress", false, "offer permessage-deflate compression")
+	pingEvery := flag.Duration("ping", 30*time.Second, "how often to ping the server; it's given up on if two go unanswered (0 disables)")
+	file := flag.String("file", "", "send this file as a binary message before reading input")
+	header := http.Header{}
+	flag.Func("H", `extra request header, "Name: value" (repeatable)`, func(s string) error {
+		name, value, ok := strings.Cut(s, ":")
+		if !ok {
+			return fmt.Errorf("%q isn't Name: value", s)
+		}
+		header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+		return nil
+	})
+	flag.Parse()
+
+	var dialer ws.Dialer
+	if *origin != "" {
+		header.Set("Origin", *origin)
+	}
+	if *subprotocols != "" {
+		dialer.Subprotocols = strings.Split(*subprotocols, ",")
+	}
+	if *compress {
+		dialer.Compression = &ws.Compression{MinSize: 64}
+	}
+	if *caFile != "" {
+		pem, err := os.ReadFile(*caFile)
+		if err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			fmt.Println("error: no certificates in", *caFile)
+			os.Exit(1)
+		}
+		dialer.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+
+	// Ctrl+C cancels the dial, or once connected closes the connection
+	// cleanly.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	c, _, err := dialer.DialContext(ctx, *url, header)
 	if err != nil {
-		panic(err)
+		fmt.Println("Handshake failed:", err)
+		os.Exit(1)
 	}
-	defer conn.Close()
-	// Generate a random key for the handshake
-	keyBytes := make([]byte, 16)
-	rand.Read(keyBytes)
-	key := base64.StdEncoding.EncodeToString(keyBytes)
-	// Send the handshake request
-	req := "GET /ws HTTP/1.1\r\n" +
-		"Host: localhost:8082\r\n" +
-		"Upgrade: websocket\r\n" +
-		"Connection: Upgrade\r\n" +
-		"Sec-WebSocket-Key: " + key + "\r\n" +
-		"Sec-WebSocket-Version: 13\r\n\r\n"
-	conn.Write([]byte(req))
-	// Read handshake response
-	resp, _ := bufio.NewReader(conn).ReadString('\n')
-	if !strings.Contains(resp, "101") {
-		fmt.Println("Handshake failed:", resp)
-		return
+	defer c.Close()
+	if p := c.Subprotocol(); p != "" {
+		fmt.Println("Subprotocol:", p)
 	}
-	// Skip headers
-	for {
-		line, _ := bufio.NewReader(conn).ReadString('\n')
-		if line == "\r\n" {
-			break
+	fmt.Println("Connected! Type messages to send, Ctrl+D or Ctrl+C to quit.")
+
+	// A server that stops answering pings is dead even if TCP hasn't
+	// noticed: each pong pushes the read deadline back.
+	var ticks <-chan time.Time
+	if *pingEvery > 0 {
+		c.NetConn().SetReadDeadline(time.Now().Add(2 * *pingEvery))
+		c.SetPongHandler(func([]byte) error {
+			return c.NetConn().SetReadDeadline(time.Now().Add(2 * *pingEvery))
+		})
+		ticker := time.NewTicker(*pingEvery)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	echoed, stopping, done := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	go func() {
+		readEchoes(c, echoed, stopping)
+		close(done)
+	}()
+	// closeAndWait starts the closing handshake and waits for the
+	// server's answer. Echoes that cross the close frame are lost, so
+	// on end of input it waits for those still due first.
+	closeAndWait := func(code int) {
+		close(stopping)
+		c.WriteClose(code, "")
+		<-done
+	}
+	pending := 0
+
+	if *file != "" {
+		if err := sendFile(c, *file); err != nil {
+			fmt.Println("error:", err)
+			return
 		}
+		pending++
 	}
-	fmt.Println("Connected! Type messages to send, Ctrl+C to quit.")
-	// Send a text frame and read echo
+
+	// Whole lines, spaces and all, each sent as one text message.
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		scanner.Buffer(nil, ws.DefaultReadLimit)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
 	for {
-		fmt.Print("> ")
-		var msg string
-		fmt.Scanln(&msg)
-		if msg == "" {
-			continue
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				if pending == 0 {
+					closeAndWait(ws.CloseNormal)
+					return
+				}
+				lines = nil
+				continue
+			}
+			if line == "" {
+				continue
+			}
+			if err := c.WriteMessage(ws.OpText, []byte(line)); err != nil {
+				fmt.Println("error:", err)
+				return
+			}
+			pending++
+		case <-echoed:
+			if pending--; pending == 0 && lines == nil {
+				closeAndWait(ws.CloseNormal)
+				return
+			}
+		case <-ticks:
+			if err := c.Ping(nil); err != nil {
+				fmt.Println("error:", err)
+				return
+			}
+		case <-ctx.Done():
+			closeAndWait(ws.CloseGoingAway)
+			return
+		case <-done:
+			return
 		}
-		// Send text frame (FIN=1, opcode=1)
-		frame := []byte{0x81, byte(len(msg))}
-		frame = append(frame, []byte(msg)...)
-		conn.Write(frame)
-		// Read echo
-		head := make([]byte, 2)
-		io.ReadFull(conn, head)
-		payloadLen := int(head[1] & 0x7F)
-		payload := make([]byte, payloadLen)
-		io.ReadFull(conn, payload)
-		fmt.Println("Echo:", string(payload))
 	}
 }
@@ -0,0 +1,3 @@
+module websocket-native-server
+
+go 1.24.4
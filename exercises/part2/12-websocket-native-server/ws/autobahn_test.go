@@ -0,0 +1,464 @@
+package ws
+
+// A conformance suite modelled on the Autobahn TestSuite
+// (https://github.com/crossbario/autobahn-testsuite), runnable offline.
+// Each case is a script of frames a fuzzer sends, the messages and
+// pongs it must get back, and the close code the connection must end
+// with. Every case runs twice: against the server side of the package
+// through Upgrader, as Autobahn's fuzzingclient does, and against the
+// client side, as its fuzzingserver does. The numbering follows
+// Autobahn's where a case has a counterpart there; cases under 11 are
+// this package's own (masking direction and the read limit).
+//
+//	go test -v -run Autobahn
+//
+// lists every case with its result, and the summary at the end names
+// any that failed.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// abFrame is a frame the fuzzer sends, or a message or pong it
+// expects back.
+type abFrame struct {
+	first     byte // FIN, RSV bits and opcode
+	payload   []byte
+	wrongMask bool // masked toward a client, or unmasked toward a server
+}
+
+func text(s string) abFrame      { return abFrame{first: 0x80 | OpText, payload: []byte(s)} }
+func binaryMsg(b []byte) abFrame { return abFrame{first: 0x80 | OpBinary, payload: b} }
+func ping(s string) abFrame      { return abFrame{first: 0x80 | OpPing, payload: []byte(s)} }
+func pong(s string) abFrame      { return abFrame{first: 0x80 | OpPong, payload: []byte(s)} }
+
+func closeFrame(code int, reason string) abFrame {
+	return abFrame{first: 0x80 | OpClose, payload: closePayload(code, reason)}
+}
+
+// fragments splits a message into frames of size bytes.
+func fragments(opcode byte, payload []byte, size int) []abFrame {
+	var out []abFrame
+	for first := true; first || len(payload) > 0; first = false {
+		n := min(size, len(payload))
+		f := abFrame{first: OpContinuation, payload: payload[:n]}
+		if first {
+			f.first = opcode
+		}
+		payload = payload[n:]
+		if len(payload) == 0 {
+			f.first |= 0x80
+		}
+		out = append(out, f)
+	}
+	return out
+}
+
+type abCase struct {
+	id, name string
+	send     []abFrame
+	chop     int // write the frames in pieces this size, 0 for a frame per write
+	want     []abFrame
+	// code is what the subject's close frame must carry: CloseNormal
+	// for a case that should go through cleanly (the fuzzer closes
+	// with 1000 after its frames, unless the script closes itself),
+	// the failure code for one that shouldn't, and CloseNoStatus for
+	// an empty close frame.
+	code  int
+	limit int64
+}
+
+func autobahnCases() []abCase {
+	var cases []abCase
+	add := func(id, name string, c abCase) {
+		c.id, c.name = id, name
+		if c.code == 0 {
+			c.code = CloseNormal
+		}
+		cases = append(cases, c)
+	}
+	bytesOf := func(n int, b byte) []byte { return bytes.Repeat([]byte{b}, n) }
+
+	// 1 Framing: payload lengths either side of each length form.
+	for i, n := range []int{0, 125, 126, 127, 128, 65535, 65536} {
+		t := strings.Repeat("*", n)
+		add(fmt.Sprintf("1.1.%d", i+1), fmt.Sprintf("text, %d bytes", n), abCase{send: []abFrame{text(t)}, want: []abFrame{text(t)}})
+		b := bytesOf(n, 0xfe)
+		add(fmt.Sprintf("1.2.%d", i+1), fmt.Sprintf("binary, %d bytes", n), abCase{send: []abFrame{binaryMsg(b)}, want: []abFrame{binaryMsg(b)}})
+	}
+	big := strings.Repeat("*", 65536)
+	add("1.1.8", "text, 65536 bytes, written in 997-byte chunks", abCase{send: []abFrame{text(big)}, chop: 997, want: []abFrame{text(big)}})
+	add("1.2.8", "binary, 65536 bytes, written in 997-byte chunks", abCase{send: []abFrame{binaryMsg([]byte(big))}, chop: 997, want: []abFrame{binaryMsg([]byte(big))}})
+
+	// 2 Pings and pongs.
+	hello := "Hello, world!"
+	binaryPing := string([]byte{0x00, 0xff, 0xfe, 0xfd, 0xfc, 0xfb, 0x00, 0xff})
+	add("2.1", "empty ping", abCase{send: []abFrame{ping("")}, want: []abFrame{pong("")}})
+	add("2.2", "ping with text", abCase{send: []abFrame{ping(hello)}, want: []abFrame{pong(hello)}})
+	add("2.3", "ping with binary", abCase{send: []abFrame{ping(binaryPing)}, want: []abFrame{pong(binaryPing)}})
+	add("2.4", "ping with 125 bytes", abCase{send: []abFrame{ping(strings.Repeat("\xfe", 125))}, want: []abFrame{pong(strings.Repeat("\xfe", 125))}})
+	add("2.5", "ping with 126 bytes", abCase{send: []abFrame{ping(strings.Repeat("\xfe", 126))}, code: CloseProtocolError})
+	add("2.6", "ping with 125 bytes, written a byte at a time", abCase{send: []abFrame{ping(strings.Repeat("\xfe", 125))}, chop: 1, want: []abFrame{pong(strings.Repeat("\xfe", 125))}})
+	add("2.7", "unsolicited empty pong", abCase{send: []abFrame{pong("")}})
+	add("2.8", "unsolicited pong with payload", abCase{send: []abFrame{pong("unsolicited")}})
+	add("2.9", "unsolicited pong, then a ping", abCase{send: []abFrame{pong("unsolicited"), ping("solicited")}, want: []abFrame{pong("solicited")}})
+	var pings, pongs []abFrame
+	for i := range 10 {
+		pings, pongs = append(pings, ping(fmt.Sprint("payload-", i))), append(pongs, pong(fmt.Sprint("payload-", i)))
+	}
+	add("2.10", "10 pings", abCase{send: pings, want: pongs})
+	add("2.11", "10 pings, written a byte at a time", abCase{send: pings, chop: 1, want: pongs})
+
+	// 3 Reserved bits. Whatever came before the bad frame is echoed;
+	// what comes after it isn't.
+	add("3.1", "text with RSV1", abCase{send: []abFrame{{first: 0x80 | 0x40 | OpText, payload: []byte(hello)}}, code: CloseProtocolError})
+	add("3.2", "text, text with RSV2, ping", abCase{send: []abFrame{text(hello), {first: 0x80 | 0x20 | OpText, payload: []byte(hello)}, ping("")},
+		want: []abFrame{text(hello)}, code: CloseProtocolError})
+	add("3.3", "text, text with RSV1+2, ping", abCase{send: []abFrame{text(hello), {first: 0x80 | 0x60 | OpText, payload: []byte(hello)}, ping("")},
+		want: []abFrame{text(hello)}, code: CloseProtocolError})
+	add("3.4", "as 3.3 with RSV3, a byte at a time", abCase{send: []abFrame{text(hello), {first: 0x80 | 0x10 | OpText, payload: []byte(hello)}, ping("")},
+		chop: 1, want: []abFrame{text(hello)}, code: CloseProtocolError})
+	add("3.5", "binary with RSV1+3", abCase{send: []abFrame{{first: 0x80 | 0x50 | OpBinary, payload: []byte{0, 1, 2}}}, code: CloseProtocolError})
+	add("3.6", "ping with RSV2+3", abCase{send: []abFrame{{first: 0x80 | 0x30 | OpPing, payload: []byte(hello)}}, code: CloseProtocolError})
+	add("3.7", "close with all RSV bits", abCase{send: []abFrame{{first: 0x80 | 0x70 | OpClose, payload: closePayload(CloseNormal, "")}}, code: CloseProtocolError})
+
+	// 4 Reserved opcodes, data (3-7) and control (11-15).
+	for i, op := range []byte{3, 4, 5, 6, 7} {
+		ctl := op + 8
+		switch i {
+		case 0, 1:
+			var p []byte
+			if i == 1 {
+				p = []byte("reserved")
+			}
+			add(fmt.Sprintf("4.1.%d", i+1), fmt.Sprintf("opcode %d", op), abCase{send: []abFrame{{first: 0x80 | op, payload: p}}, code: CloseProtocolError})
+			add(fmt.Sprintf("4.2.%d", i+1), fmt.Sprintf("opcode %d", ctl), abCase{send: []abFrame{{first: 0x80 | ctl, payload: p}}, code: CloseProtocolError})
+		default:
+			c := abCase{want: []abFrame{text(hello)}, code: CloseProtocolError}
+			if i == 4 {
+				c.chop = 1
+			}
+			c.send = []abFrame{text(hello), {first: 0x80 | op, payload: []byte("reserved")}, ping("")}
+			add(fmt.Sprintf("4.1.%d", i+1), fmt.Sprintf("text, opcode %d, ping", op), c)
+			c.send = []abFrame{text(hello), {first: 0x80 | ctl, payload: []byte("reserved")}, ping("")}
+			add(fmt.Sprintf("4.2.%d", i+1), fmt.Sprintf("text, opcode %d, ping", ctl), c)
+		}
+	}
+
+	// 5 Fragmentation.
+	frag := func(first byte, s string) abFrame { return abFrame{first: first, payload: []byte(s)} }
+	add("5.1", "ping in 2 fragments", abCase{send: []abFrame{frag(OpPing, "frag1"), frag(0x80|OpContinuation, "frag2")}, code: CloseProtocolError})
+	add("5.2", "pong in 2 fragments", abCase{send: []abFrame{frag(OpPong, "frag1"), frag(0x80|OpContinuation, "frag2")}, code: CloseProtocolError})
+	twoFrags := []abFrame{frag(OpText, "fragment1"), frag(0x80|OpContinuation, "fragment2")}
+	add("5.3", "text in 2 fragments", abCase{send: twoFrags, want: []abFrame{text("fragment1fragment2")}})
+	add("5.4", "text in 2 fragments, a byte at a time", abCase{send: twoFrags, chop: 1, want: []abFrame{text("fragment1fragment2")}})
+	withPing := []abFrame{frag(OpText, "fragment1"), ping("pongme!"), frag(0x80|OpContinuation, "fragment2")}
+	add("5.6", "text in 2 fragments, ping between them", abCase{send: withPing, want: []abFrame{pong("pongme!"), text("fragment1fragment2")}})
+	add("5.7", "as 5.6, a byte at a time", abCase{send: withPing, chop: 1, want: []abFrame{pong("pongme!"), text("fragment1fragment2")}})
+	orphan := []abFrame{frag(0x80|OpContinuation, "non-continuation payload"), frag(OpText, "fragment1"), frag(0x80|OpContinuation, "fragment2")}
+	add("5.9", "finished continuation with nothing to continue", abCase{send: orphan, code: CloseProtocolError})
+	add("5.10", "as 5.9, a byte at a time", abCase{send: orphan, chop: 1, code: CloseProtocolError})
+	orphan[0].first = OpContinuation
+	add("5.12", "unfinished continuation with nothing to continue", abCase{send: orphan, code: CloseProtocolError})
+	add("5.13", "as 5.12, a byte at a time", abCase{send: orphan, chop: 1, code: CloseProtocolError})
+	add("5.15", "text in 2 fragments, then 2 continuations", abCase{send: append(slices.Clone(twoFrags), frag(OpContinuation, "fragment3"), frag(0x80|OpContinuation, "fragment4")),
+		want: []abFrame{text("fragment1fragment2")}, code: CloseProtocolError})
+	add("5.16", "continuation, continuation, then a message", abCase{send: []abFrame{frag(OpContinuation, "fragment1"), frag(0x80|OpContinuation, "fragment2"), text("fragment3")}, code: CloseProtocolError})
+	add("5.18", "text, then another text before the first finished", abCase{send: []abFrame{frag(OpText, "fragment1"), frag(0x80|OpText, "fragment2")}, code: CloseProtocolError})
+	five := []abFrame{frag(OpText, "fragment1"), frag(OpContinuation, "fragment2"), ping("pongme 1!"),
+		frag(OpContinuation, "fragment3"), frag(OpContinuation, "fragment4"), ping("pongme 2!"), frag(0x80|OpContinuation, "fragment5")}
+	fiveWant := []abFrame{pong("pongme 1!"), pong("pongme 2!"), text("fragment1fragment2fragment3fragment4fragment5")}
+	add("5.19", "text in 5 fragments with 2 pings", abCase{send: five, want: fiveWant})
+	add("5.20", "as 5.19, a byte at a time", abCase{send: five, chop: 1, want: fiveWant})
+
+	// 6 UTF-8.
+	add("6.1.1", "empty text", abCase{send: []abFrame{text("")}, want: []abFrame{text("")}})
+	add("6.1.2", "text in 3 empty fragments", abCase{send: []abFrame{frag(OpText, ""), frag(OpContinuation, ""), frag(0x80|OpContinuation, "")}, want: []abFrame{text("")}})
+	add("6.1.3", "empty fragments around a character", abCase{send: []abFrame{frag(OpText, ""), frag(OpContinuation, "middle"), frag(0x80|OpContinuation, "")}, want: []abFrame{text("middle")}})
+	valid := []string{
+		"Hello-µ@ßöäüàá-UTF-8!!", "κόσμε", "\x00", "\u0080", "ࠀ", "\U00010000", "\u007f", "߿", "￿",
+		"\U0010ffff", "퟿", "", "�", "﷐", "￾", "\U0001fffe",
+	}
+	invalid := []string{
+		"\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5\xed\xa0\x80\x65\x64\x69\x74\x65\x64", // κόσμε, then a surrogate
+		"\xf4\x90\x80\x80", "\xf8\x88\x80\x80\x80", "\xfc\x84\x80\x80\x80\x80", // beyond U+10FFFF
+		"\x80", "\xbf", "\x80\xbf\x80\xbf", // lone continuation bytes
+		"\xc0\x20", "\xe0\x20", "\xf0\x20", // start bytes followed by a space
+		"\xc0", "\xe0\x80", "\xf0\x80\x80", "\xdf", "\xef\xbf", // sequences cut off at the end
+		"\xfe", "\xff", "\xfe\xfe\xff\xff",
+		"\xc0\xaf", "\xe0\x80\xaf", "\xf0\x80\x80\xaf", "\xc1\xbf", "\xe0\x9f\xbf", "\xc0\x80", // overlong
+		"\xed\xa0\x80", "\xed\xbf\xbf", "\xed\xa0\x80\xed\xb0\x80", // surrogates
+	}
+	for i, s := range valid {
+		add(fmt.Sprintf("6.2.%d", i+1), fmt.Sprintf("valid %q", s), abCase{send: []abFrame{text(s)}, want: []abFrame{text(s)}})
+		add(fmt.Sprintf("6.3.%d", i+1), fmt.Sprintf("valid %q, a byte per fragment", s), abCase{send: fragments(OpText, []byte(s), 1), want: []abFrame{text(s)}})
+	}
+	for i, s := range invalid {
+		add(fmt.Sprintf("6.4.%d", i+1), fmt.Sprintf("invalid %q", s), abCase{send: []abFrame{text(s)}, code: CloseInvalidPayload})
+		add(fmt.Sprintf("6.5.%d", i+1), fmt.Sprintf("invalid %q, a byte per fragment", s), abCase{send: fragments(OpText, []byte(s), 1), code: CloseInvalidPayload})
+	}
+	// Fail fast: the message is never finished, so the subject has to
+	// notice the bad bytes in the fragments it has.
+	add("6.6.1", "invalid UTF-8 in the first fragment of an unfinished message", abCase{send: []abFrame{frag(OpText, "κόσμε\xed\xa0\x80")}, code: CloseInvalidPayload})
+	add("6.6.2", "invalid UTF-8 in a middle fragment", abCase{send: []abFrame{frag(OpText, "κόσμε"), frag(OpContinuation, "\xf4\x90\x80\x80")}, code: CloseInvalidPayload})
+
+	// 7 Close handling.
+	add("7.1.1", "text, then close", abCase{send: []abFrame{text(hello), closeFrame(CloseNormal, "")}, want: []abFrame{text(hello)}})
+	add("7.1.2", "close twice", abCase{send: []abFrame{closeFrame(CloseNormal, ""), closeFrame(CloseNormal, "")}})
+	add("7.1.3", "close, then ping", abCase{send: []abFrame{closeFrame(CloseNormal, ""), ping(hello)}})
+	add("7.1.4", "close, then text", abCase{send: []abFrame{closeFrame(CloseNormal, ""), text(hello)}})
+	add("7.1.5", "fragment, close, last fragment", abCase{send: []abFrame{frag(OpText, "fragment1"), closeFrame(CloseNormal, ""), frag(0x80|OpContinuation, "fragment2")}})
+	add("7.1.6", "big text, ping and close together", abCase{send: []abFrame{text(strings.Repeat("BAsd7&jh23", 26214)), ping(hello), closeFrame(CloseNormal, "")},
+		want: []abFrame{text(strings.Repeat("BAsd7&jh23", 26214)), pong(hello)}})
+	add("7.3.1", "empty close", abCase{send: []abFrame{{first: 0x80 | OpClose}}, code: CloseNoStatus})
+	add("7.3.2", "close with a 1-byte payload", abCase{send: []abFrame{{first: 0x80 | OpClose, payload: []byte{0x03}}}, code: CloseProtocolError})
+	add("7.3.3", "close with a code", abCase{send: []abFrame{closeFrame(CloseNormal, "")}})
+	add("7.3.4", "close with a code and reason", abCase{send: []abFrame{closeFrame(CloseNormal, "Hello World!")}})
+	add("7.3.5", "close with a 123-byte reason", abCase{send: []abFrame{closeFrame(CloseNormal, strings.Repeat("*", 123))}})
+	add("7.3.6", "close with a 124-byte reason", abCase{send: []abFrame{closeFrame(CloseNormal, strings.Repeat("*", 124))}, code: CloseProtocolError})
+	add("7.5.1", "close reason that isn't UTF-8", abCase{send: []abFrame{closeFrame(CloseNormal, "κόσμε\xed\xa0\x80edited")}, code: CloseInvalidPayload})
+	for i, code := range []int{1000, 1001, 1002, 1003, 1007, 1008, 1009, 1010, 1011, 3000, 3999, 4000, 4999} {
+		add(fmt.Sprintf("7.7.%d", i+1), fmt.Sprintf("close code %d", code), abCase{send: []abFrame{closeFrame(code, "")}, code: code})
+	}
+	for i, code := range []int{0, 999, 1004, 1005, 1006, 1012, 1013, 1014, 1015, 1016, 1100, 2000, 2999, 5000, 65535} {
+		add(fmt.Sprintf("7.9.%d", i+1), fmt.Sprintf("invalid close code %d", code), abCase{send: []abFrame{closeFrame(code, "")}, code: CloseProtocolError})
+	}
+
+	// 9 Big messages, whole and in fragments.
+	for i, n := range []int{64 << 10, 256 << 10, 1 << 20, 4 << 20, 8 << 20, 16 << 20} {
+		t := strings.Repeat("*", n)
+		add(fmt.Sprintf("9.1.%d", i+1), fmt.Sprintf("text, %d bytes", n), abCase{send: []abFrame{text(t)}, want: []abFrame{text(t)}})
+		b := bytesOf(n, 0xfe)
+		add(fmt.Sprintf("9.2.%d", i+1), fmt.Sprintf("binary, %d bytes", n), abCase{send: []abFrame{binaryMsg(b)}, want: []abFrame{binaryMsg(b)}})
+	}
+	for i, size := range []int{64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20} {
+		t := bytes.Repeat([]byte("*"), 4<<20)
+		add(fmt.Sprintf("9.3.%d", i+1), fmt.Sprintf("4 MiB text in %d-byte fragments", size), abCase{send: fragments(OpText, t, size), want: []abFrame{text(string(t))}})
+		b := bytesOf(4<<20, 0xfe)
+		add(fmt.Sprintf("9.4.%d", i+1), fmt.Sprintf("4 MiB binary in %d-byte fragments", size), abCase{send: fragments(OpBinary, b, size), want: []abFrame{binaryMsg(b)}})
+	}
+
+	// 10 Miscellaneous.
+	add("10.1.1", "64 KiB text, 1300-byte fragments", abCase{send: fragments(OpText, []byte(big), 1300), want: []abFrame{text(big)}})
+
+	// 11 This package's own: masking in the wrong direction, and the
+	// read limit.
+	add("11.1.1", "frame masked the wrong way", abCase{send: []abFrame{{first: 0x80 | OpText, payload: []byte(hello), wrongMask: true}}, code: CloseProtocolError})
+	add("11.1.2", "text, then a ping masked the wrong way", abCase{send: []abFrame{text(hello), {first: 0x80 | OpPing, wrongMask: true}},
+		want: []abFrame{text(hello)}, code: CloseProtocolError})
+	add("11.2.1", "message at the read limit", abCase{send: []abFrame{binaryMsg(bytesOf(1024, 1))}, want: []abFrame{binaryMsg(bytesOf(1024, 1))}, limit: 1024})
+	add("11.2.2", "message over the read limit", abCase{send: []abFrame{binaryMsg(bytesOf(1025, 1))}, code: CloseTooBig, limit: 1024})
+	add("11.2.3", "fragments adding up to over the read limit", abCase{send: fragments(OpText, bytesOf(1025, 'a'), 100), code: CloseTooBig, limit: 1024})
+	add("11.2.4", "64-bit length far over the read limit", abCase{send: []abFrame{{first: 0x80 | OpBinary, payload: nil}}, code: CloseTooBig, limit: 1024})
+	return cases
+}
+
+// fuzzer plays the peer of the connection under test.
+type fuzzer struct {
+	conn     net.Conn
+	br       *bufio.Reader
+	toServer bool // the subject is a server: mask what we send, expect unmasked frames
+}
+
+// encode lays out the frames the way the fuzzer sends them.
+func (f *fuzzer) encode(c abCase) [][]byte {
+	var out [][]byte
+	for i, fr := range c.send {
+		h := header{fin: fr.first&0x80 != 0, rsv: fr.first & 0x70, opcode: fr.first & 0x0F,
+			masked: f.toServer != fr.wrongMask, mask: [4]byte{0x37, 0xfa, 0x21, byte(i)}, length: int64(len(fr.payload))}
+		if c.id == "11.2.4" {
+			// Claim a length that could never be buffered.
+			h.length = 1 << 40
+		}
+		b := appendHeader(nil, h)
+		start := len(b)
+		b = append(b, fr.payload...)
+		if h.masked {
+			maskBytes(h.mask, 0, b[start:])
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+func (f *fuzzer) send(frames [][]byte, chop int) {
+	for _, b := range frames {
+		for len(b) > 0 {
+			n := len(b)
+			if chop > 0 {
+				n = min(chop, n)
+			}
+			if _, err := f.conn.Write(b[:n]); err != nil {
+				return // the subject has given up on us, which the reader will judge
+			}
+			b = b[n:]
+		}
+	}
+}
+
+// next returns the next message, put together from its fragments, or
+// control frame.
+func (f *fuzzer) next() (abFrame, error) {
+	var msg abFrame
+	started := false
+	for {
+		h, err := readHeader(f.br)
+		if err != nil {
+			return abFrame{}, err
+		}
+		if h.rsv != 0 {
+			return abFrame{}, errors.New("frame with reserved bits set")
+		}
+		if h.masked == f.toServer {
+			return abFrame{}, fmt.Errorf("frame with mask bit %v", h.masked)
+		}
+		p := make([]byte, h.length)
+		if _, err := io.ReadFull(f.br, p); err != nil {
+			return abFrame{}, err
+		}
+		if h.masked {
+			maskBytes(h.mask, 0, p)
+		}
+		switch {
+		case isControl(h.opcode):
+			return abFrame{first: 0x80 | h.opcode, payload: p}, nil
+		case h.opcode == OpContinuation && !started, h.opcode != OpContinuation && started:
+			return abFrame{}, errors.New("badly fragmented message")
+		}
+		if !started {
+			msg, started = abFrame{first: 0x80 | h.opcode}, true
+		}
+		msg.payload = append(msg.payload, p...)
+		if h.fin {
+			return msg, nil
+		}
+	}
+}
+
+func describe(f abFrame) string {
+	p := f.payload
+	if len(p) > 40 {
+		return fmt.Sprintf("opcode %d with %d bytes %q...", f.first&0x0F, len(p), p[:40])
+	}
+	return fmt.Sprintf("opcode %d %q", f.first&0x0F, p)
+}
+
+// run plays c and reports how the subject fell short, if it did.
+func (f *fuzzer) run(c abCase) error {
+	f.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	send := c.send
+	if c.code == CloseNormal && !slices.ContainsFunc(send, func(fr abFrame) bool { return fr.first&0x0F == OpClose }) {
+		send = append(slices.Clone(send), closeFrame(CloseNormal, ""))
+	}
+	frames := f.encode(abCase{id: c.id, send: send})
+	go f.send(frames, c.chop)
+
+	for i, want := range c.want {
+		got, err := f.next()
+		if err != nil {
+			return fmt.Errorf("reply %d: %v, want %s", i+1, err, describe(want))
+		}
+		if got.first != want.first || !bytes.Equal(got.payload, want.payload) {
+			return fmt.Errorf("reply %d: got %s, want %s", i+1, describe(got), describe(want))
+		}
+	}
+	got, err := f.next()
+	if err != nil {
+		return fmt.Errorf("waiting for the close frame: %v", err)
+	}
+	if got.first&0x0F != OpClose {
+		return fmt.Errorf("got %s, want a close frame", describe(got))
+	}
+	switch {
+	case c.code == CloseNoStatus && len(got.payload) != 0:
+		return fmt.Errorf("close frame %q, want an empty one", got.payload)
+	case c.code != CloseNoStatus && (len(got.payload) < 2 || int(binary.BigEndian.Uint16(got.payload)) != c.code):
+		return fmt.Errorf("close frame %q, want code %d", got.payload, c.code)
+	}
+	if !f.toServer {
+		// The server closes TCP first; the client should follow.
+		f.conn.(*net.TCPConn).CloseWrite()
+	}
+	if _, err := f.br.ReadByte(); err != io.EOF {
+		return fmt.Errorf("after the close frame: %v, want EOF", err)
+	}
+	return nil
+}
+
+// runAutobahn runs every case against subjects made by dial, logging a
+// summary of the results.
+func runAutobahn(t *testing.T, dial func(t *testing.T, limit int64) *fuzzer) {
+	var failed []string
+	cases := autobahnCases()
+	for _, c := range cases {
+		big := slices.ContainsFunc(c.send, func(fr abFrame) bool { return len(fr.payload) > 1<<20 }) || len(c.send) > 1000
+		t.Run(c.id+" "+c.name, func(t *testing.T) {
+			if big && testing.Short() {
+				t.Skip("big message")
+			}
+			f := dial(t, c.limit)
+			defer f.conn.Close()
+			if err := f.run(c); err != nil {
+				failed = append(failed, c.id)
+				t.Error(err)
+			}
+		})
+	}
+	t.Logf("%d of %d cases passed", len(cases)-len(failed), len(cases))
+	if len(failed) > 0 {
+		t.Logf("failed: %s", strings.Join(failed, ", "))
+	}
+}
+
+func TestAutobahnServer(t *testing.T) {
+	runAutobahn(t, func(t *testing.T, limit int64) *fuzzer {
+		addr, _ := startEcho(t, &Upgrader{ReadLimit: limit})
+		c := dialRaw(t, addr)
+		return &fuzzer{conn: c.conn, br: c.br, toServer: true}
+	})
+}
+
+func TestAutobahnClient(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	runAutobahn(t, func(t *testing.T, limit int64) *fuzzer {
+		// The client side of a connection whose handshake is done,
+		// echoing what it reads.
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := newConn(conn, nil, true)
+		if limit > 0 {
+			c.SetReadLimit(limit)
+		}
+		go func() {
+			defer c.Close()
+			for {
+				op, msg, err := c.ReadMessage()
+				if err != nil {
+					return
+				}
+				c.WriteMessage(op, msg)
+			}
+		}()
+		server, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &fuzzer{conn: server, br: bufio.NewReader(server)}
+	})
+}
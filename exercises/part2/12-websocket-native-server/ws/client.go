@@ -0,0 +1,225 @@
+package ws
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrBadHandshake is returned, wrapped with the reason, when the server
+// answers the opening handshake with anything but a valid 101.
+var ErrBadHandshake = errors.New("websocket: bad handshake")
+
+// defaultHandshakeTimeout bounds connecting, TLS and the opening
+// handshake unless a Dialer says otherwise.
+const defaultHandshakeTimeout = 30 * time.Second
+
+// Dialer opens client connections.
+type Dialer struct {
+	// Subprotocols are offered to the server in order of preference.
+	Subprotocols []string
+	// Compression, if set, offers permessage-deflate.
+	Compression *Compression
+	// TLSClientConfig is used for wss:// URLs; nil means the defaults.
+	TLSClientConfig *tls.Config
+	// HandshakeTimeout bounds connecting, TLS and the handshake; 0
+	// means 30 seconds.
+	HandshakeTimeout time.Duration
+	// ReadLimit caps the size of an incoming message; 0 means
+	// DefaultReadLimit.
+	ReadLimit int64
+}
+
+// Dial connects to a ws:// or wss:// URL with the default Dialer.
+func Dial(urlStr string, requestHeader http.Header) (*Conn, *http.Response, error) {
+	return (&Dialer{}).DialContext(context.Background(), urlStr, requestHeader)
+}
+
+// DialContext connects to a ws:// or wss:// URL with the default
+// Dialer.
+func DialContext(ctx context.Context, urlStr string, requestHeader http.Header) (*Conn, *http.Response, error) {
+	return (&Dialer{}).DialContext(ctx, urlStr, requestHeader)
+}
+
+// Dial is DialContext with context.Background().
+func (d *Dialer) Dial(urlStr string, requestHeader http.Header) (*Conn, *http.Response, error) {
+	return d.DialContext(context.Background(), urlStr, requestHeader)
+}
+
+// DialContext connects to a ws:// or wss:// URL, giving up when ctx is
+// done or the handshake timeout passes, whichever comes first; ctx
+// doesn't affect the connection once it's open. requestHeader adds
+// headers, such as Origin, Authorization or Cookie, to the handshake
+// request; setting the handshake's own headers there is an error, use
+// the Dialer's fields instead. The server's response is returned
+// whenever there is one, so a failed handshake's status and headers can
+// be looked at.
+func (d *Dialer) DialContext(ctx context.Context, urlStr string, requestHeader http.Header) (*Conn, *http.Response, error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	var port string
+	switch u.Scheme {
+	case "ws":
+		port = "80"
+	case "wss":
+		port = "443"
+	default:
+		return nil, nil, fmt.Errorf("websocket: URL scheme %q isn't ws or wss", u.Scheme)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Host:       u.Host,
+	}
+	for name, values := range requestHeader {
+		switch name = http.CanonicalHeaderKey(name); {
+		case name == "Host":
+			req.Host = values[0]
+		case handshakeHeaders[name]:
+			return nil, nil, fmt.Errorf("websocket: the handshake sets the %s header itself", name)
+		default:
+			req.Header[name] = values
+		}
+	}
+	req.Header["Upgrade"] = []string{"websocket"}
+	req.Header["Connection"] = []string{"Upgrade"}
+	req.Header["Sec-WebSocket-Key"] = []string{key}
+	req.Header["Sec-WebSocket-Version"] = []string{"13"}
+	if len(d.Subprotocols) > 0 {
+		req.Header["Sec-WebSocket-Protocol"] = []string{strings.Join(d.Subprotocols, ", ")}
+	}
+	if d.Compression != nil {
+		req.Header["Sec-WebSocket-Extensions"] = []string{d.Compression.offer()}
+	}
+
+	timeout := d.HandshakeTimeout
+	if timeout == 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return nil, nil, err
+	}
+	// Reads and writes don't take a context, so a done ctx interrupts
+	// them by moving the deadline into the past. Mirroring ctx's
+	// deadline on the socket instead would race ctx's own timer, and a
+	// read could time out before ctx.Err() said why.
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+	if u.Scheme == "wss" {
+		cfg := d.TLSClientConfig.Clone()
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, nil, contextErr(ctx, err)
+		}
+		conn = tlsConn
+	}
+
+	c, resp, err := d.handshake(conn, req, key)
+	if err != nil {
+		conn.Close()
+		return nil, resp, contextErr(ctx, err)
+	}
+	if !stop() {
+		// ctx was done just as the handshake finished.
+		conn.Close()
+		return nil, resp, ctx.Err()
+	}
+	return c, resp, nil
+}
+
+// contextErr reports a failure caused by ctx ending as ctx's error
+// rather than the deadline it set off. Only ctx's AfterFunc sets a
+// deadline, so a timeout means ctx is done.
+func contextErr(ctx context.Context, err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return err
+}
+
+// handshake sends the request and checks the response. The response is
+// read through the same bufio.Reader the Conn goes on to use, so frames
+// sent straight after it aren't lost.
+func (d *Dialer) handshake(conn net.Conn, req *http.Request, key string) (*Conn, *http.Response, error) {
+	if err := req.Write(conn); err != nil {
+		return nil, nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// Keep the start of the body, which usually says what was wrong.
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		return nil, resp, fmt.Errorf("%w: server answered %s", ErrBadHandshake, resp.Status)
+	}
+	resp.Body = http.NoBody
+	switch {
+	case !headerHasToken(resp.Header, "Upgrade", "websocket"), !headerHasToken(resp.Header, "Connection", "upgrade"):
+		return nil, resp, fmt.Errorf("%w: response doesn't upgrade to websocket", ErrBadHandshake)
+	case resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key):
+		return nil, resp, fmt.Errorf("%w: wrong Sec-WebSocket-Accept", ErrBadHandshake)
+	}
+	subprotocol := resp.Header.Get("Sec-WebSocket-Protocol")
+	if subprotocol != "" && !slices.Contains(d.Subprotocols, subprotocol) {
+		return nil, resp, fmt.Errorf("%w: server chose subprotocol %q, which wasn't offered", ErrBadHandshake, subprotocol)
+	}
+	var dfl *deflate
+	exts := parseExtensions(resp.Header.Values("Sec-WebSocket-Extensions"))
+	if d.Compression != nil {
+		if dfl, err = d.Compression.accepted(exts); err != nil {
+			return nil, resp, fmt.Errorf("%w: %v", ErrBadHandshake, err)
+		}
+	} else if len(exts) > 0 {
+		return nil, resp, fmt.Errorf("%w: server accepted extensions that weren't offered", ErrBadHandshake)
+	}
+
+	c := newConn(conn, br, true)
+	c.deflate = dfl
+	c.subprotocol = subprotocol
+	if d.ReadLimit > 0 {
+		c.readLimit = d.ReadLimit
+	}
+	return c, resp, nil
+}
@@ -0,0 +1,598 @@
+package ws
+
+import (
+	"bufio"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Close codes, from RFC 6455 section 7.4.1.
+const (
+	CloseNormal             = 1000
+	CloseGoingAway          = 1001
+	CloseProtocolError      = 1002
+	CloseUnsupportedData    = 1003
+	CloseNoStatus           = 1005 // never sent: the close frame had no code
+	CloseAbnormal           = 1006 // never sent: the connection dropped without one
+	CloseInvalidPayload     = 1007
+	ClosePolicyViolation    = 1008
+	CloseTooBig             = 1009
+	CloseMandatoryExtension = 1010
+	CloseInternalError      = 1011
+)
+
+// DefaultReadLimit is the largest message a Conn accepts unless told
+// otherwise.
+const DefaultReadLimit = 32 << 20
+
+// closeTimeout bounds how long the closing handshake waits for the
+// peer.
+const closeTimeout = 5 * time.Second
+
+// ErrCloseSent is returned by writes after the close frame has gone.
+var ErrCloseSent = errors.New("websocket: close frame already sent")
+
+// CloseError is the close frame that ended a connection: either the
+// peer's, or the one this side sent because the peer broke the
+// protocol.
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	if e.Text == "" {
+		return fmt.Sprintf("websocket: closed with %d", e.Code)
+	}
+	return fmt.Sprintf("websocket: closed with %d: %s", e.Code, e.Text)
+}
+
+// Conn is a WebSocket connection. One goroutine may read while another
+// writes; writes are serialized, so pongs sent while reading never
+// interleave with a message being written.
+type Conn struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	client bool // masks its frames and expects unmasked ones
+
+	deflate     *deflate // nil unless permessage-deflate was negotiated
+	subprotocol string
+
+	readLimit   int64
+	readErr     error // once set, every read returns it
+	pingHandler func(appData []byte) error
+	pongHandler func(appData []byte) error
+
+	wmu       sync.Mutex
+	bw        *bufio.Writer
+	wbuf      []byte
+	writing   bool // a NextWriter message is under way
+	closeSent bool
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, client bool) *Conn {
+	if br == nil {
+		br = bufio.NewReader(conn)
+	}
+	return &Conn{
+		conn:      conn,
+		br:        br,
+		client:    client,
+		readLimit: DefaultReadLimit,
+		bw:        bufio.NewWriter(conn),
+	}
+}
+
+// NetConn returns the underlying connection, for deadlines and
+// addresses.
+func (c *Conn) NetConn() net.Conn { return c.conn }
+
+// Subprotocol returns the subprotocol agreed in the handshake, or "".
+func (c *Conn) Subprotocol() string { return c.subprotocol }
+
+// SetPingHandler sets what ReadMessage does with a ping's payload; nil
+// restores the default, which answers with a pong. The handler runs on
+// the reading goroutine, and an error from it ends reading: ReadMessage
+// returns it.
+func (c *Conn) SetPingHandler(h func(appData []byte) error) { c.pingHandler = h }
+
+// SetPongHandler sets what ReadMessage does with a pong's payload, such
+// as pushing back a read deadline; nil, the default, drops pongs. It
+// runs like a ping handler.
+func (c *Conn) SetPongHandler(h func(appData []byte) error) { c.pongHandler = h }
+
+// SetReadLimit caps the size of an incoming message, after any
+// decompression. A larger one ends the connection with CloseTooBig.
+func (c *Conn) SetReadLimit(n int64) { c.readLimit = n }
+
+// ReadMessage returns the next text or binary message, put together
+// from its fragments. Pings and pongs go to their handlers along the
+// way. Once the connection is over, ReadMessage returns a *CloseError
+// if it ended with a close frame, or the network error if it didn't.
+func (c *Conn) ReadMessage() (opcode int, p []byte, err error) {
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+	op, msg, err := c.readMessage()
+	if err != nil {
+		c.readErr = err
+		return 0, nil, err
+	}
+	return int(op), msg, nil
+}
+
+func (c *Conn) readMessage() (byte, []byte, error) {
+	var (
+		opcode     byte // of the message being put together; 0 before its first frame
+		compressed bool
+		msg        []byte
+		checked    int // bytes of msg known to be valid UTF-8
+	)
+	for {
+		h, err := readHeader(c.br)
+		if errors.Is(err, errBadLength) {
+			return 0, nil, c.fail(CloseProtocolError, err.Error())
+		}
+		if err != nil {
+			c.conn.Close()
+			return 0, nil, err
+		}
+		// RSV1 marks the first frame of a compressed message, if
+		// compression was negotiated.
+		if h.rsv == 0x40 && c.deflate != nil && (h.opcode == OpText || h.opcode == OpBinary) {
+			compressed = true
+		} else if h.rsv != 0 {
+			return 0, nil, c.fail(CloseProtocolError, "reserved bits set")
+		}
+		if h.masked == c.client {
+			if c.client {
+				return 0, nil, c.fail(CloseProtocolError, "masked frame from the server")
+			}
+			return 0, nil, c.fail(CloseProtocolError, "unmasked frame from the client")
+		}
+		switch {
+		case isControl(h.opcode) && h.opcode <= OpPong:
+			if !h.fin || h.length > maxControlPayload {
+				return 0, nil, c.fail(CloseProtocolError, "fragmented or oversized control frame")
+			}
+		case h.opcode == OpContinuation:
+			if opcode == 0 {
+				return 0, nil, c.fail(CloseProtocolError, "continuation frame with no message to continue")
+			}
+		case h.opcode == OpText || h.opcode == OpBinary:
+			if opcode != 0 {
+				return 0, nil, c.fail(CloseProtocolError, "new message before the last one finished")
+			}
+		default:
+			return 0, nil, c.fail(CloseProtocolError, fmt.Sprintf("unknown opcode %d", h.opcode))
+		}
+
+		if isControl(h.opcode) {
+			payload := make([]byte, h.length)
+			if _, err := io.ReadFull(c.br, payload); err != nil {
+				c.conn.Close()
+				return 0, nil, err
+			}
+			if h.masked {
+				maskBytes(h.mask, 0, payload)
+			}
+			switch h.opcode {
+			case OpPing:
+				if c.pingHandler != nil {
+					if err := c.pingHandler(payload); err != nil {
+						return 0, nil, err
+					}
+				} else if err := c.writeControl(OpPong, payload); err != nil && !errors.Is(err, ErrCloseSent) {
+					return 0, nil, err
+				}
+			case OpPong:
+				if c.pongHandler != nil {
+					if err := c.pongHandler(payload); err != nil {
+						return 0, nil, err
+					}
+				}
+			case OpClose:
+				return 0, nil, c.closeReceived(payload)
+			}
+			continue
+		}
+
+		if h.length > c.readLimit-int64(len(msg)) {
+			return 0, nil, c.fail(CloseTooBig, fmt.Sprintf("message over %d bytes", c.readLimit))
+		}
+		n := len(msg)
+		msg = slices.Grow(msg, int(h.length))[:n+int(h.length)]
+		if _, err := io.ReadFull(c.br, msg[n:]); err != nil {
+			c.conn.Close()
+			return 0, nil, err
+		}
+		if h.masked {
+			maskBytes(h.mask, 0, msg[n:])
+		}
+		if h.opcode != OpContinuation {
+			opcode = h.opcode
+		}
+		// Checked frame by frame, so a bad message fails as soon as
+		// the bad bytes arrive rather than after the whole of it.
+		if opcode == OpText && !compressed {
+			k, ok := validUTF8Prefix(msg[checked:])
+			checked += k
+			if !ok || h.fin && checked != len(msg) {
+				return 0, nil, c.fail(CloseInvalidPayload, "invalid UTF-8 in a text message")
+			}
+		}
+		if !h.fin {
+			continue
+		}
+		if c.sentClose() {
+			// We're closing: wait for the peer's close, ignoring the
+			// messages that cross it.
+			opcode, compressed, msg, checked = 0, false, nil, 0
+			continue
+		}
+		if compressed {
+			msg, err = c.deflate.decompress(msg, c.readLimit)
+			if errors.Is(err, errTooBig) {
+				return 0, nil, c.fail(CloseTooBig, fmt.Sprintf("message over %d bytes", c.readLimit))
+			}
+			if err != nil {
+				return 0, nil, c.fail(CloseInvalidPayload, "bad compressed data")
+			}
+			if opcode == OpText && !utf8.Valid(msg) {
+				return 0, nil, c.fail(CloseInvalidPayload, "invalid UTF-8 in a text message")
+			}
+		}
+		return opcode, msg, nil
+	}
+}
+
+// closeReceived answers the peer's close frame and ends the connection.
+func (c *Conn) closeReceived(payload []byte) error {
+	code, text := CloseNoStatus, ""
+	switch {
+	case len(payload) == 1:
+		return c.fail(CloseProtocolError, "close frame with a 1-byte payload")
+	case len(payload) >= 2:
+		code, text = int(binary.BigEndian.Uint16(payload)), string(payload[2:])
+		if !validCloseCode(code) {
+			return c.fail(CloseProtocolError, fmt.Sprintf("invalid close code %d", code))
+		}
+		if !utf8.ValidString(text) {
+			return c.fail(CloseInvalidPayload, "close reason isn't UTF-8")
+		}
+	}
+	// Echo the code, unless this close is the answer to ours.
+	c.writeClose(code, "")
+	c.finish()
+	return &CloseError{Code: code, Text: text}
+}
+
+// fail sends a close frame for a peer that broke the protocol, ends the
+// connection and returns the error describing it.
+func (c *Conn) fail(code int, reason string) error {
+	c.writeClose(code, reason)
+	c.finish()
+	return &CloseError{Code: code, Text: reason}
+}
+
+// finish ends the connection once the close frames are out. The server
+// closes the TCP connection first (section 7.1.1), and the client waits
+// for that. The server half-closes and drains what's left before the
+// full close, so unread bytes can't turn the close into a reset that
+// destroys the close frame still on its way to the client.
+func (c *Conn) finish() {
+	if cw, ok := c.conn.(interface{ CloseWrite() error }); ok && !c.client {
+		cw.CloseWrite()
+	}
+	c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+	io.Copy(io.Discard, c.br)
+	c.conn.Close()
+}
+
+// validCloseCode reports whether a close frame may carry code. 1005,
+// 1006 and 1015 only describe closes locally, and the rest of 1000-2999
+// is reserved for the protocol.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// validUTF8Prefix checks p for UTF-8 that may be cut off partway
+// through its last character. It returns how many bytes form complete
+// characters and whether the rest could still become one.
+func validUTF8Prefix(p []byte) (int, bool) {
+	for i := 0; i < len(p); {
+		if p[i] < utf8.RuneSelf {
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRune(p[i:])
+		if r == utf8.RuneError && size == 1 {
+			// FullRune treats invalid sequences as complete, so only
+			// a genuine prefix gets through.
+			return i, !utf8.FullRune(p[i:])
+		}
+		i += size
+	}
+	return len(p), true
+}
+
+var errWriting = errors.New("websocket: the last NextWriter hasn't been closed")
+
+// WriteMessage sends p as one text or binary frame, compressed if
+// permessage-deflate was negotiated.
+func (c *Conn) WriteMessage(opcode int, p []byte) error {
+	if opcode != OpText && opcode != OpBinary {
+		return fmt.Errorf("websocket: opcode %d isn't a message type", opcode)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	switch {
+	case c.closeSent:
+		return ErrCloseSent
+	case c.writing:
+		return errWriting
+	}
+	return c.writeMessage(byte(opcode), p)
+}
+
+// writeMessage sends a whole message as one frame, compressing it if
+// it's worth it. The caller holds c.wmu.
+func (c *Conn) writeMessage(opcode byte, p []byte) error {
+	h := header{fin: true, opcode: opcode}
+	if c.deflate != nil && c.deflate.compresses(len(p)) {
+		compressed, err := c.deflate.compress(p)
+		if err != nil {
+			return err
+		}
+		h.rsv, p = 0x40, compressed
+	}
+	return c.writeFrame(h, p)
+}
+
+// writeFrameSize is how much of a streamed message NextWriter gathers
+// before sending it as a frame.
+const writeFrameSize = 16 << 10
+
+// NextWriter starts a text or binary message of any length, streamed
+// through the returned writer a frame at a time; Close sends the last
+// frame. A message that turns out to fit in one frame is sent just as
+// WriteMessage would send it. Until Close, pings and pongs can still
+// go out, but no other message.
+func (c *Conn) NextWriter(opcode int) (io.WriteCloser, error) {
+	if opcode != OpText && opcode != OpBinary {
+		return nil, fmt.Errorf("websocket: opcode %d isn't a message type", opcode)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	switch {
+	case c.closeSent:
+		return nil, ErrCloseSent
+	case c.writing:
+		return nil, errWriting
+	}
+	c.writing = true
+	return &messageWriter{c: c, opcode: byte(opcode)}, nil
+}
+
+// messageWriter is a message being written through NextWriter.
+type messageWriter struct {
+	c      *Conn
+	opcode byte // of the next frame: the message's, then OpContinuation
+	rsv    byte
+	buf    []byte        // payload not sent yet
+	fw     *flate.Writer // set once a compressed message outgrows a frame
+	err    error         // once set, every call returns it
+}
+
+var errWriterClosed = errors.New("websocket: write to a closed message writer")
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, d := len(p), w.c.deflate
+	if w.fw == nil {
+		w.buf = append(w.buf, p...)
+		if len(w.buf) < writeFrameSize {
+			return n, nil
+		}
+		// Too big for one frame, so it's a stream. Under a window
+		// smaller than Go's 32 KB it can't be compressed (see
+		// compresses); otherwise everything from here goes through
+		// the compressor.
+		if w.opcode == OpContinuation || d == nil || d.window != 15 {
+			sent := 0
+			for ; len(w.buf)-sent >= writeFrameSize; sent += writeFrameSize {
+				if err := w.send(w.buf[sent:sent+writeFrameSize], false); err != nil {
+					return 0, w.fail(err)
+				}
+			}
+			w.buf = w.buf[:copy(w.buf, w.buf[sent:])]
+			return n, nil
+		}
+		fw, err := d.writer()
+		if err != nil {
+			return 0, w.fail(err)
+		}
+		w.fw, w.rsv, p, w.buf = fw, 0x40, w.buf, nil
+	}
+	if _, err := w.fw.Write(p); err != nil {
+		return 0, w.fail(err)
+	}
+	// The last four bytes are held back: if they turn out to be the
+	// end of the final flush, they're the ones left off the wire.
+	if d.cbuf.Len() >= writeFrameSize+4 {
+		out := d.cbuf.Bytes()
+		n := len(out) - 4
+		if err := w.send(out[:n], false); err != nil {
+			return 0, w.fail(err)
+		}
+		copy(out, out[n:])
+		d.cbuf.Truncate(4)
+	}
+	return n, nil
+}
+
+// Close sends the rest of the message in its final frame.
+func (w *messageWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	defer func() {
+		if w.err == nil {
+			w.err = errWriterClosed
+		}
+	}()
+	if w.fw != nil {
+		out, err := w.c.deflate.flush(w.fw)
+		if err != nil {
+			return w.fail(err)
+		}
+		return w.send(out, true)
+	}
+	if w.opcode != OpContinuation {
+		// Nothing sent yet: it's a whole message.
+		c := w.c
+		c.wmu.Lock()
+		defer c.wmu.Unlock()
+		c.writing = false
+		if c.closeSent {
+			return ErrCloseSent
+		}
+		return c.writeMessage(w.opcode, w.buf)
+	}
+	return w.send(w.buf, true)
+}
+
+// send writes one frame of the message.
+func (w *messageWriter) send(p []byte, fin bool) error {
+	c := w.c
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if fin {
+		c.writing = false
+	}
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	err := c.writeFrame(header{fin: fin, rsv: w.rsv, opcode: w.opcode}, p)
+	w.opcode, w.rsv = OpContinuation, 0
+	return err
+}
+
+// fail ends the message with err, freeing the connection for the next
+// one (which is unlikely to get far).
+func (w *messageWriter) fail(err error) error {
+	w.err = err
+	w.c.wmu.Lock()
+	w.c.writing = false
+	w.c.wmu.Unlock()
+	return err
+}
+
+// Ping sends a ping; the peer's pong goes to the pong handler. It may
+// be called from any goroutine, even while a message is being written.
+func (c *Conn) Ping(p []byte) error { return c.writeControl(OpPing, p) }
+
+// Pong sends an unsolicited pong, or answers a ping from a ping
+// handler.
+func (c *Conn) Pong(p []byte) error { return c.writeControl(OpPong, p) }
+
+// WriteClose starts the closing handshake. Reading goes on, skipping
+// messages, until the peer's close frame arrives, when ReadMessage
+// returns it as a *CloseError; a peer that never answers is given up
+// on after a few seconds.
+func (c *Conn) WriteClose(code int, reason string) error {
+	if err := c.writeClose(code, reason); err != nil {
+		return err
+	}
+	return c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+}
+
+// Close closes the connection straight away, without a close frame.
+func (c *Conn) Close() error { return c.conn.Close() }
+
+func (c *Conn) sentClose() bool {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.closeSent
+}
+
+// writeClose sends a close frame unless one has gone already. A code of
+// CloseNoStatus sends an empty one.
+func (c *Conn) writeClose(code int, reason string) error {
+	var payload []byte
+	if code != CloseNoStatus {
+		payload = binary.BigEndian.AppendUint16(nil, uint16(code))
+		payload = append(payload, reason...)
+		if len(payload) > maxControlPayload {
+			payload = payload[:maxControlPayload]
+		}
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	c.closeSent = true
+	return c.writeFrame(header{fin: true, opcode: OpClose}, payload)
+}
+
+func (c *Conn) writeControl(opcode byte, p []byte) error {
+	if len(p) > maxControlPayload {
+		return fmt.Errorf("websocket: control frame payload over %d bytes", maxControlPayload)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	return c.writeFrame(header{fin: true, opcode: opcode}, p)
+}
+
+// writeFrame sends one frame, masking it if this is the client. The
+// caller holds c.wmu.
+func (c *Conn) writeFrame(h header, p []byte) error {
+	h.length = int64(len(p))
+	if c.client {
+		h.masked = true
+		if _, err := rand.Read(h.mask[:]); err != nil {
+			return err
+		}
+	}
+	c.wbuf = appendHeader(c.wbuf[:0], h)
+	if !h.masked {
+		c.bw.Write(c.wbuf)
+		c.bw.Write(p)
+		return c.bw.Flush()
+	}
+	// Mask a copy, a chunk at a time, leaving the caller's p alone.
+	pos := 0
+	for len(p) > 0 {
+		n := min(len(p), 4096)
+		start := len(c.wbuf)
+		c.wbuf = append(c.wbuf, p[:n]...)
+		pos = maskBytes(h.mask, pos, c.wbuf[start:])
+		c.bw.Write(c.wbuf)
+		c.wbuf, p = c.wbuf[:0], p[n:]
+	}
+	if len(c.wbuf) > 0 {
+		c.bw.Write(c.wbuf)
+	}
+	return c.bw.Flush()
+}
@@ -0,0 +1,450 @@
+package ws
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rawClient speaks frames to a server byte by byte, so tests can send
+// exactly the frames they want, broken ones included.
+type rawClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+	resp *http.Response // the handshake's
+}
+
+// startEcho runs an echo server and returns what each connection's
+// ReadMessage finally failed with.
+func startEcho(t *testing.T, u *Upgrader) (string, <-chan error) {
+	t.Helper()
+	done := make(chan error, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := u.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			op, msg, err := c.ReadMessage()
+			if err != nil {
+				done <- err
+				return
+			}
+			c.WriteMessage(op, msg)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String(), done
+}
+
+// dialRaw does the opening handshake, adding any extra header lines.
+func dialRaw(t *testing.T, addr string, extra ...string) *rawClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: "+addr+"\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: "+key+"\r\nSec-WebSocket-Version: 13\r\n"+strings.Join(append(extra, ""), "\r\n")+"\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake answered %d, accept %q", resp.StatusCode, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+	return &rawClient{t: t, conn: conn, br: br, resp: resp}
+}
+
+// send writes a masked frame; first is the FIN/RSV/opcode byte.
+func (c *rawClient) send(first byte, payload []byte) {
+	c.t.Helper()
+	h := header{fin: first&0x80 != 0, rsv: first & 0x70, opcode: first & 0x0F,
+		masked: true, mask: [4]byte{1, 2, 3, 4}, length: int64(len(payload))}
+	b := appendHeader(nil, h)
+	masked := append([]byte(nil), payload...)
+	maskBytes(h.mask, 0, masked)
+	if _, err := c.conn.Write(append(b, masked...)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *rawClient) read() (header, []byte) {
+	c.t.Helper()
+	h, err := readHeader(c.br)
+	if err != nil {
+		c.t.Fatalf("reading a frame: %v", err)
+	}
+	if h.masked {
+		c.t.Fatal("server sent a masked frame")
+	}
+	p := make([]byte, h.length)
+	if _, err := io.ReadFull(c.br, p); err != nil {
+		c.t.Fatal(err)
+	}
+	return h, p
+}
+
+// expectClose reads the server's close frame, checks its code and that
+// the server then closes the connection, and closes this end too.
+func (c *rawClient) expectClose(code int) {
+	c.t.Helper()
+	h, p := c.read()
+	if h.opcode != OpClose || len(p) < 2 || int(binary.BigEndian.Uint16(p)) != code {
+		c.t.Fatalf("got opcode %d %q, want close %d", h.opcode, p, code)
+	}
+	c.expectEOF()
+}
+
+// expectEOF checks the server has closed the connection, then closes
+// this end, which the server waits for.
+func (c *rawClient) expectEOF() {
+	c.t.Helper()
+	if _, err := c.br.ReadByte(); err != io.EOF {
+		c.t.Fatalf("after the close frame: %v, want EOF", err)
+	}
+	c.conn.Close()
+}
+
+func closePayload(code int, reason string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...)
+}
+
+func TestEchoPayloadLengths(t *testing.T) {
+	addr, _ := startEcho(t, &Upgrader{})
+	c := dialRaw(t, addr)
+	for _, n := range []int{0, 125, 126, 127, 0xFFFF, 0x10000, 1 << 20} {
+		payload := bytes.Repeat([]byte("x"), n)
+		for _, op := range []byte{OpText, OpBinary} {
+			c.send(0x80|op, payload)
+			h, p := c.read()
+			if !h.fin || h.opcode != op || !bytes.Equal(p, payload) {
+				t.Fatalf("%d-byte opcode %d message came back as opcode %d with %d bytes", n, op, h.opcode, len(p))
+			}
+		}
+	}
+}
+
+func TestFragmentsAndControlFrames(t *testing.T) {
+	addr, _ := startEcho(t, &Upgrader{})
+	c := dialRaw(t, addr)
+
+	// A ping in the middle of a fragmented message is answered first.
+	c.send(OpText, []byte("Hel"))
+	c.send(0x80|OpPing, []byte("are you there"))
+	c.send(OpContinuation, []byte("lo, "))
+	c.send(0x80|OpPong, []byte("unsolicited"))
+	c.send(0x80|OpContinuation, []byte("world"))
+	if h, p := c.read(); h.opcode != OpPong || string(p) != "are you there" {
+		t.Fatalf("got opcode %d %q, want the pong", h.opcode, p)
+	}
+	if h, p := c.read(); h.opcode != OpText || string(p) != "Hello, world" {
+		t.Fatalf("got opcode %d %q, want the reassembled message", h.opcode, p)
+	}
+
+	// A character split across fragments is fine.
+	euro := []byte("€")
+	c.send(OpText, euro[:1])
+	c.send(OpContinuation, euro[1:2])
+	c.send(0x80|OpContinuation, euro[2:])
+	if _, p := c.read(); string(p) != "€" {
+		t.Fatalf("split character came back as %q", p)
+	}
+}
+
+func TestProtocolViolations(t *testing.T) {
+	tests := []struct {
+		name  string
+		send  func(c *rawClient)
+		code  int
+		limit int64
+	}{
+		{"reserved bits", func(c *rawClient) { c.send(0x80|0x40|OpText, []byte("x")) }, CloseProtocolError, 0},
+		{"reserved opcode", func(c *rawClient) { c.send(0x80|0x3, nil) }, CloseProtocolError, 0},
+		{"reserved control opcode", func(c *rawClient) { c.send(0x80|0xB, nil) }, CloseProtocolError, 0},
+		{"fragmented ping", func(c *rawClient) { c.send(OpPing, nil) }, CloseProtocolError, 0},
+		{"126-byte ping", func(c *rawClient) { c.send(0x80|OpPing, make([]byte, 126)) }, CloseProtocolError, 0},
+		{"continuation first", func(c *rawClient) { c.send(0x80|OpContinuation, []byte("x")) }, CloseProtocolError, 0},
+		{"interleaved messages", func(c *rawClient) {
+			c.send(OpText, []byte("a"))
+			c.send(0x80|OpText, []byte("b"))
+		}, CloseProtocolError, 0},
+		{"unmasked", func(c *rawClient) { c.conn.Write([]byte{0x81, 1, 'x'}) }, CloseProtocolError, 0},
+		{"long length form for a short payload", func(c *rawClient) {
+			c.conn.Write([]byte{0x81, 0x80 | 126, 0, 5, 0, 0, 0, 0, 'h', 'e', 'l', 'l', 'o'})
+		}, CloseProtocolError, 0},
+		{"64-bit length with the top bit set", func(c *rawClient) {
+			c.conn.Write([]byte{0x82, 0x80 | 127, 0x80, 0, 0, 0, 0, 0, 0, 0})
+		}, CloseProtocolError, 0},
+		{"invalid UTF-8", func(c *rawClient) { c.send(0x80|OpText, []byte{'a', 0xC0, 0xAF}) }, CloseInvalidPayload, 0},
+		{"invalid UTF-8 in an early fragment", func(c *rawClient) { c.send(OpText, []byte{0xED, 0xA0, 0x80}) }, CloseInvalidPayload, 0},
+		{"text ending partway through a character", func(c *rawClient) { c.send(0x80|OpText, []byte{0xE2, 0x82}) }, CloseInvalidPayload, 0},
+		{"message over the limit", func(c *rawClient) { c.send(0x80|OpBinary, make([]byte, 1025)) }, CloseTooBig, 1024},
+		{"fragments over the limit", func(c *rawClient) {
+			c.send(OpBinary, make([]byte, 1000))
+			c.send(0x80|OpContinuation, make([]byte, 25))
+		}, CloseTooBig, 1024},
+		{"1-byte close", func(c *rawClient) { c.send(0x80|OpClose, []byte{3}) }, CloseProtocolError, 0},
+		{"close code 1005", func(c *rawClient) { c.send(0x80|OpClose, closePayload(1005, "")) }, CloseProtocolError, 0},
+		{"close code 2000", func(c *rawClient) { c.send(0x80|OpClose, closePayload(2000, "")) }, CloseProtocolError, 0},
+		{"close reason not UTF-8", func(c *rawClient) { c.send(0x80|OpClose, closePayload(1000, "\xff")) }, CloseInvalidPayload, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, done := startEcho(t, &Upgrader{ReadLimit: tt.limit})
+			c := dialRaw(t, addr)
+			tt.send(c)
+			c.expectClose(tt.code)
+			var ce *CloseError
+			if err := <-done; !errors.As(err, &ce) || ce.Code != tt.code {
+				t.Errorf("server's ReadMessage returned %v", err)
+			}
+		})
+	}
+}
+
+func TestClientInitiatedClose(t *testing.T) {
+	addr, done := startEcho(t, &Upgrader{})
+	c := dialRaw(t, addr)
+	c.send(0x80|OpClose, closePayload(CloseGoingAway, "bye"))
+	c.expectClose(CloseGoingAway)
+	var ce *CloseError
+	if err := <-done; !errors.As(err, &ce) || ce.Code != CloseGoingAway || ce.Text != "bye" {
+		t.Errorf("server's ReadMessage returned %v", err)
+	}
+
+	// An empty close frame is answered with an empty one.
+	addr, done = startEcho(t, &Upgrader{})
+	c = dialRaw(t, addr)
+	c.send(0x80|OpClose, nil)
+	if h, p := c.read(); h.opcode != OpClose || len(p) != 0 {
+		t.Errorf("got opcode %d %q, want an empty close", h.opcode, p)
+	}
+	c.expectEOF()
+	if err := <-done; !errors.As(err, &ce) || ce.Code != CloseNoStatus {
+		t.Errorf("server's ReadMessage returned %v", err)
+	}
+}
+
+func TestServerInitiatedClose(t *testing.T) {
+	done := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := (&Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.WriteClose(CloseNormal, "done")
+		_, _, err = c.ReadMessage()
+		done <- err
+	}))
+	defer srv.Close()
+	c := dialRaw(t, srv.Listener.Addr().String())
+	if h, p := c.read(); h.opcode != OpClose || !bytes.Equal(p, closePayload(CloseNormal, "done")) {
+		t.Fatalf("got opcode %d %q, want the close", h.opcode, p)
+	}
+	// A message crossing the close is dropped, not echoed or returned.
+	c.send(0x80|OpText, []byte("late"))
+	c.send(0x80|OpClose, closePayload(CloseNormal, ""))
+	c.expectEOF()
+	var ce *CloseError
+	if err := <-done; !errors.As(err, &ce) || ce.Code != CloseNormal {
+		t.Errorf("server's ReadMessage returned %v", err)
+	}
+}
+
+func TestClientConnMasks(t *testing.T) {
+	server, client := net.Pipe()
+	s, c := newConn(server, nil, false), newConn(client, nil, true)
+	go func() {
+		op, msg, err := s.ReadMessage()
+		if err == nil {
+			s.WriteMessage(op, msg)
+		}
+	}()
+	msg := []byte(strings.Repeat("masked ", 1000))
+	if err := c.WriteMessage(OpText, msg); err != nil {
+		t.Fatal(err)
+	}
+	op, got, err := c.ReadMessage()
+	if err != nil || op != OpText || !bytes.Equal(got, msg) {
+		t.Fatalf("echo: %d, %d bytes, %v", op, len(got), err)
+	}
+	if string(msg[:7]) != "masked " {
+		t.Error("WriteMessage masked the caller's buffer")
+	}
+}
+
+func TestValidUTF8Prefix(t *testing.T) {
+	for _, tt := range []struct {
+		in       string
+		complete int
+		ok       bool
+	}{
+		{"", 0, true},
+		{"héllo", 6, true},
+		{"a\xe2\x82", 1, true},      // cut off inside €
+		{"a\xe2\x28\xa1", 1, false}, // bad continuation byte
+		{"\xf4\x90\x80\x80", 0, false},
+		{"\xed\xa0\x80", 0, false}, // surrogate
+	} {
+		n, ok := validUTF8Prefix([]byte(tt.in))
+		if n != tt.complete || ok != tt.ok {
+			t.Errorf("%q: %d %v, want %d %v", tt.in, n, ok, tt.complete, tt.ok)
+		}
+	}
+}
+
+func TestNextWriter(t *testing.T) {
+	big := bytes.Repeat([]byte("streamed "), 6000)
+	errs := make(chan error, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := (&Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		mw, _ := c.NextWriter(OpText)
+		for p := big; len(p) > 0; {
+			n := min(1000, len(p))
+			mw.Write(p[:n])
+			if p = p[n:]; len(p) == 30000 {
+				c.Ping([]byte("mid"))
+			}
+		}
+		errs <- c.WriteMessage(OpText, []byte("interleaved"))
+		errs <- mw.Close()
+		mw, _ = c.NextWriter(OpBinary)
+		io.WriteString(mw, "short")
+		mw.Close()
+		c.ReadMessage()
+	}))
+	defer srv.Close()
+	c := dialRaw(t, srv.Listener.Addr().String())
+
+	var got []byte
+	var frames, pings int
+	for {
+		h, p := c.read()
+		if h.opcode == OpPing {
+			pings++
+			continue
+		}
+		if frames == 0 && h.opcode != OpText || frames > 0 && h.opcode != OpContinuation {
+			t.Fatalf("frame %d has opcode %d", frames, h.opcode)
+		}
+		frames++
+		got = append(got, p...)
+		if h.fin {
+			break
+		}
+	}
+	if !bytes.Equal(got, big) || frames < 2 || pings != 1 {
+		t.Errorf("got %d bytes in %d frames with %d pings", len(got), frames, pings)
+	}
+	if err := <-errs; !errors.Is(err, errWriting) {
+		t.Errorf("WriteMessage during a stream: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	// A short message is one frame.
+	if h, p := c.read(); h.opcode != OpBinary || !h.fin || string(p) != "short" {
+		t.Errorf("short message: opcode %d, fin %v, %q", h.opcode, h.fin, p)
+	}
+}
+
+// A streamed message is compressed as one, RSV1 on its first frame
+// only, and context takeover carries on into the next message.
+func TestNextWriterCompressed(t *testing.T) {
+	for _, o := range []Compression{{}, {NoContextTakeover: true}, {WindowBits: 10}} {
+		addr, _ := startEcho(t, &Upgrader{Compression: &Compression{}})
+		c, _, err := (&Dialer{Compression: &o}).Dial("ws://"+addr+"/ws", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Random prices, so it doesn't compress into a single frame.
+		rnd := rand.New(rand.NewPCG(1, 2))
+		var msg []byte
+		for i := range 3000 {
+			msg = fmt.Appendf(msg, `{"seq":%d,"price":%d}`, i, rnd.IntN(1e9))
+		}
+		for range 2 {
+			mw, err := c.NextWriter(OpText)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for p := msg; len(p) > 0; p = p[min(777, len(p)):] {
+				if _, err := mw.Write(p[:min(777, len(p))]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := mw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, got, err := c.ReadMessage(); err != nil || !bytes.Equal(got, msg) {
+				t.Fatalf("%+v: echo of %d bytes: %d bytes, %v", o, len(msg), len(got), err)
+			}
+		}
+		c.Close()
+	}
+}
+
+func TestPingPongHandlers(t *testing.T) {
+	pongs := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := (&Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.SetPongHandler(func(p []byte) error {
+			pongs <- string(p)
+			return nil
+		})
+		c.Ping([]byte("p1"))
+		c.WriteMessage(OpText, []byte("after p1"))
+		c.ReadMessage()
+		c.Ping([]byte("p2"))
+		c.ReadMessage()
+	}))
+	defer srv.Close()
+	c, _, err := Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	errStop := errors.New("stop")
+	c.SetPingHandler(func(p []byte) error {
+		if string(p) == "p2" {
+			return errStop
+		}
+		return c.Pong(append([]byte("re:"), p...))
+	})
+	if _, msg, err := c.ReadMessage(); err != nil || string(msg) != "after p1" {
+		t.Fatalf("read %q, %v", msg, err)
+	}
+	c.WriteMessage(OpText, []byte("go on"))
+	if pong := <-pongs; pong != "re:p1" {
+		t.Errorf("server got pong %q", pong)
+	}
+	if _, _, err := c.ReadMessage(); err != errStop {
+		t.Errorf("ReadMessage returned %v, want the ping handler's error", err)
+	}
+}
@@ -0,0 +1,352 @@
+package ws
+
+// permessage-deflate (RFC 7692). Each message is compressed on its own
+// with raw DEFLATE, ending in a sync flush whose fixed last four bytes
+// (00 00 ff ff) are left off the wire. The first frame of a compressed
+// message has RSV1 set; control frames are never compressed.
+//
+// By default each side keeps its LZ77 window from one message to the
+// next ("context takeover"), so a repeated JSON key costs a couple of
+// bytes even in a later message. That takes a compressor and a 32 KB
+// dictionary per connection; the *_no_context_takeover parameters
+// turn it off for either direction, and the *_max_window_bits ones
+// limit how far back a reference can reach. The negotiation:
+//
+//	client: Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits; server_no_context_takeover
+//	server: Sec-WebSocket-Extensions: permessage-deflate; server_no_context_takeover
+//
+// A small compressed message can inflate enormously, so the read
+// limit applies to a message's size after decompression, and inflating
+// stops as soon as it's passed.
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Compression configures permessage-deflate. "Own" settings are about
+// what this side sends, "peer" ones are requests for the other side.
+type Compression struct {
+	// Level is the flate level; 0 means flate.DefaultCompression.
+	Level int
+	// MinSize is the smallest message worth compressing; shorter ones
+	// are sent as they are. Messages of a few dozen bytes rarely
+	// shrink, and can grow by a few bytes.
+	MinSize int
+	// NoContextTakeover compresses each message on its own. It costs
+	// some compression but saves holding a compressor per connection.
+	NoContextTakeover bool
+	// PeerNoContextTakeover asks the peer to do the same, so this side
+	// doesn't keep a dictionary per connection.
+	PeerNoContextTakeover bool
+	// WindowBits caps this side's window at 2^WindowBits bytes, 8 to
+	// 15; 0 means 15.
+	WindowBits int
+	// PeerWindowBits asks the peer to cap its window, 8 to 15; 0 means
+	// 15.
+	PeerWindowBits int
+}
+
+const maxWindow = 1 << 15
+
+// deflateTail is what the sender left off (the end of the sync flush),
+// then an empty final block so the reader finishes cleanly.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// Compressors are pooled for connections without context takeover;
+// flate.Writer is big. Indexed by level + 2, so HuffmanOnly (-2)
+// through BestCompression (9).
+var (
+	flateWriters [12]sync.Pool
+	flateReaders sync.Pool
+)
+
+// deflate is the negotiated state of one connection.
+type deflate struct {
+	level    int
+	minSize  int
+	takeover bool // our compressor keeps its window between messages
+	window   int  // bits our compressor may reach back
+	// peerTakeover means the peer's compressor keeps its window, so
+	// our decompressor has to keep the last 32 KB it produced.
+	peerTakeover bool
+
+	fw   *flate.Writer // kept between messages if takeover
+	cbuf bytes.Buffer
+	dict []byte
+}
+
+func (o *Compression) newDeflate() *deflate {
+	d := &deflate{level: o.Level, minSize: o.MinSize, takeover: !o.NoContextTakeover,
+		window: 15, peerTakeover: !o.PeerNoContextTakeover}
+	if d.level == 0 {
+		d.level = flate.DefaultCompression
+	}
+	if validWindow(o.WindowBits) {
+		d.window = o.WindowBits
+	}
+	return d
+}
+
+func validWindow(bits int) bool { return bits >= 8 && bits <= 15 }
+
+// extension is one entry of a Sec-WebSocket-Extensions header.
+type extension struct {
+	name   string
+	params []param
+}
+
+type param struct{ key, value string }
+
+// parseExtensions reads the extensions listed in a set of
+// Sec-WebSocket-Extensions header values.
+func parseExtensions(values []string) []extension {
+	var exts []extension
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			parts := strings.Split(item, ";")
+			name := strings.TrimSpace(parts[0])
+			if name == "" {
+				continue
+			}
+			e := extension{name: name}
+			for _, p := range parts[1:] {
+				k, v, _ := strings.Cut(p, "=")
+				e.params = append(e.params, param{strings.TrimSpace(k), strings.Trim(strings.TrimSpace(v), `"`)})
+			}
+			exts = append(exts, e)
+		}
+	}
+	return exts
+}
+
+// windowParam parses a *_max_window_bits value.
+func windowParam(v string) (int, bool) {
+	n, err := strconv.Atoi(v)
+	return n, err == nil && validWindow(n) && v == strconv.Itoa(n)
+}
+
+// accept picks the first permessage-deflate offer the server can take,
+// returning the connection's state and the response to send, or nil
+// if there isn't one.
+func (o *Compression) accept(exts []extension) (*deflate, string) {
+offers:
+	for _, e := range exts {
+		if e.name != "permessage-deflate" {
+			continue
+		}
+		d := o.newDeflate()
+		seen := map[string]bool{}
+		var offeredServerWindow, clientWindowOK bool
+		clientWindow := 15
+		for _, p := range e.params {
+			if seen[p.key] {
+				continue offers
+			}
+			seen[p.key] = true
+			switch p.key {
+			case "server_no_context_takeover":
+				if p.value != "" {
+					continue offers
+				}
+				d.takeover = false
+			case "client_no_context_takeover":
+				if p.value != "" {
+					continue offers
+				}
+				d.peerTakeover = false
+			case "server_max_window_bits":
+				n, ok := windowParam(p.value)
+				if !ok {
+					continue offers
+				}
+				d.window, offeredServerWindow = min(d.window, n), true
+			case "client_max_window_bits":
+				if p.value != "" {
+					n, ok := windowParam(p.value)
+					if !ok {
+						continue offers
+					}
+					clientWindow = n
+				}
+				clientWindowOK = true
+			default:
+				continue offers
+			}
+		}
+		resp := []string{"permessage-deflate"}
+		if !d.takeover {
+			resp = append(resp, "server_no_context_takeover")
+		}
+		if !d.peerTakeover {
+			resp = append(resp, "client_no_context_takeover")
+		}
+		if offeredServerWindow || d.window < 15 {
+			resp = append(resp, fmt.Sprintf("server_max_window_bits=%d", d.window))
+		}
+		// The client's window can only be capped if it said it
+		// could be.
+		if clientWindowOK && validWindow(o.PeerWindowBits) && o.PeerWindowBits < clientWindow {
+			resp = append(resp, fmt.Sprintf("client_max_window_bits=%d", o.PeerWindowBits))
+		}
+		return d, strings.Join(resp, "; ")
+	}
+	return nil, ""
+}
+
+// offer is the client's Sec-WebSocket-Extensions request.
+func (o *Compression) offer() string {
+	offer := []string{"permessage-deflate", "client_max_window_bits"}
+	if validWindow(o.WindowBits) && o.WindowBits < 15 {
+		offer[1] = fmt.Sprintf("client_max_window_bits=%d", o.WindowBits)
+	}
+	if o.NoContextTakeover {
+		offer = append(offer, "client_no_context_takeover")
+	}
+	if o.PeerNoContextTakeover {
+		offer = append(offer, "server_no_context_takeover")
+	}
+	if validWindow(o.PeerWindowBits) && o.PeerWindowBits < 15 {
+		offer = append(offer, fmt.Sprintf("server_max_window_bits=%d", o.PeerWindowBits))
+	}
+	return strings.Join(offer, "; ")
+}
+
+// accepted checks the server's response to offer, returning the
+// connection's state, or nil if the server declined compression. Dial
+// wraps its errors in ErrBadHandshake.
+func (o *Compression) accepted(exts []extension) (*deflate, error) {
+	if len(exts) == 0 {
+		return nil, nil
+	}
+	if len(exts) > 1 || exts[0].name != "permessage-deflate" {
+		return nil, errors.New("server accepted extensions that weren't offered")
+	}
+	d := o.newDeflate()
+	seen := map[string]bool{}
+	for _, p := range exts[0].params {
+		if seen[p.key] {
+			return nil, fmt.Errorf("permessage-deflate parameter %s repeated", p.key)
+		}
+		seen[p.key] = true
+		switch p.key {
+		case "server_no_context_takeover":
+			d.peerTakeover = false
+		case "client_no_context_takeover":
+			d.takeover = false
+		case "server_max_window_bits":
+			n, ok := windowParam(p.value)
+			if !ok || validWindow(o.PeerWindowBits) && n > o.PeerWindowBits {
+				return nil, fmt.Errorf("bad server_max_window_bits %q", p.value)
+			}
+		case "client_max_window_bits":
+			n, ok := windowParam(p.value)
+			if !ok || n > d.window && validWindow(o.WindowBits) {
+				return nil, fmt.Errorf("bad client_max_window_bits %q", p.value)
+			}
+			d.window = min(d.window, n)
+		default:
+			return nil, fmt.Errorf("unknown permessage-deflate parameter %s", p.key)
+		}
+	}
+	// What the client asked of the server has to be granted.
+	if o.PeerNoContextTakeover && !seen["server_no_context_takeover"] ||
+		validWindow(o.PeerWindowBits) && o.PeerWindowBits < 15 && !seen["server_max_window_bits"] {
+		return nil, errors.New("server ignored the permessage-deflate parameters it was sent")
+	}
+	return d, nil
+}
+
+// compresses reports whether a message of n bytes should be compressed.
+// Go's flate always uses a 32 KB window, so under a smaller one a
+// message is only compressed when it can't reach back further than the
+// window allows: on its own, and no bigger than the window.
+func (d *deflate) compresses(n int) bool {
+	return n >= d.minSize && (d.window == 15 || n <= 1<<d.window)
+}
+
+// compress returns p deflated, without the four bytes the receiver
+// adds back. The result is only good until the next call.
+func (d *deflate) compress(p []byte) ([]byte, error) {
+	fw, err := d.writer()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(p); err != nil {
+		return nil, err
+	}
+	return d.flush(fw)
+}
+
+// writer returns the compressor for a message, writing into d.cbuf.
+// With context takeover it's the connection's own, carrying the window
+// on from the last message; otherwise a fresh one from the pool.
+func (d *deflate) writer() (*flate.Writer, error) {
+	d.cbuf.Reset()
+	if d.fw != nil {
+		return d.fw, nil
+	}
+	fw, ok := flateWriters[d.level+2].Get().(*flate.Writer)
+	if ok {
+		fw.Reset(&d.cbuf)
+	} else {
+		var err error
+		if fw, err = flate.NewWriter(&d.cbuf, d.level); err != nil {
+			return nil, err
+		}
+	}
+	if d.takeover && d.window == 15 {
+		d.fw = fw
+	}
+	return fw, nil
+}
+
+// flush ends a message begun with writer, returning what's in d.cbuf
+// without the sync flush's last four bytes.
+func (d *deflate) flush(fw *flate.Writer) ([]byte, error) {
+	if err := fw.Flush(); err != nil {
+		return nil, err
+	}
+	if fw != d.fw {
+		flateWriters[d.level+2].Put(fw)
+	}
+	out := d.cbuf.Bytes()
+	if !bytes.HasSuffix(out, deflateTail[:4]) {
+		return nil, errors.New("websocket: flate flush didn't end in 00 00 ff ff")
+	}
+	return out[:len(out)-4], nil
+}
+
+var errTooBig = errors.New("decompressed message over the read limit")
+
+// decompress inflates a message, giving up once it's past limit bytes.
+func (d *deflate) decompress(p []byte, limit int64) ([]byte, error) {
+	src := io.MultiReader(bytes.NewReader(p), bytes.NewReader(deflateTail))
+	fr, ok := flateReaders.Get().(io.ReadCloser)
+	if ok {
+		fr.(flate.Resetter).Reset(src, d.dict)
+	} else {
+		fr = flate.NewReaderDict(src, d.dict)
+	}
+	defer flateReaders.Put(fr)
+	out, err := io.ReadAll(io.LimitReader(fr, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > limit {
+		return nil, errTooBig
+	}
+	if d.peerTakeover {
+		d.dict = append(d.dict, out...)
+		if len(d.dict) > maxWindow {
+			d.dict = append(d.dict[:0], d.dict[len(d.dict)-maxWindow:]...)
+		}
+	}
+	return out, nil
+}
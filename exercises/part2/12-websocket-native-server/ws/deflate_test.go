@@ -0,0 +1,268 @@
+package ws
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDeflateNegotiation(t *testing.T) {
+	tests := []struct {
+		server   Compression
+		offer    string
+		response string // "" if the offer is declined
+	}{
+		{Compression{}, "permessage-deflate", "permessage-deflate"},
+		{Compression{}, "permessage-deflate; client_max_window_bits", "permessage-deflate"},
+		{Compression{}, "permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+			"permessage-deflate; server_no_context_takeover; client_no_context_takeover"},
+		{Compression{}, "permessage-deflate; server_max_window_bits=10", "permessage-deflate; server_max_window_bits=10"},
+		{Compression{WindowBits: 9}, "permessage-deflate; server_max_window_bits=10", "permessage-deflate; server_max_window_bits=9"},
+		{Compression{NoContextTakeover: true, PeerNoContextTakeover: true}, "permessage-deflate",
+			"permessage-deflate; server_no_context_takeover; client_no_context_takeover"},
+		{Compression{PeerWindowBits: 10}, "permessage-deflate; client_max_window_bits", "permessage-deflate; client_max_window_bits=10"},
+		{Compression{PeerWindowBits: 10}, "permessage-deflate; client_max_window_bits=9", "permessage-deflate"},
+		{Compression{PeerWindowBits: 10}, "permessage-deflate", "permessage-deflate"},
+		// Offers the server can't take are skipped for the next one.
+		{Compression{}, "permessage-deflate; server_max_window_bits=7, permessage-deflate", "permessage-deflate"},
+		{Compression{}, "permessage-deflate; server_max_window_bits=010", ""},
+		{Compression{}, "permessage-deflate; client_max_window_bits=16", ""},
+		{Compression{}, "permessage-deflate; server_no_context_takeover=1", ""},
+		{Compression{}, "permessage-deflate; server_no_context_takeover; server_no_context_takeover", ""},
+		{Compression{}, "permessage-deflate; mystery", ""},
+		{Compression{}, "x-webkit-deflate-frame", ""},
+		{Compression{}, "x-webkit-deflate-frame, permessage-deflate; client_max_window_bits=\"12\"", "permessage-deflate"},
+	}
+	for _, tt := range tests {
+		d, resp := tt.server.accept(parseExtensions([]string{tt.offer}))
+		if resp != tt.response || (d == nil) != (tt.response == "") {
+			t.Errorf("%+v accepting %q: %q, want %q", tt.server, tt.offer, resp, tt.response)
+		}
+	}
+}
+
+// Whatever the two sides want, what they agree on must be consistent:
+// neither side may keep a window the other resets, or reach further
+// back than the other agreed to.
+func TestDeflateNegotiationAgrees(t *testing.T) {
+	configs := []Compression{
+		{}, {NoContextTakeover: true}, {PeerNoContextTakeover: true},
+		{WindowBits: 9}, {PeerWindowBits: 10}, {NoContextTakeover: true, PeerNoContextTakeover: true, WindowBits: 12, PeerWindowBits: 8},
+	}
+	for _, client := range configs {
+		for _, server := range configs {
+			sd, resp := server.accept(parseExtensions([]string{client.offer()}))
+			if sd == nil {
+				t.Errorf("server %+v declined client %+v's offer %q", server, client, client.offer())
+				continue
+			}
+			cd, err := client.accepted(parseExtensions([]string{resp}))
+			if err != nil {
+				t.Errorf("client %+v rejected %q from server %+v: %v", client, resp, server, err)
+				continue
+			}
+			name := fmt.Sprintf("client %+v, server %+v", client, server)
+			if cd.takeover && !sd.peerTakeover || sd.takeover && !cd.peerTakeover {
+				t.Errorf("%s: one side keeps a window the other resets", name)
+			}
+			if client.PeerNoContextTakeover && sd.takeover || server.PeerNoContextTakeover && cd.takeover {
+				t.Errorf("%s: no_context_takeover request ignored", name)
+			}
+			if validWindow(server.PeerWindowBits) && cd.window > server.PeerWindowBits ||
+				validWindow(client.PeerWindowBits) && sd.window > client.PeerWindowBits {
+				t.Errorf("%s: window request ignored (client %d, server %d)", name, cd.window, sd.window)
+			}
+		}
+	}
+
+	// The client refuses answers it didn't ask for.
+	for _, resp := range []string{
+		"permessage-deflate; mystery",
+		"permessage-deflate, permessage-deflate",
+		"x-webkit-deflate-frame",
+		"permessage-deflate; client_max_window_bits=20",
+	} {
+		if _, err := (&Compression{}).accepted(parseExtensions([]string{resp})); err == nil {
+			t.Errorf("client accepted %q", resp)
+		}
+	}
+	if _, err := (&Compression{PeerNoContextTakeover: true}).accepted(parseExtensions([]string{"permessage-deflate"})); err == nil {
+		t.Error("client accepted a response ignoring server_no_context_takeover")
+	}
+}
+
+// The examples from RFC 7692 section 7.2.3.
+func TestDeflateRFCExamples(t *testing.T) {
+	d := (&Compression{}).newDeflate()
+	for i, msg := range [][]byte{
+		{0xf2, 0x48, 0xcd, 0xc9, 0xc9, 0x07, 0x00},
+		{0xf2, 0x00, 0x11, 0x00, 0x00}, // refers back to the first message
+		{0x00},                         // an empty message
+	} {
+		want := "Hello"
+		if i == 2 {
+			want = ""
+		}
+		got, err := d.decompress(msg, 1<<10)
+		if err != nil || string(got) != want {
+			t.Errorf("message %d: %q, %v", i+1, got, err)
+		}
+	}
+	// Split into stored blocks, the last one a sync flush's.
+	stored := []byte{0x00, 0x05, 0x00, 0xfa, 0xff, 0x48, 0x65, 0x6c, 0x6c, 0x6f, 0x00}
+	if got, err := (&Compression{}).newDeflate().decompress(stored, 1<<10); err != nil || string(got) != "Hello" {
+		t.Errorf("stored block: %q, %v", got, err)
+	}
+}
+
+// countingConn counts the bytes read from a connection.
+type countingConn struct {
+	net.Conn
+	n atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// dialDeflate connects a client Conn offering compression o.
+func dialDeflate(t *testing.T, addr string, o *Compression) (*Conn, *countingConn) {
+	t.Helper()
+	raw := dialRaw(t, addr, "Sec-WebSocket-Extensions: "+o.offer())
+	d, err := o.accepted(parseExtensions(raw.resp.Header.Values("Sec-WebSocket-Extensions")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == nil {
+		t.Fatal("server declined compression")
+	}
+	counted := &countingConn{Conn: raw.conn}
+	buffered, _ := raw.br.Peek(raw.br.Buffered())
+	c := newConn(counted, bufio.NewReader(io.MultiReader(bytes.NewReader(bytes.Clone(buffered)), counted)), true)
+	c.deflate = d
+	return c, counted
+}
+
+func TestCompressedEcho(t *testing.T) {
+	var quotes []string
+	for _, symbol := range []string{"ACME", "INITECH", "UMBRELLA", "GLOBEX"} {
+		quotes = append(quotes, `{"event":"price_update","symbol":"`+symbol+`","exchange":"NASDAQ","currency":"USD","bid":101.25,"ask":101.27,"volume":1200}`)
+	}
+	msg := []byte("[" + strings.Join(quotes, ",") + "]")
+	uncompressed := 200 * int64(len(msg)+4)
+	configs := []struct {
+		name           string
+		client, server Compression
+		maxBytes       int64 // read by the client for 200 echoes
+	}{
+		{"context takeover", Compression{}, Compression{}, uncompressed / 10},
+		{"no context takeover", Compression{NoContextTakeover: true}, Compression{NoContextTakeover: true}, uncompressed / 2},
+		{"requested no context takeover", Compression{PeerNoContextTakeover: true}, Compression{PeerNoContextTakeover: true}, uncompressed / 2},
+		// The messages are bigger than the window, so they go as they are.
+		{"8-bit windows", Compression{WindowBits: 8, PeerWindowBits: 8}, Compression{WindowBits: 8, PeerWindowBits: 8}, uncompressed},
+		{"too small to compress", Compression{MinSize: 1 << 10}, Compression{MinSize: 1 << 10}, uncompressed},
+	}
+	for _, tt := range configs {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, _ := startEcho(t, &Upgrader{Compression: &tt.server})
+			c, counted := dialDeflate(t, addr, &tt.client)
+			defer c.Close()
+			start := counted.n.Load()
+			for i := range 200 {
+				// Vary the messages a little, so they're not all the same.
+				m := bytes.Replace(msg, []byte("101.25"), fmt.Appendf(nil, "%06.2f", float64(i)), 1)
+				if err := c.WriteMessage(OpText, m); err != nil {
+					t.Fatal(err)
+				}
+				op, got, err := c.ReadMessage()
+				if err != nil || op != OpText || !bytes.Equal(got, m) {
+					t.Fatalf("echo %d: %d %q %v", i, op, got, err)
+				}
+			}
+			if n := counted.n.Load() - start; n > tt.maxBytes {
+				t.Errorf("%d bytes for 200 %d-byte messages, want at most %d", n, len(msg), tt.maxBytes)
+			}
+		})
+	}
+
+	// A message bigger than a small window goes uncompressed, and
+	// still arrives intact.
+	addr, _ := startEcho(t, &Upgrader{Compression: &Compression{WindowBits: 9}})
+	c, _ := dialDeflate(t, addr, &Compression{WindowBits: 9})
+	defer c.Close()
+	big := []byte(strings.Repeat("window ", 1000))
+	if err := c.WriteMessage(OpBinary, big); err != nil {
+		t.Fatal(err)
+	}
+	if _, got, err := c.ReadMessage(); err != nil || !bytes.Equal(got, big) {
+		t.Fatalf("big message: %d bytes, %v", len(got), err)
+	}
+}
+
+func TestDecompressionBomb(t *testing.T) {
+	addr, done := startEcho(t, &Upgrader{ReadLimit: 1 << 20, Compression: &Compression{}})
+	c, _ := dialDeflate(t, addr, &Compression{Level: 1})
+	defer c.Close()
+	// 16 MiB of zeros deflate to well under the limit, and quickly
+	// enough at level 1 to beat dialRaw's deadline under -race.
+	if err := c.WriteMessage(OpBinary, make([]byte, 16<<20)); err != nil {
+		t.Fatal(err)
+	}
+	var ce *CloseError
+	if _, _, err := c.ReadMessage(); !errors.As(err, &ce) || ce.Code != CloseTooBig {
+		t.Errorf("client got %v, want close %d", err, CloseTooBig)
+	}
+	if err := <-done; !errors.As(err, &ce) || ce.Code != CloseTooBig {
+		t.Errorf("server's ReadMessage returned %v", err)
+	}
+}
+
+func TestCompressedFrameViolations(t *testing.T) {
+	offer := "Sec-WebSocket-Extensions: permessage-deflate"
+	for _, tt := range []struct {
+		name   string
+		frames []abFrame
+		code   int
+	}{
+		{"RSV1 on a continuation", []abFrame{{first: OpText, payload: []byte("a")}, {first: 0x80 | 0x40 | OpContinuation, payload: []byte{0x00}}}, CloseProtocolError},
+		{"RSV1 on a ping", []abFrame{{first: 0x80 | 0x40 | OpPing, payload: []byte{0x00}}}, CloseProtocolError},
+		{"RSV2 on a message", []abFrame{{first: 0x80 | 0x20 | OpText, payload: []byte{0x00}}}, CloseProtocolError},
+		{"corrupt deflate data", []abFrame{{first: 0x80 | 0x40 | OpBinary, payload: []byte{0xff, 0xff, 0xff}}}, CloseInvalidPayload},
+		{"compressed text that isn't UTF-8", []abFrame{{first: 0x80 | 0x40 | OpText, payload: deflated(t, "\xff")}}, CloseInvalidPayload},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, _ := startEcho(t, &Upgrader{Compression: &Compression{}})
+			raw := dialRaw(t, addr, offer)
+			for _, f := range tt.frames {
+				raw.send(f.first, f.payload)
+			}
+			raw.expectClose(tt.code)
+		})
+	}
+
+	// Without compression negotiated, RSV1 is still a violation.
+	addr, _ := startEcho(t, &Upgrader{})
+	raw := dialRaw(t, addr, offer)
+	if ext := raw.resp.Header.Get("Sec-WebSocket-Extensions"); ext != "" {
+		t.Fatalf("server without compression accepted %q", ext)
+	}
+	raw.send(0x80|0x40|OpBinary, deflated(t, "x"))
+	raw.expectClose(CloseProtocolError)
+}
+
+func deflated(t *testing.T, s string) []byte {
+	t.Helper()
+	out, err := (&Compression{}).newDeflate().compress([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Clone(out)
+}
@@ -0,0 +1,133 @@
+package ws
+
+// Frames, as laid out in RFC 6455 section 5.2:
+//
+//	 0                   1                   2                   3
+//	 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+//	+-+-+-+-+-------+-+-------------+-------------------------------+
+//	|F|R|R|R| opcode|M| Payload len |    Extended payload length    |
+//	|I|S|S|S|  (4)  |A|     (7)     |             (16/64)           |
+//	|N|V|V|V|       |S|             |   (if payload len==126/127)   |
+//	| |1|2|3|       |K|             |                               |
+//	+-+-+-+-+-------+-+-------------+ - - - - - - - - - - - - - - - +
+//	|     Extended payload length continued, if payload len == 127  |
+//	+ - - - - - - - - - - - - - - - +-------------------------------+
+//	|                               | Masking-key, if MASK set to 1 |
+//	+-------------------------------+-------------------------------+
+//	| Masking-key (continued)       |          Payload Data         |
+//	+-------------------------------- - - - - - - - - - - - - - - - +
+//
+// Lengths under 126 fit in the 7 bits; 126 means a 16-bit length
+// follows and 127 a 64-bit one, whose top bit must be 0. Lengths are
+// always in the shortest form. Frames from a client are masked: the
+// payload is XORed with the 4-byte key, which stops a hostile page
+// from making a browser send bytes a confused proxy might cache.
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Opcodes. Text, Binary and Continuation frames carry messages;
+// Close, Ping and Pong are control frames.
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xA
+)
+
+// maxControlPayload is the most a control frame can carry, so it
+// always fits in the short length form.
+const maxControlPayload = 125
+
+type header struct {
+	fin    bool
+	rsv    byte // RSV1-3, in bits 0x40, 0x20 and 0x10
+	opcode byte
+	masked bool
+	mask   [4]byte
+	length int64
+}
+
+func isControl(opcode byte) bool { return opcode&0x8 != 0 }
+
+var errBadLength = errors.New("payload length not in its shortest form or over 2^63")
+
+// readHeader reads a frame header from r.
+func readHeader(r io.Reader) (header, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return header{}, err
+	}
+	h := header{
+		fin:    b[0]&0x80 != 0,
+		rsv:    b[0] & 0x70,
+		opcode: b[0] & 0x0F,
+		masked: b[1]&0x80 != 0,
+		length: int64(b[1] & 0x7F),
+	}
+	switch h.length {
+	case 126:
+		if _, err := io.ReadFull(r, b[:2]); err != nil {
+			return header{}, err
+		}
+		h.length = int64(binary.BigEndian.Uint16(b[:2]))
+		if h.length < 126 {
+			return header{}, errBadLength
+		}
+	case 127:
+		if _, err := io.ReadFull(r, b[:8]); err != nil {
+			return header{}, err
+		}
+		n := binary.BigEndian.Uint64(b[:8])
+		if n>>63 != 0 || n <= 0xFFFF {
+			return header{}, errBadLength
+		}
+		h.length = int64(n)
+	}
+	if h.masked {
+		if _, err := io.ReadFull(r, h.mask[:]); err != nil {
+			return header{}, err
+		}
+	}
+	return h, nil
+}
+
+// appendHeader appends h to b, using the shortest length form.
+func appendHeader(b []byte, h header) []byte {
+	first := h.rsv | h.opcode
+	if h.fin {
+		first |= 0x80
+	}
+	var maskBit byte
+	if h.masked {
+		maskBit = 0x80
+	}
+	switch {
+	case h.length < 126:
+		b = append(b, first, maskBit|byte(h.length))
+	case h.length <= 0xFFFF:
+		b = append(b, first, maskBit|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(h.length))
+	default:
+		b = append(b, first, maskBit|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(h.length))
+	}
+	if h.masked {
+		b = append(b, h.mask[:]...)
+	}
+	return b
+}
+
+// maskBytes XORs p with key, starting pos bytes into the payload, and
+// returns the position after p, so a payload can be masked in pieces.
+func maskBytes(key [4]byte, pos int, p []byte) int {
+	for i := range p {
+		p[i] ^= key[(pos+i)&3]
+	}
+	return (pos + len(p)) & 3
+}
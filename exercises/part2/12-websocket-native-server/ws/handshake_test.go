@@ -0,0 +1,293 @@
+package ws
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// handshakeResponse sends a raw handshake request and returns the
+// response's status and headers.
+func handshakeResponse(t *testing.T, addr, request string) *http.Response {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	io.WriteString(conn, request)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestUpgradeChecks(t *testing.T) {
+	addr, _ := startEcho(t, &Upgrader{})
+	valid := map[string]string{
+		"Upgrade":               "websocket",
+		"Connection":            "Upgrade",
+		"Sec-WebSocket-Key":     "dGhlIHNhbXBsZSBub25jZQ==",
+		"Sec-WebSocket-Version": "13",
+	}
+	tests := []struct {
+		name    string
+		start   string // the request line
+		headers map[string]string
+		status  int
+	}{
+		{"valid", "GET /ws HTTP/1.1", nil, http.StatusSwitchingProtocols},
+		{"token lists", "GET /ws HTTP/1.1", map[string]string{"Connection": "keep-alive, Upgrade", "Upgrade": "WebSocket"}, http.StatusSwitchingProtocols},
+		{"same origin", "GET /ws HTTP/1.1", map[string]string{"Origin": "http://" + addr}, http.StatusSwitchingProtocols},
+		{"other origin", "GET /ws HTTP/1.1", map[string]string{"Origin": "https://evil.example"}, http.StatusForbidden},
+		{"no Connection upgrade", "GET /ws HTTP/1.1", map[string]string{"Connection": "keep-alive"}, http.StatusBadRequest},
+		{"no Upgrade", "GET /ws HTTP/1.1", map[string]string{"Upgrade": ""}, http.StatusBadRequest},
+		{"old version", "GET /ws HTTP/1.1", map[string]string{"Sec-WebSocket-Version": "8"}, http.StatusUpgradeRequired},
+		{"short key", "GET /ws HTTP/1.1", map[string]string{"Sec-WebSocket-Key": "c2hvcnQ="}, http.StatusBadRequest},
+		{"POST", "POST /ws HTTP/1.1", map[string]string{"Content-Length": "0"}, http.StatusMethodNotAllowed},
+		{"HTTP/1.0", "GET /ws HTTP/1.0", nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.start + "\r\nHost: " + addr + "\r\n"
+			for name, v := range valid {
+				if override, ok := tt.headers[name]; ok {
+					v = override
+				}
+				if v != "" {
+					req += name + ": " + v + "\r\n"
+				}
+			}
+			for name, v := range tt.headers {
+				if _, ok := valid[name]; !ok {
+					req += name + ": " + v + "\r\n"
+				}
+			}
+			resp := handshakeResponse(t, addr, req+"\r\n")
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status == http.StatusUpgradeRequired && resp.Header.Get("Sec-WebSocket-Version") != "13" {
+				t.Error("426 doesn't say which version is supported")
+			}
+		})
+	}
+}
+
+func TestDial(t *testing.T) {
+	u := &Upgrader{Subprotocols: []string{"v2.chat", "chat"}, Compression: &Compression{}}
+	tokens := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens <- r.Header.Get("X-Token")
+		c, err := u.Upgrade(w, r, http.Header{"Set-Cookie": {"session=1"}, "Sec-WebSocket-Protocol": {"ignored"}})
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		op, msg, err := c.ReadMessage()
+		if err == nil {
+			c.WriteMessage(op, msg)
+		}
+	}))
+	defer srv.Close()
+
+	d := &Dialer{Subprotocols: []string{"chat", "v2.chat"}, Compression: &Compression{}}
+	c, resp, err := d.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?room=1", http.Header{"X-Token": {"secret"}, "Origin": {srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if token := <-tokens; token != "secret" {
+		t.Errorf("server got X-Token %q", token)
+	}
+	if resp.Header.Get("Set-Cookie") != "session=1" {
+		t.Errorf("response header Set-Cookie %q", resp.Header.Get("Set-Cookie"))
+	}
+	// The server's preference wins.
+	if c.Subprotocol() != "v2.chat" {
+		t.Errorf("subprotocol %q, want v2.chat", c.Subprotocol())
+	}
+	if c.deflate == nil {
+		t.Error("compression wasn't negotiated")
+	}
+	if err := c.WriteMessage(OpText, []byte(strings.Repeat("hello ", 100))); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := c.ReadMessage(); err != nil || string(msg) != strings.Repeat("hello ", 100) {
+		t.Errorf("echo: %.20q, %v", msg, err)
+	}
+}
+
+func TestDialTLS(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := (&Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.WriteMessage(OpText, []byte("secure"))
+	}))
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0) // the untrusted dial's TLS error
+	srv.StartTLS()
+	defer srv.Close()
+	url := "wss" + strings.TrimPrefix(srv.URL, "https")
+
+	if _, _, err := Dial(url, nil); err == nil {
+		t.Error("dialed a server with an untrusted certificate")
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	c, _, err := (&Dialer{TLSClientConfig: &tls.Config{RootCAs: roots}}).Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, msg, err := c.ReadMessage(); err != nil || string(msg) != "secure" {
+		t.Errorf("read %q, %v", msg, err)
+	}
+}
+
+// fakeServer answers one handshake with whatever respond writes.
+func fakeServer(t *testing.T, respond func(w io.Writer, accept string)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		respond(conn, acceptKey(req.Header.Get("Sec-WebSocket-Key")))
+		io.Copy(io.Discard, conn)
+	}()
+	return "ws://" + ln.Addr().String() + "/ws"
+}
+
+func TestDialChecksResponse(t *testing.T) {
+	upgrade := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"
+	tests := []struct {
+		name     string
+		response func(accept string) string
+	}{
+		{"wrong accept", func(string) string {
+			return upgrade + "Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n\r\n"
+		}},
+		{"no upgrade", func(accept string) string {
+			return "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + accept + "\r\n\r\n"
+		}},
+		{"subprotocol not offered", func(accept string) string {
+			return upgrade + "Sec-WebSocket-Accept: " + accept + "\r\nSec-WebSocket-Protocol: mqtt\r\n\r\n"
+		}},
+		{"extension not offered", func(accept string) string {
+			return upgrade + "Sec-WebSocket-Accept: " + accept + "\r\nSec-WebSocket-Extensions: permessage-deflate\r\n\r\n"
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := fakeServer(t, func(w io.Writer, accept string) { io.WriteString(w, tt.response(accept)) })
+			if _, _, err := Dial(url, nil); !errors.Is(err, ErrBadHandshake) {
+				t.Errorf("Dial returned %v, want ErrBadHandshake", err)
+			}
+		})
+	}
+
+	t.Run("refused", func(t *testing.T) {
+		url := fakeServer(t, func(w io.Writer, _ string) {
+			io.WriteString(w, "HTTP/1.1 403 Forbidden\r\nContent-Length: 9\r\n\r\nno entry\n")
+		})
+		_, resp, err := Dial(url, nil)
+		if !errors.Is(err, ErrBadHandshake) || resp == nil || resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("Dial returned %v, %v", resp, err)
+		}
+		if body, _ := io.ReadAll(resp.Body); string(body) != "no entry\n" {
+			t.Errorf("body %q", body)
+		}
+	})
+
+	// A frame in the same packet as the 101 isn't lost.
+	t.Run("frame after 101", func(t *testing.T) {
+		url := fakeServer(t, func(w io.Writer, accept string) {
+			io.WriteString(w, upgrade+"Sec-WebSocket-Accept: "+accept+"\r\n\r\n\x81\x05early")
+		})
+		c, _, err := Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if _, msg, err := c.ReadMessage(); err != nil || string(msg) != "early" {
+			t.Errorf("read %q, %v", msg, err)
+		}
+	})
+}
+
+func TestDialRequestErrors(t *testing.T) {
+	for _, tt := range []struct {
+		url    string
+		header http.Header
+	}{
+		{"http://localhost/ws", nil},
+		{"ws://localhost/ws", http.Header{"Sec-WebSocket-Key": {"x"}}},
+		{"ws://localhost/ws", http.Header{"sec-websocket-protocol": {"chat"}}},
+	} {
+		if _, _, err := Dial(tt.url, tt.header); err == nil {
+			t.Errorf("Dial(%q, %v) succeeded", tt.url, tt.header)
+		}
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	// A server that accepts connections and never answers.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	url := "ws://" + ln.Addr().String() + "/ws"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := DialContext(ctx, url, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("past the context's deadline: %v", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, _, err := DialContext(ctx, url, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled: %v", err)
+	}
+	start := time.Now()
+	if _, _, err := (&Dialer{HandshakeTimeout: 50 * time.Millisecond}).Dial(url, nil); err == nil || time.Since(start) > 5*time.Second {
+		t.Errorf("past the handshake timeout: %v after %v", err, time.Since(start))
+	}
+}
@@ -0,0 +1,182 @@
+// Package ws is a WebSocket (RFC 6455) implementation using only the
+// standard library: the opening handshake, framing, fragmented
+// messages, control frames, the closing handshake and permessage-deflate
+// compression (RFC 7692).
+package ws
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// GUID as per RFC 6455
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Headers the handshake sets itself, which callers can't add to the
+// request or the response.
+var handshakeHeaders = map[string]bool{
+	"Upgrade":                  true,
+	"Connection":               true,
+	"Sec-Websocket-Key":        true,
+	"Sec-Websocket-Version":    true,
+	"Sec-Websocket-Accept":     true,
+	"Sec-Websocket-Protocol":   true,
+	"Sec-Websocket-Extensions": true,
+}
+
+// headerTokens returns the comma-separated tokens of every value of a
+// header, trimmed.
+func headerTokens(h http.Header, name string) []string {
+	var tokens []string
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				tokens = append(tokens, t)
+			}
+		}
+	}
+	return tokens
+}
+
+// headerHasToken reports whether a header lists token, ignoring case,
+// as Connection and Upgrade do: "Connection: keep-alive, Upgrade".
+func headerHasToken(h http.Header, name, token string) bool {
+	return slices.ContainsFunc(headerTokens(h, name), func(t string) bool { return strings.EqualFold(t, token) })
+}
+
+// Upgrader turns HTTP requests into WebSocket connections.
+type Upgrader struct {
+	// ReadLimit caps the size of an incoming message; 0 means
+	// DefaultReadLimit.
+	ReadLimit int64
+	// Compression, if set, accepts clients offering permessage-deflate.
+	Compression *Compression
+	// Subprotocols are the ones the server speaks, in order of
+	// preference. The first one the client offers too is chosen; if
+	// there's none, the connection goes ahead without one.
+	Subprotocols []string
+	// CheckOrigin decides whether to accept a handshake from a page on
+	// the request's Origin. nil accepts requests without an Origin,
+	// which don't come from browsers, and same-origin ones.
+	CheckOrigin func(r *http.Request) bool
+}
+
+// Upgrade completes the handshake for r and takes over its connection.
+// responseHeader adds headers, such as Set-Cookie, to the 101 response;
+// the handshake's own are left out of it. If the request isn't a valid
+// handshake, Upgrade has already replied with an HTTP error when it
+// returns one.
+func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (*Conn, error) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "WebSocket handshakes must be GET requests", http.StatusMethodNotAllowed)
+		return nil, errors.New("websocket: handshake method isn't GET")
+	}
+	if !r.ProtoAtLeast(1, 1) || !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Not a websocket handshake", http.StatusBadRequest)
+		return nil, errors.New("websocket: not a websocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("websocket: unsupported version %q", r.Header.Get("Sec-WebSocket-Version"))
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if nonce, err := base64.StdEncoding.DecodeString(key); err != nil || len(nonce) != 16 {
+		http.Error(w, "Bad Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("websocket: bad Sec-WebSocket-Key")
+	}
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(r) {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return nil, fmt.Errorf("websocket: origin %q not allowed", r.Header.Get("Origin"))
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return nil, errors.New("websocket: response can't be hijacked")
+	}
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, "Hijack failed", http.StatusInternalServerError)
+		return nil, err
+	}
+
+	var subprotocol string
+	offered := headerTokens(r.Header, "Sec-WebSocket-Protocol")
+	for _, p := range u.Subprotocols {
+		if slices.Contains(offered, p) {
+			subprotocol = p
+			break
+		}
+	}
+	// Extensions the server doesn't know are left out of the response,
+	// which declines them.
+	var d *deflate
+	var extensions string
+	if u.Compression != nil {
+		d, extensions = u.Compression.accept(parseExtensions(r.Header.Values("Sec-WebSocket-Extensions")))
+	}
+
+	var resp bytes.Buffer
+	resp.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n")
+	if subprotocol != "" {
+		resp.WriteString("Sec-WebSocket-Protocol: " + subprotocol + "\r\n")
+	}
+	if extensions != "" {
+		resp.WriteString("Sec-WebSocket-Extensions: " + extensions + "\r\n")
+	}
+	for name, values := range responseHeader {
+		if handshakeHeaders[http.CanonicalHeaderKey(name)] {
+			continue
+		}
+		for _, v := range values {
+			resp.WriteString(name + ": " + headerValueReplacer.Replace(v) + "\r\n")
+		}
+	}
+	resp.WriteString("\r\n")
+	if _, err := conn.Write(resp.Bytes()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c := newConn(conn, buf.Reader, false)
+	c.deflate = d
+	c.subprotocol = subprotocol
+	if u.ReadLimit > 0 {
+		c.readLimit = u.ReadLimit
+	}
+	return c, nil
+}
+
+// headerValueReplacer keeps a header value on its own line.
+var headerValueReplacer = strings.NewReplacer("\r", " ", "\n", " ")
+
+// sameOrigin is the default origin check: no Origin header, or one
+// naming the host the request was sent to.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
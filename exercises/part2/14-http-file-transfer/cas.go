@@ -0,0 +1,274 @@
+package main
+
+// A content-addressable store for uploaded files. Every blob is named
+// by the SHA-256 of its contents, so uploading the same bytes twice
+// (under any name) stores them once. A separate index maps the names
+// clients use to a list of versions, each pointing at a blob:
+//
+//	store/
+//	  blobs/3a/3a7bd3e2360a...   <- file contents, keyed by hash
+//	  tmp/                       <- uploads being hashed
+//	  index.json                 <- name -> [version 1, version 2, ...]
+//
+// Re-uploading a name adds a version instead of overwriting, deleting
+// a version only drops the index entry, and gc removes blobs that no
+// version references any more.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errNotFound       = errors.New("not found")
+	errDigestMismatch = errors.New("content doesn't match the expected sha256")
+)
+
+// blobRef is one version of a named file.
+type blobRef struct {
+	Version int       `json:"version"`
+	Hash    string    `json:"sha256"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+type casStore struct {
+	dir string
+
+	// mu guards index and also orders blob creation against gc: a
+	// blob is renamed into place and referenced from the index under
+	// the same lock gc holds while deciding what is unreferenced.
+	mu    sync.Mutex
+	index map[string][]blobRef
+}
+
+func openStore(dir string) (*casStore, error) {
+	for _, sub := range []string{"blobs", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	s := &casStore{dir: dir, index: make(map[string][]blobRef)}
+	data, err := os.ReadFile(s.indexPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.index); err != nil {
+		return nil, fmt.Errorf("corrupt index: %w", err)
+	}
+	return s, nil
+}
+
+func (s *casStore) indexPath() string { return filepath.Join(s.dir, "index.json") }
+
+// blobPath shards blobs by the first two hex digits of their hash so
+// no single directory ends up with millions of entries.
+func (s *casStore) blobPath(hash string) string {
+	return filepath.Join(s.dir, "blobs", hash[:2], hash)
+}
+
+// saveIndex must be called with s.mu held.
+func (s *casStore) saveIndex() error {
+	data, err := json.MarshalIndent(s.index, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.indexPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.indexPath())
+}
+
+// put streams r into the store as a new version of name. If size is
+// non-negative, exactly that many bytes must arrive or nothing is
+// stored — a truncated upload never becomes a visible version. Likewise
+// a non-empty want (a hex SHA-256 the sender computed) must match what
+// arrived, or put fails with errDigestMismatch.
+func (s *casStore) put(name string, r io.Reader, size int64, want string) (blobRef, error) {
+	// Hash while writing to a temp file: we only learn the blob's name
+	// once the last byte has been read.
+	tmp, err := os.CreateTemp(filepath.Join(s.dir, "tmp"), "upload-*")
+	if err != nil {
+		return blobRef{}, err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed into blobs/
+	defer tmp.Close()
+
+	h := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		return blobRef{}, err
+	}
+	if size >= 0 && written != size {
+		return blobRef{}, fmt.Errorf("short upload: got %d of %d bytes", written, size)
+	}
+	if err := tmp.Close(); err != nil {
+		return blobRef{}, err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	if want != "" && !strings.EqualFold(want, hash) {
+		return blobRef{}, fmt.Errorf("%w: got %s", errDigestMismatch, hash)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dst := s.blobPath(hash)
+	if _, err := os.Stat(dst); errors.Is(err, fs.ErrNotExist) {
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return blobRef{}, err
+		}
+		if err := os.Rename(tmp.Name(), dst); err != nil {
+			return blobRef{}, err
+		}
+	}
+	// Otherwise the blob already exists: that's the deduplication, and
+	// the deferred Remove discards our identical temp copy.
+
+	versions := s.index[name]
+	ref := blobRef{Version: 1, Hash: hash, Size: written, Created: time.Now().UTC()}
+	if n := len(versions); n > 0 {
+		ref.Version = versions[n-1].Version + 1
+	}
+	s.index[name] = append(versions, ref)
+	if err := s.saveIndex(); err != nil {
+		s.index[name] = versions
+		return blobRef{}, err
+	}
+	return ref, nil
+}
+
+// get returns the given version of name, or the latest when version
+// is 0.
+func (s *casStore) get(name string, version int) (blobRef, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	versions := s.index[name]
+	if len(versions) == 0 {
+		return blobRef{}, errNotFound
+	}
+	if version == 0 {
+		return versions[len(versions)-1], nil
+	}
+	for _, v := range versions {
+		if v.Version == version {
+			return v, nil
+		}
+	}
+	return blobRef{}, errNotFound
+}
+
+// open returns the blob behind ref for reading.
+func (s *casStore) open(ref blobRef) (*os.File, error) {
+	return os.Open(s.blobPath(ref.Hash))
+}
+
+// list returns a snapshot of the index, names in sorted order.
+func (s *casStore) list() []fileEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := make([]fileEntry, 0, len(s.index))
+	for name, versions := range s.index {
+		entries = append(entries, fileEntry{
+			Name:     name,
+			Versions: append([]blobRef(nil), versions...),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+type fileEntry struct {
+	Name     string    `json:"name"`
+	Versions []blobRef `json:"versions"`
+}
+
+// remove deletes one version of name, or every version when version
+// is 0. The blobs stay on disk until the next gc, since another name
+// or version may still point at the same content.
+func (s *casStore) remove(name string, version int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	versions, ok := s.index[name]
+	if !ok {
+		return errNotFound
+	}
+	if version == 0 {
+		delete(s.index, name)
+		return s.saveIndex()
+	}
+	for i, v := range versions {
+		if v.Version != version {
+			continue
+		}
+		kept := append(versions[:i:i], versions[i+1:]...)
+		if len(kept) == 0 {
+			delete(s.index, name)
+		} else {
+			s.index[name] = kept
+		}
+		return s.saveIndex()
+	}
+	return errNotFound
+}
+
+// gc deletes blobs no version references, plus temp files left behind
+// by uploads that died more than an hour ago. It returns the number of
+// blobs removed and the bytes reclaimed.
+func (s *casStore) gc() (removed int, reclaimed int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	live := make(map[string]bool)
+	for _, versions := range s.index {
+		for _, v := range versions {
+			live[v.Hash] = true
+		}
+	}
+
+	err = filepath.WalkDir(filepath.Join(s.dir, "blobs"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || live[d.Name()] {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		reclaimed += info.Size()
+		return nil
+	})
+	if err != nil {
+		return removed, reclaimed, err
+	}
+
+	tmps, err := os.ReadDir(filepath.Join(s.dir, "tmp"))
+	if err != nil {
+		return removed, reclaimed, err
+	}
+	for _, d := range tmps {
+		info, err := d.Info()
+		if err == nil && time.Since(info.ModTime()) > time.Hour {
+			os.Remove(filepath.Join(s.dir, "tmp", d.Name()))
+		}
+	}
+	return removed, reclaimed, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// maxUploadSize caps the decoded size of a compressed request
+	// body, so a few kilobytes of zeros can't expand into terabytes.
+	maxUploadSize = 10 << 30
+
+	// minCompressSize is the smallest download worth compressing; below
+	// it the codec's framing overhead eats most of the savings.
+	minCompressSize = 1024
+)
+
+// decodeRequestBody replaces r.Body with a decoder for its
+// Content-Encoding. It returns false after writing a 415 (with an
+// Accept-Encoding header listing what we do support, per RFC 7694)
+// when the encoding is unknown.
+func decodeRequestBody(w http.ResponseWriter, r *http.Request) bool {
+	var body io.ReadCloser
+	switch enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); enc {
+	case "", "identity":
+		return true
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "bad gzip body", http.StatusBadRequest)
+			return false
+		}
+		body = zr
+	case "zstd":
+		// A single-threaded decoder with a capped window keeps the
+		// memory a hostile stream can make us allocate predictable.
+		zr, err := zstd.NewReader(r.Body,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxWindow(64<<20),
+		)
+		if err != nil {
+			http.Error(w, "bad zstd body", http.StatusBadRequest)
+			return false
+		}
+		body = zr.IOReadCloser()
+	default:
+		w.Header().Set("Accept-Encoding", "zstd, gzip")
+		http.Error(w, fmt.Sprintf("unsupported Content-Encoding %q", enc),
+			http.StatusUnsupportedMediaType)
+		return false
+	}
+
+	r.Body = http.MaxBytesReader(w, body, maxUploadSize)
+	// The declared length described the compressed bytes; nothing
+	// downstream should trust it for the decoded stream.
+	r.ContentLength = -1
+	r.Header.Del("Content-Length")
+	r.Header.Del("Content-Encoding")
+	return true
+}
+
+// negotiateEncoding picks a response encoding from Accept-Encoding,
+// honouring q-values ("gzip;q=0.5") and the "*" wildcard. On a tie
+// our own preference order (zstd, then gzip) decides. It returns
+// "identity" when the client accepts nothing better.
+func negotiateEncoding(header string) string {
+	q := map[string]float64{}
+	wildcard := -1.0
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		weight := 1.0
+		if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(k) == "q" {
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				weight = f
+			}
+		}
+		if name == "*" {
+			wildcard = weight
+			continue
+		}
+		q[name] = weight
+	}
+
+	best, bestQ := "identity", 0.0
+	for _, enc := range []string{"zstd", "gzip"} {
+		weight, ok := q[enc]
+		if !ok {
+			weight = wildcard
+		}
+		if weight > bestQ {
+			best, bestQ = enc, weight
+		}
+	}
+	return best
+}
+
+// compressibleType reports whether a Content-Type is worth compressing.
+// Images, audio, video and archives are already compressed; running
+// them through gzip again only burns CPU.
+func compressibleType(ct string) bool {
+	mediaType, _, _ := mime.ParseMediaType(ct)
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	case strings.HasPrefix(mediaType, "image/svg"):
+		return true
+	case strings.HasPrefix(mediaType, "image/"), strings.HasPrefix(mediaType, "audio/"),
+		strings.HasPrefix(mediaType, "video/"), strings.HasPrefix(mediaType, "font/woff"):
+		return false
+	}
+	switch mediaType {
+	case "application/gzip", "application/x-gzip", "application/zstd",
+		"application/zip", "application/x-7z-compressed", "application/x-xz",
+		"application/x-bzip2", "application/x-rar-compressed", "application/pdf":
+		return false
+	}
+	// Unknown binary formats (logs without an extension, JSON, CSVs,
+	// databases) usually compress well.
+	return true
+}
+
+// contentType guesses a file's type from its name, falling back to
+// sniffing the first 512 bytes the way http.ServeContent does.
+func contentType(name string, rs io.ReadSeeker) string {
+	if ct := mime.TypeByExtension(filepath.Ext(name)); ct != "" {
+		return ct
+	}
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(rs, head)
+	rs.Seek(0, io.SeekStart)
+	return http.DetectContentType(head[:n])
+}
+
+// compressResponse wraps w in an encoder for enc. Close flushes the
+// final frame and must be called before the handler returns.
+func compressResponse(w io.Writer, enc string) (io.WriteCloser, error) {
+	if enc == "zstd" {
+		return zstd.NewWriter(w)
+	}
+	return gzip.NewWriter(w), nil
+}
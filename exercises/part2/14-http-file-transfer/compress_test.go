@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		header, want string
+	}{
+		{"", "identity"},
+		{"gzip", "gzip"},
+		{"gzip, zstd", "zstd"},
+		{"gzip;q=1, zstd;q=0.5", "gzip"},
+		{"zstd;q=0, gzip;q=0", "identity"},
+		{"*", "zstd"},
+		{"*;q=0.5, zstd;q=0", "gzip"},
+		{"br, identity", "identity"},
+		{"GZIP", "gzip"},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.header); got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+// download fetches name with the given request headers, as name, value
+// pairs. Setting Accept-Encoding ourselves stops the client from
+// decoding gzip behind our back.
+func download(t *testing.T, srv *httptest.Server, name string, headers ...string) (*http.Response, []byte) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/download?name="+name, nil)
+	req.Header.Set("Accept-Encoding", "identity")
+	for i := 0; i < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func decode(t *testing.T, enc string, body []byte) string {
+	t.Helper()
+	var r io.Reader
+	switch enc {
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return string(body)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestDownloadEncoding(t *testing.T) {
+	store := newTestStore(t)
+	text := strings.Repeat("the quick brown fox jumps over the lazy dog\n", 100)
+	ref := putString(t, store, "notes.txt", text)
+	putString(t, store, "photo.jpg", text)
+	putString(t, store, "tiny.txt", "hi")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/download", downloadHandler(store))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	tests := []struct {
+		name, file, accept, want string
+	}{
+		{"zstd", "notes.txt", "gzip, zstd", "zstd"},
+		{"gzip", "notes.txt", "gzip", "gzip"},
+		{"identity only", "notes.txt", "identity", "identity"},
+		{"unsupported codec", "notes.txt", "br", "identity"},
+		{"already compressed type", "photo.jpg", "gzip, zstd", "identity"},
+		{"too small", "tiny.txt", "gzip, zstd", "identity"},
+	}
+	etags := map[string]string{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := download(t, srv, tt.file, "Accept-Encoding", tt.accept)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status %d", resp.StatusCode)
+			}
+			enc := resp.Header.Get("Content-Encoding")
+			if enc == "" {
+				enc = "identity"
+			}
+			if enc != tt.want {
+				t.Fatalf("Content-Encoding %q, want %q", enc, tt.want)
+			}
+			if resp.Header.Get("Vary") != "Accept-Encoding" {
+				t.Error("no Vary: Accept-Encoding")
+			}
+			if tt.file == "notes.txt" {
+				if got := decode(t, enc, body); got != text {
+					t.Errorf("decoded %d bytes, want %d", len(got), len(text))
+				}
+				etags[enc] = resp.Header.Get("ETag")
+			}
+		})
+	}
+
+	// Each representation has its own ETag, and the identity one is the
+	// content hash.
+	if etags["identity"] != `"`+ref.Hash+`"` {
+		t.Errorf("identity ETag %s", etags["identity"])
+	}
+	if etags["gzip"] == etags["identity"] || etags["gzip"] == etags["zstd"] {
+		t.Errorf("ETags shared between encodings: %v", etags)
+	}
+
+	t.Run("If-None-Match", func(t *testing.T) {
+		resp, _ := download(t, srv, "notes.txt", "Accept-Encoding", "gzip", "If-None-Match", etags["gzip"])
+		if resp.StatusCode != http.StatusNotModified {
+			t.Errorf("matching gzip ETag: status %d, want 304", resp.StatusCode)
+		}
+		// The identity ETag doesn't validate the gzip representation.
+		resp, _ = download(t, srv, "notes.txt", "Accept-Encoding", "gzip", "If-None-Match", etags["identity"])
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("identity ETag on a gzip request: status %d, want 200", resp.StatusCode)
+		}
+
+		gz := etags["gzip"]
+		for _, tt := range []struct {
+			inm, ims string
+			want     int
+		}{
+			{`"other", W/` + gz, "", http.StatusNotModified},
+			{"*", "", http.StatusNotModified},
+			{`"x` + gz[1:], "", http.StatusOK},
+			{gz[:len(gz)-1] + `x"`, "", http.StatusOK},
+			{"", ref.Created.Add(time.Minute).Format(http.TimeFormat), http.StatusNotModified},
+			{"", ref.Created.Add(-time.Hour).Format(http.TimeFormat), http.StatusOK},
+			// If-None-Match wins over If-Modified-Since.
+			{`"other"`, ref.Created.Add(time.Minute).Format(http.TimeFormat), http.StatusOK},
+		} {
+			headers := []string{"Accept-Encoding", "gzip"}
+			if tt.inm != "" {
+				headers = append(headers, "If-None-Match", tt.inm)
+			}
+			if tt.ims != "" {
+				headers = append(headers, "If-Modified-Since", tt.ims)
+			}
+			if resp, _ := download(t, srv, "notes.txt", headers...); resp.StatusCode != tt.want {
+				t.Errorf("If-None-Match %s, If-Modified-Since %s: status %d, want %d", tt.inm, tt.ims, resp.StatusCode, tt.want)
+			}
+		}
+	})
+
+	// Ranges count uncompressed bytes, so a resumed download comes back
+	// unencoded even when the client accepts compression.
+	t.Run("Range", func(t *testing.T) {
+		resp, body := download(t, srv, "notes.txt", "Accept-Encoding", "gzip, zstd", "Range", "bytes=4-8")
+		if resp.StatusCode != http.StatusPartialContent {
+			t.Fatalf("status %d, want 206", resp.StatusCode)
+		}
+		if enc := resp.Header.Get("Content-Encoding"); enc != "" {
+			t.Errorf("ranged response encoded as %s", enc)
+		}
+		if string(body) != text[4:9] {
+			t.Errorf("range body %q, want %q", body, text[4:9])
+		}
+		if resp.Header.Get("ETag") != etags["identity"] {
+			t.Errorf("ranged ETag %s", resp.Header.Get("ETag"))
+		}
+
+		// If-Range with the identity ETag still gets the range.
+		resp, _ = download(t, srv, "notes.txt", "Range", "bytes=0-1", "If-Range", etags["identity"])
+		if resp.StatusCode != http.StatusPartialContent {
+			t.Errorf("If-Range: status %d, want 206", resp.StatusCode)
+		}
+	})
+}
+
+func TestUploadEncoding(t *testing.T) {
+	store := newTestStore(t)
+	srv := httptest.NewServer(uploadHandler(store))
+	defer srv.Close()
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	fw, _ := mw.CreateFormFile("file", "up.txt")
+	io.WriteString(fw, "compressed upload")
+	mw.Close()
+
+	encoders := map[string]func(io.Writer) io.WriteCloser{
+		"identity": func(w io.Writer) io.WriteCloser { return nopCloser{w} },
+		"gzip":     func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"zstd": func(w io.Writer) io.WriteCloser {
+			zw, _ := zstd.NewWriter(w)
+			return zw
+		},
+	}
+	for enc, newEncoder := range encoders {
+		t.Run(enc, func(t *testing.T) {
+			var body bytes.Buffer
+			zw := newEncoder(&body)
+			zw.Write(form.Bytes())
+			zw.Close()
+			req, _ := http.NewRequest(http.MethodPost, srv.URL, &body)
+			req.Header.Set("Content-Type", mw.FormDataContentType())
+			req.Header.Set("Content-Encoding", enc)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status %d", resp.StatusCode)
+			}
+			if got, err := readBlob(t, store, "up.txt"); err != nil || got != "compressed upload" {
+				t.Errorf("stored %q, %v", got, err)
+			}
+		})
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL, bytes.NewReader(form.Bytes()))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Content-Encoding", "br")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType || resp.Header.Get("Accept-Encoding") == "" {
+		t.Errorf("unknown encoding: status %d, Accept-Encoding %q", resp.StatusCode, resp.Header.Get("Accept-Encoding"))
+	}
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
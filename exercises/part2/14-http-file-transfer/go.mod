@@ -0,0 +1,5 @@
+module http-file-transfer
+
+go 1.24.4
+
+require github.com/klauspost/compress v1.18.0
@@ -1,58 +1,288 @@
 // HTTP File Upload/Download Example
-// Serves a multipart upload endpoint and a download endpoint that
-// delegates to http.ServeFile for range-request support.
+// Serves a multipart upload endpoint and a download endpoint built on
+// http.ServeContent for range-request support, plus a tus resumable
+// upload endpoint under /files/ (see tus.go) for large uploads that
+// must survive network hiccups. Everything uploaded lands in a
+// content-addressable store (see cas.go) that deduplicates identical
+// files and keeps every version of a name. Uploads may be sent with
+// Content-Encoding: gzip or zstd, and downloads are compressed to
+// match Accept-Encoding when the content is worth it (see compress.go).
+// Deleting versions and garbage collection are served on a separate
+// loopback-only -admin listener, since anyone who can reach them can
+// delete every stored file.
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func uploadHandler(w http.ResponseWriter, r *http.Request) {
-	// 32 MB is the memory ceiling for parsed form parts; larger files
-	// spill over to temporary disk files automatically.
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		http.Error(w, "bad upload", http.StatusBadRequest)
-		return
+func uploadHandler(store *casStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !decodeRequestBody(w, r) {
+			return
+		}
+		// 32 MB is the memory ceiling for parsed form parts; larger files
+		// spill over to temporary disk files automatically.
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			http.Error(w, "bad upload", http.StatusBadRequest)
+			return
+		}
+
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "missing file field", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		// An optional sha256 field, the hex digest the client computed,
+		// catches corruption anywhere between its disk and ours.
+		name := filepath.Base(header.Filename)
+		ref, err := store.put(name, file, header.Size, r.FormValue("sha256"))
+		if errors.Is(err, errDigestMismatch) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			http.Error(w, "write failed", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "uploaded %d bytes as %s version %d (sha256 %s)\n",
+			ref.Size, name, ref.Version, ref.Hash)
 	}
+}
 
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		http.Error(w, "missing file field", http.StatusBadRequest)
-		return
+// parseVersion reads the optional ?version= parameter; 0 means
+// "latest" for downloads and "all versions" for deletes.
+func parseVersion(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("version")
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid version %q", v)
 	}
-	defer file.Close()
+	return n, nil
+}
 
-	dst, err := os.Create("uploads/" + filepath.Base(header.Filename))
-	if err != nil {
-		http.Error(w, "server error", http.StatusInternalServerError)
-		return
+func downloadHandler(store *casStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := filepath.Base(r.URL.Query().Get("name"))
+		version, err := parseVersion(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ref, err := store.get(name, version)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		f, err := store.open(ref)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+
+		// The response differs by Accept-Encoding, so caches must key on it.
+		w.Header().Set("Vary", "Accept-Encoding")
+		ct := contentType(name, f)
+		w.Header().Set("Content-Type", ct)
+
+		// Byte ranges refer to the uncompressed file, so a Range request
+		// (a resumed download) always gets the identity encoding.
+		enc := "identity"
+		if r.Header.Get("Range") == "" && ref.Size >= minCompressSize && compressibleType(ct) {
+			enc = negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		}
+		if enc == "identity" {
+			// The content hash is a perfect ETag: it changes exactly when
+			// the bytes do. ServeContent uses it for If-None-Match and
+			// If-Range.
+			w.Header().Set("ETag", `"`+ref.Hash+`"`)
+			http.ServeContent(w, r, name, ref.Created, f)
+			return
+		}
+
+		// A compressed body is a different representation of the same
+		// file, so it gets its own ETag.
+		etag := `"` + ref.Hash + "-" + enc + `"`
+		w.Header().Set("ETag", etag)
+		if notModified(r, etag, ref.Created) {
+			w.Header().Del("Content-Type")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Encoding", enc)
+		w.Header().Set("Last-Modified", ref.Created.Format(http.TimeFormat))
+		if r.Method == http.MethodHead {
+			return
+		}
+
+		// No Content-Length: we don't know the compressed size until
+		// we're done, so net/http falls back to chunked encoding.
+		zw, err := compressResponse(w, enc)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		if _, err := io.Copy(zw, f); err != nil {
+			log.Printf("download %s: %v", name, err)
+		}
+		zw.Close()
 	}
-	defer dst.Close()
+}
 
-	written, err := io.Copy(dst, file)
+// notModified evaluates If-None-Match, or failing that
+// If-Modified-Since, the way http.ServeContent does for the identity
+// representation (RFC 9110 section 13.2.2).
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagListMatches(inm, etag)
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
 	if err != nil {
-		http.Error(w, "write failed", http.StatusInternalServerError)
-		return
+		return false
+	}
+	// Last-Modified has whole seconds; so does the client's copy.
+	return !modified.Truncate(time.Second).After(ims)
+}
+
+// etagListMatches reports whether an If-None-Match list names etag,
+// or is "*". The comparison is weak, so W/"x" matches "x".
+func etagListMatches(list, etag string) bool {
+	for {
+		list = strings.TrimLeft(list, " \t,")
+		switch {
+		case list == "":
+			return false
+		case list[0] == '*':
+			return true
+		}
+		list = strings.TrimPrefix(list, "W/")
+		if len(list) < 2 || list[0] != '"' {
+			return false // malformed
+		}
+		end := strings.IndexByte(list[1:], '"')
+		if end < 0 {
+			return false
+		}
+		if list[:end+2] == etag {
+			return true
+		}
+		list = list[end+2:]
+	}
+}
+
+func listHandler(store *casStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(store.list())
+	}
+}
+
+func deleteHandler(store *casStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete && r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		version, err := parseVersion(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = store.remove(r.URL.Query().Get("name"), version)
+		if errors.Is(err, errNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, "delete failed", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
 	}
-	fmt.Fprintf(w, "uploaded %d bytes as %s\n", written, header.Filename)
 }
 
-func downloadHandler(w http.ResponseWriter, r *http.Request) {
-	name := filepath.Base(r.URL.Query().Get("name"))
-	http.ServeFile(w, r, filepath.Join("uploads", name))
+func gcHandler(store *casStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		removed, reclaimed, err := store.gc()
+		if err != nil {
+			http.Error(w, "gc failed", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "removed %d blobs, reclaimed %d bytes\n", removed, reclaimed)
+	}
+}
+
+// gcLoop collects unreferenced blobs periodically, so deleted files
+// free their disk space even if nobody calls /gc by hand.
+func gcLoop(store *casStore, interval time.Duration) {
+	for range time.Tick(interval) {
+		removed, reclaimed, err := store.gc()
+		if err != nil {
+			log.Printf("gc: %v", err)
+			continue
+		}
+		if removed > 0 {
+			log.Printf("gc: removed %d blobs, reclaimed %d bytes", removed, reclaimed)
+		}
+	}
 }
 
 func main() {
-	if err := os.MkdirAll("uploads", 0o755); err != nil {
-		log.Fatalf("could not create uploads dir: %v", err)
+	addr := flag.String("addr", ":8082", "listen address")
+	adminAddr := flag.String("admin", "127.0.0.1:8083", "listen address for /delete and /gc (empty to disable)")
+	flag.Parse()
+
+	store, err := openStore("store")
+	if err != nil {
+		log.Fatalf("could not open store: %v", err)
+	}
+	go gcLoop(store, time.Hour)
+
+	// Partial tus uploads are kept for a day of inactivity; completed
+	// ones become versions in the store like any multipart upload.
+	tus, err := newTusStore("uploads-partial", store, 10<<30, 24*time.Hour)
+	if err != nil {
+		log.Fatalf("could not open tus store: %v", err)
+	}
+	go tus.sweep(10 * time.Minute)
+
+	if *adminAddr != "" {
+		admin := http.NewServeMux()
+		admin.HandleFunc("/list", listHandler(store))
+		admin.HandleFunc("/delete", deleteHandler(store))
+		admin.HandleFunc("/gc", gcHandler(store))
+		go func() {
+			fmt.Println("admin API listening on", *adminAddr)
+			if err := http.ListenAndServe(*adminAddr, admin); err != nil {
+				log.Println("admin API stopped:", err)
+			}
+		}()
 	}
-	http.HandleFunc("/upload", uploadHandler)
-	http.HandleFunc("/download", downloadHandler)
-	fmt.Println("listening on :8082")
-	log.Fatal(http.ListenAndServe(":8082", nil))
+
+	http.HandleFunc("/upload", uploadHandler(store))
+	http.HandleFunc("/download", downloadHandler(store))
+	http.HandleFunc("/list", listHandler(store))
+	http.Handle("/files/", tus)
+	fmt.Println("listening on", *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
 }
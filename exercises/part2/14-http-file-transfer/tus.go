@@ -0,0 +1,589 @@
+package main
+
+// A resumable upload endpoint speaking the tus 1.0.0 protocol
+// (https://tus.io/protocols/resumable-upload). Instead of one huge
+// multipart request that must succeed in a single attempt, a client:
+//
+//  1. POSTs to /files/ with Upload-Length to create an upload and gets
+//     back its URL in the Location header,
+//  2. PATCHes chunks to that URL, each carrying the Upload-Offset it
+//     expects the server to be at,
+//  3. after a dropped connection, HEADs the URL to learn how many bytes
+//     actually arrived and resumes PATCHing from there.
+//
+// Supported extensions: creation, termination (DELETE), checksum
+// (Upload-Checksum on PATCH) and expiration (Upload-Expires, plus a
+// sweep that deletes abandoned partial uploads).
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,checksum,expiration"
+	tusAlgorithms = "sha1,sha256,md5"
+
+	// statusChecksumMismatch is the non-standard status code the tus
+	// checksum extension defines for a PATCH whose body didn't hash to
+	// the value in Upload-Checksum.
+	statusChecksumMismatch = 460
+)
+
+// tusUpload is the persisted state of one resumable upload. It is
+// written next to the partial data as <id>.info so uploads in flight
+// survive a server restart.
+type tusUpload struct {
+	ID       string            `json:"id"`
+	Length   int64             `json:"length"`
+	Offset   int64             `json:"offset"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Expires  time.Time         `json:"expires"`
+	// Stored is set once a complete upload has been handed to the
+	// file store. Offset == Length alone doesn't mean that: finish can
+	// fail after the last chunk has been saved.
+	Stored bool `json:"stored,omitempty"`
+
+	// mu serialises PATCHes to the same upload; two clients appending
+	// at the same offset at once would interleave their bytes. It also
+	// guards every field above once the upload is in tusStore.uploads.
+	mu sync.Mutex
+}
+
+type tusStore struct {
+	dir     string        // where partial uploads live
+	files   *casStore     // where completed uploads are stored
+	maxSize int64         // largest Upload-Length we accept
+	ttl     time.Duration // how long an idle, incomplete upload is kept
+
+	mu      sync.Mutex
+	uploads map[string]*tusUpload
+}
+
+func newTusStore(dir string, files *casStore, maxSize int64, ttl time.Duration) (*tusStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &tusStore{
+		dir:     dir,
+		files:   files,
+		maxSize: maxSize,
+		ttl:     ttl,
+		uploads: make(map[string]*tusUpload),
+	}
+
+	// Reload uploads that were in progress when the server last stopped.
+	infos, err := filepath.Glob(filepath.Join(dir, "*.info"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range infos {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		u := &tusUpload{}
+		if err := json.Unmarshal(data, u); err != nil {
+			log.Printf("tus: skipping corrupt %s: %v", path, err)
+			continue
+		}
+		s.uploads[u.ID] = u
+	}
+	return s, nil
+}
+
+// ServeHTTP routes /files/ (the creation URL) and /files/<id> (an
+// upload URL) by method.
+func (s *tusStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/files/")
+	if strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodOptions:
+		s.handleOptions(w, r)
+	case r.Method == http.MethodPost && id == "":
+		s.handleCreate(w, r)
+	case r.Method == http.MethodHead && id != "":
+		s.handleHead(w, r, id)
+	case r.Method == http.MethodPatch && id != "":
+		s.handlePatch(w, r, id)
+	case r.Method == http.MethodDelete && id != "":
+		s.handleDelete(w, r, id)
+	default:
+		tusHeaders(w)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *tusStore) dataPath(id string) string { return filepath.Join(s.dir, id) }
+func (s *tusStore) infoPath(id string) string { return filepath.Join(s.dir, id+".info") }
+
+func (s *tusStore) save(u *tusUpload) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	// Write-then-rename so a crash mid-write never leaves a truncated
+	// .info file that would make the upload unrecoverable.
+	tmp := s.infoPath(u.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.infoPath(u.ID))
+}
+
+func (s *tusStore) lookup(id string) (*tusUpload, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.uploads[id]
+	return u, ok
+}
+
+func (s *tusStore) remove(id string) {
+	s.mu.Lock()
+	delete(s.uploads, id)
+	s.mu.Unlock()
+	os.Remove(s.dataPath(id))
+	os.Remove(s.infoPath(id))
+}
+
+// tusHeaders sets the headers every tus response carries, plus the
+// CORS headers browsers need to call us from a page on another
+// origin and to read our custom response headers.
+func tusHeaders(w http.ResponseWriter) {
+	h := w.Header()
+	h.Set("Tus-Resumable", tusVersion)
+	h.Set("Access-Control-Allow-Origin", "*")
+	h.Set("Access-Control-Expose-Headers",
+		"Location, Upload-Offset, Upload-Length, Upload-Metadata, Upload-Expires, "+
+			"Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Tus-Checksum-Algorithm")
+}
+
+// checkVersion rejects requests from clients speaking a tus version
+// we don't implement. Every request except OPTIONS must declare one.
+func checkVersion(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+func (s *tusStore) handleOptions(w http.ResponseWriter, r *http.Request) {
+	tusHeaders(w)
+	h := w.Header()
+	h.Set("Tus-Version", tusVersion)
+	h.Set("Tus-Extension", tusExtensions)
+	h.Set("Tus-Max-Size", strconv.FormatInt(s.maxSize, 10))
+	h.Set("Tus-Checksum-Algorithm", tusAlgorithms)
+	// The same OPTIONS request doubles as the CORS preflight.
+	h.Set("Access-Control-Allow-Methods", "POST, HEAD, PATCH, DELETE, OPTIONS")
+	h.Set("Access-Control-Allow-Headers",
+		"Content-Type, Content-Encoding, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset, Upload-Checksum")
+	h.Set("Access-Control-Max-Age", "86400")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *tusStore) handleCreate(w http.ResponseWriter, r *http.Request) {
+	tusHeaders(w)
+	if !checkVersion(w, r) {
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "missing or invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > s.maxSize {
+		http.Error(w, "upload exceeds Tus-Max-Size", http.StatusRequestEntityTooLarge)
+		return
+	}
+	meta, err := parseMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := newUploadID()
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	u := &tusUpload{
+		ID:       id,
+		Length:   length,
+		Metadata: meta,
+		Expires:  time.Now().Add(s.ttl),
+	}
+	f, err := os.Create(s.dataPath(id))
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+	if err := s.save(u); err != nil {
+		os.Remove(s.dataPath(id))
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Once u is published, its fields belong to u.mu.
+	expires := u.Expires.UTC().Format(http.TimeFormat)
+	s.mu.Lock()
+	s.uploads[id] = u
+	s.mu.Unlock()
+
+	// A zero-length upload is complete the moment it is created.
+	if length == 0 {
+		u.mu.Lock()
+		err := s.finish(u)
+		u.mu.Unlock()
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Location", "/files/"+id)
+	w.Header().Set("Upload-Expires", expires)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *tusStore) handleHead(w http.ResponseWriter, r *http.Request, id string) {
+	tusHeaders(w)
+	if !checkVersion(w, r) {
+		return
+	}
+	u, ok := s.lookup(id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if time.Now().After(u.Expires) {
+		// Expired but not yet swept: as good as gone.
+		http.Error(w, "upload expired", http.StatusGone)
+		return
+	}
+
+	h := w.Header()
+	// The offset changes with every PATCH, so no cache along the way
+	// may answer this request on our behalf.
+	h.Set("Cache-Control", "no-store")
+	h.Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	h.Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	if len(u.Metadata) > 0 {
+		h.Set("Upload-Metadata", formatMetadata(u.Metadata))
+	}
+	if u.Offset < u.Length {
+		h.Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	} else if !u.Stored {
+		// Every byte arrived but storing the file failed. Try again
+		// rather than let the client take the offset as success.
+		if err := s.finish(u); err != nil {
+			log.Printf("tus: storing upload %s: %v", u.ID, err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *tusStore) handlePatch(w http.ResponseWriter, r *http.Request, id string) {
+	tusHeaders(w)
+	if !checkVersion(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream",
+			http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "missing or invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	// A compressed chunk is decoded before it's appended, so offsets,
+	// lengths and Upload-Checksum all describe the file itself.
+	if !decodeRequestBody(w, r) {
+		return
+	}
+
+	var sum hash.Hash
+	var want []byte
+	if v := r.Header.Get("Upload-Checksum"); v != "" {
+		if sum, want, err = parseChecksum(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	u, ok := s.lookup(id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !u.mu.TryLock() {
+		http.Error(w, "upload is busy", http.StatusLocked)
+		return
+	}
+	defer u.mu.Unlock()
+
+	if time.Now().After(u.Expires) {
+		http.Error(w, "upload expired", http.StatusGone)
+		return
+	}
+	if offset != u.Offset {
+		// The client's idea of the offset is stale (usually a resumed
+		// upload that skipped the HEAD); it must re-sync and retry.
+		http.Error(w, "Upload-Offset mismatch", http.StatusConflict)
+		return
+	}
+	if u.Offset == u.Length {
+		// Already complete (a retried final PATCH); nothing to append,
+		// but the file may not have made it into the store last time.
+		if !u.Stored {
+			if err := s.finish(u); err != nil {
+				log.Printf("tus: storing upload %s: %v", u.ID, err)
+				http.Error(w, "server error", http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	f, err := os.OpenFile(s.dataPath(u.ID), os.O_WRONLY, 0)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Seek(u.Offset, io.SeekStart); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Read one byte past what's left so we can tell a body that
+	// overruns Upload-Length apart from one that fits exactly.
+	remaining := u.Length - u.Offset
+	var body io.Reader = io.LimitReader(r.Body, remaining+1)
+	if sum != nil {
+		body = io.TeeReader(body, sum)
+	}
+	written, copyErr := io.Copy(f, body)
+	if written > remaining {
+		f.Truncate(u.Offset)
+		http.Error(w, "body exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if sum != nil && (copyErr != nil || !bytes.Equal(sum.Sum(nil), want)) {
+		// With a checksum the chunk is all-or-nothing: we can't verify
+		// a prefix, so anything short or mismatched is discarded and
+		// the client resends the whole chunk.
+		f.Truncate(u.Offset)
+		if copyErr != nil {
+			return // client went away; nobody to answer
+		}
+		http.Error(w, "checksum mismatch", statusChecksumMismatch)
+		return
+	}
+
+	// Without a checksum, keep whatever arrived even if the connection
+	// dropped mid-body — that's the whole point of resumability. The
+	// next HEAD tells the client where to pick up.
+	u.Offset += written
+	u.Expires = time.Now().Add(s.ttl)
+	if err := s.save(u); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if copyErr != nil {
+		log.Printf("tus: upload %s interrupted at %d/%d: %v", u.ID, u.Offset, u.Length, copyErr)
+		return
+	}
+	if u.Offset == u.Length {
+		f.Close()
+		if err := s.finish(u); err != nil {
+			log.Printf("tus: storing upload %s: %v", u.ID, err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	if u.Offset < u.Length {
+		w.Header().Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *tusStore) handleDelete(w http.ResponseWriter, r *http.Request, id string) {
+	tusHeaders(w)
+	if !checkVersion(w, r) {
+		return
+	}
+	u, ok := s.lookup(id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	s.remove(u.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finish hands a completed upload to the file store, where it becomes
+// a new version of its name just like a multipart upload, so /download
+// can serve it. The info file is kept (with Stored set) so a client
+// that HEADs after a lost final response still learns the upload is
+// done instead of getting a 404. If finish fails the partial data stays
+// put, and the next HEAD or PATCH tries again.
+func (s *tusStore) finish(u *tusUpload) error {
+	name := filepath.Base(u.Metadata["filename"])
+	if name == "." || name == string(filepath.Separator) || name == "" {
+		name = u.ID
+	}
+	f, err := os.Open(s.dataPath(u.ID))
+	if err != nil {
+		return err
+	}
+	ref, err := s.files.put(name, f, u.Length, "")
+	f.Close()
+	if err != nil {
+		return err
+	}
+	u.Stored = true
+	if err := s.save(u); err != nil {
+		// The file is in the store; only a restart before the next
+		// save would forget that and store it a second time.
+		log.Printf("tus: saving upload %s: %v", u.ID, err)
+		return nil
+	}
+	os.Remove(s.dataPath(u.ID))
+	log.Printf("tus: upload %s complete, stored as %s v%d (%d bytes)", u.ID, name, ref.Version, u.Length)
+	return nil
+}
+
+// sweep expires uploads every interval.
+func (s *tusStore) sweep(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.expire(time.Now())
+	}
+}
+
+// expire deletes uploads whose expiry has passed by now. Unstored ones
+// are abandoned partial files taking up disk; stored ones only have
+// their bookkeeping removed, since the file itself now lives in the
+// file store.
+func (s *tusStore) expire(now time.Time) {
+	s.mu.Lock()
+	uploads := make([]*tusUpload, 0, len(s.uploads))
+	for _, u := range s.uploads {
+		uploads = append(uploads, u)
+	}
+	s.mu.Unlock()
+
+	for _, u := range uploads {
+		// Skip uploads with a request in flight: it may be about to
+		// push Expires back. The next sweep catches them if they're
+		// still idle.
+		if !u.mu.TryLock() {
+			continue
+		}
+		if now.After(u.Expires) {
+			if !u.Stored {
+				log.Printf("tus: expiring abandoned upload %s at %d/%d bytes", u.ID, u.Offset, u.Length)
+			}
+			s.remove(u.ID)
+		}
+		u.mu.Unlock()
+	}
+}
+
+func newUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// parseMetadata decodes Upload-Metadata: comma-separated pairs of a
+// key and an optional base64-encoded value, e.g.
+// "filename d29ybGQuanBn,is_confidential".
+func parseMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	if header == "" {
+		return meta, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("invalid Upload-Metadata")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata value for %q", key)
+		}
+		meta[key] = string(decoded)
+	}
+	return meta, nil
+}
+
+func formatMetadata(meta map[string]string) string {
+	pairs := make([]string, 0, len(meta))
+	for k, v := range meta {
+		pairs = append(pairs, k+" "+base64.StdEncoding.EncodeToString([]byte(v)))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// parseChecksum decodes "Upload-Checksum: <algorithm> <base64 digest>".
+func parseChecksum(header string) (hash.Hash, []byte, error) {
+	algo, encoded, ok := strings.Cut(header, " ")
+	if !ok {
+		return nil, nil, errors.New("invalid Upload-Checksum")
+	}
+	want, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, errors.New("invalid Upload-Checksum digest")
+	}
+	switch algo {
+	case "sha1":
+		return sha1.New(), want, nil
+	case "sha256":
+		return sha256.New(), want, nil
+	case "md5":
+		return md5.New(), want, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported checksum algorithm %q", algo)
+}
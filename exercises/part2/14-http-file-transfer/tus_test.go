@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func init() {
+	// The handlers log every completed and failed upload.
+	log.SetOutput(io.Discard)
+}
+
+// newTusServer serves a tusStore backed by a fresh casStore.
+func newTusServer(t *testing.T) (*httptest.Server, *tusStore) {
+	t.Helper()
+	dir := t.TempDir()
+	files, err := openStore(filepath.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tus, err := newTusStore(filepath.Join(dir, "partial"), files, 1<<20, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(tus)
+	t.Cleanup(srv.Close)
+	return srv, tus
+}
+
+// tusDo sends a tus request carrying Tus-Resumable and any other
+// headers, given as name, value pairs.
+func tusDo(t *testing.T, method, url string, body []byte, headers ...string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+	for i := 0; i < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp
+}
+
+// create starts an upload of length bytes named name and returns its
+// URL.
+func create(t *testing.T, srv *httptest.Server, name string, length int) string {
+	t.Helper()
+	resp := tusDo(t, http.MethodPost, srv.URL+"/files/", nil,
+		"Upload-Length", strconv.Itoa(length),
+		"Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte(name)))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: status %d", resp.StatusCode)
+	}
+	return srv.URL + resp.Header.Get("Location")
+}
+
+func patch(t *testing.T, url string, offset int, chunk []byte, headers ...string) *http.Response {
+	t.Helper()
+	return tusDo(t, http.MethodPatch, url, chunk, append([]string{
+		"Content-Type", "application/offset+octet-stream",
+		"Upload-Offset", strconv.Itoa(offset),
+	}, headers...)...)
+}
+
+// offset HEADs url and returns the Upload-Offset it reports.
+func offset(t *testing.T, url string) int {
+	t.Helper()
+	resp := tusDo(t, http.MethodHead, url, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("HEAD: status %d", resp.StatusCode)
+	}
+	n, err := strconv.Atoi(resp.Header.Get("Upload-Offset"))
+	if err != nil {
+		t.Fatalf("HEAD: Upload-Offset %q", resp.Header.Get("Upload-Offset"))
+	}
+	return n
+}
+
+// stored returns the latest version of name in the file store.
+func stored(t *testing.T, tus *tusStore, name string) string {
+	t.Helper()
+	ref, err := tus.files.get(name, 0)
+	if err != nil {
+		t.Fatalf("%s isn't in the store: %v", name, err)
+	}
+	f, err := tus.files.open(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, _ := io.ReadAll(f)
+	return string(data)
+}
+
+func TestTusResume(t *testing.T) {
+	srv, tus := newTusServer(t)
+	url := create(t, srv, "hello.txt", 11)
+	if n := offset(t, url); n != 0 {
+		t.Fatalf("new upload at offset %d", n)
+	}
+
+	if resp := patch(t, url, 0, []byte("hello")); resp.StatusCode != http.StatusNoContent || resp.Header.Get("Upload-Offset") != "5" {
+		t.Fatalf("first chunk: status %d, offset %s", resp.StatusCode, resp.Header.Get("Upload-Offset"))
+	}
+	// A client resuming from where it thinks it was is turned away
+	// until it asks.
+	if resp := patch(t, url, 0, []byte(" world")); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("stale offset: status %d, want 409", resp.StatusCode)
+	}
+	n := offset(t, url)
+	if n != 5 {
+		t.Fatalf("HEAD says offset %d, want 5", n)
+	}
+	if resp := patch(t, url, n, []byte(" world")); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("last chunk: status %d", resp.StatusCode)
+	}
+	if got := stored(t, tus, "hello.txt"); got != "hello world" {
+		t.Errorf("stored %q", got)
+	}
+
+	// A retried final PATCH is answered, and doesn't store it twice.
+	if resp := patch(t, url, 11, nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("retried final chunk: status %d", resp.StatusCode)
+	}
+	if versions := tus.files.index["hello.txt"]; len(versions) != 1 {
+		t.Errorf("%d versions stored", len(versions))
+	}
+}
+
+func TestTusRequests(t *testing.T) {
+	srv, _ := newTusServer(t)
+	url := create(t, srv, "a", 4)
+	tests := []struct {
+		name string
+		resp func() *http.Response
+		want int
+	}{
+		{"no version", func() *http.Response {
+			resp, err := http.Head(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return resp
+		}, http.StatusPreconditionFailed},
+		{"too large", func() *http.Response {
+			return tusDo(t, http.MethodPost, srv.URL+"/files/", nil, "Upload-Length", "2000000")
+		}, http.StatusRequestEntityTooLarge},
+		{"wrong content type", func() *http.Response {
+			return patch(t, url, 0, []byte("abcd"), "Content-Type", "application/octet-stream")
+		}, http.StatusUnsupportedMediaType},
+		{"overrun", func() *http.Response { return patch(t, url, 0, []byte("abcde")) }, http.StatusRequestEntityTooLarge},
+		{"unknown upload", func() *http.Response { return patch(t, srv.URL+"/files/nope", 0, []byte("abcd")) }, http.StatusNotFound},
+		{"unknown encoding", func() *http.Response {
+			return patch(t, url, 0, []byte("abcd"), "Content-Encoding", "br")
+		}, http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if resp := tt.resp(); resp.StatusCode != tt.want {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+	if n := offset(t, url); n != 0 {
+		t.Errorf("rejected chunks moved the offset to %d", n)
+	}
+}
+
+func TestTusChecksum(t *testing.T) {
+	srv, tus := newTusServer(t)
+	url := create(t, srv, "sum", 8)
+	digest := func(b []byte) string {
+		sum := sha256.Sum256(b)
+		return "sha256 " + base64.StdEncoding.EncodeToString(sum[:])
+	}
+
+	if resp := patch(t, url, 0, []byte("abcd"), "Upload-Checksum", digest([]byte("abce"))); resp.StatusCode != statusChecksumMismatch {
+		t.Fatalf("bad checksum: status %d, want %d", resp.StatusCode, statusChecksumMismatch)
+	}
+	if n := offset(t, url); n != 0 {
+		t.Fatalf("mismatched chunk kept: offset %d", n)
+	}
+	if resp := patch(t, url, 0, []byte("abcd"), "Upload-Checksum", "crc32 AAAA"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown algorithm: status %d", resp.StatusCode)
+	}
+	if resp := patch(t, url, 0, []byte("abcd"), "Upload-Checksum", digest([]byte("abcd"))); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("good checksum: status %d", resp.StatusCode)
+	}
+	if resp := patch(t, url, 4, []byte("efgh"), "Upload-Checksum", digest([]byte("efgh"))); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("good checksum: status %d", resp.StatusCode)
+	}
+	if got := stored(t, tus, "sum"); got != "abcdefgh" {
+		t.Errorf("stored %q", got)
+	}
+}
+
+func TestTusExpiry(t *testing.T) {
+	srv, tus := newTusServer(t)
+	url := create(t, srv, "late", 4)
+	u, _ := tus.lookup(filepath.Base(url))
+	u.Expires = time.Now().Add(-time.Second)
+	if resp := patch(t, url, 0, []byte("abcd")); resp.StatusCode != http.StatusGone {
+		t.Errorf("status %d, want 410", resp.StatusCode)
+	}
+}
+
+func TestTusCompressedPatch(t *testing.T) {
+	srv, tus := newTusServer(t)
+	url := create(t, srv, "gz", 10)
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("0123456789"))
+	zw.Close()
+
+	// Offsets count the decoded bytes, whatever size the body was.
+	resp := patch(t, url, 0, buf.Bytes(), "Content-Encoding", "gzip")
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Upload-Offset") != "10" {
+		t.Fatalf("status %d, offset %s", resp.StatusCode, resp.Header.Get("Upload-Offset"))
+	}
+	if got := stored(t, tus, "gz"); got != "0123456789" {
+		t.Errorf("stored %q", got)
+	}
+}
+
+// A final chunk that arrives but can't be stored mustn't look like a
+// finished upload: both HEAD and a retried PATCH keep failing until the
+// file really is in the store.
+func TestTusFinishRetry(t *testing.T) {
+	srv, tus := newTusServer(t)
+	url := create(t, srv, "retry", 4)
+	tmp := filepath.Join(tus.files.dir, "tmp")
+	os.RemoveAll(tmp)
+
+	if resp := patch(t, url, 0, []byte("abcd")); resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("store down: status %d, want 500", resp.StatusCode)
+	}
+	if resp := tusDo(t, http.MethodHead, url, nil); resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("HEAD with the store down: status %d, want 500", resp.StatusCode)
+	}
+	if resp := patch(t, url, 4, nil); resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("retry with the store down: status %d, want 500", resp.StatusCode)
+	}
+
+	os.Mkdir(tmp, 0o755)
+	if resp := patch(t, url, 4, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("retry: status %d", resp.StatusCode)
+	}
+	if got := stored(t, tus, "retry"); got != "abcd" {
+		t.Errorf("stored %q", got)
+	}
+	if n := offset(t, url); n != 4 {
+		t.Errorf("HEAD after storing: offset %d", n)
+	}
+}
+
+func TestTusSweep(t *testing.T) {
+	srv, tus := newTusServer(t)
+	idle := create(t, srv, "idle", 4)
+	busy := create(t, srv, "busy", 4)
+	done := create(t, srv, "done", 4)
+	if resp := patch(t, done, 0, []byte("abcd")); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+
+	// An upload expired but not yet swept is already gone to clients.
+	later := time.Now().Add(2 * time.Hour)
+	u, _ := tus.lookup(filepath.Base(idle))
+	u.Expires = time.Now().Add(-time.Second)
+	if resp := tusDo(t, http.MethodHead, idle, nil); resp.StatusCode != http.StatusGone {
+		t.Errorf("HEAD on an expired upload: status %d, want 410", resp.StatusCode)
+	}
+
+	// One with a request in flight is left for the next sweep.
+	b, _ := tus.lookup(filepath.Base(busy))
+	b.mu.Lock()
+	tus.expire(later)
+	b.mu.Unlock()
+
+	for _, url := range []string{idle, done} {
+		if resp := tusDo(t, http.MethodHead, url, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("HEAD %s after sweeping: status %d, want 404", filepath.Base(url), resp.StatusCode)
+		}
+		if _, err := os.Stat(tus.infoPath(filepath.Base(url))); !os.IsNotExist(err) {
+			t.Errorf("%s.info survived the sweep: %v", filepath.Base(url), err)
+		}
+	}
+	if _, err := os.Stat(tus.dataPath(filepath.Base(idle))); !os.IsNotExist(err) {
+		t.Errorf("partial data survived the sweep: %v", err)
+	}
+	if got := stored(t, tus, "done"); got != "abcd" {
+		t.Errorf("sweeping removed the stored file: %q", got)
+	}
+	if _, ok := tus.lookup(filepath.Base(busy)); !ok {
+		t.Error("swept an upload with a request in flight")
+	}
+	tus.expire(later)
+	if _, ok := tus.lookup(filepath.Base(busy)); ok {
+		t.Error("busy upload survived the next sweep")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// fakeServer runs the server side of the PSK exchange on a pipe. verify
+// decides whether the client's response is accepted, and proof builds
+// what is sent after authOK from the server and client nonces.
+func fakeServer(verify func(ns, nc, mac []byte) bool, proof func(ns, nc []byte) []byte) net.Conn {
+	server, client := net.Pipe()
+	go func() {
+		defer server.Close()
+		ns := make([]byte, nonceSize)
+		rand.Read(ns)
+		if _, err := server.Write(ns); err != nil {
+			return
+		}
+		resp := make([]byte, nonceSize+32)
+		if _, err := io.ReadFull(server, resp); err != nil {
+			return
+		}
+		nc, mac := resp[:nonceSize], resp[nonceSize:]
+		if !verify(ns, nc, mac) {
+			server.Write([]byte{1})
+			return
+		}
+		server.Write(append([]byte{authOK}, proof(ns, nc)...))
+	}()
+	return client
+}
+
+func TestRespond(t *testing.T) {
+	psk := []byte("correct horse battery staple")
+	checks := func(key []byte) func(ns, nc, mac []byte) bool {
+		return func(ns, nc, mac []byte) bool { return string(mac) == string(pskMAC(key, "client", ns, nc)) }
+	}
+	proves := func(key []byte) func(ns, nc []byte) []byte {
+		return func(ns, nc []byte) []byte { return pskMAC(key, "server", nc, ns) }
+	}
+	acceptAll := func(ns, nc, mac []byte) bool { return true }
+
+	// A proof recorded from an earlier session with the real server.
+	var recorded []byte
+	conn := fakeServer(checks(psk), func(ns, nc []byte) []byte {
+		recorded = pskMAC(psk, "server", nc, ns)
+		return recorded
+	})
+	if err := respond(conn, psk); err != nil {
+		t.Fatalf("recording session: %v", err)
+	}
+	conn.Close()
+
+	tests := []struct {
+		name   string
+		verify func(ns, nc, mac []byte) bool
+		proof  func(ns, nc []byte) []byte
+		want   error
+	}{
+		{"good key", checks(psk), proves(psk), nil},
+		{"wrong key", checks([]byte("other")), proves([]byte("other")), errAuthRejected},
+		// An impostor that waves every client through can't prove
+		// it knows the key, whether it guesses or replays.
+		{"impostor", acceptAll, proves([]byte("guess")), errServerUnverified},
+		{"replayed proof", acceptAll, func(ns, nc []byte) []byte { return recorded }, errServerUnverified},
+		{"reflected mac", acceptAll, func(ns, nc []byte) []byte { return pskMAC(psk, "client", ns, nc) }, errServerUnverified},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := fakeServer(tt.verify, tt.proof)
+			defer conn.Close()
+			if err := respond(conn, psk); !errors.Is(err, tt.want) {
+				t.Errorf("respond returned %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
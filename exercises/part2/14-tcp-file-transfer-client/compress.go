@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression negotiation runs after authentication and before the
+// transfer header (see 14-tcp-file-transfer-server/compress.go):
+//
+//	client -> server: negotiateMagic, count, codec IDs in preference order
+//	server -> client: the chosen codec ID, or codecRefused
+//
+// The header's size field always carries the uncompressed size; only
+// the file body that follows is compressed.
+const (
+	negotiateMagic byte = 0xC5
+	codecRefused   byte = 0xFF
+)
+
+type codec byte
+
+const (
+	codecNone codec = 0
+	codecGzip codec = 1
+	codecZstd codec = 2
+)
+
+func (c codec) String() string {
+	switch c {
+	case codecNone:
+		return "none"
+	case codecGzip:
+		return "gzip"
+	case codecZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("codec(%d)", byte(c))
+}
+
+// parseCodecs turns the -compress flag into the list we offer the
+// server. "auto" prefers zstd, then gzip, and always allows none.
+func parseCodecs(flag string) ([]codec, error) {
+	if flag == "auto" {
+		return []codec{codecZstd, codecGzip, codecNone}, nil
+	}
+	var offer []codec
+	for _, name := range strings.Split(flag, ",") {
+		switch strings.TrimSpace(name) {
+		case "none":
+			offer = append(offer, codecNone)
+		case "gzip":
+			offer = append(offer, codecGzip)
+		case "zstd":
+			offer = append(offer, codecZstd)
+		default:
+			return nil, fmt.Errorf("unknown compression %q", name)
+		}
+	}
+	return offer, nil
+}
+
+// alreadyCompressed extensions, and the sniffed content types below,
+// gain nothing from another compression pass — it only burns CPU and
+// can even make the stream slightly larger.
+var alreadyCompressed = map[string]bool{
+	".gz": true, ".tgz": true, ".zst": true, ".xz": true, ".bz2": true,
+	".zip": true, ".7z": true, ".rar": true, ".jar": true, ".apk": true,
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true,
+	".mp3": true, ".ogg": true, ".mp4": true, ".mkv": true, ".webm": true,
+	".pdf": true, ".woff2": true,
+}
+
+func looksCompressed(f *os.File) bool {
+	if alreadyCompressed[strings.ToLower(filepath.Ext(f.Name()))] {
+		return true
+	}
+	head := make([]byte, 512)
+	n, _ := f.ReadAt(head, 0)
+	head = head[:n]
+	// Zstandard frames start with 28 B5 2F FD; DetectContentType
+	// doesn't know about them.
+	if bytes.HasPrefix(head, []byte{0x28, 0xB5, 0x2F, 0xFD}) {
+		return true
+	}
+	switch ct := http.DetectContentType(head); {
+	case strings.HasPrefix(ct, "image/"), strings.HasPrefix(ct, "audio/"),
+		strings.HasPrefix(ct, "video/"), ct == "application/x-gzip",
+		ct == "application/zip", ct == "application/x-rar-compressed",
+		ct == "application/pdf", ct == "font/woff2":
+		return true
+	}
+	return false
+}
+
+// negotiate offers our codecs and returns the one the server picked.
+func negotiate(conn io.ReadWriter, offer []codec) (codec, error) {
+	msg := []byte{negotiateMagic, byte(len(offer))}
+	for _, c := range offer {
+		msg = append(msg, byte(c))
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return 0, err
+	}
+	reply := make([]byte, 1)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return 0, fmt.Errorf("read negotiated codec: %w", err)
+	}
+	if reply[0] == codecRefused {
+		return 0, fmt.Errorf("server accepts none of the offered codecs %v", offer)
+	}
+	chosen := codec(reply[0])
+	for _, c := range offer {
+		if c == chosen {
+			return chosen, nil
+		}
+	}
+	return 0, fmt.Errorf("server picked %v, which we did not offer", chosen)
+}
+
+// compressWriter wraps w in an encoder for c. Close must be called to
+// flush the final frame; it does not close w.
+func compressWriter(w io.Writer, c codec) (io.WriteCloser, error) {
+	switch c {
+	case codecGzip:
+		return gzip.NewWriter(w), nil
+	case codecZstd:
+		return zstd.NewWriter(w)
+	}
+	return nopWriteCloser{w}, nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// countingWriter tallies bytes actually put on the wire, so we can
+// report the compression ratio.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// replyConn records what's written and answers reads from reply.
+type replyConn struct {
+	io.Reader
+	sent bytes.Buffer
+}
+
+func (c *replyConn) Write(p []byte) (int, error) { return c.sent.Write(p) }
+
+func TestNegotiate(t *testing.T) {
+	offer := []codec{codecZstd, codecGzip, codecNone}
+	tests := []struct {
+		name    string
+		reply   []byte
+		want    codec
+		wantErr bool
+	}{
+		{"zstd", []byte{byte(codecZstd)}, codecZstd, false},
+		{"gzip", []byte{byte(codecGzip)}, codecGzip, false},
+		{"identity fallback", []byte{byte(codecNone)}, codecNone, false},
+		{"refused", []byte{codecRefused}, 0, true},
+		{"not offered", []byte{7}, 0, true},
+		{"hung up", nil, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &replyConn{Reader: bytes.NewReader(tt.reply)}
+			got, err := negotiate(conn, offer)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("negotiate = %v, %v; want %v", got, err, tt.want)
+			}
+			want := []byte{negotiateMagic, 3, byte(codecZstd), byte(codecGzip), byte(codecNone)}
+			if !bytes.Equal(conn.sent.Bytes(), want) {
+				t.Errorf("offered %x, want %x", conn.sent.Bytes(), want)
+			}
+		})
+	}
+}
+
+func TestCompressWriter(t *testing.T) {
+	text := strings.Repeat("all work and no play makes jack a dull boy\n", 50)
+	decoders := map[codec]func(io.Reader) (io.Reader, error){
+		codecNone: func(r io.Reader) (io.Reader, error) { return r, nil },
+		codecGzip: func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		codecZstd: func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+	}
+	for c, newDecoder := range decoders {
+		t.Run(c.String(), func(t *testing.T) {
+			wire := &countingWriter{w: &bytes.Buffer{}}
+			zw, err := compressWriter(wire, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(zw, text)
+			if err := zw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if c != codecNone && wire.n >= int64(len(text)) {
+				t.Errorf("%d bytes compressed to %d", len(text), wire.n)
+			}
+			r, err := newDecoder(wire.w.(*bytes.Buffer))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := io.ReadAll(r); err != nil || string(got) != text {
+				t.Errorf("decoded %d bytes, %v", len(got), err)
+			}
+		})
+	}
+}
+
+func TestParseCodecs(t *testing.T) {
+	if got, err := parseCodecs("auto"); err != nil || len(got) != 3 || got[0] != codecZstd || got[2] != codecNone {
+		t.Errorf("auto = %v, %v", got, err)
+	}
+	if got, err := parseCodecs("gzip,none"); err != nil || len(got) != 2 || got[0] != codecGzip {
+		t.Errorf("gzip,none = %v, %v", got, err)
+	}
+	if _, err := parseCodecs("brotli"); err == nil {
+		t.Error("accepted an unknown codec")
+	}
+}
+
+func TestLooksCompressed(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content []byte
+		want    bool
+	}{
+		{"notes.txt", []byte("plain text compresses well"), false},
+		{"photo.JPG", []byte("extension alone decides"), true},
+		{"noext", []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0}, true},           // gzip magic
+		{"frame.bin", []byte{0x28, 0xB5, 0x2F, 0xFD, 0, 0, 0, 0}, true}, // zstd magic
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		os.WriteFile(path, tt.content, 0o644)
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := looksCompressed(f); got != tt.want {
+			t.Errorf("looksCompressed(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+		f.Close()
+	}
+}
@@ -0,0 +1,5 @@
+module tcp-file-transfer-client
+
+go 1.24.4
+
+require github.com/klauspost/compress v1.18.0
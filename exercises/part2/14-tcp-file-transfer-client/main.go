@@ -1,10 +1,14 @@
 // TCP File Transfer Client Example
 // Sends a local file to 14-tcp-file-transfer-server using a small
-// size-prefixed header protocol.
+// size-prefixed header protocol, optionally over TLS (with a client
+// certificate for mutual TLS) and/or after a pre-shared key challenge,
+// compressing the body with whichever codec the server agrees to.
 package main
 
 import (
+	"crypto/tls"
 	"encoding/binary"
+	"flag"
 	"fmt"
 	"io"
 	"net"
@@ -35,7 +39,21 @@ func dialWithRetry(
 	return nil, fmt.Errorf("after %d attempts: %w", attempts, lastErr)
 }
 
-func sendFile(path, addr string) error {
+// minCompressSize is the smallest file worth compressing; below it the
+// codec's framing overhead eats most of the savings.
+const minCompressSize = 1024
+
+// transferOptions selects how the connection is secured and which
+// compression codecs we offer, in preference order. A nil tlsConfig
+// and psk send in plaintext with no authentication, matching the
+// server's default mode.
+type transferOptions struct {
+	tlsConfig *tls.Config
+	psk       []byte
+	codecs    []codec
+}
+
+func sendFile(path, addr string, opts transferOptions) error {
 	f, err := os.Open(path)
 	if err != nil {
 		return err
@@ -53,6 +71,29 @@ func sendFile(path, addr string) error {
 	}
 	defer conn.Close()
 
+	if opts.tlsConfig != nil {
+		if conn, err = secureConn(conn, opts.tlsConfig); err != nil {
+			return err
+		}
+		defer conn.Close()
+	}
+	if opts.psk != nil {
+		if err := respond(conn, opts.psk); err != nil {
+			return err
+		}
+	}
+
+	// Only offer compression when it can pay off: JPEGs, zips and
+	// tiny files are sent as-is no matter what -compress says.
+	offer := opts.codecs
+	if info.Size() < minCompressSize || looksCompressed(f) {
+		offer = []codec{codecNone}
+	}
+	chosen, err := negotiate(conn, offer)
+	if err != nil {
+		return err
+	}
+
 	name := filepath.Base(path)
 
 	// Write the header: size, then name length, then name.
@@ -70,20 +111,85 @@ func sendFile(path, addr string) error {
 
 	// io.Copy streams the file in chunks — it never loads the whole
 	// file into memory, so this works the same for a 1 KB file or a 10 GB one.
-	sent, err := io.Copy(conn, f)
+	if chosen == codecNone {
+		// Copying straight into the connection keeps the sendfile fast path.
+		sent, err := io.Copy(conn, f)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("sent %d bytes\n", sent)
+		return nil
+	}
+
+	wire := &countingWriter{w: conn}
+	zw, err := compressWriter(wire, chosen)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("sent %d bytes\n", sent)
+	sent, err := io.Copy(zw, f)
+	if err != nil {
+		return err
+	}
+	// Close flushes the codec's final frame; without it the server's
+	// decoder would wait for bytes that never come.
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("sent %d bytes as %d %s-compressed bytes (%.1f%%)\n",
+		sent, wire.n, chosen, 100*float64(wire.n)/float64(max(sent, 1)))
 	return nil
 }
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("usage: 14-tcp-file-transfer-client <path>")
+	addr := flag.String("addr", "localhost:9100", "server address")
+	useTLS := flag.Bool("tls", false, "connect over TLS")
+	caFile := flag.String("ca", "", "CA bundle to verify the server certificate (implies -tls)")
+	certFile := flag.String("cert", "", "client certificate for mutual TLS (implies -tls)")
+	keyFile := flag.String("key", "", "client private key for mutual TLS")
+	serverName := flag.String("server-name", "", "expected server name (defaults to the host in -addr)")
+	pskFile := flag.String("psk-file", "", "file holding the pre-shared key")
+	compress := flag.String("compress", "auto", `codecs to offer, in preference order: "auto" or a list of zstd, gzip, none`)
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		fmt.Println("usage: 14-tcp-file-transfer-client [flags] <path>")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	codecs, err := parseCodecs(*compress)
+	if err != nil {
+		fmt.Println("error:", err)
 		os.Exit(1)
 	}
-	if err := sendFile(os.Args[1], "localhost:9100"); err != nil {
+	opts := transferOptions{codecs: codecs}
+	if *useTLS || *caFile != "" || *certFile != "" {
+		name := *serverName
+		if name == "" {
+			host, _, err := net.SplitHostPort(*addr)
+			if err != nil {
+				fmt.Println("error:", err)
+				os.Exit(1)
+			}
+			name = host
+		}
+		config, err := loadTLSConfig(*caFile, *certFile, *keyFile, name)
+		if err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		opts.tlsConfig = config
+	}
+	if *pskFile != "" {
+		psk, err := loadPSK(*pskFile)
+		if err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		opts.psk = psk
+	}
+
+	if err := sendFile(flag.Arg(0), *addr, opts); err != nil {
 		fmt.Println("error:", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// serveAdmin exposes the store over HTTP:
+//
+//	GET    /list                          every name and its versions
+//	DELETE /delete?name=x[&version=n]     drop one version, or all of them
+//	POST   /gc                            remove unreferenced blobs now
+//
+// It listens on loopback by default: anyone who can reach it can
+// delete files, and the upload protocol's TLS/PSK checks don't apply.
+func serveAdmin(addr string, store *casStore) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/list", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(store.list())
+	})
+	mux.HandleFunc("/delete", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete && r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		version := 0
+		if v := r.URL.Query().Get("version"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				http.Error(w, "invalid version", http.StatusBadRequest)
+				return
+			}
+			version = n
+		}
+		err := store.remove(r.URL.Query().Get("name"), version)
+		if errors.Is(err, errNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, "delete failed", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/gc", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		removed, reclaimed, err := store.gc()
+		if err != nil {
+			http.Error(w, "gc failed", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "removed %d blobs, reclaimed %d bytes\n", removed, reclaimed)
+	})
+
+	fmt.Println("admin API listening on", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Println("admin API stopped:", err)
+	}
+}
+
+// gcLoop collects unreferenced blobs periodically, so deleted files
+// free their disk space even if nobody calls /gc by hand.
+func gcLoop(store *casStore, interval time.Duration) {
+	for range time.Tick(interval) {
+		removed, reclaimed, err := store.gc()
+		if err != nil {
+			log.Printf("gc: %v", err)
+			continue
+		}
+		if removed > 0 {
+			log.Printf("gc: removed %d blobs, reclaimed %d bytes", removed, reclaimed)
+		}
+	}
+}
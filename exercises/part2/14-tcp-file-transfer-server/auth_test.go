@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// answer plays the client side of the PSK exchange with key, returning
+// what it sent and the server's status byte and proof.
+func answer(t *testing.T, conn net.Conn, key []byte) (sent []byte, status byte, proof []byte) {
+	t.Helper()
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(conn, nonce); err != nil {
+		t.Fatal(err)
+	}
+	ours := make([]byte, nonceSize)
+	rand.Read(ours)
+	sent = append(ours, pskMAC(key, "client", nonce, ours)...)
+	return sent, replay(t, conn, sent), readProof(conn)
+}
+
+// replay discards the server's nonce, sends resp and returns the status.
+func replay(t *testing.T, conn net.Conn, resp []byte) byte {
+	t.Helper()
+	if _, err := conn.Write(resp); err != nil {
+		t.Fatal(err)
+	}
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(conn, status); err != nil {
+		t.Fatal(err)
+	}
+	return status[0]
+}
+
+func readProof(conn net.Conn) []byte {
+	proof := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, proof); err != nil {
+		return nil
+	}
+	return proof
+}
+
+// runChallenge starts challenge on one end of a pipe and returns the
+// other end along with the challenge's eventual result.
+func runChallenge(psk []byte) (net.Conn, <-chan error) {
+	server, client := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- challenge(server, psk)
+		server.Close()
+	}()
+	return client, done
+}
+
+func TestChallenge(t *testing.T) {
+	psk := []byte("correct horse battery staple")
+
+	t.Run("good key", func(t *testing.T) {
+		conn, done := runChallenge(psk)
+		defer conn.Close()
+		sent, status, proof := answer(t, conn, psk)
+		if status != authOK {
+			t.Fatalf("status %d, want authOK", status)
+		}
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		if len(proof) != sha256.Size {
+			t.Fatal("no server proof after authOK")
+		}
+		// The proof answers our nonce, and isn't our own MAC sent back.
+		if string(proof) == string(sent[nonceSize:]) {
+			t.Error("server reflected the client's MAC")
+		}
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		conn, done := runChallenge(psk)
+		defer conn.Close()
+		_, status, proof := answer(t, conn, []byte("wrong"))
+		if status != authDenied {
+			t.Errorf("status %d, want authDenied", status)
+		}
+		if proof != nil {
+			t.Error("server sent a proof to a client that failed")
+		}
+		if err := <-done; !errors.Is(err, errAuthFailed) {
+			t.Errorf("challenge returned %v, want errAuthFailed", err)
+		}
+	})
+
+	t.Run("replayed response", func(t *testing.T) {
+		conn, done := runChallenge(psk)
+		sent, _, _ := answer(t, conn, psk)
+		conn.Close()
+		<-done
+
+		// A recording of that session is no good against a new nonce.
+		conn, done = runChallenge(psk)
+		defer conn.Close()
+		io.ReadFull(conn, make([]byte, nonceSize))
+		if status := replay(t, conn, sent); status != authDenied {
+			t.Errorf("status %d, want authDenied", status)
+		}
+		if err := <-done; !errors.Is(err, errAuthFailed) {
+			t.Errorf("challenge returned %v, want errAuthFailed", err)
+		}
+	})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestStore(t *testing.T) *casStore {
+	t.Helper()
+	s, err := openStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func putString(t *testing.T, s *casStore, name, content string) blobRef {
+	t.Helper()
+	ref, err := s.put(name, strings.NewReader(content), int64(len(content)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ref
+}
+
+// countFiles counts the regular files under dir.
+func countFiles(t *testing.T, dir string) int {
+	t.Helper()
+	n := 0
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			n++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func readBlob(t *testing.T, s *casStore, name string) (string, error) {
+	t.Helper()
+	ref, err := s.get(name, 0)
+	if err != nil {
+		return "", err
+	}
+	f, err := s.open(ref)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	return string(data), err
+}
+
+func TestPutDeduplicates(t *testing.T) {
+	s := newTestStore(t)
+	a := putString(t, s, "a.txt", "same bytes")
+	b := putString(t, s, "b.txt", "same bytes")
+	again := putString(t, s, "a.txt", "same bytes")
+
+	if a.Hash != b.Hash || a.Hash != again.Hash {
+		t.Fatalf("hashes differ: %s %s %s", a.Hash, b.Hash, again.Hash)
+	}
+	if again.Version != 2 {
+		t.Errorf("re-upload is version %d, want 2", again.Version)
+	}
+	if n := countFiles(t, filepath.Join(s.dir, "blobs")); n != 1 {
+		t.Errorf("%d blobs on disk, want 1", n)
+	}
+	if n := countFiles(t, filepath.Join(s.dir, "tmp")); n != 0 {
+		t.Errorf("%d temp files left behind", n)
+	}
+
+	// The index survives a restart.
+	reopened, err := openStore(s.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reopened.list(); len(got) != 2 || len(got[0].Versions) != 2 {
+		t.Errorf("reopened index: %+v", got)
+	}
+}
+
+func TestPutChecksContent(t *testing.T) {
+	s := newTestStore(t)
+	sum := sha256.Sum256([]byte("payload"))
+	digest := hex.EncodeToString(sum[:])
+
+	if _, err := s.put("f", strings.NewReader("payload!"), -1, digest); !errors.Is(err, errDigestMismatch) {
+		t.Errorf("wrong digest: %v, want errDigestMismatch", err)
+	}
+	if _, err := s.put("f", strings.NewReader("pay"), 7, ""); err == nil {
+		t.Error("short upload was stored")
+	}
+	if _, err := s.get("f", 0); !errors.Is(err, errNotFound) {
+		t.Errorf("a rejected upload became a version: %v", err)
+	}
+	if n := countFiles(t, filepath.Join(s.dir, "blobs")) + countFiles(t, filepath.Join(s.dir, "tmp")); n != 0 {
+		t.Errorf("rejected uploads left %d files", n)
+	}
+
+	// Digests are compared case-insensitively.
+	ref, err := s.put("f", strings.NewReader("payload"), 7, strings.ToUpper(digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Hash != digest {
+		t.Errorf("stored as %s, want %s", ref.Hash, digest)
+	}
+}
+
+func TestRemoveSharedBlob(t *testing.T) {
+	s := newTestStore(t)
+	putString(t, s, "a", "shared")
+	putString(t, s, "b", "shared")
+
+	if err := s.remove("a", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.remove("a", 0); !errors.Is(err, errNotFound) {
+		t.Errorf("removing twice: %v", err)
+	}
+	// b still points at the blob, so gc must leave it alone.
+	if removed, _, err := s.gc(); err != nil || removed != 0 {
+		t.Fatalf("gc removed %d blobs, %v", removed, err)
+	}
+	if got, err := readBlob(t, s, "b"); err != nil || got != "shared" {
+		t.Fatalf("b after removing a: %q, %v", got, err)
+	}
+
+	if err := s.remove("b", 1); err != nil {
+		t.Fatal(err)
+	}
+	removed, reclaimed, err := s.gc()
+	if err != nil || removed != 1 || reclaimed != int64(len("shared")) {
+		t.Errorf("gc removed %d blobs (%d bytes), %v; want 1 (6 bytes)", removed, reclaimed, err)
+	}
+	if _, err := os.Stat(filepath.Join(s.dir, "blobs")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression negotiation runs after authentication and before the
+// transfer header:
+//
+//	client -> server: negotiateMagic, count, codec IDs in preference order
+//	server -> client: the chosen codec ID, or codecRefused
+//
+// The magic byte can never start a legacy header (it would mean a file
+// over 14 exabytes), so clients that predate negotiation still work:
+// they go straight to the header and are treated as sending "none".
+const (
+	negotiateMagic byte = 0xC5
+	codecRefused   byte = 0xFF
+)
+
+type codec byte
+
+const (
+	codecNone codec = 0
+	codecGzip codec = 1
+	codecZstd codec = 2
+)
+
+func (c codec) String() string {
+	switch c {
+	case codecNone:
+		return "none"
+	case codecGzip:
+		return "gzip"
+	case codecZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("codec(%d)", byte(c))
+}
+
+var errNoCommonCodec = errors.New("no mutually supported compression")
+
+// parseCodecs reads the -compression flag: the set of codecs this
+// server is willing to decode.
+func parseCodecs(flag string) (map[codec]bool, error) {
+	allowed := make(map[codec]bool)
+	for _, name := range strings.Split(flag, ",") {
+		switch strings.TrimSpace(name) {
+		case "none":
+			allowed[codecNone] = true
+		case "gzip":
+			allowed[codecGzip] = true
+		case "zstd":
+			allowed[codecZstd] = true
+		default:
+			return nil, fmt.Errorf("unknown compression %q", name)
+		}
+	}
+	return allowed, nil
+}
+
+// negotiate picks the client's most preferred codec that we allow.
+// The client knows its data (it won't offer compression for a JPEG),
+// so its preference order wins over ours.
+func negotiate(r *bufio.Reader, w io.Writer, allowed map[codec]bool) (codec, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	if first[0] != negotiateMagic {
+		return codecNone, nil // legacy client, uncompressed body
+	}
+	r.Discard(1)
+
+	count, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	offer := make([]byte, count)
+	if _, err := io.ReadFull(r, offer); err != nil {
+		return 0, err
+	}
+	for _, b := range offer {
+		if c := codec(b); allowed[c] {
+			_, err := w.Write([]byte{byte(c)})
+			return c, err
+		}
+	}
+	w.Write([]byte{codecRefused})
+	return 0, errNoCommonCodec
+}
+
+// decompressReader wraps r in a decoder for c. The caller bounds how
+// much it reads from the result by the header's declared size, which
+// is also what stops a tiny compressed "bomb" from expanding into an
+// unbounded amount of disk.
+func decompressReader(r io.Reader, c codec) (io.ReadCloser, error) {
+	switch c {
+	case codecGzip:
+		return gzip.NewReader(r)
+	case codecZstd:
+		// A single-threaded decoder with a capped window keeps the
+		// memory a hostile stream can make us allocate predictable.
+		d, err := zstd.NewReader(r,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxWindow(64<<20),
+		)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return io.NopCloser(r), nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiate(t *testing.T) {
+	all := map[codec]bool{codecNone: true, codecGzip: true, codecZstd: true}
+	tests := []struct {
+		name    string
+		in      []byte
+		allowed map[codec]bool
+		want    codec
+		reply   []byte
+		err     error
+	}{
+		{"client preference wins", []byte{negotiateMagic, 2, byte(codecGzip), byte(codecZstd)}, all, codecGzip, []byte{byte(codecGzip)}, nil},
+		{"zstd", []byte{negotiateMagic, 1, byte(codecZstd)}, all, codecZstd, []byte{byte(codecZstd)}, nil},
+		{"skips what we don't allow", []byte{negotiateMagic, 3, byte(codecZstd), byte(codecGzip), byte(codecNone)}, map[codec]bool{codecNone: true}, codecNone, []byte{byte(codecNone)}, nil},
+		{"nothing in common", []byte{negotiateMagic, 1, byte(codecZstd)}, map[codec]bool{codecGzip: true}, 0, []byte{codecRefused}, errNoCommonCodec},
+		{"unknown codec", []byte{negotiateMagic, 1, 9}, all, 0, []byte{codecRefused}, errNoCommonCodec},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reply bytes.Buffer
+			got, err := negotiate(bufio.NewReader(bytes.NewReader(tt.in)), &reply, tt.allowed)
+			if !errors.Is(err, tt.err) || got != tt.want {
+				t.Errorf("negotiate = %v, %v; want %v, %v", got, err, tt.want, tt.err)
+			}
+			if !bytes.Equal(reply.Bytes(), tt.reply) {
+				t.Errorf("replied %x, want %x", reply.Bytes(), tt.reply)
+			}
+		})
+	}
+
+	// A client from before negotiation starts straight with the size
+	// header: no reply, nothing consumed, and an uncompressed body.
+	legacy := bufio.NewReader(bytes.NewReader([]byte{0, 0, 0, 0, 0, 0, 0, 5}))
+	var reply bytes.Buffer
+	if got, err := negotiate(legacy, &reply, all); err != nil || got != codecNone {
+		t.Fatalf("legacy client: %v, %v", got, err)
+	}
+	if reply.Len() != 0 || legacy.Buffered() != 8 {
+		t.Errorf("legacy client: replied %x, %d header bytes left", reply.Bytes(), legacy.Buffered())
+	}
+}
+
+func TestDecompressReader(t *testing.T) {
+	text := strings.Repeat("all work and no play makes jack a dull boy\n", 50)
+	encoders := map[codec]func(io.Writer) io.WriteCloser{
+		codecGzip: func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		codecZstd: func(w io.Writer) io.WriteCloser {
+			zw, _ := zstd.NewWriter(w)
+			return zw
+		},
+	}
+	for c, newEncoder := range encoders {
+		t.Run(c.String(), func(t *testing.T) {
+			var wire bytes.Buffer
+			zw := newEncoder(&wire)
+			io.WriteString(zw, text)
+			zw.Close()
+			if wire.Len() >= len(text) {
+				t.Errorf("%d bytes compressed to %d", len(text), wire.Len())
+			}
+			r, err := decompressReader(&wire, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			if got, err := io.ReadAll(r); err != nil || string(got) != text {
+				t.Errorf("decoded %d bytes, %v", len(got), err)
+			}
+		})
+	}
+	t.Run("none", func(t *testing.T) {
+		r, _ := decompressReader(strings.NewReader(text), codecNone)
+		if got, _ := io.ReadAll(r); string(got) != text {
+			t.Error("identity body changed")
+		}
+	})
+}
+
+func TestParseCodecs(t *testing.T) {
+	got, err := parseCodecs("zstd, none")
+	if err != nil || !got[codecZstd] || !got[codecNone] || got[codecGzip] {
+		t.Errorf("parseCodecs = %v, %v", got, err)
+	}
+	if _, err := parseCodecs("brotli"); err == nil {
+		t.Error("accepted an unknown codec")
+	}
+}
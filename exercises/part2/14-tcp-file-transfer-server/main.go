@@ -2,68 +2,181 @@
 // Reads a size-prefixed header, then streams exactly that many
 // bytes to a local file — see 14-tcp-file-transfer-client for the
 // matching sender.
+//
+// Optionally wraps the listener in TLS (-cert/-key), requires client
+// certificates (-client-ca) and/or a pre-shared key challenge
+// (-psk-file) before accepting an upload. Received files go into a
+// content-addressable store (see cas.go) that deduplicates identical
+// uploads and keeps every version of a name; -admin serves a small
+// HTTP API to list, delete and garbage-collect them (see admin.go).
+// Bodies may arrive gzip- or zstd-compressed (see compress.go).
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"time"
 )
 
-func handleConn(conn net.Conn) {
+// fileServer holds what every connection handler needs: the optional
+// pre-shared key, where files go, and which compression codecs we
+// accept.
+type fileServer struct {
+	psk    []byte
+	store  *casStore
+	codecs map[codec]bool
+}
+
+func (s *fileServer) handleConn(conn net.Conn) {
 	defer conn.Close()
 
-	// 1. Read the 8-byte size prefix.
+	// Run the TLS handshake eagerly (it would otherwise happen on the
+	// first Read) so certificate failures are reported here, under a
+	// deadline, rather than as a confusing "failed to read size".
+	if tc, ok := conn.(*tls.Conn); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := tc.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			fmt.Println("tls handshake failed:", err)
+			return
+		}
+	}
+	if s.psk != nil {
+		if err := challenge(conn, s.psk); err != nil {
+			if errors.Is(err, errAuthFailed) {
+				fmt.Println("rejected", conn.RemoteAddr(), "bad psk response")
+			} else {
+				fmt.Println("psk challenge failed:", err)
+			}
+			return
+		}
+	}
+
+	// Everything after authentication goes through a buffered reader so
+	// negotiate can peek at the first byte without consuming it.
+	br := bufio.NewReader(conn)
+	chosen, err := negotiate(br, conn, s.codecs)
+	if err != nil {
+		fmt.Println("compression negotiation failed:", err)
+		return
+	}
+
+	// 1. Read the 8-byte size prefix. It is the uncompressed size, even
+	// when the body that follows is compressed.
 	var size uint64
-	if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+	if err := binary.Read(br, binary.BigEndian, &size); err != nil {
 		fmt.Println("failed to read size:", err)
 		return
 	}
 
 	// 2. Read the 2-byte name length, then the name itself.
 	var nameLen uint16
-	if err := binary.Read(conn, binary.BigEndian, &nameLen); err != nil {
+	if err := binary.Read(br, binary.BigEndian, &nameLen); err != nil {
 		fmt.Println("failed to read name length:", err)
 		return
 	}
 	nameBuf := make([]byte, nameLen)
-	if _, err := io.ReadFull(conn, nameBuf); err != nil {
+	if _, err := io.ReadFull(br, nameBuf); err != nil {
 		fmt.Println("failed to read name:", err)
 		return
 	}
-	name := string(nameBuf)
+	// filepath.Base strips any directory components, so a client can't
+	// name its upload "../../etc/passwd".
+	name := filepath.Base(string(nameBuf))
 
-	// 3. Create the destination file and copy exactly `size` bytes into it.
-	out, err := os.Create("received_" + name)
+	body, err := decompressReader(br, chosen)
 	if err != nil {
-		fmt.Println("failed to create file:", err)
+		fmt.Println("failed to start decompression:", err)
 		return
 	}
-	defer out.Close()
+	defer body.Close()
 
-	// io.CopyN stops after exactly `size` bytes, protecting us from a
-	// misbehaving or malicious client sending more than it declared.
-	written, err := io.CopyN(out, conn, int64(size))
-	if err != nil && err != io.EOF {
+	// 3. Stream exactly `size` bytes into the store. io.LimitReader stops
+	// a misbehaving or malicious client from sending more than it
+	// declared, and put refuses to record a version if fewer arrive.
+	ref, err := s.store.put(name, io.LimitReader(body, int64(size)), int64(size), "")
+	if err != nil {
 		fmt.Println("transfer error:", err)
 		return
 	}
-	fmt.Printf("received %q (%d bytes)\n", name, written)
+	fmt.Printf("received %q v%d (%d bytes, %s, sha256 %.12s) from %s\n",
+		name, ref.Version, ref.Size, chosen, ref.Hash, peerIdentity(conn))
 }
 
 func main() {
-	ln, err := net.Listen("tcp", ":9100")
+	addr := flag.String("addr", ":9100", "listen address")
+	certFile := flag.String("cert", "", "TLS certificate (enables TLS)")
+	keyFile := flag.String("key", "", "TLS private key")
+	clientCA := flag.String("client-ca", "", "CA bundle for client certificates (enables mutual TLS)")
+	pskFile := flag.String("psk-file", "", "file holding a pre-shared key for challenge-response auth")
+	storeDir := flag.String("store", "store", "directory for the content-addressable file store")
+	compression := flag.String("compression", "zstd,gzip,none", "compression codecs to accept")
+	adminAddr := flag.String("admin", "127.0.0.1:9101", "listen address for the admin HTTP API (empty to disable)")
+	flag.Parse()
+
+	codecs, err := parseCodecs(*compression)
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+	store, err := openStore(*storeDir)
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+	go gcLoop(store, time.Hour)
+	if *adminAddr != "" {
+		go serveAdmin(*adminAddr, store)
+	}
+
+	ln, err := net.Listen("tcp", *addr)
 	if err != nil {
 		panic(err)
 	}
-	fmt.Println("file server listening on :9100")
+
+	mode := "plaintext"
+	if *certFile != "" {
+		config, err := loadTLSConfig(*certFile, *keyFile, *clientCA)
+		if err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		ln = tls.NewListener(ln, config)
+		mode = "tls"
+		if *clientCA != "" {
+			mode = "mutual tls"
+		}
+	} else if *clientCA != "" {
+		fmt.Println("error: -client-ca requires -cert and -key")
+		os.Exit(1)
+	}
+
+	var psk []byte
+	if *pskFile != "" {
+		if psk, err = loadPSK(*pskFile); err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		mode += " + psk"
+	}
+
+	srv := &fileServer{psk: psk, store: store, codecs: codecs}
+	fmt.Printf("file server listening on %s (%s)\n", *addr, mode)
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			continue
 		}
-		go handleConn(conn)
+		go srv.handleConn(conn)
 	}
 }
@@ -0,0 +1,355 @@
+package main
+
+// Authentication per route. auth lines under a route say how clients
+// prove who they are; with several, any one of them will do:
+//
+//	route  api.example.com  /  http://10.0.0.5:8080
+//	  auth  jwt     jwks=https://auth.example.com/jwks.json  issuer=https://auth.example.com  audience=api  claims=sub:X-User,scope:X-Scope
+//	  auth  apikey  file=/etc/proxy/apikeys  header=X-API-Key  as=X-Client
+//	  auth  basic   file=/etc/proxy/users  as=X-User  realm=admin
+//
+// jwt takes an "Authorization: Bearer" token, verifies it against the
+// JWKS file or URL (see jwt.go), requires an unexpired exp, and checks
+// iss and aud when issuer= and audience= are given. claims= copies
+// claims into request headers: strings as they are, arrays joined with
+// spaces, anything else as JSON.
+//
+// apikey looks up the value of header= (default X-API-Key) in a file of
+// "<key> <client name>" lines. basic checks "Authorization: Basic"
+// against a file of username:password lines. For both, as= names a
+// header to carry the client name or username to the upstream.
+//
+// Before checking anything, the headers a route's auth would set are
+// deleted from the incoming request, so a client can't supply its own.
+// A request no method accepts gets a 401 with a WWW-Authenticate
+// challenge for each method and never reaches the upstream. With
+// -cache, responses on a route with auth are only stored the way ones
+// to an Authorization request are: if the upstream says they may be
+// shared.
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// errNoCredentials means the request didn't try this method at all.
+var errNoCredentials = errors.New("no credentials")
+
+type authenticator interface {
+	// authenticate checks req, returning the headers to forward.
+	authenticate(req *http.Request) (http.Header, error)
+	// challenge is the WWW-Authenticate value for a refused request.
+	challenge() string
+	// sets lists the headers authenticate may set.
+	sets() []string
+}
+
+// parseAuth reads an auth line: auth <method> key=value...
+func (r *route) parseAuth(fields []string) error {
+	if len(fields) < 2 {
+		return errors.New("expected auth <jwt|apikey|basic> key=value...")
+	}
+	opts := map[string]string{}
+	for _, f := range fields[2:] {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok || v == "" {
+			return fmt.Errorf("expected key=value, got %q", f)
+		}
+		opts[k] = v
+	}
+	allowed := map[string][]string{
+		"jwt":    {"jwks", "issuer", "audience", "claims"},
+		"apikey": {"file", "header", "as"},
+		"basic":  {"file", "as", "realm"},
+	}[fields[1]]
+	if allowed == nil {
+		return fmt.Errorf("unknown auth method %q", fields[1])
+	}
+	for k := range opts {
+		if !slices.Contains(allowed, k) {
+			return fmt.Errorf("auth %s doesn't take %s=", fields[1], k)
+		}
+	}
+
+	var a authenticator
+	var err error
+	switch fields[1] {
+	case "jwt":
+		a, err = newJWTAuth(opts)
+	case "apikey":
+		a, err = newAPIKeyAuth(opts)
+	case "basic":
+		a, err = newBasicAuth(opts)
+	}
+	if err != nil {
+		return err
+	}
+	r.auth = append(r.auth, a)
+	return nil
+}
+
+// authorize runs the route's auth on req. If it fails, authorize
+// writes the 401 and returns false.
+func (r *route) authorize(w http.ResponseWriter, req *http.Request) bool {
+	if len(r.auth) == 0 {
+		return true
+	}
+	for _, a := range r.auth {
+		for _, h := range a.sets() {
+			req.Header.Del(h)
+		}
+	}
+	var reasons []string
+	for _, a := range r.auth {
+		h, err := a.authenticate(req)
+		if err == nil {
+			for k, v := range h {
+				req.Header[k] = v
+			}
+			return true
+		}
+		if !errors.Is(err, errNoCredentials) {
+			reasons = append(reasons, err.Error())
+		}
+	}
+	for _, a := range r.auth {
+		w.Header().Add("WWW-Authenticate", a.challenge())
+	}
+	if len(reasons) == 0 {
+		reasons = []string{"authentication required"}
+	}
+	writeJSONError(w, http.StatusUnauthorized, errors.New(strings.Join(reasons, "; ")))
+	return false
+}
+
+type jwtAuth struct {
+	keys     *jwks
+	issuer   string
+	audience string
+	claims   [][2]string // claim name, header
+}
+
+func newJWTAuth(opts map[string]string) (*jwtAuth, error) {
+	if opts["jwks"] == "" {
+		return nil, errors.New("auth jwt needs jwks=<file or URL>")
+	}
+	keys, err := loadJWKS(opts["jwks"])
+	if err != nil {
+		return nil, err
+	}
+	a := &jwtAuth{keys: keys, issuer: opts["issuer"], audience: opts["audience"]}
+	if opts["claims"] != "" {
+		for _, pair := range strings.Split(opts["claims"], ",") {
+			claim, header, ok := strings.Cut(pair, ":")
+			if !ok || claim == "" || header == "" {
+				return nil, fmt.Errorf("expected claims=<claim>:<header>,..., got %q", pair)
+			}
+			a.claims = append(a.claims, [2]string{claim, http.CanonicalHeaderKey(header)})
+		}
+	}
+	return a, nil
+}
+
+func (a *jwtAuth) authenticate(req *http.Request) (http.Header, error) {
+	scheme, token, _ := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return nil, errNoCredentials
+	}
+	claims, err := verifyJWT(strings.TrimSpace(token), a.keys, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if a.issuer != "" && claims["iss"] != a.issuer {
+		return nil, errors.New("token from the wrong issuer")
+	}
+	if a.audience != "" && !hasAudience(claims["aud"], a.audience) {
+		return nil, errors.New("token for the wrong audience")
+	}
+	h := http.Header{}
+	for _, c := range a.claims {
+		if v, ok := claims[c[0]]; ok {
+			h.Set(c[1], claimString(v))
+		}
+	}
+	return h, nil
+}
+
+// hasAudience reports whether aud, a string or an array of them,
+// includes want.
+func hasAudience(aud any, want string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == want
+	case []any:
+		for _, v := range aud {
+			if v == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func claimString(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case []any:
+		parts := make([]string, len(v))
+		for i, p := range v {
+			parts[i] = claimString(p)
+		}
+		return strings.Join(parts, " ")
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func (a *jwtAuth) challenge() string { return `Bearer realm="proxy"` }
+
+func (a *jwtAuth) sets() []string {
+	var names []string
+	for _, c := range a.claims {
+		names = append(names, c[1])
+	}
+	return names
+}
+
+type apiKeyAuth struct {
+	header  string
+	as      string
+	clients map[[32]byte]string // SHA-256 of the key -> client name
+}
+
+func newAPIKeyAuth(opts map[string]string) (*apiKeyAuth, error) {
+	if opts["file"] == "" {
+		return nil, errors.New("auth apikey needs file=")
+	}
+	a := &apiKeyAuth{header: "X-Api-Key", as: http.CanonicalHeaderKey(opts["as"]), clients: make(map[[32]byte]string)}
+	if opts["header"] != "" {
+		a.header = http.CanonicalHeaderKey(opts["header"])
+	}
+	err := readLines(opts["file"], func(line string) error {
+		key, name, ok := strings.Cut(line, " ")
+		if !ok || strings.TrimSpace(name) == "" {
+			return fmt.Errorf("expected <key> <client name>, got %q", line)
+		}
+		// Keyed by hash, so the lookup's timing says nothing useful
+		// about how close a guess came.
+		a.clients[sha256.Sum256([]byte(key))] = strings.TrimSpace(name)
+		return nil
+	})
+	return a, err
+}
+
+func (a *apiKeyAuth) authenticate(req *http.Request) (http.Header, error) {
+	key := req.Header.Get(a.header)
+	if key == "" {
+		return nil, errNoCredentials
+	}
+	name, ok := a.clients[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, errors.New("unknown API key")
+	}
+	h := http.Header{}
+	if a.as != "" {
+		h.Set(a.as, name)
+	}
+	return h, nil
+}
+
+func (a *apiKeyAuth) challenge() string { return `ApiKey header="` + a.header + `"` }
+
+func (a *apiKeyAuth) sets() []string { return nonEmpty(a.as) }
+
+type basicAuth struct {
+	users map[string]string
+	as    string
+	realm string
+}
+
+func newBasicAuth(opts map[string]string) (*basicAuth, error) {
+	if opts["file"] == "" {
+		return nil, errors.New("auth basic needs file=")
+	}
+	a := &basicAuth{users: make(map[string]string), as: http.CanonicalHeaderKey(opts["as"]), realm: "proxy"}
+	if opts["realm"] != "" {
+		a.realm = opts["realm"]
+	}
+	err := readLines(opts["file"], func(line string) error {
+		user, pass, ok := strings.Cut(line, ":")
+		if !ok {
+			return fmt.Errorf("expected username:password, got %q", line)
+		}
+		a.users[user] = pass
+		return nil
+	})
+	return a, err
+}
+
+func (a *basicAuth) authenticate(req *http.Request) (http.Header, error) {
+	scheme, encoded, _ := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Basic") {
+		return nil, errNoCredentials
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, errors.New("malformed basic credentials")
+	}
+	user, pass, _ := strings.Cut(string(decoded), ":")
+	want, known := a.users[user]
+	// Compare even for unknown users, so timing doesn't reveal which
+	// usernames exist.
+	if subtle.ConstantTimeCompare([]byte(pass), []byte(want)) != 1 || !known {
+		return nil, errors.New("wrong username or password")
+	}
+	h := http.Header{}
+	if a.as != "" {
+		h.Set(a.as, user)
+	}
+	return h, nil
+}
+
+func (a *basicAuth) challenge() string { return `Basic realm="` + a.realm + `", charset="UTF-8"` }
+
+func (a *basicAuth) sets() []string { return nonEmpty(a.as) }
+
+func nonEmpty(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return []string{s}
+}
+
+// readLines calls fn for each line of a file, skipping blanks and
+// # comments.
+func readLines(path string, fn func(string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+	}
+	return scanner.Err()
+}
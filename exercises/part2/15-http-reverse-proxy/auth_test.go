@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var b64 = base64.RawURLEncoding
+
+// signJWT makes a token for claims, signed with key (a []byte secret,
+// an *rsa.PrivateKey or an *ecdsa.PrivateKey; nil leaves it unsigned).
+func signJWT(t *testing.T, alg, kid string, key any, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	h, _ := hashFor(alg)
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(h.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := h.New()
+		digest.Write([]byte(signed))
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, h, digest.Sum(nil)); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		digest := h.New()
+		digest.Write([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	}
+	return signed + "." + b64.EncodeToString(sig)
+}
+
+// testKeys are one key of each type and the JWKS that publishes them.
+type testKeys struct {
+	secret []byte
+	rsa    *rsa.PrivateKey
+	ec     *ecdsa.PrivateKey
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testKeys{secret: []byte("a shared secret of decent length"), rsa: rsaKey, ec: ecKey}
+}
+
+func (k *testKeys) jwks(t *testing.T, kidSuffix string) []byte {
+	t.Helper()
+	point, err := k.ec.PublicKey.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := map[string]any{"keys": []map[string]string{
+		{"kty": "oct", "kid": "hs" + kidSuffix, "alg": "HS256", "k": b64.EncodeToString(k.secret)},
+		{"kty": "RSA", "kid": "rs" + kidSuffix, "use": "sig", "n": b64.EncodeToString(k.rsa.N.Bytes()),
+			"e": b64.EncodeToString(big.NewInt(int64(k.rsa.E)).Bytes())},
+		{"kty": "EC", "kid": "es" + kidSuffix, "crv": "P-256", "x": b64.EncodeToString(point[1:33]), "y": b64.EncodeToString(point[33:])},
+		{"kty": "OKP", "kid": "ignored", "crv": "Ed25519", "x": "AAAA"},
+	}}
+	b, _ := json.Marshal(set)
+	return b
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAuthMethods(t *testing.T) {
+	keys := newTestKeys(t)
+	jwksFile := writeFile(t, "jwks.json", string(keys.jwks(t, "")))
+	apiKeys := writeFile(t, "apikeys", "# key client\nk-123 billing\n")
+	users := writeFile(t, "users", "alice:wonderland\n")
+	backend := startBackend(t, "backend")
+	proxy := startRoutes(t, "route * / "+backend.URL+"\n"+
+		"  auth jwt jwks="+jwksFile+" issuer=https://issuer audience=api claims=sub:X-User,scope:X-Scope,admin:X-Admin\n"+
+		"  auth apikey file="+apiKeys+" as=X-Client\n"+
+		"  auth basic file="+users+" as=X-User realm=test\n",
+		&proxyOptions{forwarding: &forwarding{}})
+
+	now := time.Now().Unix()
+	claims := func(extra ...any) map[string]any {
+		c := map[string]any{"sub": "user-1", "iss": "https://issuer", "aud": []string{"other", "api"},
+			"exp": now + 60, "scope": []string{"read", "write"}, "admin": true}
+		for i := 0; i+1 < len(extra); i += 2 {
+			c[extra[i].(string)] = extra[i+1]
+		}
+		return c
+	}
+	bearer := func(token string) http.Header { return http.Header{"Authorization": {"Bearer " + token}} }
+	tampered := signJWT(t, "HS256", "hs", keys.secret, claims())
+	parts := strings.Split(tampered, ".")
+	parts[1] = b64.EncodeToString([]byte(`{"sub":"root","exp":9999999999}`))
+	tampered = strings.Join(parts, ".")
+	// The classic confusion attack: the RSA public key used as an HMAC
+	// secret, with the RSA key's kid.
+	confused := signJWT(t, "HS256", "rs", keys.rsa.N.Bytes(), claims())
+
+	ok := []struct {
+		name   string
+		header http.Header
+		want   map[string]string
+	}{
+		{"HS256", bearer(signJWT(t, "HS256", "hs", keys.secret, claims())),
+			map[string]string{"X-User": "user-1", "X-Scope": "read write", "X-Admin": "true"}},
+		{"RS256", bearer(signJWT(t, "RS256", "rs", keys.rsa, claims())), map[string]string{"X-User": "user-1"}},
+		{"ES256 without kid", bearer(signJWT(t, "ES256", "", keys.ec, claims())), map[string]string{"X-User": "user-1"}},
+		{"API key", http.Header{"X-Api-Key": {"k-123"}}, map[string]string{"X-Client": "billing", "X-User": ""}},
+		{"basic", http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("alice:wonderland"))}},
+			map[string]string{"X-User": "alice"}},
+	}
+	for _, tt := range ok {
+		// Claim headers sent by the client must not survive.
+		tt.header.Set("X-User", "spoofed")
+		tt.header.Set("X-Client", "spoofed")
+		resp, e := get(t, proxy.URL+"/", "example.com", tt.header)
+		if resp.StatusCode != 200 {
+			t.Errorf("%s: status %d", tt.name, resp.StatusCode)
+			continue
+		}
+		for k, v := range tt.want {
+			if got := e.Header.Get(k); got != v {
+				t.Errorf("%s: upstream got %s %q, want %q", tt.name, k, got, v)
+			}
+		}
+	}
+
+	refused := []struct {
+		name   string
+		header http.Header
+		reason string
+	}{
+		{"no credentials", nil, "authentication required"},
+		{"expired", bearer(signJWT(t, "HS256", "hs", keys.secret, claims("exp", now-3600))), "token expired"},
+		{"no exp", bearer(signJWT(t, "HS256", "hs", keys.secret, claims("exp", nil))), "token has no exp"},
+		{"not yet valid", bearer(signJWT(t, "HS256", "hs", keys.secret, claims("nbf", now+3600))), "token not valid yet"},
+		{"wrong issuer", bearer(signJWT(t, "HS256", "hs", keys.secret, claims("iss", "https://evil"))), "wrong issuer"},
+		{"wrong audience", bearer(signJWT(t, "HS256", "hs", keys.secret, claims("aud", "other"))), "wrong audience"},
+		{"tampered", bearer(tampered), "bad signature"},
+		{"alg none", bearer(signJWT(t, "none", "hs", nil, claims())), "unsupported alg"},
+		{"key confusion", bearer(confused), "unknown signing key"},
+		{"wrong secret", bearer(signJWT(t, "HS256", "hs", []byte("guess"), claims())), "bad signature"},
+		{"bad API key", http.Header{"X-Api-Key": {"k-124"}}, "unknown API key"},
+		{"bad password", http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("alice:guess"))}}, "wrong username or password"},
+	}
+	for _, tt := range refused {
+		resp, e := get(t, proxy.URL+"/", "example.com", tt.header)
+		if resp.StatusCode != 401 || e.Name != "" {
+			t.Errorf("%s: status %d, backend %q", tt.name, resp.StatusCode, e.Name)
+			continue
+		}
+		if n := len(resp.Header.Values("WWW-Authenticate")); n != 3 {
+			t.Errorf("%s: %d challenges, want 3", tt.name, n)
+		}
+	}
+
+	// The reasons come back in the error body.
+	for _, tt := range refused {
+		req, _ := http.NewRequest("GET", proxy.URL+"/", nil)
+		for k, v := range tt.header {
+			req.Header[k] = v
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !strings.Contains(string(body), tt.reason) {
+			t.Errorf("%s: body %s, want %q", tt.name, body, tt.reason)
+		}
+	}
+}
+
+func TestJWKSFromURLRotates(t *testing.T) {
+	oldKeys, newKeys := newTestKeys(t), newTestKeys(t)
+	var mu sync.Mutex
+	current, fetches := oldKeys.jwks(t, "-1"), 0
+	issuer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetches++
+		w.Write(current)
+	}))
+	defer issuer.Close()
+
+	keys, err := loadJWKS(issuer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string]any{"exp": time.Now().Unix() + 60}
+	if _, err := verifyJWT(signJWT(t, "ES256", "es-1", oldKeys.ec, exp), keys, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	current = newKeys.jwks(t, "-2")
+	mu.Unlock()
+	rotated := signJWT(t, "ES256", "es-2", newKeys.ec, exp)
+
+	// Just after a fetch, an unknown kid doesn't trigger another...
+	if _, err := verifyJWT(rotated, keys, time.Now()); err == nil || fetches != 1 {
+		t.Fatalf("unknown kid straight after a fetch: %v, %d fetches", err, fetches)
+	}
+	// ...but once the interval has passed, it does.
+	keys.mu.Lock()
+	keys.fetched = time.Now().Add(-jwksRefetchInterval - time.Second)
+	keys.mu.Unlock()
+	if _, err := verifyJWT(rotated, keys, time.Now()); err != nil || fetches != 2 {
+		t.Fatalf("rotated key: %v, %d fetches", err, fetches)
+	}
+}
+
+// A refetch for an unknown kid waits on the issuer, but requests
+// signed with keys already known don't wait with it.
+func TestJWKSFetchDoesntBlock(t *testing.T) {
+	keys := newTestKeys(t)
+	set := keys.jwks(t, "")
+	release := make(chan struct{})
+	var fetches atomic.Int32
+	issuer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) > 1 {
+			<-release
+		}
+		w.Write(set)
+	}))
+	defer issuer.Close()
+	defer close(release)
+
+	jwks, err := loadJWKS(issuer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks.mu.Lock()
+	jwks.fetched = time.Now().Add(-jwksRefetchInterval - time.Second)
+	jwks.mu.Unlock()
+
+	exp := map[string]any{"exp": time.Now().Unix() + 60}
+	go verifyJWT(signJWT(t, "ES256", "unknown", keys.ec, exp), jwks, time.Now())
+	for fetches.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	known := signJWT(t, "ES256", "es", keys.ec, exp)
+	done := make(chan error, 1)
+	go func() {
+		_, err := verifyJWT(known, jwks, time.Now())
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("verifying with a known key waited for the JWKS fetch")
+	}
+}
+
+func TestParseAuthErrors(t *testing.T) {
+	jwksFile := writeFile(t, "jwks.json", `{"keys":[{"kty":"oct","k":"c2VjcmV0"}]}`)
+	for _, line := range []string{
+		"auth",
+		"auth oauth file=x",
+		"auth jwt",
+		"auth jwt jwks=/nonexistent",
+		"auth jwt jwks=" + jwksFile + " claims=sub",
+		"auth basic",
+		"auth basic file=/nonexistent",
+		"auth apikey file=" + jwksFile + " realm=x",
+	} {
+		path := writeFile(t, "routes", "route * / http://localhost:8080\n  "+line+"\n")
+		if _, err := parseRoutes(path, &proxyOptions{forwarding: &forwarding{}}); err == nil {
+			t.Errorf("%q parsed without error", line)
+		}
+	}
+}
+
+// A response to one API key's client mustn't be served from the cache
+// to another's, unless the upstream marked it public.
+func TestAuthenticatedResponsesNotShared(t *testing.T) {
+	apiKeys := writeFile(t, "apikeys", "k-1 alice\nk-2 bob\n")
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", r.URL.Query().Get("cc"))
+		io.WriteString(w, "account of "+r.Header.Get("X-Client"))
+	}))
+	defer backend.Close()
+	proxy := startRoutes(t, "route * / "+backend.URL+"\n  auth apikey file="+apiKeys+" as=X-Client\n",
+		&proxyOptions{forwarding: &forwarding{}, cache: newHTTPCache(newMemoryStore(1 << 20))})
+
+	fetchAs := func(key, path string) (string, string) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", proxy.URL+path, nil)
+		req.Header.Set("X-Api-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.Header.Get("X-Cache"), string(body)
+	}
+
+	fetchAs("k-1", "/account?cc=max-age=60")
+	if got, body := fetchAs("k-2", "/account?cc=max-age=60"); got != "MISS" || body != "account of bob" {
+		t.Errorf("second client: %s %q", got, body)
+	}
+	fetchAs("k-1", "/news?cc=public,max-age=60")
+	if got, _ := fetchAs("k-2", "/news?cc=public,max-age=60"); got != "HIT" {
+		t.Errorf("public response: %s, want HIT", got)
+	}
+}
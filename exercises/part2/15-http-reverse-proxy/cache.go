@@ -0,0 +1,577 @@
+package main
+
+// An RFC 9111 shared cache, sitting between each route's ReverseProxy
+// and the upstream as its Transport. Responses are keyed by the URL the
+// client asked for (scheme, Host and path, before any rewriting), so
+// routes that share an upstream don't share entries.
+//
+// Only GET responses are stored, and only when the request and
+// response allow it: no no-store, no private (this is a shared cache),
+// no Authorization unless the response says public, s-maxage or
+// must-revalidate, no Set-Cookie unless it says public, and Vary isn't
+// "*". Each URL keeps one variant per combination of the request
+// headers its Vary names.
+//
+// A stored response is fresh for s-maxage, max-age, Expires - Date or,
+// for statuses that allow it, 10% of its age at Last-Modified (at most
+// a day). Fresh responses are served with an Age header. Once stale,
+// or when either side says no-cache, the cache revalidates with
+// If-None-Match/If-Modified-Since and serves its copy on a 304. If the
+// upstream fails or answers 5xx, a stale copy can still be served
+// within stale-if-error seconds, unless must-revalidate (or
+// proxy-revalidate, or s-maxage) forbids it. Requests can ask for
+// max-age, max-stale, min-fresh and only-if-cached, and a successful
+// POST, PUT, PATCH or DELETE drops the target URL's entry.
+//
+// Every response gets X-Cache: HIT, MISS, REVALIDATED or STALE. The
+// -cache-api address serves GET /cache for statistics and
+// DELETE /cache?url=<url> or ?prefix=<prefix> (or neither, for
+// everything) to purge entries.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxCachedBody is the largest body the cache stores; bigger ones
+// stream straight through.
+const maxCachedBody = 8 << 20
+
+// maxVariants bounds how many Vary variants one URL keeps.
+const maxVariants = 8
+
+type httpCache struct {
+	transport http.RoundTripper
+
+	mu    sync.Mutex
+	store cacheStore
+
+	hits, misses, revalidated, stale atomic.Int64
+}
+
+func newHTTPCache(store cacheStore) *httpCache {
+	return &httpCache{transport: http.DefaultTransport, store: store}
+}
+
+type cacheKeyContext struct{}
+
+// cacheRequest is what the cache needs to know about the client's
+// request that the outgoing one no longer shows.
+type cacheRequest struct {
+	key string
+	// authenticated is set when the route checked credentials the
+	// client sent, in whatever header. The response is then treated
+	// as personal, like one to a request with Authorization.
+	authenticated bool
+}
+
+// withCacheKey records the URL the client asked for on the outgoing
+// request, before the route rewrites it, and whether the route
+// authenticated the client.
+func withCacheKey(out, in *http.Request, authenticated bool) *http.Request {
+	scheme := "http"
+	if in.TLS != nil {
+		scheme = "https"
+	}
+	key := scheme + "://" + strings.ToLower(in.Host) + in.URL.RequestURI()
+	return out.WithContext(context.WithValue(out.Context(), cacheKeyContext{}, cacheRequest{key, authenticated}))
+}
+
+func cacheKey(req *http.Request) string {
+	if cr, ok := req.Context().Value(cacheKeyContext{}).(cacheRequest); ok {
+		return cr.key
+	}
+	return req.URL.String()
+}
+
+// authenticated reports whether req carries credentials: its own
+// Authorization header, or ones its route checked.
+func authenticated(req *http.Request) bool {
+	cr, _ := req.Context().Value(cacheKeyContext{}).(cacheRequest)
+	return cr.authenticated || req.Header.Get("Authorization") != ""
+}
+
+func (c *httpCache) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := cacheKey(req)
+	if req.Header.Get("Upgrade") != "" {
+		return c.transport.RoundTrip(req) // a WebSocket or similar, not a cacheable exchange
+	}
+	if req.Method != "GET" && req.Method != "HEAD" {
+		resp, err := c.transport.RoundTrip(req)
+		if err == nil && req.Method != "OPTIONS" && req.Method != "TRACE" && resp.StatusCode < 400 {
+			c.mu.Lock()
+			c.store.remove(key)
+			c.mu.Unlock()
+		}
+		return resp, err
+	}
+
+	reqCC := parseCacheControl(req.Header)
+	if len(reqCC) == 0 && req.Header.Get("Pragma") == "no-cache" {
+		reqCC = cacheControl{"no-cache": ""}
+	}
+	now := time.Now()
+	stored := c.lookup(key, req)
+	if stored != nil && stored.usable(reqCC, now) {
+		c.hits.Add(1)
+		return stored.response(req, "HIT", now), nil
+	}
+	if reqCC.has("only-if-cached") {
+		c.misses.Add(1)
+		return statusResponse(req, http.StatusGatewayTimeout), nil
+	}
+
+	out := req
+	if stored != nil {
+		out = stored.conditional(req)
+	}
+	requestTime := time.Now()
+	resp, err := c.transport.RoundTrip(out)
+	responseTime := time.Now()
+
+	if stored != nil && (err != nil || resp.StatusCode >= 500) && stored.staleIfError(reqCC, responseTime) {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		c.stale.Add(1)
+		return stored.response(req, "STALE", responseTime), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if stored != nil && out != req && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		updated := stored.refreshed(resp.Header, requestTime, responseTime)
+		c.save(key, updated)
+		c.revalidated.Add(1)
+		return updated.response(req, "REVALIDATED", responseTime), nil
+	}
+
+	c.misses.Add(1)
+	resp.Header.Set("X-Cache", "MISS")
+	if req.Method != "GET" || !storable(req, reqCC, resp) {
+		return resp, nil
+	}
+	if resp.ContentLength > maxCachedBody {
+		return resp, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxCachedBody+1))
+	if err != nil || len(body) > maxCachedBody {
+		// Hand back what was read plus the rest, uncached.
+		resp.Body = readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	e := &cachedResponse{
+		StatusCode:   resp.StatusCode,
+		Header:       resp.Header.Clone(),
+		Body:         body,
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+		VaryValues:   varyValues(req, resp.Header),
+	}
+	e.Header.Del("X-Cache")
+	c.save(key, e)
+	return resp, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// lookup returns the stored variant matching req, if any.
+func (c *httpCache) lookup(key string, req *http.Request) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.store.get(key) {
+		if e.matches(req) {
+			return e
+		}
+	}
+	return nil
+}
+
+// save stores e as key's variant for the request headers it was
+// fetched with, replacing any older copy of that variant.
+func (c *httpCache) save(key string, e *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	variants := []*cachedResponse{e}
+	for _, old := range c.store.get(key) {
+		if !sameVariant(old, e) && len(variants) < maxVariants {
+			variants = append(variants, old)
+		}
+	}
+	c.store.put(key, variants)
+}
+
+// purge removes every key match accepts and reports how many.
+func (c *httpCache) purge(match func(string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, k := range c.store.keys() {
+		if match(k) {
+			c.store.remove(k)
+			n++
+		}
+	}
+	return n
+}
+
+// storable reports whether resp, answering req, may go in a shared cache.
+func storable(req *http.Request, reqCC cacheControl, resp *http.Response) bool {
+	cc := parseCacheControl(resp.Header)
+	switch {
+	case resp.StatusCode < 200 || resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusNotModified:
+		return false
+	case reqCC.has("no-store") || cc.has("no-store") || cc.has("private"):
+		return false
+	case authenticated(req) && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate"):
+		return false
+	case resp.Header.Get("Set-Cookie") != "" && !cc.has("public"):
+		return false
+	case strings.Contains(resp.Header.Get("Vary"), "*"):
+		return false
+	}
+	explicit := cc.has("s-maxage") || cc.has("max-age") || resp.Header.Get("Expires") != "" || cc.has("public")
+	if !explicit && !heuristicallyCacheable(resp.StatusCode) {
+		return false
+	}
+	// Worth keeping only if it can be served or revalidated later.
+	return explicit || resp.Header.Get("Last-Modified") != "" || resp.Header.Get("ETag") != ""
+}
+
+// heuristicallyCacheable lists the statuses RFC 9110 section 15.1
+// allows to be cached without explicit freshness.
+func heuristicallyCacheable(status int) bool {
+	switch status {
+	case 200, 203, 204, 300, 301, 308, 404, 405, 410, 414, 501:
+		return true
+	}
+	return false
+}
+
+func (e *cachedResponse) date() time.Time {
+	if t, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return t
+	}
+	return e.ResponseTime
+}
+
+// freshness is how long the response stays fresh (RFC 9111 4.2.1).
+func (e *cachedResponse) freshness() time.Duration {
+	cc := parseCacheControl(e.Header)
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	if v := e.Header.Get("Expires"); v != "" {
+		t, err := http.ParseTime(v)
+		if err != nil {
+			return 0 // an invalid Expires means already expired
+		}
+		return t.Sub(e.date())
+	}
+	if lm, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil && heuristicallyCacheable(e.StatusCode) {
+		return min(e.date().Sub(lm)/10, 24*time.Hour)
+	}
+	return 0
+}
+
+// age is the response's current age (RFC 9111 4.2.3).
+func (e *cachedResponse) age(now time.Time) time.Duration {
+	apparent := max(0, e.ResponseTime.Sub(e.date()))
+	ageValue, _ := strconv.Atoi(e.Header.Get("Age"))
+	corrected := time.Duration(ageValue)*time.Second + e.ResponseTime.Sub(e.RequestTime)
+	return max(apparent, corrected) + now.Sub(e.ResponseTime)
+}
+
+// mustRevalidate reports whether the response may never be served stale.
+func (e *cachedResponse) mustRevalidate(cc cacheControl) bool {
+	return cc.has("must-revalidate") || cc.has("proxy-revalidate") || cc.has("s-maxage")
+}
+
+// usable reports whether the response can answer a request with the
+// given directives without contacting the upstream.
+func (e *cachedResponse) usable(reqCC cacheControl, now time.Time) bool {
+	cc := parseCacheControl(e.Header)
+	if cc.has("no-cache") || reqCC.has("no-cache") {
+		return false
+	}
+	age, lifetime := e.age(now), e.freshness()
+	if d, ok := reqCC.seconds("max-age"); ok && age > d {
+		return false
+	}
+	if d, ok := reqCC.seconds("min-fresh"); ok && lifetime-age < d {
+		return false
+	}
+	if age < lifetime {
+		return true
+	}
+	if !reqCC.has("max-stale") || e.mustRevalidate(cc) {
+		return false
+	}
+	d, ok := reqCC.seconds("max-stale")
+	return !ok || age-lifetime <= d // max-stale without a value accepts any staleness
+}
+
+// staleIfError reports whether the response may stand in for an
+// upstream error (RFC 5861).
+func (e *cachedResponse) staleIfError(reqCC cacheControl, now time.Time) bool {
+	cc := parseCacheControl(e.Header)
+	if e.mustRevalidate(cc) {
+		return false
+	}
+	limit, ok := cc.seconds("stale-if-error")
+	if d, reqOK := reqCC.seconds("stale-if-error"); reqOK {
+		limit, ok = d, true
+	}
+	return ok && e.age(now)-e.freshness() <= limit
+}
+
+// conditional turns req into a revalidation of the stored response,
+// replacing any conditions of the client's own.
+func (e *cachedResponse) conditional(req *http.Request) *http.Request {
+	etag, lastModified := e.Header.Get("ETag"), e.Header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return req
+	}
+	out := req.Clone(req.Context())
+	for _, h := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"} {
+		out.Header.Del(h)
+	}
+	if etag != "" {
+		out.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		out.Header.Set("If-Modified-Since", lastModified)
+	}
+	return out
+}
+
+// refreshed returns a copy of the stored response updated from a 304
+// (RFC 9111 4.3.4). The original may be in use by other requests.
+func (e *cachedResponse) refreshed(h http.Header, requestTime, responseTime time.Time) *cachedResponse {
+	updated := *e
+	updated.Header = e.Header.Clone()
+	for k, v := range h {
+		switch k {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding", "Connection", "Keep-Alive", "X-Cache":
+			continue
+		}
+		updated.Header[k] = v
+	}
+	updated.RequestTime, updated.ResponseTime = requestTime, responseTime
+	return &updated
+}
+
+// response builds what the proxy sends for a stored response,
+// answering the client's own conditions with a 304 where they match.
+func (e *cachedResponse) response(req *http.Request, status string, now time.Time) *http.Response {
+	h := e.Header.Clone()
+	h.Set("Age", strconv.Itoa(int(e.age(now)/time.Second)))
+	h.Set("X-Cache", status)
+	resp := &http.Response{
+		StatusCode: e.StatusCode,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     h,
+		Request:    req,
+	}
+	switch {
+	case e.StatusCode == 200 && e.notModified(req):
+		resp.StatusCode = http.StatusNotModified
+		h.Del("Content-Length")
+		resp.Body = http.NoBody
+	case req.Method == "HEAD":
+		resp.Body = http.NoBody
+	default:
+		h.Set("Content-Length", strconv.Itoa(len(e.Body)))
+		resp.ContentLength = int64(len(e.Body))
+		resp.Body = io.NopCloser(bytes.NewReader(e.Body))
+	}
+	return resp
+}
+
+// notModified evaluates the client's If-None-Match, or failing that
+// its If-Modified-Since, against the stored response.
+func (e *cachedResponse) notModified(req *http.Request) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(e.Header.Get("ETag"), "W/")
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+			if t == "*" || etag != "" && t == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
+
+// varyValues records req's values for the headers resp varies on.
+func varyValues(req *http.Request, h http.Header) http.Header {
+	values := http.Header{}
+	for _, name := range varyNames(h) {
+		values[name] = []string{normalizeHeader(req.Header.Values(name))}
+	}
+	return values
+}
+
+func varyNames(h http.Header) []string {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// normalizeHeader joins a header's values so that spacing and line
+// breaks between them don't create separate variants.
+func normalizeHeader(values []string) string {
+	var parts []string
+	for _, v := range values {
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				parts = append(parts, p)
+			}
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// matches reports whether the stored response was fetched with the
+// same values as req for every header it varies on.
+func (e *cachedResponse) matches(req *http.Request) bool {
+	for _, name := range varyNames(e.Header) {
+		if normalizeHeader(req.Header.Values(name)) != e.VaryValues.Get(name) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameVariant(a, b *cachedResponse) bool {
+	if len(a.VaryValues) != len(b.VaryValues) {
+		return false
+	}
+	for k := range a.VaryValues {
+		if a.VaryValues.Get(k) != b.VaryValues.Get(k) {
+			return false
+		}
+	}
+	return true
+}
+
+func statusResponse(req *http.Request, status int) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"X-Cache": {"MISS"}},
+		Body:       http.NoBody,
+		Request:    req,
+	}
+}
+
+// cacheControl maps Cache-Control directives to their values.
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, line := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(line, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if name != "" {
+				cc[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// seconds returns a delta-seconds directive's value. A directive with
+// a bad value counts as zero, which errs towards not serving from cache.
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	v, ok := cc[directive]
+	if !ok || v == "" && directive == "max-stale" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+	return time.Duration(min(n, 1<<31)) * time.Second, true
+}
+
+// serveAPI handles the -cache-api endpoints.
+func (c *httpCache) serveAPI(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/cache" {
+		writeJSONError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	switch r.Method {
+	case "GET":
+		c.mu.Lock()
+		entries, size := len(c.store.keys()), c.store.bytes()
+		c.mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]int64{
+			"urls":        int64(entries),
+			"bytes":       size,
+			"hits":        c.hits.Load(),
+			"misses":      c.misses.Load(),
+			"revalidated": c.revalidated.Load(),
+			"stale":       c.stale.Load(),
+		})
+	case "DELETE":
+		url, prefix := r.URL.Query().Get("url"), r.URL.Query().Get("prefix")
+		n := c.purge(func(k string) bool {
+			return url == "" && strings.HasPrefix(k, prefix) || url != "" && k == url
+		})
+		writeJSON(w, http.StatusOK, map[string]int{"purged": n})
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// cacheBackend answers /<anything>?cc=<Cache-Control> with ETag "v1",
+// honouring If-None-Match, and counts the requests that reach it.
+type cacheBackend struct {
+	*httptest.Server
+	failing atomic.Bool
+	mu      sync.Mutex
+	hits    map[string]int
+}
+
+func startCacheBackend(t *testing.T) *cacheBackend {
+	t.Helper()
+	b := &cacheBackend{hits: make(map[string]int)}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.mu.Lock()
+		b.hits[r.URL.Path]++
+		b.mu.Unlock()
+		if b.failing.Load() {
+			http.Error(w, "upstream broke", http.StatusInternalServerError)
+			return
+		}
+		q := r.URL.Query()
+		w.Header().Set("Cache-Control", q.Get("cc"))
+		w.Header().Set("ETag", `"v1"`)
+		if v := q.Get("vary"); v != "" {
+			w.Header().Set("Vary", v)
+		}
+		if q.Has("cookie") {
+			w.Header().Set("Set-Cookie", "session=secret")
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		io.WriteString(w, r.URL.Path+" "+r.Header.Get("Accept-Language"))
+	}))
+	t.Cleanup(b.Close)
+	return b
+}
+
+func (b *cacheBackend) count(path string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.hits[path]
+}
+
+// fetch sends a request through the cache and returns X-Cache, the
+// status and the body.
+func fetch(t *testing.T, c *httpCache, method, url string, header ...string) (string, int, string) {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := c.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.Header.Get("X-Cache"), resp.StatusCode, string(body)
+}
+
+func TestCacheFreshnessAndRevalidation(t *testing.T) {
+	b := startCacheBackend(t)
+	c := newHTTPCache(newMemoryStore(1 << 20))
+
+	steps := []struct {
+		path, cc string
+		header   []string
+		want     string
+		upstream int // requests the backend has seen for path afterwards
+	}{
+		{"/fresh", "max-age=60", nil, "MISS", 1},
+		{"/fresh", "max-age=60", nil, "HIT", 1},
+		{"/fresh", "max-age=60", []string{"Cache-Control", "no-cache"}, "REVALIDATED", 2},
+		{"/fresh", "max-age=60", []string{"Cache-Control", "max-age=0"}, "REVALIDATED", 3},
+		{"/stale", "max-age=0", nil, "MISS", 1},
+		{"/stale", "max-age=0", nil, "REVALIDATED", 2},
+		{"/stale", "max-age=0", []string{"Cache-Control", "max-stale"}, "HIT", 2},
+		{"/private", "private, max-age=60", nil, "MISS", 1},
+		{"/private", "private, max-age=60", nil, "MISS", 2},
+		{"/nostore", "no-store", nil, "MISS", 1},
+		{"/nostore", "no-store", nil, "MISS", 2},
+		{"/auth", "max-age=60", []string{"Authorization", "Bearer x"}, "MISS", 1},
+		{"/auth", "max-age=60", []string{"Authorization", "Bearer x"}, "MISS", 2},
+		{"/cookie", "max-age=60", nil, "MISS", 1},
+		{"/cookie", "max-age=60", nil, "MISS", 2},
+	}
+	for i, s := range steps {
+		url := b.URL + s.path + "?cc=" + strings.ReplaceAll(s.cc, " ", "")
+		if s.path == "/cookie" {
+			url += "&cookie"
+		}
+		got, status, body := fetch(t, c, "GET", url, s.header...)
+		if got != s.want || status != 200 || !strings.HasPrefix(body, s.path) || b.count(s.path) != s.upstream {
+			t.Errorf("step %d %s: %s %d %q with %d upstream requests, want %s with %d",
+				i, s.path, got, status, body, b.count(s.path), s.want, s.upstream)
+		}
+	}
+
+	// A client's own conditional request is answered from the cache.
+	if got, status, _ := fetch(t, c, "GET", b.URL+"/fresh?cc=max-age=60", "If-None-Match", `W/"v1"`); got != "HIT" || status != 304 {
+		t.Errorf("conditional request: %s %d, want a 304 HIT", got, status)
+	}
+	if got, status, body := fetch(t, c, "HEAD", b.URL+"/fresh?cc=max-age=60"); got != "HIT" || status != 200 || body != "" {
+		t.Errorf("HEAD: %s %d %q", got, status, body)
+	}
+	if got, status, _ := fetch(t, c, "GET", b.URL+"/missing", "Cache-Control", "only-if-cached"); got != "MISS" || status != 504 {
+		t.Errorf("only-if-cached miss: %s %d", got, status)
+	}
+
+	// A successful unsafe request drops the entry.
+	fetch(t, c, "POST", b.URL+"/fresh?cc=max-age=60")
+	if got, _, _ := fetch(t, c, "GET", b.URL+"/fresh?cc=max-age=60"); got != "MISS" {
+		t.Errorf("after POST: %s, want MISS", got)
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	b := startCacheBackend(t)
+	c := newHTTPCache(newMemoryStore(1 << 20))
+	url := b.URL + "/page?cc=max-age=60&vary=Accept-Language"
+	for _, step := range []struct{ lang, want string }{
+		{"en", "MISS"}, {"fr", "MISS"}, {"en", "HIT"}, {"fr", "HIT"}, {"de", "MISS"},
+	} {
+		got, _, body := fetch(t, c, "GET", url, "Accept-Language", step.lang)
+		if got != step.want || body != "/page "+step.lang {
+			t.Errorf("Accept-Language %s: %s %q, want %s", step.lang, got, body, step.want)
+		}
+	}
+	if got, _, _ := fetch(t, c, "GET", b.URL+"/star?cc=max-age=60&vary=*"); got != "MISS" {
+		t.Fatal(got)
+	}
+	if got, _, _ := fetch(t, c, "GET", b.URL+"/star?cc=max-age=60&vary=*"); got != "MISS" {
+		t.Errorf("Vary: * response served from cache")
+	}
+}
+
+func TestCacheStaleIfError(t *testing.T) {
+	b := startCacheBackend(t)
+	c := newHTTPCache(newMemoryStore(1 << 20))
+	allowed := b.URL + "/a?cc=max-age=0,stale-if-error=60"
+	forbidden := b.URL + "/b?cc=max-age=0,stale-if-error=60,must-revalidate"
+	fetch(t, c, "GET", allowed)
+	fetch(t, c, "GET", forbidden)
+
+	b.failing.Store(true)
+	if got, status, body := fetch(t, c, "GET", allowed); got != "STALE" || status != 200 || body != "/a " {
+		t.Errorf("stale-if-error: %s %d %q", got, status, body)
+	}
+	if got, status, _ := fetch(t, c, "GET", forbidden); got != "MISS" || status != 500 {
+		t.Errorf("must-revalidate: %s %d, want the upstream's 500", got, status)
+	}
+
+	// An unreachable upstream counts as an error too.
+	b.Close()
+	if got, _, _ := fetch(t, c, "GET", allowed); got != "STALE" {
+		t.Errorf("upstream down: %s", got)
+	}
+}
+
+func TestCacheStoresAndAPI(t *testing.T) {
+	b := startCacheBackend(t)
+	dir := t.TempDir()
+	disk, err := newDiskStore(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newHTTPCache(disk)
+	fetch(t, c, "GET", b.URL+"/one?cc=max-age=60")
+	fetch(t, c, "GET", b.URL+"/two?cc=max-age=60")
+
+	// A new store over the same directory picks up the entries.
+	disk, err = newDiskStore(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = newHTTPCache(disk)
+	if got, _, body := fetch(t, c, "GET", b.URL+"/one?cc=max-age=60"); got != "HIT" || body != "/one " {
+		t.Errorf("after reopening: %s %q", got, body)
+	}
+
+	api := httptest.NewServer(http.HandlerFunc(c.serveAPI))
+	defer api.Close()
+	req, _ := http.NewRequest("DELETE", api.URL+"/cache?url="+b.URL+"/one?cc=max-age=60", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var purged map[string]int
+	json.NewDecoder(resp.Body).Decode(&purged)
+	resp.Body.Close()
+	if purged["purged"] != 1 {
+		t.Errorf("purged %v, want 1", purged)
+	}
+	if got, _, _ := fetch(t, c, "GET", b.URL+"/one?cc=max-age=60"); got != "MISS" {
+		t.Errorf("after purge: %s", got)
+	}
+	if got, _, _ := fetch(t, c, "GET", b.URL+"/two?cc=max-age=60"); got != "HIT" {
+		t.Errorf("other entry after purge: %s", got)
+	}
+
+	// The memory store evicts the least recently used URL when full.
+	mem := newMemoryStore(300)
+	c = newHTTPCache(mem)
+	fetch(t, c, "GET", b.URL+"/one?cc=max-age=60")
+	fetch(t, c, "GET", b.URL+"/two?cc=max-age=60")
+	fetch(t, c, "GET", b.URL+"/one?cc=max-age=60")
+	fetch(t, c, "GET", b.URL+"/three?cc=max-age=60")
+	// Checked in this order: refetching /two evicts again.
+	for _, step := range []struct{ path, want string }{{"/one", "HIT"}, {"/two", "MISS"}} {
+		if got, _, _ := fetch(t, c, "GET", b.URL+step.path+"?cc=max-age=60"); got != step.want {
+			t.Errorf("%s after eviction: %s, want %s (%d bytes cached)", step.path, got, step.want, mem.bytes())
+		}
+	}
+}
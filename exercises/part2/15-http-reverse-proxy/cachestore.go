@@ -0,0 +1,251 @@
+package main
+
+// Where cached responses live. Both stores hold every variant of a URL
+// (one per combination of Vary'd request headers) under the URL's key,
+// and evict least recently used URLs once -cache-size bytes are in use.
+// The memory store keeps the responses themselves in the LRU list; the
+// disk store keeps one gob file per URL in -cache-dir and only their
+// sizes in memory, reloading the index from the directory at startup.
+// Stores aren't safe for concurrent use; httpCache serialises access.
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// cachedResponse is one stored response and what's needed to work out
+// its age and which requests it answers.
+type cachedResponse struct {
+	StatusCode   int
+	Header       http.Header
+	Body         []byte
+	RequestTime  time.Time   // when the request that fetched it was sent
+	ResponseTime time.Time   // when the response arrived
+	VaryValues   http.Header // that request's values for the headers in Vary
+}
+
+func (e *cachedResponse) size() int64 {
+	n := int64(len(e.Body))
+	for k, vs := range e.Header {
+		for _, v := range vs {
+			n += int64(len(k) + len(v))
+		}
+	}
+	return n
+}
+
+type cacheStore interface {
+	get(key string) []*cachedResponse
+	put(key string, variants []*cachedResponse)
+	remove(key string)
+	keys() []string
+	bytes() int64
+}
+
+// lru tracks keys by recency and their total size.
+type lru struct {
+	max   int64
+	size  int64
+	ll    *list.List // front: most recently used
+	items map[string]*list.Element
+}
+
+type lruItem struct {
+	key      string
+	size     int64
+	variants []*cachedResponse // nil in the disk store
+}
+
+func newLRU(max int64) lru {
+	return lru{max: max, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (l *lru) get(key string) (*lruItem, bool) {
+	el, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.ll.MoveToFront(el)
+	return el.Value.(*lruItem), true
+}
+
+// add stores an item and returns the keys evicted to make room. An
+// item bigger than the whole cache evicts only its own older copy.
+func (l *lru) add(item *lruItem) (evicted []string) {
+	if l.remove(item.key) {
+		evicted = append(evicted, item.key)
+	}
+	if item.size > l.max {
+		return evicted
+	}
+	l.items[item.key] = l.ll.PushFront(item)
+	l.size += item.size
+	for l.size > l.max {
+		oldest := l.ll.Back().Value.(*lruItem)
+		l.remove(oldest.key)
+		evicted = append(evicted, oldest.key)
+	}
+	return evicted
+}
+
+func (l *lru) remove(key string) bool {
+	el, ok := l.items[key]
+	if !ok {
+		return false
+	}
+	l.ll.Remove(el)
+	delete(l.items, key)
+	l.size -= el.Value.(*lruItem).size
+	return true
+}
+
+func (l *lru) keys() []string {
+	keys := make([]string, 0, len(l.items))
+	for k := range l.items {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (l *lru) bytes() int64 { return l.size }
+
+func variantsSize(variants []*cachedResponse) int64 {
+	var n int64
+	for _, v := range variants {
+		n += v.size()
+	}
+	return n
+}
+
+type memoryStore struct {
+	lru
+}
+
+func newMemoryStore(max int64) *memoryStore {
+	return &memoryStore{lru: newLRU(max)}
+}
+
+func (s *memoryStore) get(key string) []*cachedResponse {
+	if item, ok := s.lru.get(key); ok {
+		return item.variants
+	}
+	return nil
+}
+
+func (s *memoryStore) put(key string, variants []*cachedResponse) {
+	s.lru.add(&lruItem{key: key, size: variantsSize(variants), variants: variants})
+}
+
+func (s *memoryStore) remove(key string) { s.lru.remove(key) }
+
+type diskStore struct {
+	lru
+	dir string
+}
+
+// diskFile is what's written for each URL.
+type diskFile struct {
+	Key      string
+	Variants []*cachedResponse
+}
+
+func newDiskStore(dir string, max int64) (*diskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &diskStore{lru: newLRU(max), dir: dir}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.cache"))
+	if err != nil {
+		return nil, err
+	}
+	type found struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+	var files []found
+	for _, path := range paths {
+		f, err := s.read(path)
+		info, statErr := os.Stat(path)
+		if err != nil || statErr != nil || s.path(f.Key) != path {
+			os.Remove(path)
+			continue
+		}
+		files = append(files, found{f.Key, variantsSize(f.Variants), info.ModTime()})
+	}
+	// Oldest first, so the newest ends up at the front of the list.
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, f := range files {
+		for _, k := range s.lru.add(&lruItem{key: f.key, size: f.size}) {
+			os.Remove(s.path(k))
+		}
+	}
+	return s, nil
+}
+
+func (s *diskStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".cache")
+}
+
+func (s *diskStore) read(path string) (*diskFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f diskFile
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func (s *diskStore) get(key string) []*cachedResponse {
+	if _, ok := s.lru.get(key); !ok {
+		return nil
+	}
+	f, err := s.read(s.path(key))
+	if err != nil || f.Key != key {
+		s.remove(key)
+		return nil
+	}
+	return f.Variants
+}
+
+func (s *diskStore) put(key string, variants []*cachedResponse) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(diskFile{Key: key, Variants: variants}); err != nil {
+		return
+	}
+	// Write and rename, so a crash never leaves half a file behind.
+	path := s.path(key)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return
+	}
+	for _, k := range s.lru.add(&lruItem{key: key, size: variantsSize(variants)}) {
+		if k != key {
+			os.Remove(s.path(k))
+		}
+	}
+	if _, ok := s.items[key]; !ok {
+		os.Remove(path) // too big to keep
+	}
+}
+
+func (s *diskStore) remove(key string) {
+	s.lru.remove(key)
+	os.Remove(s.path(key))
+}
@@ -0,0 +1,97 @@
+package main
+
+// X-Forwarded-* and Forwarded (RFC 7239). The upstream only sees the
+// proxy's address, so these headers tell it who the client was and
+// what it asked for. A client can send them too, so they're only
+// carried over from peers listed in -trusted-proxies: anything else
+// would let a client claim to be any IP it likes.
+//
+//	X-Forwarded-For    every hop's client, oldest first; we append ours
+//	X-Forwarded-Proto  the original client's scheme
+//	X-Forwarded-Host   the original client's Host
+//	Forwarded          one element per hop, each describing the request
+//	                   that hop received: for=, host= and proto=
+
+import (
+	"net"
+	"net/http/httputil"
+	"strings"
+)
+
+type forwarding struct {
+	trusted []*net.IPNet
+}
+
+func (f *forwarding) trusts(ip net.IP) bool {
+	for _, n := range f.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// set replaces the forwarding headers on pr.Out, which ReverseProxy
+// has already stripped of the client's copies.
+func (f *forwarding) set(pr *httputil.ProxyRequest) {
+	in := pr.In
+	client := in.RemoteAddr
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	proto := "http"
+	if in.TLS != nil {
+		proto = "https"
+	}
+	origProto, origHost := proto, in.Host
+
+	var forwardedFor, forwarded []string
+	if f.trusts(net.ParseIP(client)) {
+		forwardedFor = in.Header["X-Forwarded-For"]
+		forwarded = in.Header["Forwarded"]
+		if v := in.Header.Get("X-Forwarded-Proto"); v != "" {
+			origProto = v
+		}
+		if v := in.Header.Get("X-Forwarded-Host"); v != "" {
+			origHost = v
+		}
+	}
+
+	forIP := client
+	if strings.Contains(client, ":") {
+		forIP = "[" + client + "]"
+	}
+	element := "for=" + forwardedValue(forIP) + ";host=" + forwardedValue(in.Host) + ";proto=" + proto
+
+	out := pr.Out.Header
+	out.Set("X-Forwarded-For", joinList(forwardedFor, client))
+	out.Set("X-Forwarded-Proto", origProto)
+	out.Set("X-Forwarded-Host", origHost)
+	out.Set("Forwarded", joinList(forwarded, element))
+}
+
+// joinList appends v to the comma-separated values in prior, which may
+// span several header lines.
+func joinList(prior []string, v string) string {
+	if len(prior) == 0 {
+		return v
+	}
+	return strings.Join(prior, ", ") + ", " + v
+}
+
+// forwardedValue returns v as an RFC 7239 token, or as a quoted string
+// if it has characters a token can't, such as the colons in an IPv6
+// address or host:port.
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !isTokenChar(c) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
+
+func isTokenChar(c rune) bool {
+	return c < 0x7f && (c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+		strings.ContainsRune("!#$%&'*+-.^_`|~", c))
+}
@@ -0,0 +1,368 @@
+package main
+
+// JWT verification (RFC 7519) against a JSON Web Key Set (RFC 7517),
+// with nothing but the standard library. A token is three base64url
+// parts, header.payload.signature, and the signature covers the first
+// two. The header's alg says how it was signed:
+//
+//	HS256/384/512  HMAC-SHA2 with a shared secret (an "oct" key)
+//	RS256/384/512  RSASSA-PKCS1-v1_5 with SHA-2 (an "RSA" key)
+//	ES256/384/512  ECDSA on P-256/P-384/P-521 (an "EC" key)
+//
+// The alg is only trusted as far as choosing among keys of the
+// matching type: an RSA public key is never used as an HMAC secret,
+// which is the classic way to forge tokens, and "none" isn't accepted
+// at all. If the header names a kid, only that key is tried.
+//
+// A JWKS from a URL is refetched hourly, and also when a token names a
+// kid the set doesn't have (the issuer has rotated its keys), at most
+// once every jwksRefetchInterval so bogus kids can't flood the issuer.
+// Fetches happen outside the lock, one at a time, and other requests
+// go on verifying against the old keys until the new ones arrive.
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // register the hashes crypto.Hash.New uses
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jwksMaxAge          = time.Hour
+	jwksRefetchInterval = 30 * time.Second
+	clockSkew           = time.Minute // leeway for exp and nbf
+)
+
+type jwk struct {
+	kid string
+	alg string // "" if the key doesn't restrict it
+	key any    // []byte, *rsa.PublicKey or *ecdsa.PublicKey
+}
+
+type jwks struct {
+	source string // file path or http(s) URL
+
+	mu       sync.Mutex
+	keys     []jwk
+	fetched  time.Time // when the last fetch started
+	fetching bool
+}
+
+func loadJWKS(source string) (*jwks, error) {
+	s := &jwks{source: source, fetched: time.Now()}
+	keys, err := s.fetch()
+	if err != nil {
+		return nil, fmt.Errorf("JWKS %s: %w", source, err)
+	}
+	s.keys = keys
+	return s, nil
+}
+
+func (s *jwks) remote() bool {
+	return strings.HasPrefix(s.source, "http://") || strings.HasPrefix(s.source, "https://")
+}
+
+// refresh fetches a fresh copy of the set and swaps it in, reporting
+// whether it did. If another refresh is already under way it returns
+// false at once; if the fetch fails the old keys stay.
+func (s *jwks) refresh() bool {
+	s.mu.Lock()
+	if s.fetching {
+		s.mu.Unlock()
+		return false
+	}
+	s.fetching, s.fetched = true, time.Now()
+	s.mu.Unlock()
+
+	keys, err := s.fetch()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fetching = false
+	if err != nil {
+		return false
+	}
+	s.keys = keys
+	return true
+}
+
+// fetch reads and parses the set. It touches no state, so it runs
+// without s.mu held.
+func (s *jwks) fetch() ([]jwk, error) {
+	var data []byte
+	var err error
+	if s.remote() {
+		data, err = fetchURL(s.source)
+	} else {
+		data, err = os.ReadFile(s.source)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []struct {
+			Kty, Kid, Alg, Use, Crv string
+			K, N, E, X, Y           string
+		}
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	var keys []jwk
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := parseJWK(k.Kty, k.Crv, k.K, k.N, k.E, k.X, k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		if key != nil {
+			keys = append(keys, jwk{kid: k.Kid, alg: k.Alg, key: key})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable signing keys")
+	}
+	return keys, nil
+}
+
+func fetchURL(url string) ([]byte, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// parseJWK returns the public key or secret a JWK describes, or nil
+// for key types this verifier doesn't use.
+func parseJWK(kty, crv, k, n, e, x, y string) (any, error) {
+	b64 := base64.RawURLEncoding
+	switch kty {
+	case "oct":
+		secret, err := b64.DecodeString(k)
+		if err != nil || len(secret) == 0 {
+			return nil, errors.New("bad k")
+		}
+		return secret, nil
+	case "RSA":
+		nb, err1 := b64.DecodeString(n)
+		eb, err2 := b64.DecodeString(e)
+		if err1 != nil || err2 != nil || len(eb) == 0 || len(eb) > 4 {
+			return nil, errors.New("bad n or e")
+		}
+		exp := new(big.Int).SetBytes(eb).Int64()
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(nb), E: int(exp)}, nil
+	case "EC":
+		curve := curveFor(crv)
+		if curve == nil {
+			return nil, fmt.Errorf("unsupported curve %q", crv)
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		xb, err1 := b64.DecodeString(x)
+		yb, err2 := b64.DecodeString(y)
+		if err1 != nil || err2 != nil || len(xb) != size || len(yb) != size {
+			return nil, errors.New("bad x or y")
+		}
+		return ecdsa.ParseUncompressedPublicKey(curve, append(append([]byte{4}, xb...), yb...))
+	}
+	return nil, nil
+}
+
+func curveFor(crv string) elliptic.Curve {
+	switch crv {
+	case "P-256":
+		return elliptic.P256()
+	case "P-384":
+		return elliptic.P384()
+	case "P-521":
+		return elliptic.P521()
+	}
+	return nil
+}
+
+// candidates returns the keys that may have signed a token with this
+// kid and alg.
+func (s *jwks) candidates(kid, alg string) []jwk {
+	s.mu.Lock()
+	found := s.match(kid, alg)
+	missing := len(found) == 0 && kid != "" && time.Since(s.fetched) > jwksRefetchInterval
+	stale := s.remote() && time.Since(s.fetched) > jwksMaxAge
+	s.mu.Unlock()
+
+	switch {
+	case missing:
+		// Only this request waits for the issuer's rotated keys.
+		if s.refresh() {
+			s.mu.Lock()
+			found = s.match(kid, alg)
+			s.mu.Unlock()
+		}
+	case stale:
+		go s.refresh()
+	}
+	return found
+}
+
+func (s *jwks) match(kid, alg string) []jwk {
+	var found []jwk
+	for _, k := range s.keys {
+		if (kid == "" || k.kid == kid) && keyFits(k, alg) {
+			found = append(found, k)
+		}
+	}
+	return found
+}
+
+// keyFits reports whether k can verify alg: the key type has to match
+// the algorithm family, and the curve the hash size.
+func keyFits(k jwk, alg string) bool {
+	if k.alg != "" && k.alg != alg {
+		return false
+	}
+	switch key := k.key.(type) {
+	case []byte:
+		return strings.HasPrefix(alg, "HS")
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS")
+	case *ecdsa.PublicKey:
+		curves := map[string]string{"ES256": "P-256", "ES384": "P-384", "ES512": "P-521"}
+		return key.Curve.Params().Name == curves[alg]
+	}
+	return false
+}
+
+func hashFor(alg string) (crypto.Hash, bool) {
+	if len(alg) != 5 || alg[:2] != "HS" && alg[:2] != "RS" && alg[:2] != "ES" {
+		return 0, false
+	}
+	switch alg[2:] {
+	case "256":
+		return crypto.SHA256, true
+	case "384":
+		return crypto.SHA384, true
+	case "512":
+		return crypto.SHA512, true
+	}
+	return 0, false
+}
+
+// verifySignature checks sig over signed with key.
+func verifySignature(h crypto.Hash, key any, signed, sig []byte) bool {
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(h.New, key)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), sig)
+	case *rsa.PublicKey:
+		digest := h.New()
+		digest.Write(signed)
+		return rsa.VerifyPKCS1v15(key, h, digest.Sum(nil), sig) == nil
+	case *ecdsa.PublicKey:
+		// JWS signatures are r and s as fixed-size big-endian integers,
+		// not the ASN.1 that ecdsa.VerifyASN1 expects.
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+		digest := h.New()
+		digest.Write(signed)
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(key, digest.Sum(nil), r, s)
+	}
+	return false
+}
+
+// verifyJWT checks a token's signature against keys and its time
+// claims against now, returning the claims.
+func verifyJWT(token string, keys *jwks, now time.Time) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	b64 := base64.RawURLEncoding
+	headerJSON, err1 := b64.DecodeString(parts[0])
+	sig, err2 := b64.DecodeString(parts[2])
+	if err1 != nil || err2 != nil {
+		return nil, errors.New("malformed token")
+	}
+	var header struct{ Alg, Kid string }
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	h, ok := hashFor(header.Alg)
+	if !ok {
+		return nil, fmt.Errorf("unsupported alg %q", header.Alg)
+	}
+	candidates := keys.candidates(header.Kid, header.Alg)
+	if len(candidates) == 0 {
+		return nil, errors.New("unknown signing key")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range candidates {
+		if verifySignature(h, k.key, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("bad signature")
+	}
+
+	payload, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed token payload")
+	}
+	var claims map[string]any
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&claims); err != nil {
+		return nil, errors.New("malformed token payload")
+	}
+	exp, ok := numericDate(claims["exp"])
+	if !ok {
+		return nil, errors.New("token has no exp")
+	}
+	if now.After(exp.Add(clockSkew)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := numericDate(claims["nbf"]); ok && now.Add(clockSkew).Before(nbf) {
+		return nil, errors.New("token not valid yet")
+	}
+	return claims, nil
+}
+
+// numericDate reads a claim holding seconds since the epoch.
+func numericDate(v any) (time.Time, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
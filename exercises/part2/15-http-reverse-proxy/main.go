@@ -1,30 +1,227 @@
 // HTTP Reverse Proxy Example
-// Forwards every request to a single backend using the standard
-// library's production-grade httputil.ReverseProxy.
+// Forwards requests to backends using the standard library's
+// production-grade httputil.ReverseProxy. By default everything goes
+// to one backend; a -routes file picks the backend by host and path
+// prefix, rewrites headers and answers redirects (see routes.go), and
+// -cache keeps cacheable responses in memory or on disk (see cache.go).
 package main
 
 import (
+	"flag"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"strings"
+	"time"
 )
 
 func main() {
-	backend, err := url.Parse("http://localhost:8080")
-	if err != nil {
-		log.Fatal(err)
+	addr := flag.String("addr", ":9300", "listen address")
+	upstream := flag.String("upstream", "http://localhost:8080", "backend to forward everything to when there's no -routes file")
+	routesFile := flag.String("routes", "", "file of host/path routes, redirects and header rules (replaces -upstream)")
+	trustedProxies := flag.String("trusted-proxies", "", "comma-separated addresses/CIDRs whose X-Forwarded-* and Forwarded headers are kept (default: none)")
+	cacheMode := flag.String("cache", "", `"memory" or "disk" to cache upstream responses (default: no cache)`)
+	cacheDir := flag.String("cache-dir", "proxy-cache", "directory for the disk cache")
+	cacheSize := flag.Int64("cache-size", 64<<20, "bytes of responses the cache keeps before evicting the least recently used")
+	cacheAPI := flag.String("cache-api", "localhost:9301", "address for the HTTP API that reports on and purges the cache")
+	accessLog := flag.String("access-log", "", "file to append the JSON access and mirror log to (default stdout)")
+	certFile := flag.String("tls-cert", "", "certificate file to serve HTTPS with (needs -tls-key)")
+	keyFile := flag.String("tls-key", "", "private key file for -tls-cert")
+	flag.Parse()
+
+	out := os.Stdout
+	if *accessLog != "" {
+		var err error
+		if out, err = os.OpenFile(*accessLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644); err != nil {
+			log.Fatal(err)
+		}
+		defer out.Close()
+	}
+	opts := &proxyOptions{forwarding: &forwarding{}, log: slog.New(slog.NewJSONHandler(out, nil))}
+	if *trustedProxies != "" {
+		nets, err := parseCIDRs(*trustedProxies)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.forwarding.trusted = nets
+	}
+	switch *cacheMode {
+	case "":
+	case "memory":
+		opts.cache = newHTTPCache(newMemoryStore(*cacheSize))
+	case "disk":
+		store, err := newDiskStore(*cacheDir, *cacheSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.cache = newHTTPCache(store)
+	default:
+		log.Fatalf("unknown -cache %q", *cacheMode)
+	}
+	if opts.cache != nil {
+		log.Println("cache API listening on", *cacheAPI)
+		go func() { log.Fatal(http.ListenAndServe(*cacheAPI, http.HandlerFunc(opts.cache.serveAPI))) }()
+	}
+
+	var routes *routeTable
+	if *routesFile != "" {
+		var err error
+		if routes, err = parseRoutes(*routesFile, opts); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		backend, err := url.Parse(*upstream)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// A custom header on every forwarded request, a common pattern
+		// for injecting tracing or identifying the proxy hop.
+		r := &route{host: "*", prefix: "/", upstream: backend, request: []headerRule{
+			{op: "set", name: "X-Forwarded-By", value: "go-reverse-proxy"},
+		}}
+		r.build(opts)
+		routes = &routeTable{routes: []*route{r}, log: opts.log}
+	}
+
+	log.Println("reverse proxy listening on", *addr, "with", len(routes.routes), "route(s)")
+	if *certFile != "" {
+		log.Fatal(http.ListenAndServeTLS(*addr, *certFile, *keyFile, routes))
+	}
+	log.Fatal(http.ListenAndServe(*addr, routes))
+}
+
+func (rt *routeTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	rec := &countingWriter{ResponseWriter: w, status: http.StatusOK}
+	upstream, canary := rt.serve(rec, r)
+	if rt.log != nil {
+		rt.log.Info("access",
+			"client", r.RemoteAddr,
+			"method", r.Method,
+			"host", r.Host,
+			"path", r.URL.RequestURI(),
+			"status", rec.status,
+			"bytes", rec.written,
+			"upstream", upstream,
+			"canary", canary,
+			"duration_ms", time.Since(start).Milliseconds(),
+		)
+	}
+}
+
+// serve routes r, reporting where it went: an upstream URL, "redirect"
+// or "" if nothing matched or the client didn't authenticate.
+func (rt *routeTable) serve(w http.ResponseWriter, r *http.Request) (upstream string, canary bool) {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
 	}
+	if p := cleanPath(r.URL.Path); p != r.URL.Path {
+		r.URL.Path, r.URL.RawPath = p, ""
+	}
+	route := rt.match(host, r.URL.Path)
+	switch {
+	case route == nil:
+		http.NotFound(w, r)
+		return "", false
+	case route.proxy == nil:
+		target := joinPath(route.redirect, strings.TrimPrefix(r.URL.Path, route.prefix))
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, route.code)
+		return "redirect", false
+	}
+	return route.serve(w, r)
+}
+
+// proxyOptions is what every route's proxy shares.
+type proxyOptions struct {
+	forwarding *forwarding
+	cache      *httpCache   // nil: no caching
+	log        *slog.Logger // nil: no access or mirror log
+}
+
+// newRouteProxy builds a proxy that sends r's requests to upstream.
+func newRouteProxy(r *route, upstream *url.URL, opts *proxyOptions) *httputil.ReverseProxy {
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			if opts.cache != nil {
+				pr.Out = withCacheKey(pr.Out, pr.In, len(r.auth) > 0)
+			}
+			if r.strip {
+				stripPrefix(pr.Out.URL, r.prefix)
+			}
+			pr.SetURL(upstream)
+			opts.forwarding.set(pr)
+			host := pr.Out.URL.Host
+			apply(r.request, pr.Out.Header, &host)
+			if host != pr.Out.URL.Host {
+				pr.Out.Host = host
+			}
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			apply(r.response, resp.Header, nil)
+			return nil
+		},
+	}
+	if opts.cache != nil {
+		proxy.Transport = opts.cache
+	}
+	return proxy
+}
 
-	proxy := httputil.NewSingleHostReverseProxy(backend)
+// stripPrefix removes a route's path prefix, leaving at least "/".
+func stripPrefix(u *url.URL, prefix string) {
+	strip := func(p string) string {
+		p = strings.TrimPrefix(p, prefix)
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+		return p
+	}
+	if u.RawPath != "" && strings.HasPrefix(u.RawPath, prefix) {
+		u.RawPath = strip(u.RawPath)
+	} else {
+		u.RawPath = ""
+	}
+	u.Path = strip(u.Path)
+}
 
-	// Wrap the proxy to add a custom header on every forwarded request,
-	// a common pattern for injecting tracing or identifying the proxy hop.
-	handler := func(w http.ResponseWriter, r *http.Request) {
-		r.Header.Set("X-Forwarded-By", "go-reverse-proxy")
-		proxy.ServeHTTP(w, r)
+// joinPath appends rest to base with exactly one slash between them.
+func joinPath(base, rest string) string {
+	switch {
+	case rest == "":
+		return base
+	case strings.HasSuffix(base, "/") && strings.HasPrefix(rest, "/"):
+		return base + rest[1:]
+	case !strings.HasSuffix(base, "/") && !strings.HasPrefix(rest, "/"):
+		return base + "/" + rest
 	}
+	return base + rest
+}
 
-	log.Println("reverse proxy listening on :9300, forwarding to :8080")
-	log.Fatal(http.ListenAndServe(":9300", http.HandlerFunc(handler)))
+// parseCIDRs parses a comma-separated list of CIDRs and bare addresses.
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
 }
@@ -0,0 +1,281 @@
+package main
+
+// The route table. A -routes file maps hosts and path prefixes to
+// upstreams. Routes and redirects are tried in order, first match wins:
+//
+//	# header rules before the first route apply to every route
+//	request   set      X-Forwarded-By  go-reverse-proxy
+//
+//	redirect  old.example.com  /       301  https://new.example.com/
+//	redirect  *                /docs/  308  /manual/
+//
+//	route     api.example.com  /v1/    http://10.0.0.5:8080/  strip
+//	  request   del      Cookie
+//	  response  set      Cache-Control  no-store
+//	  response  rewrite  Location  ^http://10\.0\.0\.5:8080  https://api.example.com
+//	route     *.example.com    /       http://10.0.0.6:8080
+//	route     *                /       http://localhost:8080
+//
+// The host is matched without its port; "*.domain" matches any
+// subdomain and "*" matches every host. A path prefix matches whole
+// segments, so /v1 matches /v1 and /v1/users but not /v1beta. "strip"
+// removes the prefix before the path is joined onto the upstream's.
+//
+// A redirect answers with its status code instead of forwarding; the
+// rest of the path after the prefix, and the query, are appended to
+// the target, so /docs/intro above becomes /manual/intro.
+//
+// Header rules under a route apply to that route only, after the
+// shared ones. "request" rules edit what goes to the upstream,
+// "response" rules what comes back:
+//
+//	set      <header> <value>         replace every value
+//	add      <header> <value>         add another value
+//	del      <header>                 remove the header
+//	rewrite  <header> <regexp> <repl> regexp.ReplaceAllString on each value
+//
+// Request rules run after the X-Forwarded-* and Forwarded headers are
+// set, so they can change those too. "Host" in a request rule means
+// the Host the upstream sees. A route can also send some of its
+// traffic to a canary and mirror some to a shadow upstream (see
+// split.go), and require clients to authenticate (see auth.go).
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type route struct {
+	host   string // "*", "*.domain" or an exact host
+	prefix string
+
+	// Either a redirect...
+	redirect string
+	code     int
+
+	// ...or a proxied route.
+	upstream *url.URL
+	strip    bool
+	request  []headerRule
+	response []headerRule
+	proxy    *httputil.ReverseProxy
+
+	canary        *url.URL
+	canaryPercent float64
+	canaryHeader  string // requests with this header always go to the canary...
+	canaryValue   string // ...if it has this value, or any value if ""
+	canaryProxy   *httputil.ReverseProxy
+
+	mirror        *url.URL
+	mirrorPercent float64
+	mirrorProxy   *httputil.ReverseProxy
+	log           *slog.Logger
+
+	auth []authenticator // any one will do; none: open to all
+}
+
+type headerRule struct {
+	op    string // "set", "add", "del" or "rewrite"
+	name  string
+	value string
+	re    *regexp.Regexp
+}
+
+type routeTable struct {
+	routes []*route
+	log    *slog.Logger // nil: no access log
+}
+
+// parseRoutes reads a routes file, building a proxy for each route.
+func parseRoutes(path string, opts *proxyOptions) (*routeTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rt := &routeTable{log: opts.log}
+	var shared []headerRule
+	var last *route
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := rt.parseLine(line, &shared, &last); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(rt.routes) == 0 {
+		return nil, fmt.Errorf("%s: no routes", path)
+	}
+	for _, r := range rt.routes {
+		if r.upstream != nil {
+			r.request = append(append([]headerRule{}, shared...), r.request...)
+			r.build(opts)
+		}
+	}
+	return rt, nil
+}
+
+func (rt *routeTable) parseLine(line string, shared *[]headerRule, last **route) error {
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case "route":
+		if len(fields) != 4 && !(len(fields) == 5 && fields[4] == "strip") {
+			return fmt.Errorf("expected route <host> <prefix> <upstream> [strip], got %q", line)
+		}
+		upstream, err := url.Parse(fields[3])
+		if err != nil {
+			return err
+		}
+		if upstream.Scheme != "http" && upstream.Scheme != "https" || upstream.Host == "" {
+			return fmt.Errorf("upstream %q isn't an http(s) URL", fields[3])
+		}
+		r := &route{host: strings.ToLower(fields[1]), prefix: fields[2], upstream: upstream, strip: len(fields) == 5}
+		if !strings.HasPrefix(r.prefix, "/") {
+			return fmt.Errorf("path prefix %q doesn't start with /", r.prefix)
+		}
+		rt.routes = append(rt.routes, r)
+		*last = r
+	case "redirect":
+		if len(fields) != 5 {
+			return fmt.Errorf("expected redirect <host> <prefix> <code> <target>, got %q", line)
+		}
+		code, err := strconv.Atoi(fields[3])
+		if err != nil || code < 300 || code > 399 {
+			return fmt.Errorf("bad redirect status %q", fields[3])
+		}
+		r := &route{host: strings.ToLower(fields[1]), prefix: fields[2], redirect: fields[4], code: code}
+		if !strings.HasPrefix(r.prefix, "/") {
+			return fmt.Errorf("path prefix %q doesn't start with /", r.prefix)
+		}
+		rt.routes = append(rt.routes, r)
+		*last = nil // header rules can't follow a redirect
+	case "canary", "mirror", "auth":
+		if *last == nil {
+			return fmt.Errorf("%s belongs under a route", fields[0])
+		}
+		if fields[0] == "auth" {
+			return (*last).parseAuth(fields)
+		}
+		return (*last).parseSplit(fields)
+	case "request", "response":
+		rule, err := parseHeaderRule(fields[1:])
+		if err != nil {
+			return err
+		}
+		switch {
+		case *last == nil && len(rt.routes) > 0:
+			return fmt.Errorf("header rule after a redirect")
+		case *last == nil && fields[0] == "response":
+			return fmt.Errorf("response rules belong to a route")
+		case *last == nil:
+			*shared = append(*shared, rule)
+		case fields[0] == "request":
+			(*last).request = append((*last).request, rule)
+		default:
+			(*last).response = append((*last).response, rule)
+		}
+	default:
+		return fmt.Errorf("unknown directive %q", fields[0])
+	}
+	return nil
+}
+
+func parseHeaderRule(fields []string) (headerRule, error) {
+	if len(fields) < 2 {
+		return headerRule{}, fmt.Errorf("expected <op> <header> ...")
+	}
+	r := headerRule{op: fields[0], name: http.CanonicalHeaderKey(fields[1])}
+	switch {
+	case r.op == "del" && len(fields) == 2:
+	case (r.op == "set" || r.op == "add") && len(fields) >= 3:
+		r.value = strings.Join(fields[2:], " ")
+	case r.op == "rewrite" && len(fields) >= 4:
+		re, err := regexp.Compile(fields[2])
+		if err != nil {
+			return headerRule{}, err
+		}
+		r.re, r.value = re, strings.Join(fields[3:], " ")
+	default:
+		return headerRule{}, fmt.Errorf("bad header rule %q", strings.Join(fields, " "))
+	}
+	return r, nil
+}
+
+// match returns the first route for host (already lowercased, without
+// a port) and a cleaned path.
+func (rt *routeTable) match(host, p string) *route {
+	for _, r := range rt.routes {
+		if matchHost(r.host, host) && matchPrefix(r.prefix, p) {
+			return r
+		}
+	}
+	return nil
+}
+
+func matchHost(pattern, host string) bool {
+	return pattern == "*" || pattern == host ||
+		strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:])
+}
+
+func matchPrefix(prefix, p string) bool {
+	return p == prefix || strings.HasPrefix(p, prefix) &&
+		(strings.HasSuffix(prefix, "/") || p[len(prefix)] == '/')
+}
+
+// cleanPath resolves . and .. segments the way http.ServeMux does, so
+// /public/../admin can't slip past a /public/ route to an upstream
+// that would resolve it to /admin.
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// apply runs rules over h. If host is non-nil, "Host" rules edit it
+// instead of h.
+func apply(rules []headerRule, h http.Header, host *string) {
+	for _, r := range rules {
+		if r.name == "Host" && host != nil {
+			switch r.op {
+			case "set", "add":
+				*host = r.value
+			case "rewrite":
+				*host = r.re.ReplaceAllString(*host, r.value)
+			}
+			continue
+		}
+		switch r.op {
+		case "set":
+			h.Set(r.name, r.value)
+		case "add":
+			h.Add(r.name, r.value)
+		case "del":
+			h.Del(r.name)
+		case "rewrite":
+			values := h[r.name]
+			for i, v := range values {
+				values[i] = r.re.ReplaceAllString(v, r.value)
+			}
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// echoed is what a test backend saw.
+type echoed struct {
+	Name   string
+	Host   string
+	Path   string
+	Header http.Header
+}
+
+func startBackend(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "http://"+r.Host+"/elsewhere")
+		w.Header().Set("Server", "backend")
+		json.NewEncoder(w).Encode(echoed{Name: name, Host: r.Host, Path: r.URL.Path, Header: r.Header})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func startRoutes(t *testing.T, config string, opts *proxyOptions) *httptest.Server {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "routes")
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	routes, err := parseRoutes(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(routes)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func get(t *testing.T, url, host string, header http.Header) (*http.Response, echoed) {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Host = host
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var e echoed
+	json.NewDecoder(resp.Body).Decode(&e)
+	return resp, e
+}
+
+func TestRoutesPickUpstreamAndRewrite(t *testing.T) {
+	api, web, other := startBackend(t, "api"), startBackend(t, "web"), startBackend(t, "other")
+	proxy := startRoutes(t, strings.NewReplacer("API", api.URL, "WEB", web.URL, "OTHER", other.URL).Replace(`
+request   set  X-Forwarded-By  go-reverse-proxy
+redirect  old.example.com  /       301  https://new.example.com
+redirect  *                /docs/  308  /manual/
+route     api.example.com  /v1     API/base  strip
+  request   del      Cookie
+  request   set      Host  internal.api
+  response  set      Cache-Control  no-store
+  response  rewrite  Location  ^http://internal\.api  https://api.example.com
+  response  del      Server
+route     *.example.com    /       WEB
+route     *                /       OTHER
+`), &proxyOptions{forwarding: &forwarding{}})
+
+	cookie := http.Header{"Cookie": {"session=1"}}
+	tests := []struct {
+		host, path    string
+		backend, want string
+		keepsCookie   bool
+	}{
+		{"api.example.com", "/v1/users", "api", "/base/users", false},
+		{"API.example.com:9300", "/v1", "api", "/base/", false},
+		{"api.example.com", "/v1beta", "web", "/v1beta", true},
+		{"www.example.com", "/x", "web", "/x", true},
+		{"example.org", "/public/../v1/x", "other", "/v1/x", true},
+	}
+	for _, tt := range tests {
+		resp, e := get(t, proxy.URL+tt.path, tt.host, cookie)
+		if resp.StatusCode != 200 || e.Name != tt.backend || e.Path != tt.want {
+			t.Errorf("%s%s: %d from %q path %q, want %q path %q", tt.host, tt.path, resp.StatusCode, e.Name, e.Path, tt.backend, tt.want)
+			continue
+		}
+		if got := e.Header.Get("Cookie") != ""; got != tt.keepsCookie {
+			t.Errorf("%s%s: cookie forwarded %v", tt.host, tt.path, got)
+		}
+		if e.Header.Get("X-Forwarded-By") != "go-reverse-proxy" {
+			t.Errorf("%s%s: shared request rule not applied", tt.host, tt.path)
+		}
+	}
+
+	resp, e := get(t, proxy.URL+"/v1/", "api.example.com", nil)
+	if e.Host != "internal.api" {
+		t.Errorf("upstream saw Host %q", e.Host)
+	}
+	if h := resp.Header; h.Get("Cache-Control") != "no-store" || h.Get("Server") != "" ||
+		h.Get("Location") != "https://api.example.com/elsewhere" {
+		t.Errorf("response headers %v", h)
+	}
+
+	for _, tt := range []struct{ host, path, location string }{
+		{"old.example.com", "/a/b?q=1", "https://new.example.com/a/b?q=1"},
+		{"old.example.com", "/", "https://new.example.com"},
+		{"example.org", "/docs/intro", "/manual/intro"},
+	} {
+		resp, _ := get(t, proxy.URL+tt.path, tt.host, nil)
+		if resp.StatusCode/100 != 3 || resp.Header.Get("Location") != tt.location {
+			t.Errorf("%s%s: %d to %q, want %q", tt.host, tt.path, resp.StatusCode, resp.Header.Get("Location"), tt.location)
+		}
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	backend := startBackend(t, "backend")
+	config := "route * / " + backend.URL + "\n"
+	spoofed := http.Header{
+		"X-Forwarded-For":   {"1.2.3.4"},
+		"X-Forwarded-Proto": {"https"},
+		"X-Forwarded-Host":  {"client.example"},
+		"Forwarded":         {"for=1.2.3.4;proto=https"},
+	}
+
+	// From an untrusted client, what it claims is thrown away.
+	proxy := startRoutes(t, config, &proxyOptions{forwarding: &forwarding{}})
+	_, e := get(t, proxy.URL+"/", "site.example:9300", spoofed)
+	want := map[string]string{
+		"X-Forwarded-For":   "127.0.0.1",
+		"X-Forwarded-Proto": "http",
+		"X-Forwarded-Host":  "site.example:9300",
+		"Forwarded":         `for=127.0.0.1;host="site.example:9300";proto=http`,
+	}
+	for k, v := range want {
+		if got := strings.Join(e.Header[k], ", "); got != v {
+			t.Errorf("untrusted %s: %q, want %q", k, got, v)
+		}
+	}
+
+	// From a trusted proxy, the chain is extended.
+	nets, _ := parseCIDRs("127.0.0.1")
+	proxy = startRoutes(t, config, &proxyOptions{forwarding: &forwarding{trusted: nets}})
+	_, e = get(t, proxy.URL+"/", "site.example", spoofed)
+	want = map[string]string{
+		"X-Forwarded-For":   "1.2.3.4, 127.0.0.1",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "client.example",
+		"Forwarded":         "for=1.2.3.4;proto=https, for=127.0.0.1;host=site.example;proto=http",
+	}
+	for k, v := range want {
+		if got := strings.Join(e.Header[k], ", "); got != v {
+			t.Errorf("trusted %s: %q, want %q", k, got, v)
+		}
+	}
+
+	if got := forwardedValue("[2001:db8::1]"); got != `"[2001:db8::1]"` {
+		t.Errorf("IPv6 for= value %s", got)
+	}
+}
+
+func TestParseRoutesErrors(t *testing.T) {
+	for _, config := range []string{
+		"",
+		"route * v1 http://localhost:8080",
+		"route * / localhost:8080",
+		"route * / http://localhost:8080 keep",
+		"redirect * / 200 /x",
+		"response set X-A b\nroute * / http://localhost:8080",
+		"redirect * / 301 /x\nrequest del Cookie",
+		"route * / http://localhost:8080\nrequest rewrite X-A ( b",
+		"listen :80",
+	} {
+		path := filepath.Join(t.TempDir(), "routes")
+		os.WriteFile(path, []byte(config), 0o644)
+		if _, err := parseRoutes(path, &proxyOptions{forwarding: &forwarding{}}); err == nil {
+			t.Errorf("%q parsed without error", config)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+// Canary releases and shadow traffic, configured under a route:
+//
+//	route   *  /api/  http://stable:8080
+//	  canary  http://canary:8080  5%  header X-Canary=always
+//	  mirror  http://next:8080    20%
+//
+// canary sends a share of the route's requests to a second upstream
+// instead of the first. Requests carrying the header (with that value,
+// or any value if none is given) always go to the canary, so testers
+// can reach it on purpose; the percentage picks among the rest.
+// Canary responses bypass the cache, so what the canary serves is
+// always its own.
+//
+// mirror copies a share of the route's requests to another upstream in
+// the background, marked with X-Mirrored: 1. Once both have answered,
+// the shadow response is compared with what the client got (status,
+// Content-Type, body length and a SHA-256 of the body) and thrown away.
+// Requests with bodies over maxMirrorBody aren't mirrored, and neither
+// are requests that arrive while maxMirrorsInFlight mirrors are still
+// running, so a slow shadow upstream can't hold up live traffic. Every
+// method is mirrored, POST included: point mirror at an upstream whose
+// side effects don't matter.
+//
+// The access log says which upstream served each request and whether
+// it was the canary, and each mirrored request adds a "mirror" line
+// with both results and which of them differed.
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxMirrorBody      = 1 << 20
+	maxMirrorsInFlight = 64
+	mirrorTimeout      = 10 * time.Second
+)
+
+var mirrorSlots = make(chan struct{}, maxMirrorsInFlight)
+
+// parseSplit reads a canary or mirror line.
+func (r *route) parseSplit(fields []string) error {
+	if len(fields) < 2 {
+		return fmt.Errorf("expected %s <upstream> ...", fields[0])
+	}
+	upstream, err := url.Parse(fields[1])
+	if err != nil {
+		return err
+	}
+	if upstream.Scheme != "http" && upstream.Scheme != "https" || upstream.Host == "" {
+		return fmt.Errorf("upstream %q isn't an http(s) URL", fields[1])
+	}
+	percent, havePercent := 100.0, false
+	var header, value string
+	for rest := fields[2:]; len(rest) > 0; rest = rest[1:] {
+		switch {
+		case strings.HasSuffix(rest[0], "%"):
+			percent, err = strconv.ParseFloat(strings.TrimSuffix(rest[0], "%"), 64)
+			if err != nil || percent < 0 || percent > 100 {
+				return fmt.Errorf("bad percentage %q", rest[0])
+			}
+			havePercent = true
+		case rest[0] == "header" && fields[0] == "canary" && len(rest) > 1:
+			header, value, _ = strings.Cut(rest[1], "=")
+			header = http.CanonicalHeaderKey(header)
+			rest = rest[1:]
+		default:
+			return fmt.Errorf("unexpected %q", rest[0])
+		}
+	}
+	if fields[0] == "canary" {
+		switch {
+		case !havePercent && header == "":
+			return fmt.Errorf("canary needs a percentage, a header or both")
+		case !havePercent:
+			percent = 0 // only requests with the header
+		}
+		r.canary, r.canaryPercent, r.canaryHeader, r.canaryValue = upstream, percent, header, value
+	} else {
+		r.mirror, r.mirrorPercent = upstream, percent
+	}
+	return nil
+}
+
+// build creates the route's proxies.
+func (r *route) build(opts *proxyOptions) {
+	r.proxy = newRouteProxy(r, r.upstream, opts)
+	r.log = opts.log
+	uncached := *opts
+	uncached.cache = nil
+	if r.canary != nil {
+		r.canaryProxy = newRouteProxy(r, r.canary, &uncached)
+	}
+	if r.mirror != nil {
+		r.mirrorProxy = newRouteProxy(r, r.mirror, &uncached)
+		r.mirrorProxy.ErrorHandler = func(w http.ResponseWriter, _ *http.Request, err error) {
+			w.(*mirrorWriter).err = err
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}
+}
+
+// useCanary reports whether req goes to the route's canary.
+func (r *route) useCanary(req *http.Request) bool {
+	if r.canary == nil {
+		return false
+	}
+	if r.canaryHeader != "" {
+		if v := req.Header.Get(r.canaryHeader); v != "" && (r.canaryValue == "" || v == r.canaryValue) {
+			return true
+		}
+	}
+	return rand.Float64()*100 < r.canaryPercent
+}
+
+// serve proxies req along the route, reporting the upstream it chose.
+// It reports "" if the request was refused for want of credentials.
+func (r *route) serve(w http.ResponseWriter, req *http.Request) (upstream string, canary bool) {
+	if !r.authorize(w, req) {
+		return "", false
+	}
+	proxy, target := r.proxy, r.upstream
+	if canary = r.useCanary(req); canary {
+		proxy, target = r.canaryProxy, r.canary
+	}
+	var shadow <-chan responseSummary
+	if r.mirror != nil && rand.Float64()*100 < r.mirrorPercent {
+		shadow = r.startMirror(req)
+	}
+	if shadow == nil {
+		proxy.ServeHTTP(w, req)
+		return target.String(), canary
+	}
+
+	start := time.Now()
+	rec := &countingWriter{ResponseWriter: w, status: http.StatusOK, digest: sha256.New()}
+	proxy.ServeHTTP(rec, req)
+	primary := responseSummary{
+		status:      rec.status,
+		contentType: w.Header().Get("Content-Type"),
+		bytes:       rec.written,
+		sum:         rec.digest.Sum(nil),
+		duration:    time.Since(start),
+	}
+	go r.logMirror(req, target.String(), primary, shadow)
+	return target.String(), canary
+}
+
+// responseSummary is what's compared between a response and its mirror.
+type responseSummary struct {
+	status      int
+	contentType string
+	bytes       int64
+	sum         []byte
+	duration    time.Duration
+	err         error
+}
+
+// startMirror sends a copy of req to the mirror upstream, leaving req's
+// body readable for the real request. It returns nil if req can't be
+// mirrored.
+func (r *route) startMirror(req *http.Request) <-chan responseSummary {
+	if req.ContentLength > maxMirrorBody {
+		return nil
+	}
+	select {
+	case mirrorSlots <- struct{}{}:
+	default:
+		return nil
+	}
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		b, err := io.ReadAll(io.LimitReader(req.Body, maxMirrorBody+1))
+		req.Body = readCloser{io.MultiReader(bytes.NewReader(b), req.Body), req.Body}
+		if err != nil || len(b) > maxMirrorBody {
+			<-mirrorSlots
+			return nil
+		}
+		body = b
+	}
+
+	// A fresh context: the mirror mustn't be cancelled when the client
+	// goes away, and ReverseProxy mustn't treat it as a server request
+	// (it panics to abort those on a failed copy).
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+	out := req.Clone(ctx)
+	out.Body, out.ContentLength = io.NopCloser(bytes.NewReader(body)), int64(len(body))
+	out.Header.Set("X-Mirrored", "1")
+
+	done := make(chan responseSummary, 1)
+	go func() {
+		defer func() {
+			cancel()
+			<-mirrorSlots
+		}()
+		start := time.Now()
+		mw := &mirrorWriter{header: http.Header{}, status: http.StatusOK, digest: sha256.New()}
+		r.mirrorProxy.ServeHTTP(mw, out)
+		done <- responseSummary{
+			status:      mw.status,
+			contentType: mw.header.Get("Content-Type"),
+			bytes:       mw.written,
+			sum:         mw.digest.Sum(nil),
+			duration:    time.Since(start),
+			err:         mw.err,
+		}
+	}()
+	return done
+}
+
+func (r *route) logMirror(req *http.Request, upstream string, primary responseSummary, shadow <-chan responseSummary) {
+	mirrored := <-shadow
+	if r.log == nil {
+		return
+	}
+	diff := []string{}
+	if primary.status != mirrored.status {
+		diff = append(diff, "status")
+	}
+	if primary.contentType != mirrored.contentType {
+		diff = append(diff, "content_type")
+	}
+	if primary.bytes != mirrored.bytes || !bytes.Equal(primary.sum, mirrored.sum) {
+		diff = append(diff, "body")
+	}
+	attrs := []any{
+		"method", req.Method,
+		"host", req.Host,
+		"path", req.URL.RequestURI(),
+		"upstream", upstream,
+		"mirror", r.mirror.String(),
+		"match", len(diff) == 0,
+		"diff", diff,
+		"status", primary.status,
+		"mirror_status", mirrored.status,
+		"bytes", primary.bytes,
+		"mirror_bytes", mirrored.bytes,
+		"duration_ms", primary.duration.Milliseconds(),
+		"mirror_duration_ms", mirrored.duration.Milliseconds(),
+	}
+	if mirrored.err != nil {
+		attrs = append(attrs, "mirror_error", mirrored.err.Error())
+	}
+	r.log.Info("mirror", attrs...)
+}
+
+// countingWriter records the status and body size of a response and,
+// if digest is set, hashes the body.
+type countingWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+	digest  hash.Hash
+}
+
+func (w *countingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	if w.digest != nil {
+		w.digest.Write(b[:n])
+	}
+	return n, err
+}
+
+// Unwrap lets http.ResponseController (which ReverseProxy uses to
+// flush streamed responses) reach the real writer.
+func (w *countingWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// mirrorWriter takes a mirrored response and keeps only its summary.
+type mirrorWriter struct {
+	header  http.Header
+	status  int
+	written int64
+	digest  hash.Hash
+	err     error
+}
+
+func (w *mirrorWriter) Header() http.Header { return w.header }
+
+func (w *mirrorWriter) WriteHeader(status int) { w.status = status }
+
+func (w *mirrorWriter) Write(b []byte) (int, error) {
+	w.written += int64(len(b))
+	w.digest.Write(b)
+	return len(b), nil
+}
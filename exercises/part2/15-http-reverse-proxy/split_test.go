@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// logBuffer collects JSON log lines from several goroutines.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// lines returns the decoded lines with the given message.
+func (b *logBuffer) lines(msg string) []map[string]any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		var m map[string]any
+		if json.Unmarshal([]byte(line), &m) == nil && m["msg"] == msg {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// startNamed runs a backend that answers with its name and records the
+// bodies and X-Mirrored headers it receives.
+func startNamed(t *testing.T, name string, got chan<- string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if got != nil {
+			got <- r.Header.Get("X-Mirrored") + " " + r.Method + " " + string(body)
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, name)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestCanarySplit(t *testing.T) {
+	stable, canary := startNamed(t, "stable", nil), startNamed(t, "canary", nil)
+	logs := &logBuffer{}
+	proxy := startRoutes(t, "route * /pinned "+stable.URL+"\n"+
+		"  canary "+canary.URL+" header X-Canary=yes\n"+
+		"route * /split "+stable.URL+"\n"+
+		"  canary "+canary.URL+" 50%\n",
+		&proxyOptions{forwarding: &forwarding{}, log: slog.New(slog.NewJSONHandler(logs, nil))})
+
+	call := func(path string, header ...string) string {
+		req, _ := http.NewRequest("GET", proxy.URL+path, nil)
+		if len(header) == 2 {
+			req.Header.Set(header[0], header[1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+	for i := 0; i < 20; i++ {
+		if got := call("/pinned"); got != "stable" {
+			t.Fatalf("request without the header went to %s", got)
+		}
+		if got := call("/pinned", "X-Canary", "no"); got != "stable" {
+			t.Fatalf("request with the wrong header value went to %s", got)
+		}
+		if got := call("/pinned", "X-Canary", "yes"); got != "canary" {
+			t.Fatalf("request with the header went to %s", got)
+		}
+	}
+
+	n := 0
+	for i := 0; i < 400; i++ {
+		if call("/split") == "canary" {
+			n++
+		}
+	}
+	if n < 140 || n > 260 {
+		t.Errorf("%d of 400 requests went to a 50%% canary", n)
+	}
+
+	access := logs.lines("access")
+	if len(access) != 60+400 {
+		t.Fatalf("%d access log lines, want %d", len(access), 60+400)
+	}
+	last := access[len(access)-1]
+	wantUpstream := stable.URL
+	if last["canary"] == true {
+		wantUpstream = canary.URL
+	}
+	if last["upstream"] != wantUpstream || last["status"] != 200.0 || last["path"] != "/split" {
+		t.Errorf("access log line %v", last)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	primaryGot, mirrorGot := make(chan string, 10), make(chan string, 10)
+	primary := startNamed(t, "v1", primaryGot)
+	same := startNamed(t, "v1", mirrorGot)
+	different := startNamed(t, "v2", mirrorGot)
+	logs := &logBuffer{}
+	proxy := startRoutes(t, "route * /same "+primary.URL+"\n"+
+		"  mirror "+same.URL+"\n"+
+		"route * /different "+primary.URL+"\n"+
+		"  mirror "+different.URL+" 100%\n",
+		&proxyOptions{forwarding: &forwarding{}, log: slog.New(slog.NewJSONHandler(logs, nil))})
+
+	for _, path := range []string{"/same", "/different"} {
+		resp, err := http.Post(proxy.URL+path, "text/plain", strings.NewReader("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "v1" {
+			t.Fatalf("%s: client got %q, want the primary's answer", path, body)
+		}
+		if got := <-primaryGot; got != " POST payload" {
+			t.Errorf("%s: primary got %q", path, got)
+		}
+		if got := <-mirrorGot; got != "1 POST payload" {
+			t.Errorf("%s: mirror got %q", path, got)
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(logs.lines("mirror")) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	results := map[string]map[string]any{}
+	for _, line := range logs.lines("mirror") {
+		results[line["path"].(string)] = line
+	}
+	if m := results["/same"]; m == nil || m["match"] != true {
+		t.Errorf("identical mirror logged as %v", m)
+	}
+	if m := results["/different"]; m == nil || m["match"] != false || len(m["diff"].([]any)) != 1 || m["diff"].([]any)[0] != "body" {
+		t.Errorf("different mirror logged as %v", m)
+	}
+}
+
+func TestMirrorUnreachable(t *testing.T) {
+	primary := startNamed(t, "v1", nil)
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+	logs := &logBuffer{}
+	proxy := startRoutes(t, "route * / "+primary.URL+"\n  mirror "+gone.URL+"\n",
+		&proxyOptions{forwarding: &forwarding{}, log: slog.New(slog.NewJSONHandler(logs, nil))})
+	resp, err := http.Get(proxy.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("client got %d when only the mirror was down", resp.StatusCode)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(logs.lines("mirror")) < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m := logs.lines("mirror"); len(m) != 1 || m[0]["mirror_status"] != 502.0 || m[0]["mirror_error"] == nil {
+		t.Errorf("mirror log %v", m)
+	}
+}
+
+func TestParseSplitErrors(t *testing.T) {
+	for _, config := range []string{
+		"mirror http://localhost:8081\nroute * / http://localhost:8080",
+		"route * / http://localhost:8080\n  canary http://localhost:8081",
+		"route * / http://localhost:8080\n  canary http://localhost:8081 150%",
+		"route * / http://localhost:8080\n  canary localhost:8081 5%",
+		"route * / http://localhost:8080\n  mirror http://localhost:8081 header X-A=b",
+		"redirect * / 301 /x\n  mirror http://localhost:8081",
+	} {
+		path := filepath.Join(t.TempDir(), "routes")
+		os.WriteFile(path, []byte(config), 0o644)
+		if _, err := parseRoutes(path, &proxyOptions{forwarding: &forwarding{}}); err == nil {
+			t.Errorf("%q parsed without error", config)
+		}
+	}
+}
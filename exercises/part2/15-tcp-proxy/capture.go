@@ -0,0 +1,177 @@
+package main
+
+// Traffic capture for tcp mode. With -record, every connection's bytes
+// are appended to a JSON Lines file as they are relayed, one event per
+// line:
+//
+//	{"conn":3,"time":"...","event":"open","client":"192.0.2.7:51234","server":"10.0.0.5:443"}
+//	{"conn":3,"time":"...","event":"data","from":"client","data":"R0VUIC8gSFRUUC8xLjENCg=="}
+//	{"conn":3,"time":"...","event":"data","from":"server","data":"..."}
+//	{"conn":3,"time":"...","event":"close","from":"client"}
+//	{"conn":3,"time":"...","event":"close","from":"server"}
+//
+// data is base64, as encoding/json writes []byte. Each side gets a
+// close event when it stops sending, so a client that half-closes and
+// then reads the reply shows up as such. 15-tcp-replay plays a
+// recorded client back against a server and diffs the responses. With
+// -pcap, the same traffic is also written as pcap-ng for Wireshark
+// (see pcapng.go).
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+type captureEvent struct {
+	Conn   uint64    `json:"conn"`
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Client string    `json:"client,omitempty"`
+	Server string    `json:"server,omitempty"`
+	From   string    `json:"from,omitempty"`
+	Data   []byte    `json:"data,omitempty"`
+}
+
+// recorder writes the capture files shared by every connection.
+type recorder struct {
+	mu     sync.Mutex
+	events *json.Encoder // nil without -record
+	pcap   *pcapWriter   // nil without -pcap
+	files  []*os.File
+	nextID uint64
+}
+
+func newRecorder(recordPath, pcapPath string) (*recorder, error) {
+	rec := &recorder{}
+	open := func(path string) (*os.File, error) {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+		if err == nil {
+			rec.files = append(rec.files, f)
+		}
+		return f, err
+	}
+	if recordPath != "" {
+		f, err := open(recordPath)
+		if err != nil {
+			rec.Close()
+			return nil, err
+		}
+		rec.events = json.NewEncoder(f)
+	}
+	if pcapPath != "" {
+		f, err := open(pcapPath)
+		if err != nil {
+			rec.Close()
+			return nil, err
+		}
+		if rec.pcap, err = newPcapWriter(f); err != nil {
+			rec.Close()
+			return nil, err
+		}
+	}
+	return rec, nil
+}
+
+func (rec *recorder) Close() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	var errs []error
+	for _, f := range rec.files {
+		errs = append(errs, f.Close())
+	}
+	rec.files, rec.events, rec.pcap = nil, nil, nil
+	return errors.Join(errs...)
+}
+
+// session is one recorded connection.
+type session struct {
+	rec                  *recorder
+	id                   uint64
+	flow                 *pcapFlow
+	clientEnd, serverEnd sync.Once
+}
+
+// open starts recording a connection between client and the upstream
+// it was relayed to.
+func (rec *recorder) open(client, upstream net.Conn) *session {
+	rec.mu.Lock()
+	rec.nextID++
+	s := &session{rec: rec, id: rec.nextID}
+	rec.mu.Unlock()
+	if rec.pcap != nil {
+		s.flow = newPcapFlow(client.RemoteAddr(), upstream.RemoteAddr())
+	}
+	s.write(captureEvent{Event: "open", Client: client.RemoteAddr().String(), Server: upstream.RemoteAddr().String()})
+	return s
+}
+
+func (s *session) write(e captureEvent) {
+	s.rec.mu.Lock()
+	defer s.rec.mu.Unlock()
+	e.Conn, e.Time = s.id, time.Now() // under the lock, so times only go forward
+	if s.rec.events != nil {
+		s.rec.events.Encode(e)
+	}
+	if s.rec.pcap != nil && s.flow != nil {
+		fromClient := e.From == "client"
+		switch e.Event {
+		case "open":
+			s.rec.pcap.handshake(s.flow, e.Time)
+		case "data":
+			s.rec.pcap.data(s.flow, fromClient, e.Data, e.Time)
+		case "close":
+			s.rec.pcap.close(s.flow, fromClient, e.Time)
+		}
+	}
+}
+
+func (s *session) data(from string, p []byte) {
+	s.write(captureEvent{Event: "data", From: from, Data: p})
+}
+
+// end records that from has stopped sending; repeats are ignored.
+func (s *session) end(from string) {
+	once := &s.clientEnd
+	if from == "server" {
+		once = &s.serverEnd
+	}
+	once.Do(func() { s.write(captureEvent{Event: "close", From: from}) })
+}
+
+// wrap returns conn with everything read from it recorded as sent by
+// from ("client" or "server").
+func (s *session) wrap(conn net.Conn, from string) net.Conn {
+	return &recordingConn{Conn: conn, s: s, from: from}
+}
+
+type recordingConn struct {
+	net.Conn
+	s    *session
+	from string
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.s.data(c.from, p[:n]) // written out before p can be reused
+	}
+	// A deadline passing isn't the end: with an idle timeout, copyHalf
+	// sets one per read and retries while the other direction is busy.
+	if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		c.s.end(c.from)
+	}
+	return n, err
+}
+
+// CloseWrite passes a half-close through to the connection, if it
+// supports one.
+func (c *recordingConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
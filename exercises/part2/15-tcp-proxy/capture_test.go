@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordAndPcap(t *testing.T) {
+	dir := t.TempDir()
+	rec, err := newRecorder(filepath.Join(dir, "rec.jsonl"), filepath.Join(dir, "rec.pcapng"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := startEcho(t, "127.0.0.1:0")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	closed := make(chan struct{})
+	go acceptLoop(context.Background(), ln, func(ctx context.Context, conn net.Conn) {
+		proxyConn(ctx, conn, echo.String(), &tcpOptions{recorder: rec})
+		close(closed)
+	})
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(client, "hello")
+	if _, err := io.ReadFull(client, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("proxy didn't finish")
+	}
+	rec.Close()
+
+	f, err := os.Open(filepath.Join(dir, "rec.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []string
+	for dec := json.NewDecoder(f); dec.More(); {
+		var e captureEvent
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Conn != 1 || e.Time.IsZero() {
+			t.Fatalf("event %+v", e)
+		}
+		got = append(got, e.Event+" "+e.From+" "+string(e.Data))
+	}
+	want := []string{"open  ", "data client hello", "data server hello", "close client ", "close server "}
+	if len(got) != len(want) {
+		t.Fatalf("events %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("events %q, want %q", got, want)
+		}
+	}
+
+	// The pcap-ng file: section header, interface, then one packet per
+	// handshake step, data segment and FIN/ACK, with valid checksums.
+	b, err := os.ReadFile(filepath.Join(dir, "rec.pcapng"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []uint32
+	var payload []byte
+	for len(b) >= 12 {
+		typ, length := binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint32(b[4:])
+		if length < 12 || int(length) > len(b) || binary.LittleEndian.Uint32(b[length-4:]) != length {
+			t.Fatalf("bad block length %d", length)
+		}
+		types = append(types, typ)
+		if typ == 6 {
+			pkt := b[28 : 28+binary.LittleEndian.Uint32(b[20:])]
+			if checksum(pkt[:20], 0) != 0 {
+				t.Fatal("bad IPv4 header checksum")
+			}
+			pseudo := append(append([]byte{}, pkt[12:20]...), 0, 6, 0, byte(len(pkt)-20))
+			if checksum(pkt[20:], sum(pseudo)) != 0 {
+				t.Fatal("bad TCP checksum")
+			}
+			payload = append(payload, pkt[40:]...)
+		}
+		b = b[length:]
+	}
+	if len(b) != 0 || len(types) != 2+3+2+3 || types[0] != 0x0A0D0D0A || types[1] != 1 {
+		t.Fatalf("blocks %x, %d bytes left over", types, len(b))
+	}
+	if string(payload) != "hellohello" {
+		t.Fatalf("packet payloads %q", payload)
+	}
+}
+
+// TestRecordIdleGap relays with an idle timeout while the server stays
+// quiet for longer than it: the server side's read deadline passes and
+// is retried, which mustn't be recorded as the server closing.
+func TestRecordIdleGap(t *testing.T) {
+	dir := t.TempDir()
+	rec, err := newRecorder(filepath.Join(dir, "rec.jsonl"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The server reads until the client half-closes, then answers.
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+		io.WriteString(conn, "done")
+	}()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	closed := make(chan struct{})
+	opts := &tcpOptions{recorder: rec, timeouts: relayTimeouts{idle: 200 * time.Millisecond}}
+	go acceptLoop(context.Background(), ln, func(ctx context.Context, conn net.Conn) {
+		proxyConn(ctx, conn, server.Addr().String(), opts)
+		close(closed)
+	})
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for i := 0; i < 6; i++ {
+		io.WriteString(client, "a")
+		time.Sleep(100 * time.Millisecond)
+	}
+	client.(*net.TCPConn).CloseWrite()
+	reply, err := io.ReadAll(client)
+	if err != nil || string(reply) != "done" {
+		t.Fatalf("reply %q, %v", reply, err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("proxy didn't finish")
+	}
+	rec.Close()
+
+	f, err := os.Open(filepath.Join(dir, "rec.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []string
+	for dec := json.NewDecoder(f); dec.More(); {
+		var e captureEvent
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		line := e.Event + " " + e.From
+		if n := len(got); e.Event == "data" && n > 0 && got[n-1] == line {
+			continue // the client's writes may arrive in any number of reads
+		}
+		got = append(got, line)
+	}
+	want := []string{"open ", "data client", "close client", "data server", "close server"}
+	if len(got) != len(want) {
+		t.Fatalf("events %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("events %q, want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+// Chaos mode: a fault-injection proxy in the spirit of Toxiproxy, for
+// seeing how clients cope with bad networks. Each named proxy listens
+// on one address and forwards to one upstream; toxics (see toxics.go)
+// attached to a proxy degrade the connections through it. Proxies and
+// toxics are managed at runtime through a JSON API:
+//
+//	GET    /proxies                          list proxies and their toxics
+//	POST   /proxies                          create {name, listen, upstream}
+//	GET    /proxies/{name}
+//	POST   /proxies/{name}                   update {upstream, enabled}
+//	DELETE /proxies/{name}
+//	GET    /proxies/{name}/toxics
+//	POST   /proxies/{name}/toxics            add {name, type, stream, toxicity, attributes}
+//	GET    /proxies/{name}/toxics/{toxic}
+//	POST   /proxies/{name}/toxics/{toxic}    update {toxicity, attributes}
+//	DELETE /proxies/{name}/toxics/{toxic}
+//	POST   /reset                            remove all toxics, enable all proxies
+//
+// For example:
+//
+//	curl -d '{"name":"slow","type":"latency","stream":"downstream","attributes":{"latency":300,"jitter":50}}' \
+//	    localhost:8474/proxies/main/toxics
+//
+// A disabled proxy stops listening and drops its connections, as if
+// the service were down.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type chaosServer struct {
+	mu      sync.Mutex
+	proxies map[string]*chaosProxy
+}
+
+func newChaosServer() *chaosServer {
+	return &chaosServer{proxies: make(map[string]*chaosProxy)}
+}
+
+type chaosProxy struct {
+	name string
+
+	mu       sync.Mutex
+	listen   string // the bound address, so ":0" can be re-enabled on the same port
+	upstream string
+	ln       net.Listener // nil while disabled
+	toxics   []*toxic     // replaced, never modified, so connections can share a snapshot
+	conns    map[*chaosConn]struct{}
+}
+
+// proxyView is a proxy as the API shows it.
+type proxyView struct {
+	Name     string   `json:"name"`
+	Listen   string   `json:"listen"`
+	Upstream string   `json:"upstream"`
+	Enabled  bool     `json:"enabled"`
+	Toxics   []*toxic `json:"toxics"`
+}
+
+func (p *chaosProxy) view() proxyView {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return proxyView{Name: p.name, Listen: p.listen, Upstream: p.upstream, Enabled: p.ln != nil, Toxics: append([]*toxic{}, p.toxics...)}
+}
+
+// add starts a proxy on an already-open listener.
+func (s *chaosServer) add(name string, ln net.Listener, upstream string) (*chaosProxy, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.proxies[name]; ok {
+		return nil, fmt.Errorf("proxy %q already exists", name)
+	}
+	p := &chaosProxy{name: name, listen: ln.Addr().String(), upstream: upstream, ln: ln, conns: make(map[*chaosConn]struct{})}
+	s.proxies[name] = p
+	go p.serve(ln)
+	return p, nil
+}
+
+func (s *chaosServer) get(name string) *chaosProxy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.proxies[name]
+}
+
+// shutdown stops every proxy.
+func (s *chaosServer) shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.proxies {
+		p.disable()
+	}
+}
+
+// serve accepts connections on ln until disable closes it.
+func (p *chaosProxy) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go p.handle(conn)
+	}
+}
+
+// enable listens again after disable. The lock is held throughout so
+// two API calls at once can't both bind the address.
+func (p *chaosProxy) enable() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ln != nil {
+		return nil
+	}
+	ln, err := net.Listen("tcp", p.listen)
+	if err != nil {
+		return err
+	}
+	p.ln = ln
+	go p.serve(ln)
+	return nil
+}
+
+// disable stops listening and drops every open connection.
+func (p *chaosProxy) disable() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ln != nil {
+		p.ln.Close()
+		p.ln = nil
+	}
+	for c := range p.conns {
+		c.close()
+	}
+}
+
+func (p *chaosProxy) handle(client net.Conn) {
+	p.mu.Lock()
+	upstreamAddr := p.upstream
+	p.mu.Unlock()
+	upstream, err := net.DialTimeout("tcp", upstreamAddr, 10*time.Second)
+	if err != nil {
+		fmt.Println("chaos:", p.name, "failed to reach upstream:", err)
+		client.Close()
+		return
+	}
+	c := &chaosConn{
+		proxy: p, client: client, upstream: upstream, start: time.Now(),
+		done: make(chan struct{}), rolled: make(map[*toxic]bool),
+	}
+	p.mu.Lock()
+	if p.ln == nil {
+		// Disabled while dialing.
+		p.mu.Unlock()
+		c.close()
+		return
+	}
+	p.conns[c] = struct{}{}
+	p.mu.Unlock()
+
+	c.run()
+
+	p.mu.Lock()
+	delete(p.conns, c)
+	p.mu.Unlock()
+}
+
+// toxicsFor returns the current toxics on one stream, or on both if
+// stream is "".
+func (p *chaosProxy) toxicsFor(stream string) []*toxic {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if stream == "" {
+		return p.toxics
+	}
+	var out []*toxic
+	for _, t := range p.toxics {
+		if t.Stream == stream {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// setToxic adds t, or replaces the toxic of the same name if replace
+// is set.
+func (p *chaosProxy) setToxic(t *toxic, replace bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	toxics := make([]*toxic, 0, len(p.toxics)+1)
+	found := false
+	for _, old := range p.toxics {
+		if old.Name == t.Name {
+			found = true
+			old = t
+		}
+		toxics = append(toxics, old)
+	}
+	switch {
+	case found && !replace:
+		return fmt.Errorf("toxic %q already exists", t.Name)
+	case !found && replace:
+		return errNotFound
+	case !found:
+		toxics = append(toxics, t)
+	}
+	p.toxics = toxics
+	return nil
+}
+
+func (p *chaosProxy) findToxic(name string) *toxic {
+	for _, t := range p.toxicsFor("") {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+func (p *chaosProxy) removeToxic(name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, t := range p.toxics {
+		if t.Name == name {
+			p.toxics = append(p.toxics[:i:i], p.toxics[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+var errNotFound = errors.New("not found")
+
+func (s *chaosServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "reset" && r.Method == http.MethodPost:
+		s.reset()
+		w.WriteHeader(http.StatusNoContent)
+	case parts[0] != "proxies":
+		writeJSONError(w, http.StatusNotFound, errNotFound)
+	case len(parts) == 1:
+		s.serveProxies(w, r)
+	default:
+		p := s.get(parts[1])
+		if p == nil {
+			writeJSONError(w, http.StatusNotFound, fmt.Errorf("no proxy %q", parts[1]))
+			return
+		}
+		switch {
+		case len(parts) == 2:
+			s.serveProxy(w, r, p)
+		case len(parts) == 3 && parts[2] == "toxics":
+			serveToxics(w, r, p)
+		case len(parts) == 4 && parts[2] == "toxics":
+			serveToxic(w, r, p, parts[3])
+		default:
+			writeJSONError(w, http.StatusNotFound, errNotFound)
+		}
+	}
+}
+
+func (s *chaosServer) serveProxies(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.mu.Lock()
+		views := make(map[string]proxyView, len(s.proxies))
+		for name, p := range s.proxies {
+			views[name] = p.view()
+		}
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, views)
+	case http.MethodPost:
+		var req struct {
+			Name     string `json:"name"`
+			Listen   string `json:"listen"`
+			Upstream string `json:"upstream"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" || req.Listen == "" || req.Upstream == "" {
+			writeJSONError(w, http.StatusBadRequest, errors.New("need name, listen and upstream"))
+			return
+		}
+		ln, err := net.Listen("tcp", req.Listen)
+		if err != nil {
+			writeJSONError(w, http.StatusConflict, err)
+			return
+		}
+		p, err := s.add(req.Name, ln, req.Upstream)
+		if err != nil {
+			ln.Close()
+			writeJSONError(w, http.StatusConflict, err)
+			return
+		}
+		fmt.Println("chaos:", p.name, "listening on", p.listen, "forwarding to", req.Upstream)
+		writeJSON(w, http.StatusCreated, p.view())
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New(r.Method+" not allowed"))
+	}
+}
+
+func (s *chaosServer) serveProxy(w http.ResponseWriter, r *http.Request, p *chaosProxy) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, p.view())
+	case http.MethodPost:
+		var req struct {
+			Upstream string `json:"upstream"`
+			Enabled  *bool  `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		if req.Upstream != "" {
+			// Only new connections go to the new upstream.
+			p.mu.Lock()
+			p.upstream = req.Upstream
+			p.mu.Unlock()
+		}
+		if req.Enabled != nil && *req.Enabled {
+			if err := p.enable(); err != nil {
+				writeJSONError(w, http.StatusConflict, err)
+				return
+			}
+		} else if req.Enabled != nil {
+			p.disable()
+		}
+		writeJSON(w, http.StatusOK, p.view())
+	case http.MethodDelete:
+		s.mu.Lock()
+		delete(s.proxies, p.name)
+		s.mu.Unlock()
+		p.disable()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New(r.Method+" not allowed"))
+	}
+}
+
+func serveToxics(w http.ResponseWriter, r *http.Request, p *chaosProxy) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, append([]*toxic{}, p.toxicsFor("")...))
+	case http.MethodPost:
+		t := &toxic{Toxicity: 1}
+		if err := json.NewDecoder(r.Body).Decode(t); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := t.validate(); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		t.added = time.Now()
+		if err := p.setToxic(t, false); err != nil {
+			writeJSONError(w, http.StatusConflict, err)
+			return
+		}
+		fmt.Printf("chaos: %s: added %s toxic %q on %s\n", p.name, t.Type, t.Name, t.Stream)
+		writeJSON(w, http.StatusCreated, t)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New(r.Method+" not allowed"))
+	}
+}
+
+func serveToxic(w http.ResponseWriter, r *http.Request, p *chaosProxy, name string) {
+	old := p.findToxic(name)
+	if old == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no toxic %q on %s", name, p.name))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, old)
+	case http.MethodPost:
+		// Decode over a copy, so fields the update leaves out keep
+		// their values; name, type and stream can't change.
+		t := *old
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		t.Name, t.Type, t.Stream = old.Name, old.Type, old.Stream
+		if err := t.validate(); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := p.setToxic(&t, true); err != nil {
+			writeJSONError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, &t)
+	case http.MethodDelete:
+		p.removeToxic(name)
+		fmt.Printf("chaos: %s: removed toxic %q\n", p.name, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New(r.Method+" not allowed"))
+	}
+}
+
+// reset returns every proxy to a healthy state.
+func (s *chaosServer) reset() {
+	s.mu.Lock()
+	proxies := make([]*chaosProxy, 0, len(s.proxies))
+	for _, p := range s.proxies {
+		proxies = append(proxies, p)
+	}
+	s.mu.Unlock()
+	for _, p := range proxies {
+		p.mu.Lock()
+		p.toxics = nil
+		p.mu.Unlock()
+		if err := p.enable(); err != nil {
+			fmt.Println("chaos:", p.name, "can't re-enable:", err)
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
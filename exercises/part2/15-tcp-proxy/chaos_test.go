@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startChaos runs a chaos server with one proxy, "echo", in front of
+// an echo server, returning the API's URL and the proxy's address.
+func startChaos(t *testing.T) (string, string) {
+	t.Helper()
+	echo := startEcho(t, "127.0.0.1:0")
+	chaos := newChaosServer()
+	t.Cleanup(chaos.shutdown)
+	api := httptest.NewServer(chaos)
+	t.Cleanup(api.Close)
+	var p proxyView
+	if status := callAPI(t, api.URL, "POST", "/proxies", `{"name":"echo","listen":"127.0.0.1:0","upstream":"`+echo.String()+`"}`, &p); status != http.StatusCreated {
+		t.Fatalf("create proxy: %d", status)
+	}
+	return api.URL, p.Listen
+}
+
+func callAPI(t *testing.T, base, method, path, body string, out any) int {
+	t.Helper()
+	req, _ := http.NewRequest(method, base+path, strings.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode
+}
+
+func addToxic(t *testing.T, api, body string) {
+	t.Helper()
+	if status := callAPI(t, api, "POST", "/proxies/echo/toxics", body, nil); status != http.StatusCreated {
+		t.Fatalf("add toxic %s: %d", body, status)
+	}
+}
+
+// roundTrip sends msg through conn and times how long the echo takes.
+func roundTrip(t *testing.T, conn net.Conn, msg []byte) time.Duration {
+	t.Helper()
+	start := time.Now()
+	go conn.Write(msg)
+	got := make([]byte, len(msg))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("echo corrupted")
+	}
+	return time.Since(start)
+}
+
+func TestChaosLatencyBandwidthAndSlicer(t *testing.T) {
+	api, proxy := startChaos(t)
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, []byte("ping"))
+
+	// Toxics added at runtime reach connections that are already open.
+	addToxic(t, api, `{"name":"lag","type":"latency","stream":"downstream","attributes":{"latency":150,"jitter":20}}`)
+	if d := roundTrip(t, conn, []byte("ping")); d < 130*time.Millisecond {
+		t.Fatalf("round trip with 150±20ms latency took %v", d)
+	}
+	if status := callAPI(t, api, "DELETE", "/proxies/echo/toxics/lag", "", nil); status != http.StatusNoContent {
+		t.Fatalf("delete toxic: %d", status)
+	}
+
+	addToxic(t, api, `{"name":"thin","type":"bandwidth","stream":"upstream","attributes":{"rate":100}}`)
+	if d := roundTrip(t, conn, make([]byte, 30*1024)); d < 250*time.Millisecond {
+		t.Fatalf("30KB at 100KB/s took %v", d)
+	}
+	callAPI(t, api, "DELETE", "/proxies/echo/toxics/thin", "", nil)
+
+	// 100 bytes in pieces of at most 15 is at least 7 pieces, so at
+	// least 6 gaps of 20ms. (Counting reads would be flaky: pieces can
+	// coalesce in the socket buffer if the reader is slow.)
+	addToxic(t, api, `{"name":"bits","type":"slicer","stream":"downstream","attributes":{"average_size":10,"size_variation":5,"delay":20000}}`)
+	if d := roundTrip(t, conn, make([]byte, 100)); d < 120*time.Millisecond {
+		t.Fatalf("100 bytes through a 10±5 byte, 20ms slicer took %v", d)
+	}
+}
+
+func TestChaosBlackholeAndReset(t *testing.T) {
+	api, proxy := startChaos(t)
+
+	addToxic(t, api, `{"name":"hole","type":"timeout","stream":"upstream"}`)
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("anyone there?"))
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	var netErr net.Error
+	if _, err := conn.Read(make([]byte, 1)); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("black-holed read: %v, want a timeout", err)
+	}
+
+	// Updating the toxic gives it a timeout, which closes the connection.
+	if status := callAPI(t, api, "POST", "/proxies/echo/toxics/hole", `{"attributes":{"timeout":50}}`, nil); status != http.StatusOK {
+		t.Fatalf("update toxic: %d", status)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read after timeout: %v, want EOF", err)
+	}
+
+	callAPI(t, api, "POST", "/reset", "", nil)
+	addToxic(t, api, `{"name":"rst","type":"reset_peer","stream":"downstream","attributes":{"timeout":50}}`)
+	conn, err = net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("read after reset_peer: %v, want ECONNRESET", err)
+	}
+}
+
+func TestChaosDisableAndToxicity(t *testing.T) {
+	api, proxy := startChaos(t)
+
+	callAPI(t, api, "POST", "/proxies/echo", `{"enabled":false}`, nil)
+	if conn, err := net.Dial("tcp", proxy); err == nil {
+		conn.Close()
+		t.Fatal("disabled proxy accepted a connection")
+	}
+	var p proxyView
+	callAPI(t, api, "POST", "/proxies/echo", `{"enabled":true}`, &p)
+	if !p.Enabled || p.Listen != proxy {
+		t.Fatalf("re-enabled proxy: %+v", p)
+	}
+
+	// toxicity 0 never applies.
+	addToxic(t, api, `{"name":"hole","type":"timeout","stream":"upstream","toxicity":0}`)
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, []byte("still here"))
+
+	for _, bad := range []string{
+		`{"name":"x","type":"latency","stream":"sideways"}`,
+		`{"name":"x","type":"warp","stream":"upstream"}`,
+		`{"name":"x","type":"bandwidth","stream":"upstream"}`,
+		`{"name":"hole","type":"latency","stream":"upstream"}`,
+	} {
+		if status := callAPI(t, api, "POST", "/proxies/echo/toxics", bad, nil); status < 400 {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+}
+
+// Enabling a disabled proxy from several API calls at once binds its
+// address once; the others find it already enabled.
+func TestChaosConcurrentEnable(t *testing.T) {
+	echo := startEcho(t, "127.0.0.1:0")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chaos := newChaosServer()
+	defer chaos.shutdown()
+	p, err := chaos.add("echo", ln, echo.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for round := 0; round < 20; round++ {
+		p.disable()
+		start := make(chan struct{})
+		errs := make(chan error, 16)
+		for i := 0; i < cap(errs); i++ {
+			go func() {
+				<-start
+				errs <- p.enable()
+			}()
+		}
+		close(start)
+		for i := 0; i < cap(errs); i++ {
+			if err := <-errs; err != nil {
+				t.Fatalf("round %d: %v", round, err)
+			}
+		}
+	}
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, []byte("still here"))
+}
@@ -0,0 +1,296 @@
+package main
+
+// An HTTP forward proxy. Clients pointed at it (curl -x, HTTP_PROXY,
+// HTTPS_PROXY) send two kinds of request:
+//
+//	GET http://example.com/page HTTP/1.1   plain HTTP in absolute form:
+//	                                       the proxy makes the request itself
+//	CONNECT example.com:443 HTTP/1.1       a tunnel, for HTTPS or anything
+//	                                       else: the proxy relays raw bytes
+//
+// Both may carry "Proxy-Authorization: Basic ..." credentials, both are
+// checked against the same destination rules as SOCKS5 mode, and both
+// count toward the client's concurrent connection limit.
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type httpProxy struct {
+	users    map[string]string // nil: no authentication
+	rules    ruleSet           // nil: every destination allowed
+	limit    *connLimiter
+	log      *slog.Logger
+	forward  *httputil.ReverseProxy
+	timeouts relayTimeouts // for CONNECT tunnels
+}
+
+// accessEntry collects what the access log reports about one request.
+type accessEntry struct {
+	user     string
+	status   int
+	sent     int64 // bytes from the client to the destination
+	received int64 // bytes from the destination to the client
+	err      error
+}
+
+type accessEntryKey struct{}
+
+func newHTTPProxy(users map[string]string, rules ruleSet, maxPerUser int, log *slog.Logger) *httpProxy {
+	p := &httpProxy{users: users, rules: rules, limit: newConnLimiter(maxPerUser), log: log}
+	p.forward = &httputil.ReverseProxy{
+		// The outgoing request is already a copy of the incoming one,
+		// absolute URL included, minus the hop-by-hop headers
+		// (Proxy-Authorization among them) ReverseProxy strips.
+		Rewrite: func(*httputil.ProxyRequest) {},
+		Transport: &http.Transport{
+			// Proxy is left nil: this proxy mustn't itself honour
+			// HTTP_PROXY and forward to yet another proxy.
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				host, port, err := splitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				return p.rules.dial(ctx, host, port)
+			},
+			ResponseHeaderTimeout: 30 * time.Second,
+			IdleConnTimeout:       90 * time.Second,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if e, ok := r.Context().Value(accessEntryKey{}).(*accessEntry); ok {
+				e.err = err
+			}
+			w.WriteHeader(dialStatus(err))
+		},
+	}
+	return p
+}
+
+func (p *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	e := &accessEntry{}
+	defer func() { p.logAccess(r, e, start) }()
+	fail := func(status int, msg string) {
+		e.status = status
+		http.Error(w, msg, status)
+	}
+
+	user, ok := p.authenticate(r)
+	if !ok {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+		fail(http.StatusProxyAuthRequired, "proxy authentication required")
+		return
+	}
+	e.user = user
+	// Without authentication, each client address counts as a user.
+	key := user
+	if p.users == nil {
+		key, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+	if !p.limit.acquire(key) {
+		fail(http.StatusTooManyRequests, "too many connections")
+		return
+	}
+	defer p.limit.release(key)
+
+	if r.Method == http.MethodConnect {
+		p.tunnel(w, r, e)
+		return
+	}
+	if r.URL.Scheme != "http" || r.URL.Host == "" {
+		fail(http.StatusBadRequest, "this is a proxy: send an absolute http:// URL, or CONNECT")
+		return
+	}
+	if r.Body != nil {
+		r.Body = &countingBody{ReadCloser: r.Body, n: &e.sent}
+	}
+	rec := &countingWriter{ResponseWriter: w, status: http.StatusOK}
+	p.forward.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), accessEntryKey{}, e)))
+	e.status, e.received = rec.status, rec.written
+}
+
+// tunnel handles CONNECT: dial the destination, then take over the
+// client's connection and relay bytes both ways.
+func (p *httpProxy) tunnel(w http.ResponseWriter, r *http.Request, e *accessEntry) {
+	host, port, err := splitHostPort(r.Host)
+	if err != nil {
+		e.status = http.StatusBadRequest
+		http.Error(w, "CONNECT needs host:port", e.status)
+		return
+	}
+	upstream, err := p.rules.dial(r.Context(), host, port)
+	if err != nil {
+		e.status, e.err = dialStatus(err), err
+		http.Error(w, http.StatusText(e.status), e.status)
+		return
+	}
+	defer upstream.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		e.status = http.StatusInternalServerError
+		http.Error(w, "hijacking not supported", e.status)
+		return
+	}
+	client, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		e.status, e.err = http.StatusInternalServerError, err
+		http.Error(w, err.Error(), e.status)
+		return
+	}
+	defer client.Close()
+	e.status = http.StatusOK
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		e.err = err
+		return
+	}
+	// Bytes the server buffered past the request headers belong to
+	// the tunnel; see the chapter's DeepDive on bufrw.
+	var early int64
+	if n := bufrw.Reader.Buffered(); n > 0 {
+		buffered, _ := bufrw.Reader.Peek(n)
+		upstream.Write(buffered)
+		early = int64(n)
+	}
+	sent, received := relay(client, upstream, p.timeouts)
+	e.sent, e.received = early+sent, received
+}
+
+// authenticate checks Proxy-Authorization, returning the user.
+func (p *httpProxy) authenticate(r *http.Request) (string, bool) {
+	if p.users == nil {
+		return "", true
+	}
+	scheme, encoded, ok := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	user, pass, ok := strings.Cut(string(decoded), ":")
+	if !ok || !checkPassword(p.users, user, pass) {
+		return "", false
+	}
+	return user, true
+}
+
+func (p *httpProxy) logAccess(r *http.Request, e *accessEntry, start time.Time) {
+	target := r.Host
+	if r.Method != http.MethodConnect {
+		target = r.URL.String()
+	}
+	attrs := []any{
+		"client", r.RemoteAddr,
+		"user", e.user,
+		"method", r.Method,
+		"target", target,
+		"status", e.status,
+		"sent", e.sent,
+		"received", e.received,
+		"duration_ms", time.Since(start).Milliseconds(),
+	}
+	if e.err != nil {
+		attrs = append(attrs, "error", e.err.Error())
+	}
+	p.log.Info("access", attrs...)
+}
+
+// dialStatus maps a failure to reach the destination to a status code.
+func dialStatus(err error) int {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errDenied):
+		return http.StatusForbidden
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func splitHostPort(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return "", 0, errors.New("bad port in " + addr)
+	}
+	return host, port, nil
+}
+
+// connLimiter caps concurrent connections per key; a max of 0 means
+// no cap.
+type connLimiter struct {
+	max    int
+	mu     sync.Mutex
+	active map[string]int
+}
+
+func newConnLimiter(max int) *connLimiter {
+	return &connLimiter{max: max, active: make(map[string]int)}
+}
+
+func (l *connLimiter) acquire(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && l.active[key] >= l.max {
+		return false
+	}
+	l.active[key]++
+	return true
+}
+
+func (l *connLimiter) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[key]--; l.active[key] <= 0 {
+		delete(l.active, key)
+	}
+}
+
+// countingWriter records the status and body size of a response.
+type countingWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *countingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController (which ReverseProxy uses to
+// flush streamed responses) reach the real writer.
+func (w *countingWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+type countingBody struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	*b.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe to log to from several handlers.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) entries(t *testing.T) []map[string]any {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []map[string]any
+	dec := json.NewDecoder(bytes.NewReader(b.buf.Bytes()))
+	for dec.More() {
+		var e map[string]any
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+func startHTTPProxy(t *testing.T, rules []string, maxPerUser int) (string, *syncBuffer) {
+	t.Helper()
+	var rs ruleSet
+	for _, line := range rules {
+		r, err := parseRule(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs = append(rs, r)
+	}
+	logs := &syncBuffer{}
+	p := newHTTPProxy(map[string]string{"dev": "s3cret"}, rs, maxPerUser, slog.New(slog.NewJSONHandler(logs, nil)))
+	srv := httptest.NewServer(p)
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String(), logs
+}
+
+func proxyClient(proxy, user, pass string) *http.Client {
+	u := &url.URL{Scheme: "http", Host: proxy, User: url.UserPassword(user, pass)}
+	transport := &http.Transport{Proxy: http.ProxyURL(u)}
+	return &http.Client{Transport: transport, Timeout: 5 * time.Second}
+}
+
+func TestHTTPProxyForwardsAndTunnels(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Error("Proxy-Authorization leaked to the destination")
+		}
+		io.WriteString(w, "plain")
+	}))
+	defer backend.Close()
+	tlsBackend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "tunnelled")
+	}))
+	defer tlsBackend.Close()
+
+	proxy, logs := startHTTPProxy(t, nil, 0)
+	client := proxyClient(proxy, "dev", "s3cret")
+
+	resp, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "plain" {
+		t.Fatalf("absolute-URI request: %q", body)
+	}
+
+	// HTTPS goes through CONNECT; the proxy never sees inside.
+	client.Transport.(*http.Transport).TLSClientConfig = tlsBackend.Client().Transport.(*http.Transport).TLSClientConfig
+	resp, err = client.Get(tlsBackend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "tunnelled" {
+		t.Fatalf("CONNECT tunnel: %q", body)
+	}
+	client.CloseIdleConnections() // ends the tunnel, so it gets logged
+
+	resp, err = proxyClient(proxy, "dev", "wrong").Get(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired || resp.Header.Get("Proxy-Authenticate") == "" {
+		t.Fatalf("bad credentials: %s", resp.Status)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(logs.entries(t)) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	entries := logs.entries(t)
+	if len(entries) < 3 {
+		t.Fatalf("%d access log entries, want 3", len(entries))
+	}
+	byMethod := map[string]map[string]any{}
+	for _, e := range entries {
+		byMethod[e["method"].(string)+" "+e["user"].(string)] = e
+	}
+	if e := byMethod["CONNECT dev"]; e == nil || e["status"] != 200.0 || e["received"].(float64) == 0 {
+		t.Fatalf("CONNECT log entry: %v", e)
+	}
+	if e := byMethod["GET "]; e == nil || e["status"] != 407.0 {
+		t.Fatalf("rejected request log entry: %v", e)
+	}
+}
+
+func TestHTTPProxyRulesAndLimits(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	proxy, _ := startHTTPProxy(t, []string{"allow 127.0.0.1:" + port, "deny *"}, 1)
+
+	resp, err := proxyClient(proxy, "dev", "s3cret").Get("http://127.0.0.1:1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("denied destination: %s", resp.Status)
+	}
+
+	// Hold one tunnel open; the user's second connection is refused.
+	tunnel := connectRaw(t, proxy, backend.Listener.Addr().String())
+	if status := tunnel.status; status != http.StatusOK {
+		t.Fatalf("first tunnel: %d", status)
+	}
+	if status := connectRaw(t, proxy, backend.Listener.Addr().String()).status; status != http.StatusTooManyRequests {
+		t.Fatalf("second tunnel: %d, want 429", status)
+	}
+	tunnel.conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for connectRaw(t, proxy, backend.Listener.Addr().String()).status != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("limit not released after the tunnel closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type rawTunnel struct {
+	conn   net.Conn
+	status int
+}
+
+// connectRaw sends a CONNECT by hand and leaves the connection open.
+func connectRaw(t *testing.T, proxy, target string) rawTunnel {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	req, _ := http.NewRequest(http.MethodConnect, "http://"+target, nil)
+	req.Host = target
+	req.SetBasicAuth("dev", "s3cret")
+	req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+	req.Header.Del("Authorization")
+	req.Write(conn)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rawTunnel{conn: conn, status: resp.StatusCode}
+}
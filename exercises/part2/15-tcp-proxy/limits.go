@@ -0,0 +1,167 @@
+package main
+
+// Connection caps and draining. Every listener is wrapped so the proxy
+// knows which client connections are open:
+//
+//   - -max-conns caps them in total. At the cap, Accept waits for a
+//     connection to close, leaving new clients queued in the kernel's
+//     backlog rather than turning them away.
+//   - -max-conns-per-source caps them per client IP, so one client
+//     can't use up the total. A client over its cap is disconnected
+//     straight away; waiting would hold up everyone behind it.
+//
+// On SIGTERM the listeners close, and drain gives the open connections
+// -drain-timeout to finish before closing whatever is left.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+)
+
+type connGate struct {
+	slots        chan struct{} // one per open connection; nil: no total cap
+	maxPerSource int           // 0: no per-source cap
+
+	mu        sync.Mutex
+	perSource map[string]int
+	open      map[*gatedConn]struct{}
+	wg        sync.WaitGroup
+}
+
+func newConnGate(max, maxPerSource int) *connGate {
+	g := &connGate{
+		maxPerSource: maxPerSource,
+		perSource:    make(map[string]int),
+		open:         make(map[*gatedConn]struct{}),
+	}
+	if max > 0 {
+		g.slots = make(chan struct{}, max)
+	}
+	return g
+}
+
+func (g *connGate) listener(ln net.Listener) net.Listener {
+	return &gatedListener{Listener: ln, gate: g, closed: make(chan struct{})}
+}
+
+type gatedListener struct {
+	net.Listener
+	gate      *connGate
+	closed    chan struct{} // unblocks an Accept waiting for a slot
+	closeOnce sync.Once
+}
+
+func (l *gatedListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+func (l *gatedListener) Accept() (net.Conn, error) {
+	g := l.gate
+	for {
+		if g.slots != nil {
+			select {
+			case g.slots <- struct{}{}:
+			case <-l.closed:
+				return nil, net.ErrClosed
+			}
+		}
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			g.freeSlot()
+			return nil, err
+		}
+		source := conn.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(source); err == nil {
+			source = host
+		}
+
+		g.mu.Lock()
+		if g.maxPerSource > 0 && g.perSource[source] >= g.maxPerSource {
+			g.mu.Unlock()
+			fmt.Println("limit:", conn.RemoteAddr(), "over", g.maxPerSource, "connections from", source)
+			conn.Close()
+			g.freeSlot()
+			continue
+		}
+		g.perSource[source]++
+		gc := &gatedConn{Conn: conn, gate: g, source: source}
+		g.open[gc] = struct{}{}
+		g.wg.Add(1)
+		g.mu.Unlock()
+		return gc, nil
+	}
+}
+
+func (g *connGate) freeSlot() {
+	if g.slots != nil {
+		<-g.slots
+	}
+}
+
+func (g *connGate) release(c *gatedConn) {
+	g.mu.Lock()
+	if g.perSource[c.source]--; g.perSource[c.source] <= 0 {
+		delete(g.perSource, c.source)
+	}
+	delete(g.open, c)
+	g.mu.Unlock()
+	g.freeSlot()
+	g.wg.Done()
+}
+
+// active reports how many client connections are open.
+func (g *connGate) active() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.open)
+}
+
+// drain waits for every open connection to close, or for ctx to end,
+// in which case it closes the rest. It reports how many it closed.
+func (g *connGate) drain(ctx context.Context) int {
+	drained := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return 0
+	case <-ctx.Done():
+	}
+	g.mu.Lock()
+	remaining := make([]*gatedConn, 0, len(g.open))
+	for c := range g.open {
+		remaining = append(remaining, c)
+	}
+	g.mu.Unlock()
+	for _, c := range remaining {
+		c.Close()
+	}
+	return len(remaining)
+}
+
+// gatedConn gives its slot back when closed.
+type gatedConn struct {
+	net.Conn
+	gate   *connGate
+	source string
+	once   sync.Once
+}
+
+func (c *gatedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { c.gate.release(c) })
+	return err
+}
+
+// CloseWrite keeps half-close working through the wrapper.
+func (c *gatedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
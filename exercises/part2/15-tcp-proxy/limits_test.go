@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// dialFrom connects to addr from a given loopback address, so tests
+// can act as several client IPs.
+func dialFrom(t *testing.T, local, addr string) net.Conn {
+	t.Helper()
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(local)}}
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Skip("can't dial from", local, "on this host:", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// refused reports whether the server closed conn without a word.
+func refused(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	return err == io.EOF
+}
+
+func TestConnGateCaps(t *testing.T) {
+	gate := newConnGate(2, 1)
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := gate.listener(inner)
+	defer ln.Close()
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	addr := inner.Addr().String()
+
+	dialFrom(t, "127.0.0.1", addr)
+	first := <-accepted
+	if c := dialFrom(t, "127.0.0.1", addr); !refused(c) {
+		t.Fatal("second connection from 127.0.0.1 wasn't refused")
+	}
+	dialFrom(t, "127.0.0.2", addr)
+	<-accepted
+	if gate.active() != 2 {
+		t.Fatalf("%d active, want 2", gate.active())
+	}
+
+	// At the total cap, a third client waits rather than being refused,
+	// and is accepted once a slot frees up.
+	waiting := dialFrom(t, "127.0.0.3", addr)
+	select {
+	case <-accepted:
+		t.Fatal("accepted over the total cap")
+	case <-time.After(100 * time.Millisecond):
+	}
+	first.Close()
+	select {
+	case conn := <-accepted:
+		if conn.RemoteAddr().String() != waiting.LocalAddr().String() {
+			t.Fatalf("accepted %v, want the waiting client", conn.RemoteAddr())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("waiting client not accepted after a slot freed")
+	}
+}
+
+func TestConnGateDrain(t *testing.T) {
+	gate := newConnGate(0, 0)
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := gate.listener(inner)
+	client := dialFrom(t, "127.0.0.1", inner.Addr().String())
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+
+	// A connection that finishes within the timeout is waited for...
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		conn.Close()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if n := gate.drain(ctx); n != 0 {
+		t.Fatalf("drain closed %d connections, want 0", n)
+	}
+	if !refused(client) {
+		t.Fatal("client still open")
+	}
+
+	// ...and one that doesn't is closed when it runs out.
+	inner, _ = net.Listen("tcp", "127.0.0.1:0")
+	ln = gate.listener(inner)
+	defer ln.Close()
+	client = dialFrom(t, "127.0.0.1", inner.Addr().String())
+	if _, err := ln.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if n := gate.drain(ctx); n != 1 {
+		t.Fatalf("drain closed %d connections, want 1", n)
+	}
+	if !refused(client) {
+		t.Fatal("client still open after the drain timeout")
+	}
+}
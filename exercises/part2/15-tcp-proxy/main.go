@@ -1,18 +1,50 @@
 // TCP Byte Proxy Example
 // Relays raw bytes between a client and an upstream TCP server in
 // both directions concurrently, with graceful shutdown on SIGINT/SIGTERM.
+// With -mode socks5 or -mode http it is instead a SOCKS5 server (see
+// socks5.go) or an HTTP forward proxy (see httpproxy.go) that lets each
+// client pick its own destination, optionally behind a username and
+// password and destination allow/deny rules (see rules.go). In tcp
+// mode, -routes picks the upstream per connection by TLS server name,
+// client address or local port instead (see router.go);
+// -proxy-protocol tells the upstream who the real client is (see
+// proxyproto.go); and -record and -pcap capture the traffic (see
+// capture.go and pcapng.go). -mode chaos injects latency, bandwidth
+// limits, resets and other faults controlled through an HTTP API (see
+// chaos.go and toxics.go). Relays pass half-closes through and can be
+// bounded by idle and lifetime timeouts, and connections capped in
+// total and per client IP (see limits.go); on a signal, open relays
+// are given -drain-timeout to finish.
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/subtle"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"net/http"
+	"os"
 	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
-func proxyConn(ctx context.Context, client net.Conn, upstreamAddr string) {
+// tcpOptions are the tcp-mode settings proxyConn and the router share.
+type tcpOptions struct {
+	proxyProtocol int       // PROXY protocol version to send upstream; 0 = none
+	recorder      *recorder // nil: don't capture traffic
+	timeouts      relayTimeouts
+}
+
+func proxyConn(ctx context.Context, client net.Conn, upstreamAddr string, opts *tcpOptions) {
 	defer client.Close()
 
 	var dialer net.Dialer
@@ -22,33 +54,313 @@ func proxyConn(ctx context.Context, client net.Conn, upstreamAddr string) {
 		return
 	}
 	defer upstream.Close()
+	opts.forward(client, upstream, nil)
+}
+
+// forward relays between client and a freshly dialed upstream. It
+// first sends the upstream a PROXY protocol header, if configured,
+// and then early, bytes already read from the client.
+func (o *tcpOptions) forward(client, upstream net.Conn, early []byte) {
+	var header []byte
+	if o.proxyProtocol != 0 {
+		header = proxyHeader(o.proxyProtocol, client.RemoteAddr(), client.LocalAddr())
+	}
+	if o.recorder != nil {
+		s := o.recorder.open(client, upstream)
+		if len(early) > 0 {
+			s.data("client", early)
+		}
+		client, upstream = s.wrap(client, "client"), s.wrap(upstream, "server")
+		// A side that went quiet until the idle timeout tore the
+		// relay down never read an EOF; close it in the capture here.
+		defer s.end("server")
+		defer s.end("client")
+	}
+	if len(header)+len(early) > 0 {
+		if _, err := upstream.Write(append(header, early...)); err != nil {
+			return
+		}
+	}
+	relay(client, upstream, o.timeouts)
+}
 
-	// Copy in both directions concurrently. When either side closes,
-	// both io.Copy calls return and the connections are torn down.
-	done := make(chan struct{}, 2)
+// relayTimeouts bound how long relay keeps a pair of connections
+// open. Zero means no limit.
+type relayTimeouts struct {
+	idle     time.Duration // with no bytes moving either way
+	lifetime time.Duration // in total
+}
+
+// relay copies in both directions concurrently. When one side
+// finishes sending (EOF), the other side's write half is closed, so
+// protocols that half-close (send a request, CloseWrite, then read
+// the reply) still get their reply; the relay ends once both
+// directions have. An error, such as a reset or a timeout, tears both
+// directions down at once. It reports the bytes sent upstream and back
+// to the client.
+func relay(client, upstream net.Conn, timeouts relayTimeouts) (sent, received int64) {
+	var closeOnce sync.Once
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			client.Close()
+			upstream.Close()
+		})
+	}
+	if timeouts.lifetime > 0 {
+		timer := time.AfterFunc(timeouts.lifetime, closeBoth)
+		defer timer.Stop()
+	}
+
+	var lastActive atomic.Int64 // UnixNano of the last byte relayed either way
+	lastActive.Store(time.Now().UnixNano())
+	done := make(chan error, 2)
 	go func() {
-		io.Copy(upstream, client)
-		done <- struct{}{}
+		var err error
+		sent, err = copyHalf(upstream, client, timeouts.idle, &lastActive)
+		done <- err
 	}()
 	go func() {
-		io.Copy(client, upstream)
-		done <- struct{}{}
+		var err error
+		received, err = copyHalf(client, upstream, timeouts.idle, &lastActive)
+		done <- err
 	}()
+	if err := <-done; err != nil {
+		closeBoth()
+	}
 	<-done
+	closeBoth()
+	return sent, received
+}
+
+// copyHalf copies src to dst until src reaches EOF, then closes dst's
+// write half. With an idle timeout, it gives up once neither
+// direction has moved a byte for that long.
+func copyHalf(dst, src net.Conn, idle time.Duration, lastActive *atomic.Int64) (int64, error) {
+	var n int64
+	var err error
+	if idle == 0 {
+		n, err = io.Copy(dst, src) // lets the kernel splice TCP to TCP
+	} else {
+		buf := make([]byte, 32*1024)
+		for {
+			src.SetReadDeadline(time.Now().Add(idle))
+			nr, rerr := src.Read(buf)
+			if nr > 0 {
+				lastActive.Store(time.Now().UnixNano())
+				nw, werr := dst.Write(buf[:nr])
+				n += int64(nw)
+				if werr != nil {
+					err = werr
+					break
+				}
+			}
+			if rerr == io.EOF {
+				break
+			}
+			var netErr net.Error
+			if errors.As(rerr, &netErr) && netErr.Timeout() &&
+				time.Since(time.Unix(0, lastActive.Load())) < idle {
+				continue // quiet this way, but the other direction is busy
+			}
+			if rerr != nil {
+				err = rerr
+				break
+			}
+		}
+	}
+	if err != nil {
+		return n, err
+	}
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		return n, cw.CloseWrite()
+	}
+	// No half-close on this kind of connection: end it.
+	return n, errors.New("can't half-close")
 }
 
 func main() {
+	addr := flag.String("addr", ":9200", "listen address")
+	upstream := flag.String("upstream", "localhost:9000", "upstream address (tcp mode)")
+	mode := flag.String("mode", "tcp", `"tcp" to forward everything to -upstream; "socks5" or "http" to let clients choose; "chaos" to inject faults`)
+	usersFile := flag.String("users", "", "file of username:password lines (socks5/http modes; enables authentication)")
+	rulesFile := flag.String("rules", "", "file of allow/deny destination rules (socks5/http modes)")
+	maxPerUser := flag.Int("max-conns-per-user", 0, "concurrent connections allowed per user or, without -users, per client IP (http mode; 0 = unlimited)")
+	routesFile := flag.String("routes", "", "file of SNI/source/port routes to pick the upstream by (tcp mode; replaces -upstream)")
+	proxyProtocol := flag.Int("proxy-protocol", 0, "send a PROXY protocol v1 or v2 header to the upstream naming the real client (tcp mode; 0 = off)")
+	apiAddr := flag.String("api", "localhost:8474", "address for the HTTP API that manages proxies and toxics (chaos mode)")
+	recordFile := flag.String("record", "", "file to record every connection's traffic to, as JSON Lines (tcp mode)")
+	pcapFile := flag.String("pcap", "", "file to write the traffic to as pcap-ng, with synthesised TCP/IP headers (tcp mode)")
+	accessLog := flag.String("access-log", "", "file to append the JSON access log to (http mode; default stdout)")
+	idleTimeout := flag.Duration("idle-timeout", 0, "close a relayed connection after this long with no data either way (0 = never; not chaos mode)")
+	maxLifetime := flag.Duration("max-lifetime", 0, "close a relayed connection after this long regardless (0 = never; not chaos mode)")
+	maxConns := flag.Int("max-conns", 0, "client connections open at once; more wait to be accepted (0 = unlimited; not chaos mode)")
+	maxPerSource := flag.Int("max-conns-per-source", 0, "client connections open at once from one IP; more are refused (0 = unlimited; not chaos mode)")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "on SIGINT/SIGTERM, how long open connections get to finish before they're closed")
+	flag.Parse()
+	timeouts := relayTimeouts{idle: *idleTimeout, lifetime: *maxLifetime}
+
+	var users map[string]string
+	var rules ruleSet
+	var err error
+	if *usersFile != "" {
+		if users, err = loadUsers(*usersFile); err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+	}
+	if *rulesFile != "" {
+		if rules, err = loadRules(*rulesFile); err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+	}
+	if (*mode == "socks5" || *mode == "http") && users == nil && rules == nil {
+		fmt.Println("warning: no -users or -rules; this is an open proxy")
+	}
+
+	if *proxyProtocol < 0 || *proxyProtocol > 2 {
+		fmt.Println("error: -proxy-protocol must be 0, 1 or 2")
+		os.Exit(1)
+	}
+	if (*proxyProtocol != 0 || *recordFile != "" || *pcapFile != "") && *mode != "tcp" {
+		fmt.Println("error: -proxy-protocol, -record and -pcap only apply to tcp mode")
+		os.Exit(1)
+	}
+	opts := &tcpOptions{proxyProtocol: *proxyProtocol, timeouts: timeouts}
+	if *recordFile != "" || *pcapFile != "" {
+		if opts.recorder, err = newRecorder(*recordFile, *pcapFile); err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		defer opts.recorder.Close()
+	}
+
+	var routes *router
+	addrs := []string{*addr}
+	if *routesFile != "" {
+		if *mode != "tcp" {
+			fmt.Println("error: -routes only applies to tcp mode")
+			os.Exit(1)
+		}
+		if routes, err = loadRoutes(*routesFile); err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		routes.opts = opts
+		if len(routes.listen) > 0 {
+			addrs = routes.listen
+		}
+	}
+
 	ctx, stop := signal.NotifyContext(
 		context.Background(), syscall.SIGINT, syscall.SIGTERM,
 	)
 	defer stop()
 
-	ln, err := net.Listen("tcp", ":9200")
-	if err != nil {
-		panic(err)
+	// Chaos mode manages its own connections (and needs raw TCP ones
+	// to reset), so the gate only has the others' to count and drain.
+	gate := newConnGate(*maxConns, *maxPerSource)
+	var listeners []net.Listener
+	for _, a := range addrs {
+		ln, err := net.Listen("tcp", a)
+		if err != nil {
+			panic(err)
+		}
+		if *mode != "chaos" {
+			ln = gate.listener(ln)
+		}
+		listeners = append(listeners, ln)
+	}
+	// Closing the listeners is what unblocks Accept (or Serve) once a
+	// signal arrives.
+	go func() {
+		<-ctx.Done()
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}()
+
+	handle := func(ctx context.Context, conn net.Conn) { proxyConn(ctx, conn, *upstream, opts) }
+	serve := func(ln net.Listener) { acceptLoop(ctx, ln, handle) }
+	var banner string
+	var httpSrv *http.Server
+	switch {
+	case *mode == "tcp" && routes != nil:
+		banner = "TCP proxy routing by " + *routesFile + ", listening on"
+		handle = routes.serve
+	case *mode == "tcp":
+		banner = "TCP proxy forwarding to " + *upstream + ", listening on"
+	case *mode == "socks5":
+		banner = "SOCKS5 proxy listening on"
+		handle = (&socksServer{users: users, rules: rules, timeouts: timeouts}).serve
+	case *mode == "http":
+		out := os.Stdout
+		if *accessLog != "" {
+			if out, err = os.OpenFile(*accessLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644); err != nil {
+				fmt.Println("error:", err)
+				os.Exit(1)
+			}
+			defer out.Close()
+		}
+		proxy := newHTTPProxy(users, rules, *maxPerUser, slog.New(slog.NewJSONHandler(out, nil)))
+		proxy.timeouts = timeouts
+		httpSrv = &http.Server{Handler: proxy, ReadHeaderTimeout: handshakeTimeout}
+		banner = "HTTP proxy listening on"
+		serve = func(ln net.Listener) { httpSrv.Serve(ln) }
+	case *mode == "chaos":
+		// -addr and -upstream become the proxy named "main"; the API
+		// can add more.
+		chaos := newChaosServer()
+		api := &http.Server{Addr: *apiAddr, Handler: chaos, ReadHeaderTimeout: handshakeTimeout}
+		go func() {
+			if err := api.ListenAndServe(); err != http.ErrServerClosed {
+				fmt.Println("error:", err)
+				os.Exit(1)
+			}
+		}()
+		fmt.Println("Chaos API listening on", *apiAddr)
+		banner = "Chaos proxy \"main\" forwarding to " + *upstream + ", listening on"
+		serve = func(ln net.Listener) {
+			chaos.add("main", ln, *upstream)
+			<-ctx.Done()
+			api.Close()
+			chaos.shutdown()
+		}
+	default:
+		fmt.Println("error: -mode must be tcp, socks5, http or chaos")
+		os.Exit(1)
 	}
-	fmt.Println("TCP proxy listening on :9200, forwarding to :9000")
 
+	var wg sync.WaitGroup
+	for _, ln := range listeners {
+		fmt.Println(banner, ln.Addr())
+		wg.Add(1)
+		go func(ln net.Listener) {
+			defer wg.Done()
+			serve(ln)
+		}(ln)
+	}
+	wg.Wait()
+
+	// The listeners are closed; let the relays that are still running
+	// finish, up to -drain-timeout. A second signal exits at once.
+	stop()
+	if n := gate.active(); n > 0 {
+		fmt.Println("draining", n, "connections (up to", *drainTimeout, "then they're closed)")
+	}
+	drainCtx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+	defer cancel()
+	if httpSrv != nil {
+		// Closes idle keep-alive connections and waits for requests in
+		// flight; CONNECT tunnels are hijacked, so the gate tracks those.
+		go httpSrv.Shutdown(drainCtx)
+	}
+	if n := gate.drain(drainCtx); n > 0 {
+		fmt.Println("drain timeout: closed", n, "connections")
+	}
+}
+
+func acceptLoop(ctx context.Context, ln net.Listener, handle func(context.Context, net.Conn)) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -59,6 +371,37 @@ func main() {
 				continue
 			}
 		}
-		go proxyConn(ctx, conn, "localhost:9000")
+		go handle(ctx, conn)
 	}
 }
+
+// loadUsers reads username:password lines, skipping blanks and
+// comments.
+func loadUsers(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, pass, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s: expected username:password, got %q", path, line)
+		}
+		users[user] = pass
+	}
+	return users, scanner.Err()
+}
+
+func checkPassword(users map[string]string, user, pass string) bool {
+	want, known := users[user]
+	// Compare even for unknown users, so timing doesn't reveal which
+	// usernames exist.
+	return subtle.ConstantTimeCompare([]byte(pass), []byte(want)) == 1 && known
+}
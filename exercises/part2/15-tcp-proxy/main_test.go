@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startProxy runs tcp mode in front of upstream.
+func startProxy(t *testing.T, upstream string, timeouts relayTimeouts) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	opts := &tcpOptions{timeouts: timeouts}
+	go acceptLoop(context.Background(), ln, func(ctx context.Context, conn net.Conn) {
+		proxyConn(ctx, conn, upstream, opts)
+	})
+	return ln.Addr().String()
+}
+
+// startServer runs handle for each connection to a new listener.
+func startServer(t *testing.T, handle func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestRelayPassesHalfClose(t *testing.T) {
+	// The server only answers once it has the whole request, which it
+	// knows when the client half-closes.
+	server := startServer(t, func(conn net.Conn) {
+		n, _ := io.Copy(io.Discard, conn)
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprintf(conn, "got %d bytes", n)
+	})
+	conn, err := net.Dial("tcp", startProxy(t, server, relayTimeouts{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(make([]byte, 100000))
+	conn.(*net.TCPConn).CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := io.ReadAll(conn)
+	if err != nil || string(reply) != "got 100000 bytes" {
+		t.Fatalf("reply after half-close: %q, %v", reply, err)
+	}
+}
+
+func TestRelayIdleTimeoutCountsBothDirections(t *testing.T) {
+	// The server talks for 300ms and then goes quiet; the client never
+	// says anything. Only the silence should count as idle.
+	server := startServer(t, func(conn net.Conn) {
+		for i := 0; i < 10; i++ {
+			conn.Write([]byte("tick"))
+			time.Sleep(30 * time.Millisecond)
+		}
+		time.Sleep(5 * time.Second)
+	})
+	conn, err := net.Dial("tcp", startProxy(t, server, relayTimeouts{idle: 150 * time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, _ := io.ReadAll(conn)
+	if len(got) != 40 {
+		t.Fatalf("read %d bytes before the idle timeout, want all 40", len(got))
+	}
+	if d := time.Since(start); d < 400*time.Millisecond || d > 2*time.Second {
+		t.Fatalf("closed after %v, want about 300ms of ticks plus 150ms idle", d)
+	}
+}
+
+func TestRelayMaxLifetime(t *testing.T) {
+	server := startServer(t, func(conn net.Conn) {
+		for {
+			if _, err := conn.Write([]byte("busy")); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	conn, err := net.Dial("tcp", startProxy(t, server, relayTimeouts{idle: time.Second, lifetime: 200 * time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.Copy(io.Discard, conn)
+	if d := time.Since(start); d < 200*time.Millisecond || d > 2*time.Second {
+		t.Fatalf("busy connection closed after %v, want 200ms", d)
+	}
+}
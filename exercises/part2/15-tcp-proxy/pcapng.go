@@ -0,0 +1,208 @@
+package main
+
+// A minimal pcap-ng writer, so -pcap captures open in Wireshark or
+// tcpdump -r. The proxy only ever sees byte streams, not packets, so
+// it synthesises them: each connection is drawn as one TCP connection
+// straight from the client to the upstream, with a three-way
+// handshake, one segment per relayed read (split to fit in an IP
+// packet), and a FIN as each side finishes. Sequence and acknowledgement
+// numbers track the bytes really sent, so "Follow TCP Stream" shows
+// both directions exactly as relayed. Timing is the proxy's, not the
+// wire's.
+//
+// The file is one Section Header Block, one Interface Description
+// Block with link type RAW (packets start at the IP header, v4 or v6),
+// and an Enhanced Packet Block per packet, all little-endian.
+
+import (
+	"encoding/binary"
+	"io"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+const (
+	pcapLinkTypeRaw = 101
+	pcapMaxSegment  = 65535 - 40 - 20 // largest payload that fits any IP packet
+	tcpFIN          = 0x01
+	tcpSYN          = 0x02
+	tcpPSH          = 0x08
+	tcpACK          = 0x10
+)
+
+type pcapWriter struct {
+	w io.Writer
+}
+
+func newPcapWriter(w io.Writer) (*pcapWriter, error) {
+	shb := binary.LittleEndian.AppendUint32(nil, 0x0A0D0D0A) // Section Header Block
+	shb = binary.LittleEndian.AppendUint32(shb, 28)
+	shb = binary.LittleEndian.AppendUint32(shb, 0x1A2B3C4D) // byte-order magic
+	shb = binary.LittleEndian.AppendUint16(shb, 1)          // version 1.0
+	shb = binary.LittleEndian.AppendUint16(shb, 0)
+	shb = binary.LittleEndian.AppendUint64(shb, ^uint64(0)) // section length unknown
+	shb = binary.LittleEndian.AppendUint32(shb, 28)
+
+	idb := binary.LittleEndian.AppendUint32(nil, 1) // Interface Description Block
+	idb = binary.LittleEndian.AppendUint32(idb, 20)
+	idb = binary.LittleEndian.AppendUint16(idb, pcapLinkTypeRaw)
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, 0) // no snapshot limit
+	idb = binary.LittleEndian.AppendUint32(idb, 20)
+
+	if _, err := w.Write(append(shb, idb...)); err != nil {
+		return nil, err
+	}
+	return &pcapWriter{w: w}, nil
+}
+
+// pcapFlow is the synthesised TCP state of one connection.
+type pcapFlow struct {
+	client, server *net.TCPAddr
+	v4             bool
+	clientSeq      uint32 // next sequence number the client sends
+	serverSeq      uint32
+	clientFin      bool
+	serverFin      bool
+}
+
+func newPcapFlow(client, server net.Addr) *pcapFlow {
+	c, _ := client.(*net.TCPAddr)
+	s, _ := server.(*net.TCPAddr)
+	if c == nil {
+		c = &net.TCPAddr{IP: net.IPv4zero}
+	}
+	if s == nil {
+		s = &net.TCPAddr{IP: net.IPv4zero}
+	}
+	return &pcapFlow{
+		client: c, server: s,
+		// An IPv4 client of an IPv6 upstream (or the reverse) is drawn
+		// as IPv6 with a v4-mapped address.
+		v4:        c.IP.To4() != nil && s.IP.To4() != nil,
+		clientSeq: rand.Uint32(),
+		serverSeq: rand.Uint32(),
+	}
+}
+
+func (p *pcapWriter) handshake(f *pcapFlow, t time.Time) {
+	p.packet(f, true, tcpSYN, nil, t)
+	f.clientSeq++
+	p.packet(f, false, tcpSYN|tcpACK, nil, t)
+	f.serverSeq++
+	p.packet(f, true, tcpACK, nil, t)
+}
+
+func (p *pcapWriter) data(f *pcapFlow, fromClient bool, data []byte, t time.Time) {
+	for len(data) > 0 {
+		n := min(len(data), pcapMaxSegment)
+		p.packet(f, fromClient, tcpPSH|tcpACK, data[:n], t)
+		if fromClient {
+			f.clientSeq += uint32(n)
+		} else {
+			f.serverSeq += uint32(n)
+		}
+		data = data[n:]
+	}
+}
+
+// close draws one side's FIN; after the second, the other side ACKs
+// it.
+func (p *pcapWriter) close(f *pcapFlow, fromClient bool, t time.Time) {
+	p.packet(f, fromClient, tcpFIN|tcpACK, nil, t)
+	if fromClient {
+		f.clientSeq++
+		f.clientFin = true
+	} else {
+		f.serverSeq++
+		f.serverFin = true
+	}
+	if f.clientFin && f.serverFin {
+		p.packet(f, !fromClient, tcpACK, nil, t)
+	}
+}
+
+// packet writes one segment in an Enhanced Packet Block.
+func (p *pcapWriter) packet(f *pcapFlow, fromClient bool, flags byte, payload []byte, t time.Time) {
+	src, dst := f.client, f.server
+	seq, ack := f.clientSeq, f.serverSeq
+	if !fromClient {
+		src, dst = dst, src
+		seq, ack = ack, seq
+	}
+	if flags&tcpACK == 0 {
+		ack = 0
+	}
+
+	tcp := binary.BigEndian.AppendUint16(nil, uint16(src.Port))
+	tcp = binary.BigEndian.AppendUint16(tcp, uint16(dst.Port))
+	tcp = binary.BigEndian.AppendUint32(tcp, seq)
+	tcp = binary.BigEndian.AppendUint32(tcp, ack)
+	tcp = append(tcp, 5<<4, flags)                  // 20-byte header, no options
+	tcp = binary.BigEndian.AppendUint16(tcp, 65535) // window
+	tcp = append(tcp, 0, 0, 0, 0)                   // checksum, urgent pointer
+	tcp = append(tcp, payload...)
+
+	var pkt, pseudo []byte
+	if f.v4 {
+		s, d := src.IP.To4(), dst.IP.To4()
+		pkt = []byte{0x45, 0}
+		pkt = binary.BigEndian.AppendUint16(pkt, uint16(20+len(tcp)))
+		pkt = append(pkt, 0, 0, 0x40, 0, 64, 6, 0, 0) // id, don't fragment, TTL, TCP, checksum
+		pkt = append(pkt, s...)
+		pkt = append(pkt, d...)
+		binary.BigEndian.PutUint16(pkt[10:], checksum(pkt, 0))
+		pseudo = append(append(append([]byte{}, s...), d...), 0, 6)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(tcp)))
+	} else {
+		s, d := src.IP.To16(), dst.IP.To16()
+		pkt = []byte{0x60, 0, 0, 0}
+		pkt = binary.BigEndian.AppendUint16(pkt, uint16(len(tcp)))
+		pkt = append(pkt, 6, 64) // next header TCP, hop limit
+		pkt = append(pkt, s...)
+		pkt = append(pkt, d...)
+		pseudo = append(append([]byte{}, s...), d...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(tcp)))
+		pseudo = append(pseudo, 0, 0, 0, 6)
+	}
+	binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, sum(pseudo)))
+	pkt = append(pkt, tcp...)
+
+	padded := (len(pkt) + 3) &^ 3
+	total := uint32(32 + padded)
+	usec := uint64(t.UnixMicro())
+	epb := binary.LittleEndian.AppendUint32(nil, 6) // Enhanced Packet Block
+	epb = binary.LittleEndian.AppendUint32(epb, total)
+	epb = binary.LittleEndian.AppendUint32(epb, 0) // interface 0
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(usec>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(usec))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(pkt)))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(pkt)))
+	epb = append(epb, pkt...)
+	epb = append(epb, make([]byte, padded-len(pkt))...)
+	epb = binary.LittleEndian.AppendUint32(epb, total)
+	p.w.Write(epb)
+}
+
+// sum adds b as big-endian 16-bit words, for checksum's initial value.
+func sum(b []byte) uint32 {
+	var s uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	return s
+}
+
+// checksum is the Internet checksum (RFC 1071) of b, starting from
+// initial (the pseudo-header's sum for TCP).
+func checksum(b []byte, initial uint32) uint16 {
+	s := initial + sum(b)
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
@@ -0,0 +1,76 @@
+package main
+
+// PROXY protocol, as specified in HAProxy's proxy-protocol.txt.
+// An upstream behind this proxy sees every connection coming from the
+// proxy's own address. With -proxy-protocol 1 or 2, the proxy sends a
+// short header before any client bytes, naming the client's address
+// and the address it connected to, so an upstream that understands the
+// header can log and authorize the real client:
+//
+//	v1 (text):   PROXY TCP4 203.0.113.7 192.0.2.10 51234 443\r\n
+//	v2 (binary): 12-byte signature, version/command, family, length,
+//	             then the two addresses and ports in network order
+//
+// The upstream must expect the header on every connection: it must
+// not guess, or clients could forge their own. See
+// 08-tcp-concurrent-server/proxyproto.go for the receiving side.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyHeader builds the header for a connection from src to dst (the
+// proxy's own address as the client saw it). version is 1 or 2.
+// Addresses that aren't TCP are sent as UNKNOWN (v1) or UNSPEC (v2),
+// telling the upstream to fall back to the connection's own address.
+func proxyHeader(version int, src, dst net.Addr) []byte {
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	known := sok && dok
+	// Mixed families (an IPv4 client on a dual-stack listener reports
+	// a v4-mapped local address) are sent as IPv6 unless both are v4.
+	v4 := known && s.IP.To4() != nil && d.IP.To4() != nil
+
+	if version == 1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family, sip, dip := "TCP6", v6String(s.IP), v6String(d.IP)
+		if v4 {
+			family, sip, dip = "TCP4", s.IP.To4().String(), d.IP.To4().String()
+		}
+		return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family, sip, dip, s.Port, d.Port)
+	}
+
+	h := append([]byte(nil), proxyV2Signature...)
+	h = append(h, 0x21) // version 2, command PROXY
+	switch {
+	case !known:
+		return append(h, 0x00, 0, 0) // UNSPEC, no addresses
+	case v4:
+		h = append(h, 0x11) // TCP over IPv4
+		h = binary.BigEndian.AppendUint16(h, 12)
+		h = append(h, s.IP.To4()...)
+		h = append(h, d.IP.To4()...)
+	default:
+		h = append(h, 0x21) // TCP over IPv6
+		h = binary.BigEndian.AppendUint16(h, 36)
+		h = append(h, s.IP.To16()...)
+		h = append(h, d.IP.To16()...)
+	}
+	h = binary.BigEndian.AppendUint16(h, uint16(s.Port))
+	return binary.BigEndian.AppendUint16(h, uint16(d.Port))
+}
+
+// v6String formats ip as IPv6 text. net.IP.String prints v4-mapped
+// addresses in dotted form, which a TCP6 line can't carry.
+func v6String(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return "::ffff:" + v4.String()
+	}
+	return ip.String()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234}
+	dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 443}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}
+	for _, tc := range []struct {
+		version  int
+		src, dst net.Addr
+		want     string
+	}{
+		{1, src, dst, "PROXY TCP4 203.0.113.7 192.0.2.10 51234 443\r\n"},
+		{1, src6, dst, "PROXY TCP6 2001:db8::1 ::ffff:192.0.2.10 1234 443\r\n"},
+		{1, &net.UnixAddr{Name: "/tmp/s"}, dst, "PROXY UNKNOWN\r\n"},
+		{2, src, dst, "\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c" +
+			"\xcb\x00\x71\x07\xc0\x00\x02\x0a\xc8\x22\x01\xbb"},
+		{2, &net.UnixAddr{Name: "/tmp/s"}, dst, "\r\n\r\n\x00\r\nQUIT\n\x21\x00\x00\x00"},
+	} {
+		if got := proxyHeader(tc.version, tc.src, tc.dst); string(got) != tc.want {
+			t.Errorf("v%d %v -> %v: %q, want %q", tc.version, tc.src, tc.dst, got, tc.want)
+		}
+	}
+	if got := proxyHeader(2, src6, src6); len(got) != 16+36 || got[13] != 0x21 {
+		t.Errorf("v2 IPv6 header: %x", got)
+	}
+}
+
+func TestProxyConnSendsHeaderFirst(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go acceptLoop(context.Background(), ln, func(ctx context.Context, conn net.Conn) {
+		proxyConn(ctx, conn, upstream.Addr().String(), &tcpOptions{proxyProtocol: 1})
+	})
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	io.WriteString(client, "hello")
+
+	conn, err := upstream.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	want := proxyHeader(1, client.LocalAddr(), client.RemoteAddr())
+	got := make([]byte, len(want)+len("hello"))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, append(want, "hello"...)) {
+		t.Fatalf("upstream read %q", got)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+// Routing for tcp mode: instead of sending everything to -upstream,
+// a -routes file picks the upstream per connection. One route per
+// line, tried in order, first match wins:
+//
+//	listen  :443                    addresses to accept on (repeatable)
+//	listen  :8443
+//	sni     api.example.com    10.0.0.5:443
+//	sni     *.example.com      10.0.0.6:443
+//	source  10.1.0.0/16        10.0.0.7:443
+//	port    8443               10.0.0.8:443
+//	default                    10.0.0.9:443
+//
+// sni matches the server name a TLS client sends in its ClientHello
+// ("*.domain" matches any subdomain); source matches the client's
+// address; port matches the local port the client connected to. The
+// TLS session itself is never terminated: the proxy reads the
+// ClientHello, replays it to the chosen upstream and relays bytes as
+// usual, so certificates stay on the backends.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// helloTimeout bounds the wait for a ClientHello. Protocols where the
+// server speaks first send nothing, so they wait this long before
+// falling through to the non-SNI routes.
+const helloTimeout = 2 * time.Second
+
+type tcpRoute struct {
+	kind     string // "sni", "source", "port" or "default"
+	sni      string
+	source   *net.IPNet
+	port     int
+	upstream string
+}
+
+type router struct {
+	listen  []string
+	routes  []tcpRoute
+	needSNI bool // only peek at connections if some route uses SNI
+	opts    *tcpOptions
+}
+
+func loadRoutes(path string) (*router, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rt := &router{opts: &tcpOptions{}}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := rt.parseLine(line); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(rt.routes) == 0 {
+		return nil, fmt.Errorf("%s: no routes", path)
+	}
+	return rt, nil
+}
+
+func (rt *router) parseLine(line string) error {
+	fields := strings.Fields(line)
+	switch {
+	case fields[0] == "listen" && len(fields) == 2:
+		rt.listen = append(rt.listen, fields[1])
+		return nil
+	case fields[0] == "default" && len(fields) == 2:
+		rt.routes = append(rt.routes, tcpRoute{kind: "default", upstream: fields[1]})
+		return nil
+	case len(fields) != 3:
+		return fmt.Errorf("expected <kind> <match> <upstream>, got %q", line)
+	}
+	r := tcpRoute{kind: fields[0], upstream: fields[2]}
+	switch r.kind {
+	case "sni":
+		r.sni = strings.ToLower(fields[1])
+		rt.needSNI = true
+	case "source":
+		_, cidr, err := net.ParseCIDR(fields[1])
+		if err != nil {
+			return err
+		}
+		r.source = cidr
+	case "port":
+		port, err := strconv.Atoi(fields[1])
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("bad port %q", fields[1])
+		}
+		r.port = port
+	default:
+		return fmt.Errorf("unknown route kind %q", r.kind)
+	}
+	rt.routes = append(rt.routes, r)
+	return nil
+}
+
+// pick returns the upstream for a connection.
+func (rt *router) pick(sni string, source net.IP, port int) (string, bool) {
+	for _, r := range rt.routes {
+		var match bool
+		switch r.kind {
+		case "sni":
+			match = sni != "" && (sni == r.sni ||
+				strings.HasPrefix(r.sni, "*.") && strings.HasSuffix(sni, r.sni[1:]))
+		case "source":
+			match = r.source.Contains(source)
+		case "port":
+			match = port == r.port
+		case "default":
+			match = true
+		}
+		if match {
+			return r.upstream, true
+		}
+	}
+	return "", false
+}
+
+func (rt *router) serve(ctx context.Context, client net.Conn) {
+	defer client.Close()
+	var sni string
+	var peeked []byte
+	if rt.needSNI {
+		sni, peeked = peekClientHello(client)
+	}
+	src := client.RemoteAddr().(*net.TCPAddr)
+	upstreamAddr, ok := rt.pick(sni, src.IP, client.LocalAddr().(*net.TCPAddr).Port)
+	if !ok {
+		fmt.Println("route:", src, "sni", strconv.Quote(sni), "matches no route")
+		return
+	}
+
+	var dialer net.Dialer
+	upstream, err := dialer.DialContext(ctx, "tcp", upstreamAddr)
+	if err != nil {
+		fmt.Println("failed to reach upstream:", err)
+		return
+	}
+	defer upstream.Close()
+	fmt.Println("route:", src, "sni", strconv.Quote(sni), "->", upstreamAddr)
+	rt.opts.forward(client, upstream, peeked)
+}
+
+var errHelloRead = errors.New("ClientHello read")
+
+// peekClientHello lets crypto/tls parse the start of the connection
+// as a TLS server would, stopping as soon as the ClientHello has been
+// read. It returns the requested server name ("" if the client isn't
+// speaking TLS or sent none) and every byte consumed, which the
+// upstream must still be sent.
+func peekClientHello(conn net.Conn) (string, []byte) {
+	var consumed bytes.Buffer
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var sni string
+	config := &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = strings.ToLower(hello.ServerName)
+			return nil, errHelloRead // abort before any reply is written
+		},
+	}
+	tls.Server(readOnlyConn{Conn: conn, r: io.TeeReader(conn, &consumed)}, config).Handshake()
+	return sni, consumed.Bytes()
+}
+
+// readOnlyConn records reads and refuses writes, so the aborted
+// handshake above can't send the client an alert.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
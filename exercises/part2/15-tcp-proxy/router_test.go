@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func parseRoutes(t *testing.T, lines ...string) *router {
+	t.Helper()
+	rt := &router{opts: &tcpOptions{}}
+	for _, line := range lines {
+		if err := rt.parseLine(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rt
+}
+
+func TestRouterPicksFirstMatch(t *testing.T) {
+	rt := parseRoutes(t,
+		"sni api.example.com a:1",
+		"sni *.example.com b:1",
+		"source 10.1.0.0/16 c:1",
+		"port 8443 d:1",
+		"default e:1",
+	)
+	for _, tc := range []struct {
+		sni    string
+		source string
+		port   int
+		want   string
+	}{
+		{"api.example.com", "192.0.2.1", 443, "a:1"},
+		{"www.example.com", "10.1.2.3", 8443, "b:1"},
+		{"deep.www.example.com", "192.0.2.1", 443, "b:1"},
+		{"example.com", "10.1.2.3", 443, "c:1"}, // the wildcard needs a subdomain
+		{"", "192.0.2.1", 8443, "d:1"},
+		{"other.org", "192.0.2.1", 443, "e:1"},
+	} {
+		got, _ := rt.pick(tc.sni, net.ParseIP(tc.source), tc.port)
+		if got != tc.want {
+			t.Errorf("pick(%q, %s, %d) = %s, want %s", tc.sni, tc.source, tc.port, got, tc.want)
+		}
+	}
+	if _, ok := parseRoutes(t, "sni a.example a:1").pick("b.example", nil, 1); ok {
+		t.Error("matched with no applicable route")
+	}
+}
+
+func TestRouterRoutesTLSWithoutTerminating(t *testing.T) {
+	named := func(name string) *httptest.Server {
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// The backend, not the proxy, completed the handshake.
+			io.WriteString(w, name+" "+r.TLS.ServerName)
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	a, b := named("A"), named("B")
+	echo := startEcho(t, "127.0.0.1:0")
+
+	rt := parseRoutes(t,
+		"sni a.example.com "+a.Listener.Addr().String(),
+		"sni *.example.org "+b.Listener.Addr().String(),
+		"default "+echo.String(),
+	)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go acceptLoop(context.Background(), ln, rt.serve)
+
+	get := func(serverName string) string {
+		t.Helper()
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return net.Dial("tcp", ln.Addr().String())
+			},
+			TLSClientConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: true},
+		}}
+		resp, err := client.Get("https://" + serverName + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	if got := get("a.example.com"); got != "A a.example.com" {
+		t.Fatalf("a.example.com reached %q", got)
+	}
+	if got := get("api.eu.example.org"); got != "B api.eu.example.org" {
+		t.Fatalf("api.eu.example.org reached %q", got)
+	}
+
+	// Plain TCP has no ClientHello, so it falls through to the default
+	// route with the bytes the peek consumed passed on intact.
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "hello, plain tcp")
+	got := make([]byte, len("hello, plain tcp"))
+	if _, err := io.ReadFull(conn, got); err != nil || !strings.HasPrefix(string(got), "hello") {
+		t.Fatalf("default route echoed %q, %v", got, err)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+// Destination allow/deny rules. A rules file has one rule per line:
+//
+//	allow 10.1.0.0/16
+//	deny  *.internal.example.com
+//	allow *:443
+//	deny  *
+//
+// The pattern is a CIDR, an IP, a host name, a "*.domain" wildcard
+// (matching the domain's subdomains, not the domain itself) or "*",
+// optionally followed by ":port". Rules are tried in order and the
+// first match decides; a destination no rule matches is denied.
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errDenied = errors.New("destination denied by rules")
+
+type rule struct {
+	allow bool
+	cidr  *net.IPNet // set for IP and CIDR patterns
+	host  string     // lower-case host name, "*.suffix", or "*"
+	port  int        // 0 matches any port
+}
+
+type ruleSet []rule
+
+func loadRules(path string) (ruleSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rules ruleSet
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, scanner.Err()
+}
+
+func parseRule(line string) (rule, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 || (fields[0] != "allow" && fields[0] != "deny") {
+		return rule{}, fmt.Errorf("expected allow|deny <pattern>, got %q", line)
+	}
+	r := rule{allow: fields[0] == "allow"}
+	pattern := fields[1]
+	// A port is split off the last colon, unless that colon is part
+	// of a bare IPv6 address; bracket IPv6 to give it a port.
+	if host, port, err := net.SplitHostPort(pattern); err == nil {
+		if port != "*" {
+			p, err := strconv.Atoi(port)
+			if err != nil || p < 1 || p > 65535 {
+				return rule{}, fmt.Errorf("bad port in %q", pattern)
+			}
+			r.port = p
+		}
+		pattern = host
+	}
+	if _, cidr, err := net.ParseCIDR(pattern); err == nil {
+		r.cidr = cidr
+	} else if ip := net.ParseIP(pattern); ip != nil {
+		bits := 8 * len(ip.To16())
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		r.cidr = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else {
+		r.host = strings.ToLower(pattern)
+	}
+	return r, nil
+}
+
+func (r rule) matches(host string, ip net.IP, port int) bool {
+	if r.port != 0 && r.port != port {
+		return false
+	}
+	switch {
+	case r.cidr != nil:
+		return ip != nil && r.cidr.Contains(ip)
+	case r.host == "*":
+		return true
+	case strings.HasPrefix(r.host, "*."):
+		return strings.HasSuffix(host, r.host[1:])
+	default:
+		return host == r.host
+	}
+}
+
+// allowed reports whether a connection to ip:port may be made. host is
+// the name the client asked for, or "" if it gave an address. Each
+// rule is checked against the resolved address as well as the name, so
+// a name can't smuggle a denied address past an earlier IP rule. A nil
+// ruleSet allows everything.
+func (rs ruleSet) allowed(host string, ip net.IP, port int) bool {
+	if rs == nil {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, r := range rs {
+		if r.matches(host, ip, port) {
+			return r.allow
+		}
+	}
+	return false
+}
+
+// resolve returns the addresses host (a name or an IP literal) may be
+// reached at on port, keeping only those the rules allow. Names are
+// resolved here rather than by the dialer so the rules judge the
+// address that is actually dialed.
+func (rs ruleSet) resolve(ctx context.Context, host string, port int) ([]net.IP, error) {
+	name := host
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] != nil {
+		name = ""
+	} else {
+		var err error
+		ips, err = net.DefaultResolver.LookupIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var allowed []net.IP
+	for _, ip := range ips {
+		if rs.allowed(name, ip, port) {
+			allowed = append(allowed, ip)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, errDenied
+	}
+	return allowed, nil
+}
+
+// dial connects to host:port, trying each allowed address in turn.
+func (rs ruleSet) dial(ctx context.Context, host string, port int) (net.Conn, error) {
+	ips, err := rs.resolve(ctx, host, port)
+	if err != nil {
+		return nil, err
+	}
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
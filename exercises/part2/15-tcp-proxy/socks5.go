@@ -0,0 +1,447 @@
+package main
+
+// SOCKS5 (RFC 1928) lets the client choose the destination of every
+// connection, instead of the proxy forwarding everything to one
+// upstream. Each connection starts with a short handshake:
+//
+//	client: VER=5 NMETHODS METHODS...        which auth methods it supports
+//	server: VER=5 METHOD                     the one chosen (0xFF: none acceptable)
+//	        ... RFC 1929 username/password exchange, if chosen ...
+//	client: VER=5 CMD RSV=0 ATYP DST.ADDR DST.PORT
+//	server: VER=5 REP RSV=0 ATYP BND.ADDR BND.PORT
+//
+// After a successful CONNECT the connection carries raw bytes to and
+// from the destination. After UDP ASSOCIATE it carries nothing; it
+// just lives as long as the UDP relay it set up may be used.
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	socksVersion = 5
+
+	methodNoAuth       = 0x00
+	methodUserPass     = 0x02
+	methodNoAcceptable = 0xFF
+
+	userPassVersion = 1
+
+	cmdConnect      = 1
+	cmdBind         = 2
+	cmdUDPAssociate = 3
+
+	atypIPv4   = 1
+	atypDomain = 3
+	atypIPv6   = 4
+
+	repSuccess         = 0
+	repFailure         = 1
+	repNotAllowed      = 2
+	repNetUnreachable  = 3
+	repHostUnreachable = 4
+	repRefused         = 5
+	repCmdUnsupported  = 7
+	repAddrUnsupported = 8
+
+	handshakeTimeout = 30 * time.Second
+
+	// A UDP ASSOCIATE client's destinations are remembered like NAT
+	// mappings: replies are let through for udpMappingTimeout after
+	// the client last sent there (RFC 4787's minimum), and at most
+	// maxUDPDestinations at once.
+	udpMappingTimeout  = 2 * time.Minute
+	maxUDPDestinations = 1024
+)
+
+var errAddrType = errors.New("unsupported address type")
+
+// socksAddr is a destination as the client gave it: a name to resolve
+// or an IP.
+type socksAddr struct {
+	host string // domain name, "" for an IP
+	ip   net.IP
+	port int
+}
+
+func (a socksAddr) String() string {
+	if a.host != "" {
+		return net.JoinHostPort(a.host, strconv.Itoa(a.port))
+	}
+	return net.JoinHostPort(a.ip.String(), strconv.Itoa(a.port))
+}
+
+type socksServer struct {
+	users    map[string]string // nil: no authentication
+	rules    ruleSet           // nil: every destination allowed
+	timeouts relayTimeouts     // for CONNECT relays
+}
+
+func (s *socksServer) serve(ctx context.Context, client net.Conn) {
+	defer client.Close()
+	// A client that stalls mid-handshake shouldn't hold a goroutine
+	// forever; the deadline is lifted once the request is handled.
+	client.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	user, err := s.negotiate(client)
+	if err != nil {
+		fmt.Println("socks:", client.RemoteAddr(), err)
+		return
+	}
+	cmd, dst, err := readRequest(client)
+	if errors.Is(err, errAddrType) {
+		writeReply(client, repAddrUnsupported, nil)
+		return
+	}
+	if err != nil {
+		fmt.Println("socks:", client.RemoteAddr(), err)
+		return
+	}
+
+	switch cmd {
+	case cmdConnect:
+		s.connect(ctx, client, user, dst)
+	case cmdUDPAssociate:
+		s.associate(ctx, client, user, dst)
+	default:
+		// BIND is for protocols like active-mode FTP, where the
+		// server connects back to the client; few tools need it.
+		writeReply(client, repCmdUnsupported, nil)
+	}
+}
+
+// negotiate picks an auth method and runs it, returning the username
+// ("" without authentication).
+func (s *socksServer) negotiate(conn net.Conn) (string, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return "", err
+	}
+	if hdr[0] != socksVersion {
+		return "", fmt.Errorf("not SOCKS5 (version %d)", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	want := byte(methodNoAuth)
+	if s.users != nil {
+		want = methodUserPass
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == want
+	}
+	if !offered {
+		conn.Write([]byte{socksVersion, methodNoAcceptable})
+		return "", errors.New("no acceptable auth method offered")
+	}
+	if _, err := conn.Write([]byte{socksVersion, want}); err != nil {
+		return "", err
+	}
+	if want == methodNoAuth {
+		return "", nil
+	}
+	return s.authenticate(conn)
+}
+
+// authenticate runs the RFC 1929 exchange:
+//
+//	client: VER=1 ULEN UNAME PLEN PASSWD
+//	server: VER=1 STATUS (0 = success)
+func (s *socksServer) authenticate(conn net.Conn) (string, error) {
+	ver := make([]byte, 2)
+	if _, err := io.ReadFull(conn, ver); err != nil {
+		return "", err
+	}
+	if ver[0] != userPassVersion {
+		return "", fmt.Errorf("bad auth version %d", ver[0])
+	}
+	user := make([]byte, ver[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return "", err
+	}
+	plen := make([]byte, 1)
+	if _, err := io.ReadFull(conn, plen); err != nil {
+		return "", err
+	}
+	pass := make([]byte, plen[0])
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return "", err
+	}
+	if !checkPassword(s.users, string(user), string(pass)) {
+		conn.Write([]byte{userPassVersion, 1})
+		return "", fmt.Errorf("authentication failed for %q", user)
+	}
+	_, err := conn.Write([]byte{userPassVersion, 0})
+	return string(user), err
+}
+
+// readRequest reads VER CMD RSV and the destination address.
+func readRequest(r io.Reader) (byte, socksAddr, error) {
+	hdr := make([]byte, 3)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, socksAddr{}, err
+	}
+	if hdr[0] != socksVersion {
+		return 0, socksAddr{}, fmt.Errorf("bad request version %d", hdr[0])
+	}
+	addr, err := readAddr(r)
+	return hdr[1], addr, err
+}
+
+// readAddr reads ATYP, the address and the port.
+func readAddr(r io.Reader) (socksAddr, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return socksAddr{}, err
+	}
+	var a socksAddr
+	switch atyp[0] {
+	case atypIPv4, atypIPv6:
+		size := net.IPv4len
+		if atyp[0] == atypIPv6 {
+			size = net.IPv6len
+		}
+		a.ip = make(net.IP, size)
+		if _, err := io.ReadFull(r, a.ip); err != nil {
+			return socksAddr{}, err
+		}
+	case atypDomain:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(r, n); err != nil {
+			return socksAddr{}, err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return socksAddr{}, err
+		}
+		a.host = string(name)
+	default:
+		return socksAddr{}, errAddrType
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return socksAddr{}, err
+	}
+	a.port = int(binary.BigEndian.Uint16(port))
+	return a, nil
+}
+
+// appendAddr encodes ATYP, address and port for a reply or a UDP
+// header. A nil addr encodes as 0.0.0.0:0.
+func appendAddr(b []byte, addr net.Addr) []byte {
+	var ip net.IP
+	port := 0
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil || ip == nil {
+		if ip4 == nil {
+			ip4 = net.IPv4zero.To4()
+		}
+		b = append(b, atypIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, atypIPv6)
+		b = append(b, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+func writeReply(conn net.Conn, rep byte, bound net.Addr) error {
+	_, err := conn.Write(appendAddr([]byte{socksVersion, rep, 0}, bound))
+	return err
+}
+
+// hostname is what the rules and the resolver should see: the name the
+// client asked for, or its address.
+func (a socksAddr) hostname() string {
+	if a.host != "" {
+		return a.host
+	}
+	return a.ip.String()
+}
+
+func (s *socksServer) connect(ctx context.Context, client net.Conn, user string, dst socksAddr) {
+	upstream, err := s.rules.dial(ctx, dst.hostname(), dst.port)
+	if err != nil {
+		writeReply(client, replyCode(err), nil)
+		fmt.Println("socks:", client.RemoteAddr(), user, "CONNECT", dst, err)
+		return
+	}
+	defer upstream.Close()
+	if err := writeReply(client, repSuccess, upstream.LocalAddr()); err != nil {
+		return
+	}
+	fmt.Println("socks:", client.RemoteAddr(), user, "CONNECT", dst, "via", upstream.RemoteAddr())
+	client.SetDeadline(time.Time{})
+	relay(client, upstream, s.timeouts)
+}
+
+// replyCode maps a resolve or dial error to the closest SOCKS reply.
+func replyCode(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, errDenied):
+		return repNotAllowed
+	case errors.As(err, &dnsErr):
+		return repHostUnreachable
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return repRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return repNetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return repHostUnreachable
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return repHostUnreachable
+	}
+	return repFailure
+}
+
+// associate sets up a UDP relay for the client. Datagrams to the relay
+// carry a small header naming their destination:
+//
+//	RSV(2)=0 FRAG(1) ATYP DST.ADDR DST.PORT DATA
+//
+// and replies come back wrapped the same way, naming their source.
+// The relay lives exactly as long as this TCP connection.
+func (s *socksServer) associate(ctx context.Context, client net.Conn, user string, dst socksAddr) {
+	// Bind on the address the client reached us on, which is one it
+	// can send to.
+	local := client.LocalAddr().(*net.TCPAddr)
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		writeReply(client, repFailure, nil)
+		return
+	}
+	defer udp.Close()
+	if err := writeReply(client, repSuccess, udp.LocalAddr()); err != nil {
+		return
+	}
+	fmt.Println("socks:", client.RemoteAddr(), user, "UDP ASSOCIATE via", udp.LocalAddr())
+
+	// Only the client that asked may use the relay: datagrams must come
+	// from its IP and, if it named one, the port it said it would use.
+	expected := &net.UDPAddr{IP: client.RemoteAddr().(*net.TCPAddr).IP}
+	if dst.ip != nil && !dst.ip.IsUnspecified() {
+		expected.IP = dst.ip
+	}
+	expected.Port = dst.port
+
+	// Names in datagrams are resolved for as long as the association
+	// lasts, even once shutdown has begun and ctx is done: draining
+	// lets existing clients finish.
+	assocCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		s.relayUDP(assocCtx, udp, expected)
+		close(done)
+	}()
+	client.SetDeadline(time.Time{})
+	io.Copy(io.Discard, client) // until the client hangs up
+	cancel()
+	udp.Close()
+	<-done
+}
+
+// relayUDP shuttles datagrams between the client and the destinations
+// it names until udp is closed.
+func (s *socksServer) relayUDP(ctx context.Context, udp *net.UDPConn, expected *net.UDPAddr) {
+	var client *net.UDPAddr // pinned by the first datagram if no port was given
+	sentTo := make(udpDestinations)
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := udp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if client == nil && from.IP.Equal(expected.IP) &&
+			(expected.Port == 0 || from.Port == expected.Port) {
+			client = from
+		}
+		if client != nil && from.String() == client.String() {
+			if to, payload, ok := s.unwrapUDP(ctx, buf[:n]); ok && sentTo.add(to.String(), time.Now()) {
+				udp.WriteToUDP(payload, to)
+			}
+			continue
+		}
+		// Like a NAT, only pass replies from hosts the client has
+		// contacted, so the relay can't be used to reach it unasked.
+		if client != nil && sentTo.contacted(from.String(), time.Now()) {
+			packet := appendAddr([]byte{0, 0, 0}, from)
+			udp.WriteToUDP(append(packet, buf[:n]...), client)
+		}
+	}
+}
+
+// udpDestinations maps the addresses a UDP ASSOCIATE client has sent
+// to to when it last did.
+type udpDestinations map[string]time.Time
+
+// add records a datagram to addr, reporting false (send nothing) if the
+// client already has maxUDPDestinations live ones.
+func (d udpDestinations) add(addr string, now time.Time) bool {
+	if _, ok := d[addr]; !ok && len(d) >= maxUDPDestinations {
+		for a, last := range d {
+			if now.Sub(last) >= udpMappingTimeout {
+				delete(d, a)
+			}
+		}
+		if len(d) >= maxUDPDestinations {
+			return false
+		}
+	}
+	d[addr] = now
+	return true
+}
+
+// contacted reports whether replies from addr may reach the client.
+func (d udpDestinations) contacted(addr string, now time.Time) bool {
+	last, ok := d[addr]
+	return ok && now.Sub(last) < udpMappingTimeout
+}
+
+// unwrapUDP parses a client datagram's header, returning where its
+// payload should go if the rules allow it.
+func (s *socksServer) unwrapUDP(ctx context.Context, packet []byte) (*net.UDPAddr, []byte, bool) {
+	if len(packet) < 4 || packet[2] != 0 {
+		return nil, nil, false // reassembling fragments is optional, and we don't
+	}
+	r := &sliceReader{b: packet[3:]}
+	dst, err := readAddr(r)
+	if err != nil {
+		return nil, nil, false
+	}
+	ips, err := s.rules.resolve(ctx, dst.hostname(), dst.port)
+	if err != nil {
+		return nil, nil, false
+	}
+	return &net.UDPAddr{IP: ips[0], Port: dst.port}, r.b, true
+}
+
+// sliceReader is a bytes.Reader that exposes what's left unread.
+type sliceReader struct{ b []byte }
+
+func (r *sliceReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	return n, nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startSOCKS runs s on a loopback port.
+func startSOCKS(t *testing.T, s *socksServer) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(context.Background(), conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// startEcho runs a TCP echo server on addr ("127.0.0.1:0" or "[::1]:0").
+func startEcho(t *testing.T, addr string) *net.TCPAddr {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip("no", addr, "on this host:", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+// socksDial performs the client side of the handshake, returning the
+// connection and the server's reply code.
+func socksDial(t *testing.T, proxy, user, pass string, cmd byte, dst []byte) (net.Conn, byte, net.Addr) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	method := byte(methodNoAuth)
+	if user != "" {
+		method = methodUserPass
+	}
+	conn.Write([]byte{socksVersion, 1, method})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != method {
+		return conn, methodNoAcceptable, nil
+	}
+	if user != "" {
+		msg := append([]byte{userPassVersion, byte(len(user))}, user...)
+		msg = append(append(msg, byte(len(pass))), pass...)
+		conn.Write(msg)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply[1] != 0 {
+			return conn, repNotAllowed, nil
+		}
+	}
+
+	conn.Write(append([]byte{socksVersion, cmd, 0}, dst...))
+	hdr := make([]byte, 3)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		t.Fatal(err)
+	}
+	bound, err := readAddr(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, hdr[1], &net.UDPAddr{IP: bound.ip, Port: bound.port}
+}
+
+func domainAddr(host string, port int) []byte {
+	b := append([]byte{atypDomain, byte(len(host))}, host...)
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+func echoes(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.Write([]byte("hello"))
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "hello" {
+		t.Fatalf("echo through proxy: %q, %v", got, err)
+	}
+}
+
+func TestSOCKSConnectAddressTypes(t *testing.T) {
+	proxy := startSOCKS(t, &socksServer{users: map[string]string{"dev": "s3cret"}})
+	v4 := startEcho(t, "127.0.0.1:0")
+
+	conn, rep, _ := socksDial(t, proxy, "dev", "s3cret", cmdConnect, appendAddr(nil, v4))
+	if rep != repSuccess {
+		t.Fatalf("IPv4 CONNECT: reply %d", rep)
+	}
+	echoes(t, conn)
+
+	conn, rep, _ = socksDial(t, proxy, "dev", "s3cret", cmdConnect, domainAddr("localhost", v4.Port))
+	if rep != repSuccess {
+		t.Fatalf("domain CONNECT: reply %d", rep)
+	}
+	echoes(t, conn)
+
+	if _, rep, _ := socksDial(t, proxy, "dev", "wrong", cmdConnect, appendAddr(nil, v4)); rep != repNotAllowed {
+		t.Fatal("wrong password accepted")
+	}
+	if _, rep, _ := socksDial(t, proxy, "", "", cmdConnect, appendAddr(nil, v4)); rep != methodNoAcceptable {
+		t.Fatal("unauthenticated client accepted")
+	}
+	if _, rep, _ := socksDial(t, proxy, "dev", "s3cret", cmdBind, appendAddr(nil, v4)); rep != repCmdUnsupported {
+		t.Fatalf("BIND: reply %d, want %d", rep, repCmdUnsupported)
+	}
+
+	v6 := startEcho(t, "[::1]:0")
+	conn, rep, _ = socksDial(t, proxy, "dev", "s3cret", cmdConnect, appendAddr(nil, v6))
+	if rep != repSuccess {
+		t.Fatalf("IPv6 CONNECT: reply %d", rep)
+	}
+	echoes(t, conn)
+}
+
+func TestSOCKSRules(t *testing.T) {
+	echo := startEcho(t, "127.0.0.1:0")
+	var rules ruleSet
+	for _, line := range []string{
+		"deny 127.0.0.0/8:" + strconv.Itoa(echo.Port+1),
+		"allow 127.0.0.0/8",
+		"deny *",
+	} {
+		r, err := parseRule(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, r)
+	}
+	proxy := startSOCKS(t, &socksServer{rules: rules})
+
+	if _, rep, _ := socksDial(t, proxy, "", "", cmdConnect, appendAddr(nil, echo)); rep != repSuccess {
+		t.Fatalf("allowed destination: reply %d", rep)
+	}
+	denied := &net.TCPAddr{IP: echo.IP, Port: echo.Port + 1}
+	if _, rep, _ := socksDial(t, proxy, "", "", cmdConnect, appendAddr(nil, denied)); rep != repNotAllowed {
+		t.Fatalf("denied port: reply %d, want %d", rep, repNotAllowed)
+	}
+	// "localhost" resolves into the allowed range; a name that doesn't
+	// resolve fails before the rules are consulted.
+	if _, rep, _ := socksDial(t, proxy, "", "", cmdConnect, domainAddr("localhost", echo.Port)); rep != repSuccess {
+		t.Fatalf("name resolving to an allowed address: reply %d", rep)
+	}
+	if _, rep, _ := socksDial(t, proxy, "", "", cmdConnect, domainAddr("no-such-host.invalid", 80)); rep != repHostUnreachable {
+		t.Fatalf("unresolvable name: reply %d, want %d", rep, repHostUnreachable)
+	}
+}
+
+func TestSOCKSUDPAssociate(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(bytes.ToUpper(buf[:n]), from)
+		}
+	}()
+
+	proxy := startSOCKS(t, &socksServer{})
+	_, rep, relayAddr := socksDial(t, proxy, "", "", cmdUDPAssociate, appendAddr(nil, nil))
+	if rep != repSuccess {
+		t.Fatalf("UDP ASSOCIATE: reply %d", rep)
+	}
+	client, err := net.DialUDP("udp", nil, relayAddr.(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	packet := appendAddr([]byte{0, 0, 0}, echo.LocalAddr())
+	client.Write(append(packet, "ping"...))
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal("no reply through the relay:", err)
+	}
+	r := &sliceReader{b: buf[3:n]}
+	from, err := readAddr(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(r.b) != "PING" || from.port != echo.LocalAddr().(*net.UDPAddr).Port {
+		t.Fatalf("got %q from %v", r.b, from)
+	}
+
+	// A stranger can't inject datagrams toward the client through the
+	// relay, even knowing its address.
+	stranger, _ := net.DialUDP("udp", nil, relayAddr.(*net.UDPAddr))
+	defer stranger.Close()
+	stranger.Write([]byte("spoof"))
+	client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := client.Read(buf); err == nil {
+		t.Fatalf("relay passed an unsolicited datagram: %q", strings.TrimSpace(string(buf[:n])))
+	}
+}
+
+func TestUDPDestinations(t *testing.T) {
+	d := make(udpDestinations)
+	now := time.Now()
+	for i := 0; i < maxUDPDestinations; i++ {
+		if !d.add("192.0.2.1:"+strconv.Itoa(i), now) {
+			t.Fatalf("destination %d refused", i)
+		}
+	}
+	if d.add("192.0.2.2:1", now) {
+		t.Fatal("accepted a destination past the limit")
+	}
+	if !d.add("192.0.2.1:0", now) || !d.contacted("192.0.2.1:0", now) {
+		t.Fatal("refused a destination already known")
+	}
+
+	// Once they've gone quiet, old destinations make room.
+	later := now.Add(udpMappingTimeout)
+	if d.contacted("192.0.2.1:1", later) {
+		t.Error("replies still allowed after the mapping timed out")
+	}
+	if !d.add("192.0.2.2:1", later) || !d.contacted("192.0.2.2:1", later) {
+		t.Fatal("new destination refused after the old ones expired")
+	}
+	if len(d) != 1 {
+		t.Errorf("%d destinations kept, want 1", len(d))
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+// Toxics for chaos mode (see chaos.go). Each toxic acts on one
+// direction of a connection: "upstream" is client to server,
+// "downstream" server to client. Data flows through them in the order
+// they were added:
+//
+//	latency     delay every chunk by latency ms, ± jitter ms
+//	bandwidth   cap throughput at rate KB/s
+//	slicer      split chunks into pieces of average_size ± size_variation
+//	            bytes, delay µs apart, as if they were separate packets
+//	timeout     black-hole the stream: data is silently dropped and the
+//	            connection left half-open; if timeout ms is set, the
+//	            connection is closed that long after the toxic applies
+//	reset_peer  reset the connection (TCP RST) timeout ms after the
+//	            toxic applies
+//
+// A toxic "applies" from when the connection opened or the toxic was
+// added, whichever is later. toxicity is the probability (0 to 1) that
+// a toxic affects any given connection; it defaults to 1.
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+type toxic struct {
+	Name       string     `json:"name"`
+	Type       string     `json:"type"`
+	Stream     string     `json:"stream"`
+	Toxicity   float64    `json:"toxicity"`
+	Attributes toxicAttrs `json:"attributes"`
+
+	added time.Time
+}
+
+type toxicAttrs struct {
+	Latency       int `json:"latency,omitempty"`        // ms (latency)
+	Jitter        int `json:"jitter,omitempty"`         // ms (latency)
+	Rate          int `json:"rate,omitempty"`           // KB/s (bandwidth)
+	AverageSize   int `json:"average_size,omitempty"`   // bytes (slicer)
+	SizeVariation int `json:"size_variation,omitempty"` // bytes (slicer)
+	Delay         int `json:"delay,omitempty"`          // µs (slicer)
+	Timeout       int `json:"timeout,omitempty"`        // ms (timeout, reset_peer)
+}
+
+func (t *toxic) validate() error {
+	a := t.Attributes
+	switch {
+	case t.Name == "":
+		return errors.New("toxic needs a name")
+	case t.Stream != "upstream" && t.Stream != "downstream":
+		return errors.New(`stream must be "upstream" or "downstream"`)
+	case t.Toxicity < 0 || t.Toxicity > 1:
+		return errors.New("toxicity must be between 0 and 1")
+	case a.Latency < 0 || a.Jitter < 0 || a.Rate < 0 || a.AverageSize < 0 ||
+		a.SizeVariation < 0 || a.Delay < 0 || a.Timeout < 0:
+		return errors.New("attributes can't be negative")
+	}
+	switch t.Type {
+	case "latency", "timeout", "reset_peer":
+	case "bandwidth":
+		if a.Rate == 0 {
+			return errors.New("bandwidth needs a rate")
+		}
+	case "slicer":
+		if a.AverageSize == 0 || a.SizeVariation >= a.AverageSize {
+			return errors.New("slicer needs an average_size larger than size_variation")
+		}
+	default:
+		return fmt.Errorf("unknown toxic type %q", t.Type)
+	}
+	return nil
+}
+
+// chunk is one read from a connection, stamped with when it arrived
+// so latency is added to the arrival time, not to time spent queued
+// behind earlier chunks.
+type chunk struct {
+	data []byte
+	at   time.Time
+}
+
+// chaosConn is one proxied connection.
+type chaosConn struct {
+	proxy            *chaosProxy
+	client, upstream net.Conn
+	start            time.Time
+	done             chan struct{} // closed when the connection is torn down
+	closeOnce        sync.Once
+
+	mu     sync.Mutex
+	rolled map[*toxic]bool // whether each toxic affects this connection
+}
+
+// affects rolls the toxic's toxicity once per connection. Updating a
+// toxic replaces it, so the new version rolls afresh.
+func (c *chaosConn) affects(t *toxic) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hit, ok := c.rolled[t]
+	if !ok {
+		hit = rand.Float64() < t.Toxicity
+		c.rolled[t] = hit
+	}
+	return hit
+}
+
+func (c *chaosConn) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.client.Close()
+		c.upstream.Close()
+	})
+}
+
+// reset closes both sides with an RST rather than a FIN.
+func (c *chaosConn) reset() {
+	for _, conn := range []net.Conn{c.client, c.upstream} {
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.SetLinger(0)
+		}
+	}
+	c.close()
+}
+
+// sleep waits for d, returning false if the connection closed first.
+func (c *chaosConn) sleep(d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// run relays both directions until either ends, then closes the
+// connection, and returns once both directions have stopped.
+func (c *chaosConn) run() {
+	go c.watch()
+	finished := make(chan struct{}, 2)
+	go func() { c.pump(c.client, c.upstream, "upstream"); finished <- struct{}{} }()
+	go func() { c.pump(c.upstream, c.client, "downstream"); finished <- struct{}{} }()
+	<-finished
+	c.close()
+	<-finished
+}
+
+// pump reads src in one goroutine and writes dst in this one, passing
+// each chunk through the stream's current toxics. Toxics are looked up
+// per chunk, so changes made through the API reach open connections.
+func (c *chaosConn) pump(src, dst net.Conn, stream string) {
+	chunks := make(chan chunk, 16)
+	go func() {
+		defer close(chunks)
+		for {
+			buf := make([]byte, 32*1024)
+			n, err := src.Read(buf)
+			if n > 0 {
+				select {
+				case chunks <- chunk{buf[:n], time.Now()}:
+				case <-c.done:
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for ch := range chunks {
+		write := func(ch chunk) error {
+			_, err := dst.Write(ch.data)
+			return err
+		}
+		toxics := c.proxy.toxicsFor(stream)
+		for i := len(toxics) - 1; i >= 0; i-- {
+			if t := toxics[i]; c.affects(t) {
+				next := write
+				write = func(ch chunk) error { return c.apply(t, ch, next) }
+			}
+		}
+		if err := write(ch); err != nil {
+			return
+		}
+	}
+}
+
+var errConnClosed = errors.New("connection closed")
+
+// apply passes ch through one toxic, handing on whatever it lets
+// through to next.
+func (c *chaosConn) apply(t *toxic, ch chunk, next func(chunk) error) error {
+	a := t.Attributes
+	switch t.Type {
+	case "latency":
+		delay := time.Duration(a.Latency) * time.Millisecond
+		if a.Jitter > 0 {
+			delay += time.Duration(rand.IntN(2*a.Jitter+1)-a.Jitter) * time.Millisecond
+		}
+		if !c.sleep(time.Until(ch.at.Add(delay))) {
+			return errConnClosed
+		}
+		return next(ch)
+
+	case "bandwidth":
+		// Send in pieces of a tenth of a second's worth, each after
+		// the time it would take to transmit, so the rate holds over
+		// short spans too.
+		rate := a.Rate * 1024
+		piece := max(rate/10, 1)
+		for data := ch.data; len(data) > 0; data = data[min(piece, len(data)):] {
+			n := min(piece, len(data))
+			if !c.sleep(time.Duration(n) * time.Second / time.Duration(rate)) {
+				return errConnClosed
+			}
+			if err := next(chunk{data[:n], ch.at}); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "slicer":
+		for data := ch.data; len(data) > 0; {
+			n := a.AverageSize
+			if a.SizeVariation > 0 {
+				n += rand.IntN(2*a.SizeVariation+1) - a.SizeVariation
+			}
+			n = min(n, len(data))
+			if err := next(chunk{data[:n], ch.at}); err != nil {
+				return err
+			}
+			if data = data[n:]; len(data) > 0 && !c.sleep(time.Duration(a.Delay)*time.Microsecond) {
+				return errConnClosed
+			}
+		}
+		return nil
+
+	case "timeout":
+		return nil // dropped; watch closes the connection if asked to
+	}
+	// reset_peer doesn't touch the data; watch handles it.
+	return next(ch)
+}
+
+// watch carries out the toxics that act on the connection as a whole
+// rather than on its data: reset_peer, and timeout with a timeout set.
+func (c *chaosConn) watch() {
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			for _, t := range c.proxy.toxicsFor("") {
+				if (t.Type != "reset_peer" && t.Type != "timeout") ||
+					(t.Type == "timeout" && t.Attributes.Timeout == 0) || !c.affects(t) {
+					continue
+				}
+				from := c.start
+				if t.added.After(from) {
+					from = t.added
+				}
+				if now.Sub(from) < time.Duration(t.Attributes.Timeout)*time.Millisecond {
+					continue
+				}
+				if t.Type == "reset_peer" {
+					c.reset()
+				} else {
+					c.close()
+				}
+				return
+			}
+		}
+	}
+}
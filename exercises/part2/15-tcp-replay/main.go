@@ -0,0 +1,219 @@
+// TCP Replay Example
+// Plays client sessions recorded by 15-tcp-proxy's -record flag back
+// against a server and diffs what the server sends now with what it
+// sent when the session was recorded. Each recorded connection gets a
+// new connection to -target (default: the recorded upstream); the
+// client's bytes are sent with the recorded timing, scaled by -speed
+// (0 sends as fast as possible), and the client hangs up when it did
+// in the recording. -ignore masks parts that change on every run,
+// such as Date headers, before comparing.
+//
+//	tcp-proxy -upstream localhost:8080 -record session.jsonl
+//	tcp-replay -record session.jsonl -ignore 'Date: [^\r]*'
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// captureEvent is one line of a -record file.
+type captureEvent struct {
+	Conn   uint64    `json:"conn"`
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"` // "open", "data" or "close"
+	Client string    `json:"client,omitempty"`
+	Server string    `json:"server,omitempty"`
+	From   string    `json:"from,omitempty"` // "client" or "server"
+	Data   []byte    `json:"data,omitempty"`
+}
+
+type replayOptions struct {
+	target  string // "": the recorded server
+	speed   float64
+	timeout time.Duration
+	ignore  *regexp.Regexp // nil: compare everything
+}
+
+// loadRecording reads a -record file, grouping events by connection
+// in the order connections were opened.
+func loadRecording(path string) ([]uint64, map[uint64][]captureEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	var order []uint64
+	conns := make(map[uint64][]captureEvent)
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var e captureEvent
+		if err := dec.Decode(&e); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if _, seen := conns[e.Conn]; !seen {
+			order = append(order, e.Conn)
+		}
+		conns[e.Conn] = append(conns[e.Conn], e)
+	}
+	return order, conns, nil
+}
+
+// replay plays one connection's client side against the server and
+// returns what the server sent back then and now.
+func replay(events []captureEvent, opts replayOptions) (recorded, got []byte, err error) {
+	if len(events) == 0 || events[0].Event != "open" {
+		return nil, nil, errors.New("recording doesn't start with an open event")
+	}
+	target := opts.target
+	if target == "" {
+		target = events[0].Server
+	}
+	conn, err := net.DialTimeout("tcp", target, 10*time.Second)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	var received bytes.Buffer
+	readDone := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(&received, conn)
+		readDone <- err
+	}()
+
+	start, recordedStart := time.Now(), events[0].Time
+	wait := func(e captureEvent) {
+		if opts.speed > 0 {
+			at := start.Add(time.Duration(float64(e.Time.Sub(recordedStart)) / opts.speed))
+			time.Sleep(time.Until(at))
+		}
+	}
+	for _, e := range events[1:] {
+		switch {
+		case e.Event == "data" && e.From == "server":
+			recorded = append(recorded, e.Data...)
+		case e.Event == "data":
+			wait(e)
+			if _, err := conn.Write(e.Data); err != nil {
+				// Stop the reader before looking at what it read.
+				conn.Close()
+				<-readDone
+				return recorded, received.Bytes(), err
+			}
+		case e.Event == "close" && e.From == "client":
+			// The client hung up first; let the server see the EOF.
+			wait(e)
+			if tcp, ok := conn.(*net.TCPConn); ok {
+				tcp.CloseWrite()
+			}
+		}
+	}
+
+	// Whatever the server hasn't sent within the timeout isn't coming.
+	conn.SetReadDeadline(time.Now().Add(opts.timeout))
+	err = <-readDone
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		err = nil
+	}
+	return recorded, received.Bytes(), err
+}
+
+// diff compares the responses, returning "" if they match (after
+// masking opts.ignore) or a description of the first difference.
+func diff(recorded, got []byte, ignore *regexp.Regexp) string {
+	if ignore != nil {
+		recorded = ignore.ReplaceAll(recorded, []byte("<ignored>"))
+		got = ignore.ReplaceAll(got, []byte("<ignored>"))
+	}
+	if bytes.Equal(recorded, got) {
+		return ""
+	}
+	i := 0
+	for i < len(recorded) && i < len(got) && recorded[i] == got[i] {
+		i++
+	}
+	line := bytes.Count(recorded[:i], []byte("\n")) + 1
+	return fmt.Sprintf("%d bytes recorded, %d received; first difference at byte %d (line %d)\n  recorded: %s\n  received: %s",
+		len(recorded), len(got), i, line, excerpt(recorded, i), excerpt(got, i))
+}
+
+// excerpt quotes the line of b containing offset i, trimmed to a
+// readable length around it.
+func excerpt(b []byte, i int) string {
+	if i >= len(b) {
+		return "(end of data)"
+	}
+	start := bytes.LastIndexByte(b[:i], '\n') + 1
+	end := len(b)
+	if n := bytes.IndexByte(b[i:], '\n'); n >= 0 {
+		end = i + n + 1
+	}
+	start, end = max(start, i-40), min(end, i+40)
+	return fmt.Sprintf("%q", b[start:end])
+}
+
+func main() {
+	recordFile := flag.String("record", "", "recording made by tcp-proxy -record (required)")
+	target := flag.String("target", "", "server to replay against (default: the recorded upstream)")
+	connID := flag.Uint64("conn", 0, "replay only this connection (default: all, in order)")
+	speed := flag.Float64("speed", 1, "timing multiplier: 2 replays twice as fast, 0 without any delays")
+	timeout := flag.Duration("timeout", 2*time.Second, "how long to wait for the rest of a response once the client is done")
+	ignore := flag.String("ignore", "", "regexp of response bytes to mask before comparing, e.g. 'Date: [^\\r]*'")
+	flag.Parse()
+	if *recordFile == "" {
+		fmt.Println("error: -record is required")
+		os.Exit(1)
+	}
+
+	opts := replayOptions{target: *target, speed: *speed, timeout: *timeout}
+	if *ignore != "" {
+		re, err := regexp.Compile(*ignore)
+		if err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		opts.ignore = re
+	}
+	order, conns, err := loadRecording(*recordFile)
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+	if *connID != 0 {
+		if conns[*connID] == nil {
+			fmt.Println("error: no connection", *connID, "in", *recordFile)
+			os.Exit(1)
+		}
+		order = []uint64{*connID}
+	}
+
+	failed := 0
+	for _, id := range order {
+		recorded, got, err := replay(conns[id], opts)
+		switch d := diff(recorded, got, opts.ignore); {
+		case err != nil:
+			fmt.Printf("conn %d: error: %v\n", id, err)
+			failed++
+		case d != "":
+			fmt.Printf("conn %d: DIFFERS: %s\n", id, strings.ReplaceAll(d, "\n", "\n  "))
+			failed++
+		default:
+			fmt.Printf("conn %d: ok (%d bytes)\n", id, len(got))
+		}
+	}
+	fmt.Printf("%d of %d connections matched\n", len(order)-failed, len(order))
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
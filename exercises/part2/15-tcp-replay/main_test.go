@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startServer answers each line with reply(line).
+func startServer(t *testing.T, reply func(string) string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					conn.Write([]byte(reply(scanner.Text()) + "\n"))
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func session(server string) []captureEvent {
+	t0 := time.Now()
+	at := func(ms int) time.Time { return t0.Add(time.Duration(ms) * time.Millisecond) }
+	return []captureEvent{
+		{Conn: 1, Time: at(0), Event: "open", Client: "127.0.0.1:5000", Server: server},
+		{Conn: 1, Time: at(10), Event: "data", From: "client", Data: []byte("hello\n")},
+		{Conn: 1, Time: at(11), Event: "data", From: "server", Data: []byte("echo hello\n")},
+		{Conn: 1, Time: at(50), Event: "data", From: "client", Data: []byte("time\n")},
+		{Conn: 1, Time: at(51), Event: "data", From: "server", Data: []byte("echo time 12:00\n")},
+		{Conn: 1, Time: at(60), Event: "close", From: "client"},
+	}
+}
+
+func TestReplayMatchesAndDiffs(t *testing.T) {
+	same := startServer(t, func(line string) string {
+		if line == "time" {
+			return "echo time " + time.Now().Format("15:04")
+		}
+		return "echo " + line
+	})
+	opts := replayOptions{speed: 1, timeout: time.Second}
+
+	start := time.Now()
+	recorded, got, err := replay(session(same), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("replay ignored the recorded timing")
+	}
+	opts.ignore = regexp.MustCompile(`\d\d:\d\d`)
+	if d := diff(recorded, got, opts.ignore); d != "" {
+		t.Fatalf("same server differs: %s", d)
+	}
+
+	changed := startServer(t, func(line string) string { return "ECHO " + strings.ToUpper(line) })
+	opts.target, opts.speed = changed, 0
+	recorded, got, err = replay(session(same), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := diff(recorded, got, opts.ignore)
+	if !strings.Contains(d, "first difference at byte 0 (line 1)") || !strings.Contains(d, `"ECHO HELLO\n"`) {
+		t.Fatalf("diff: %s", d)
+	}
+	if !bytes.HasPrefix(got, []byte("ECHO HELLO\nECHO TIME")) {
+		t.Fatalf("replayed against %s, got %q", changed, got)
+	}
+}
@@ -1,58 +1,176 @@
 // Rendezvous Server Example
-// Matches two UDP peers that register under the same session ID,
-// telling each the other's public address so they can hole-punch
+// Introduces UDP peers that join the same room, telling every member
+// every other member's candidate addresses so they can hole-punch
 // directly — see 17-udp-hole-punching for the matching peer.
+// Registrations are signed with a per-user secret (see protocol.go),
+// so knowing a room's name isn't enough to join it. With -relay-users
+// it also runs a TURN-style relay (see relay.go) for peers whose NATs
+// defeat hole punching.
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"net"
+	"os"
 	"sync"
 	"time"
 )
 
+const (
+	// maxSkew bounds how far a registration's timestamp may be from
+	// our clock; together with the nonce cache it stops replays.
+	maxSkew = 30 * time.Second
+
+	maxRoomSize   = 16
+	maxCandidates = 8
+)
+
+// pendingPeer is one registered room member. candidates lists every
+// address it might be reachable on, IPv4 or IPv6: first the
+// server-reflexive address its registration arrived from, then the
+// host addresses it reported itself.
 type pendingPeer struct {
-	addr   *net.UDPAddr
-	joined time.Time
+	user       string
+	addr       *net.UDPAddr // where registrations come from; replies go here
+	candidates []*net.UDPAddr
+	nonce      string // of its latest registration, echoed in replies
+	joined     time.Time
+}
+
+type room struct {
+	size    int
+	members []*pendingPeer
+	updated time.Time
 }
 
 type rendezvous struct {
-	mu    sync.Mutex
-	peers map[string]pendingPeer // session ID -> first peer's address
+	users map[string]string // username -> secret
+
+	mu     sync.Mutex
+	rooms  map[string]*room
+	nonces map[string]time.Time // recently seen nonce -> when to forget it
+}
+
+func newRendezvous(users map[string]string) *rendezvous {
+	return &rendezvous{
+		users:  users,
+		rooms:  make(map[string]*room),
+		nonces: make(map[string]time.Time),
+	}
 }
 
-func (r *rendezvous) handle(conn *net.UDPConn, addr *net.UDPAddr, session string) {
+func (r *rendezvous) handle(conn *net.UDPConn, addr *net.UDPAddr, msg string) {
+	reply := func(peer *pendingPeer, text string) {
+		if _, err := conn.WriteToUDP([]byte(text), peer.addr); err != nil {
+			fmt.Println("reply to", peer.user, "failed:", err)
+		}
+	}
+	fail := func(code int, reason string) {
+		// Errors go out unsigned: we may not know who's asking, and
+		// a forged error can do no more harm than a dropped packet.
+		if _, err := conn.WriteToUDP([]byte(fmt.Sprintf("ERR %d %s", code, reason)), addr); err != nil {
+			fmt.Println("error reply to", addr, "failed:", err)
+		}
+	}
+
+	j, err := parseJoin(msg, r.users)
+	switch {
+	case errors.Is(err, errUnauthorized):
+		fail(401, "unauthorized")
+		return
+	case err != nil:
+		fail(400, err.Error())
+		return
+	}
+	if skew := time.Since(j.timestamp); skew > maxSkew || skew < -maxSkew {
+		fail(408, "timestamp outside the allowed clock skew")
+		return
+	}
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	other, ok := r.peers[session]
+	if _, seen := r.nonces[j.nonce]; seen {
+		fail(409, "replayed registration")
+		return
+	}
+	r.nonces[j.nonce] = j.timestamp.Add(maxSkew)
+
+	rm, ok := r.rooms[j.room]
 	if !ok {
-		// First peer for this session: remember its address and wait.
-		r.peers[session] = pendingPeer{addr: addr, joined: time.Now()}
+		rm = &room{size: j.size}
+		r.rooms[j.room] = rm
+	}
+	if rm.size != j.size {
+		fail(409, fmt.Sprintf("room has size %d", rm.size))
 		return
 	}
 
-	// Second peer arrived: tell each peer the other's public address.
-	// Checking the error matters here — a silently dropped reply means
-	// one peer waits forever for an address that was actually sent.
-	if _, err := conn.WriteToUDP([]byte(other.addr.String()), addr); err != nil {
-		fmt.Println("notify second peer failed:", err)
+	// The address the registration came from goes first: it's the
+	// one most likely to work from outside the member's network.
+	peer := &pendingPeer{
+		user:       j.user,
+		addr:       addr,
+		candidates: []*net.UDPAddr{addr},
+		nonce:      j.nonce,
+		joined:     time.Now(),
+	}
+	for _, c := range j.candidates {
+		if c.String() != addr.String() { // no NAT in the way
+			peer.candidates = append(peer.candidates, c)
+		}
+	}
+	replaced := false
+	for i, m := range rm.members {
+		if m.user == j.user {
+			// A retransmission or a restarted peer: the newer
+			// registration wins.
+			rm.members[i] = peer
+			replaced = true
+			break
+		}
 	}
-	if _, err := conn.WriteToUDP([]byte(addr.String()), other.addr); err != nil {
-		fmt.Println("notify first peer failed:", err)
+	if !replaced {
+		if len(rm.members) == rm.size {
+			fail(403, "room is full")
+			return
+		}
+		rm.members = append(rm.members, peer)
+	}
+	rm.updated = time.Now()
+
+	if len(rm.members) < rm.size {
+		reply(peer, signLine(r.users[peer.user],
+			fmt.Sprintf("WAIT %s %s %d %d", j.room, peer.nonce, len(rm.members), rm.size)))
+		return
+	}
+
+	// The room is complete: tell every member about every other one.
+	// Checking the error matters here — a silently dropped reply means
+	// one peer waits forever for addresses that were actually sent.
+	// The room stays until swept so retransmitted registrations get
+	// the list again.
+	for _, m := range rm.members {
+		reply(m, signLine(r.users[m.user], peersLine(j.room, m, rm.members)))
 	}
-	delete(r.peers, session)
 }
 
-// sweep evicts sessions whose first peer never got a match within
-// maxAge, so an abandoned or mistyped session ID doesn't sit in
-// memory for the life of the server.
+// sweep evicts rooms nobody has registered with for maxAge, so an
+// abandoned or mistyped room name doesn't sit in memory for the life
+// of the server, and forgets nonces too old to be replayed anyway.
 func (r *rendezvous) sweep(maxAge time.Duration) {
 	for range time.Tick(30 * time.Second) {
 		r.mu.Lock()
-		for session, p := range r.peers {
-			if time.Since(p.joined) > maxAge {
-				delete(r.peers, session)
+		for name, rm := range r.rooms {
+			if time.Since(rm.updated) > maxAge {
+				delete(r.rooms, name)
+			}
+		}
+		for nonce, expires := range r.nonces {
+			if time.Now().After(expires) {
+				delete(r.nonces, nonce)
 			}
 		}
 		r.mu.Unlock()
@@ -60,23 +178,86 @@ func (r *rendezvous) sweep(maxAge time.Duration) {
 }
 
 func main() {
-	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: 9400})
+	addr := flag.String("addr", ":9400", "rendezvous listen address")
+	relayAddr := flag.String("relay", ":3479", "relay control listen address")
+	relayUsers := flag.String("relay-users", "", "file of username:password lines (enables the relay)")
+	relayIP := flag.String("relay-ip", "127.0.0.1", "IP to allocate relayed addresses on; set to this host's public IP")
+	realm := flag.String("realm", "networking-with-go", "relay authentication realm")
+	usersFile := flag.String("users", "", "file of username:secret lines for signing registrations (required)")
+	flag.Parse()
+
+	if *usersFile == "" {
+		fmt.Println("usage: 17-rendezvous-server -users <file> [flags]")
+		os.Exit(1)
+	}
+	users, err := loadUsers(*usersFile)
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+
+	laddr, err := net.ResolveUDPAddr("udp", *addr)
+	if err != nil {
+		panic(err)
+	}
+	conn, err := net.ListenUDP("udp", laddr)
 	if err != nil {
 		panic(err)
 	}
 	defer conn.Close()
-	fmt.Println("rendezvous server listening on :9400")
+	fmt.Println("rendezvous server listening on", conn.LocalAddr())
 
-	r := &rendezvous{peers: make(map[string]pendingPeer)}
+	if *relayUsers != "" {
+		if err := startRelay(*relayAddr, *relayUsers, *relayIP, *realm); err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+	}
+
+	r := newRendezvous(users)
 	go r.sweep(2 * time.Minute)
 
-	buf := make([]byte, 256)
+	r.serve(conn)
+}
+
+// serve reads registrations until conn is closed.
+func (r *rendezvous) serve(conn *net.UDPConn) {
+	buf := make([]byte, 1500)
 	for {
 		n, addr, err := conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			continue
 		}
-		session := string(buf[:n])
-		r.handle(conn, addr, session)
+		r.handle(conn, addr, string(buf[:n]))
+	}
+}
+
+func startRelay(addr, usersFile, relayIP, realm string) error {
+	users, err := loadUsers(usersFile)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(relayIP).To4()
+	if ip == nil {
+		return fmt.Errorf("relay IP %q is not an IPv4 address", relayIP)
+	}
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return err
+	}
+	relay, err := newRelayServer(conn, realm, ip, users)
+	if err != nil {
+		return err
 	}
+	go relay.sweep(30 * time.Second)
+	go relay.serve()
+	fmt.Printf("relay listening on %s, allocating on %s\n", conn.LocalAddr(), ip)
+	return nil
 }
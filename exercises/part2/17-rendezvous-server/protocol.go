@@ -0,0 +1,124 @@
+package main
+
+// The rendezvous wire format: one line of space-separated text per
+// datagram, easy to read in a packet capture. Every line except ERR
+// ends in an HMAC-SHA256 of everything before it, keyed with the
+// sending (or, for replies, receiving) user's secret. 17-udp-hole-punching
+// carries a copy of this file's signing and parsing helpers.
+//
+//	JOIN  <room> <user> <size> <unix-time> <nonce> <candidates|-> <mac>
+//	WAIT  <room> <nonce> <joined> <size> <mac>
+//	PEERS <room> <nonce> <user>=<addr>,<addr>... ... <mac>
+//	ERR   <code> <reason...>
+//
+// Candidates are comma-separated ip:port pairs, IPv6 in brackets
+// ("[2001:db8::1]:4000"). Replies echo the nonce of the recipient's
+// latest JOIN so an old reply can't be replayed at it.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errUnauthorized = errors.New("unauthorized")
+
+type joinRequest struct {
+	room       string
+	user       string
+	size       int
+	timestamp  time.Time
+	nonce      string
+	candidates []*net.UDPAddr
+}
+
+// signLine appends an HMAC-SHA256 of line, keyed with secret.
+func signLine(secret, line string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(line))
+	return line + " " + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyLine checks and strips the MAC signLine appended.
+func verifyLine(secret, msg string) (string, bool) {
+	i := strings.LastIndexByte(msg, ' ')
+	if i < 0 {
+		return "", false
+	}
+	line := msg[:i]
+	return line, hmac.Equal([]byte(signLine(secret, line)), []byte(msg))
+}
+
+// parseJoin validates a JOIN line. It returns errUnauthorized for an
+// unknown user or a bad MAC, and a descriptive error for anything
+// malformed.
+func parseJoin(msg string, users map[string]string) (*joinRequest, error) {
+	fields := strings.Fields(msg)
+	if len(fields) != 8 || fields[0] != "JOIN" {
+		return nil, errors.New("expected JOIN <room> <user> <size> <time> <nonce> <candidates> <mac>")
+	}
+	secret, ok := users[fields[2]]
+	if !ok {
+		return nil, errUnauthorized
+	}
+	if _, ok := verifyLine(secret, msg); !ok {
+		return nil, errUnauthorized
+	}
+
+	j := &joinRequest{room: fields[1], user: fields[2], nonce: fields[5]}
+	if len(j.room) > 64 {
+		return nil, errors.New("room name too long")
+	}
+	size, err := strconv.Atoi(fields[3])
+	if err != nil || size < 2 || size > maxRoomSize {
+		return nil, fmt.Errorf("room size must be 2-%d", maxRoomSize)
+	}
+	j.size = size
+	unix, err := strconv.ParseInt(fields[4], 10, 64)
+	if err != nil {
+		return nil, errors.New("bad timestamp")
+	}
+	j.timestamp = time.Unix(unix, 0)
+	if len(j.nonce) < 16 || len(j.nonce) > 64 {
+		return nil, errors.New("nonce must be 16-64 characters")
+	}
+	if fields[6] != "-" {
+		for _, c := range strings.Split(fields[6], ",") {
+			// netip parses literal addresses only, so a registration
+			// can't make us do DNS lookups.
+			ap, err := netip.ParseAddrPort(c)
+			if err != nil {
+				return nil, fmt.Errorf("bad candidate %q", c)
+			}
+			j.candidates = append(j.candidates, net.UDPAddrFromAddrPort(ap))
+		}
+		if len(j.candidates) > maxCandidates {
+			return nil, fmt.Errorf("at most %d candidates", maxCandidates)
+		}
+	}
+	return j, nil
+}
+
+// peersLine lists every member of a room except self.
+func peersLine(room string, self *pendingPeer, members []*pendingPeer) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "PEERS %s %s", room, self.nonce)
+	for _, m := range members {
+		if m == self {
+			continue
+		}
+		addrs := make([]string, len(m.candidates))
+		for i, c := range m.candidates {
+			addrs[i] = c.String()
+		}
+		fmt.Fprintf(&b, " %s=%s", m.user, strings.Join(addrs, ","))
+	}
+	return b.String()
+}
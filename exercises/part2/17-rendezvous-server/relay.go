@@ -0,0 +1,458 @@
+package main
+
+// A TURN-style relay (a subset of RFC 5766) for peers whose NATs
+// defeat hole punching. A client authenticates, asks for an
+// allocation, and gets back a relayed address: a UDP port on this
+// server that acts as its public face. Traffic then flows
+//
+//	client --Send indication--> relay --UDP from relayed addr--> peer
+//	client <--Data indication-- relay <--UDP to relayed addr---- peer
+//
+// Supported: Allocate, Refresh, CreatePermission, Send and Data
+// indications, and plain STUN Binding requests. ChannelBind, TCP
+// allocations and IPv6 relayed addresses are left out.
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TURN message types: the method in the low bits, combined with the
+// request (0x000), indication (0x010), success (0x100) or error
+// (0x110) class.
+const (
+	typeAllocateRequest   uint16 = 0x0003
+	typeAllocateSuccess   uint16 = 0x0103
+	typeRefreshRequest    uint16 = 0x0004
+	typeRefreshSuccess    uint16 = 0x0104
+	typeSendIndication    uint16 = 0x0016
+	typeDataIndication    uint16 = 0x0017
+	typePermissionRequest uint16 = 0x0008
+	typePermissionSuccess uint16 = 0x0108
+
+	// classError turns a request type into its error response type.
+	classError uint16 = 0x0110
+)
+
+const (
+	attrLifetime           uint16 = 0x000D
+	attrXORPeerAddress     uint16 = 0x0012
+	attrData               uint16 = 0x0013
+	attrXORRelayedAddress  uint16 = 0x0016
+	attrRequestedTransport uint16 = 0x0019
+)
+
+const (
+	software = "networking-with-go relay"
+
+	defaultLifetime    = 10 * time.Minute
+	maxLifetime        = time.Hour
+	permissionLifetime = 5 * time.Minute
+	nonceLifetime      = 10 * time.Minute
+
+	// maxAllocationsPerUser stops one set of credentials from
+	// exhausting the server's ports.
+	maxAllocationsPerUser = 8
+
+	protocolUDP = 17
+)
+
+// allocation is the relay state for one client 5-tuple.
+type allocation struct {
+	client   *net.UDPAddr
+	username string
+	relay    *net.UDPConn // the relayed address
+	expires  time.Time
+	perms    map[string]time.Time // peer IP -> permission expiry
+	lastTxID [12]byte             // to answer a retransmitted Allocate
+}
+
+type relayServer struct {
+	conn     *net.UDPConn
+	realm    string
+	relayIP  net.IP
+	users    map[string]string // username -> password
+	nonceKey []byte
+
+	mu     sync.Mutex
+	allocs map[string]*allocation // client address -> allocation
+}
+
+func newRelayServer(conn *net.UDPConn, realm string, relayIP net.IP, users map[string]string) (*relayServer, error) {
+	nonceKey := make([]byte, 32)
+	if _, err := rand.Read(nonceKey); err != nil {
+		return nil, err
+	}
+	return &relayServer{
+		conn:     conn,
+		realm:    realm,
+		relayIP:  relayIP,
+		users:    users,
+		nonceKey: nonceKey,
+		allocs:   make(map[string]*allocation),
+	}, nil
+}
+
+// loadUsers reads "username:password" lines. Keeping credentials in a
+// file rather than on the command line keeps them out of ps output.
+func loadUsers(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, pass, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s: expected username:password, got %q", path, line)
+		}
+		users[user] = pass
+	}
+	return users, scanner.Err()
+}
+
+// serve reads control traffic until the socket is closed.
+func (s *relayServer) serve() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		msg, err := parseSTUN(buf[:n])
+		if err != nil {
+			continue
+		}
+		s.handle(msg, from)
+	}
+}
+
+func (s *relayServer) handle(msg *stunMessage, from *net.UDPAddr) {
+	switch msg.Type {
+	case typeBindingRequest:
+		resp := &stunMessage{Type: typeBindingSuccess, TxID: msg.TxID}
+		resp.add(attrXORMappedAddress, encodeAddress(from, msg.TxID, true))
+		s.reply(resp, from, nil)
+	case typeSendIndication:
+		s.handleSend(msg, from)
+	case typeAllocateRequest, typeRefreshRequest, typePermissionRequest:
+		key, ok := s.authenticate(msg, from)
+		if !ok {
+			return
+		}
+		switch msg.Type {
+		case typeAllocateRequest:
+			s.handleAllocate(msg, from, key)
+		case typeRefreshRequest:
+			s.handleRefresh(msg, from, key)
+		case typePermissionRequest:
+			s.handlePermission(msg, from, key)
+		}
+	}
+}
+
+func (s *relayServer) reply(resp *stunMessage, to *net.UDPAddr, key []byte) {
+	resp.add(attrSoftware, []byte(software))
+	var packet []byte
+	if key != nil {
+		packet = resp.encodeSigned(key)
+	} else {
+		packet = resp.encode(true)
+	}
+	if _, err := s.conn.WriteToUDP(packet, to); err != nil {
+		fmt.Println("relay: reply to", to, "failed:", err)
+	}
+}
+
+func (s *relayServer) replyError(req *stunMessage, to *net.UDPAddr, code int, reason string, key []byte) {
+	resp := &stunMessage{Type: req.Type | classError, TxID: req.TxID}
+	resp.add(attrErrorCode, encodeErrorCode(code, reason))
+	if code == 401 || code == 438 {
+		resp.add(attrRealm, []byte(s.realm))
+		resp.add(attrNonce, []byte(s.newNonce()))
+	}
+	s.reply(resp, to, key)
+}
+
+// newNonce returns a stateless nonce: an expiry timestamp plus an
+// HMAC of it, so the server can check freshness without remembering
+// every nonce it handed out.
+func (s *relayServer) newNonce() string {
+	expiry := strconv.FormatInt(time.Now().Add(nonceLifetime).Unix(), 16)
+	mac := hmac.New(sha256.New, s.nonceKey)
+	mac.Write([]byte(expiry))
+	return expiry + "-" + hex.EncodeToString(mac.Sum(nil)[:12])
+}
+
+func (s *relayServer) nonceValid(nonce string) bool {
+	expiry, sig, ok := strings.Cut(nonce, "-")
+	if !ok {
+		return false
+	}
+	mac := hmac.New(sha256.New, s.nonceKey)
+	mac.Write([]byte(expiry))
+	if !hmac.Equal([]byte(sig), []byte(hex.EncodeToString(mac.Sum(nil)[:12]))) {
+		return false
+	}
+	unix, err := strconv.ParseInt(expiry, 16, 64)
+	return err == nil && time.Now().Unix() < unix
+}
+
+// authenticate runs the long-term credential check (RFC 5389 §10.2).
+// A request without credentials gets a 401 carrying the realm and a
+// nonce to sign with; a stale nonce gets a 438 with a fresh one.
+func (s *relayServer) authenticate(msg *stunMessage, from *net.UDPAddr) ([]byte, bool) {
+	user, hasUser := msg.get(attrUsername)
+	nonce, hasNonce := msg.get(attrNonce)
+	if msg.integrityOffset == 0 || !hasUser || !hasNonce {
+		s.replyError(msg, from, 401, "Unauthorized", nil)
+		return nil, false
+	}
+	password, known := s.users[string(user)]
+	if !known {
+		s.replyError(msg, from, 401, "Unauthorized", nil)
+		return nil, false
+	}
+	key := longTermKey(string(user), s.realm, password)
+	if !msg.verifyIntegrity(key) {
+		s.replyError(msg, from, 401, "Unauthorized", nil)
+		return nil, false
+	}
+	if !s.nonceValid(string(nonce)) {
+		s.replyError(msg, from, 438, "Stale Nonce", key)
+		return nil, false
+	}
+	return key, true
+}
+
+// requestedLifetime clamps the client's LIFETIME attribute (if any)
+// to what we allow.
+func requestedLifetime(msg *stunMessage) time.Duration {
+	v, ok := msg.get(attrLifetime)
+	if !ok || len(v) != 4 {
+		return defaultLifetime
+	}
+	d := time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+	return min(d, maxLifetime)
+}
+
+func lifetimeAttr(d time.Duration) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(d/time.Second))
+}
+
+func (s *relayServer) handleAllocate(msg *stunMessage, from *net.UDPAddr, key []byte) {
+	user, _ := msg.get(attrUsername)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if a, ok := s.allocs[from.String()]; ok {
+		if a.lastTxID == msg.TxID {
+			// A retransmission whose success response was lost: answer
+			// it again rather than treating it as a second allocation.
+			s.replyAllocated(msg, a, key)
+			return
+		}
+		s.replyError(msg, from, 437, "Allocation Mismatch", key)
+		return
+	}
+
+	transport, ok := msg.get(attrRequestedTransport)
+	if !ok || len(transport) != 4 {
+		s.replyError(msg, from, 400, "Bad Request", key)
+		return
+	}
+	if transport[0] != protocolUDP {
+		s.replyError(msg, from, 442, "Unsupported Transport Protocol", key)
+		return
+	}
+
+	count := 0
+	for _, a := range s.allocs {
+		if a.username == string(user) {
+			count++
+		}
+	}
+	if count >= maxAllocationsPerUser {
+		s.replyError(msg, from, 486, "Allocation Quota Reached", key)
+		return
+	}
+
+	relay, err := net.ListenUDP("udp4", &net.UDPAddr{IP: s.relayIP})
+	if err != nil {
+		s.replyError(msg, from, 508, "Insufficient Capacity", key)
+		return
+	}
+	a := &allocation{
+		client:   from,
+		username: string(user),
+		relay:    relay,
+		expires:  time.Now().Add(requestedLifetime(msg)),
+		perms:    make(map[string]time.Time),
+		lastTxID: msg.TxID,
+	}
+	s.allocs[from.String()] = a
+	go s.relayToClient(a)
+
+	fmt.Printf("relay: allocated %s for %s (%s)\n", relay.LocalAddr(), from, a.username)
+	s.replyAllocated(msg, a, key)
+}
+
+func (s *relayServer) replyAllocated(msg *stunMessage, a *allocation, key []byte) {
+	resp := &stunMessage{Type: typeAllocateSuccess, TxID: msg.TxID}
+	resp.add(attrXORRelayedAddress, encodeAddress(a.relay.LocalAddr().(*net.UDPAddr), msg.TxID, true))
+	resp.add(attrXORMappedAddress, encodeAddress(a.client, msg.TxID, true))
+	resp.add(attrLifetime, lifetimeAttr(time.Until(a.expires).Round(time.Second)))
+	s.reply(resp, a.client, key)
+}
+
+// handleRefresh extends an allocation, or deletes it when the client
+// asks for a lifetime of zero.
+func (s *relayServer) handleRefresh(msg *stunMessage, from *net.UDPAddr, key []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.allocs[from.String()]
+	if !ok {
+		s.replyError(msg, from, 437, "Allocation Mismatch", key)
+		return
+	}
+	lifetime := requestedLifetime(msg)
+	if lifetime == 0 {
+		s.release(a)
+	} else {
+		a.expires = time.Now().Add(lifetime)
+	}
+	resp := &stunMessage{Type: typeRefreshSuccess, TxID: msg.TxID}
+	resp.add(attrLifetime, lifetimeAttr(lifetime))
+	s.reply(resp, from, key)
+}
+
+// handlePermission lets traffic from the given peer IPs reach the
+// client. Permissions are per IP, not per port, so a peer behind a
+// NAT that picks a new port per destination can still get through.
+func (s *relayServer) handlePermission(msg *stunMessage, from *net.UDPAddr, key []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.allocs[from.String()]
+	if !ok {
+		s.replyError(msg, from, 437, "Allocation Mismatch", key)
+		return
+	}
+	var peers []string
+	for _, attr := range msg.Attrs {
+		if attr.Type != attrXORPeerAddress {
+			continue
+		}
+		peer, err := decodeAddress(attr.Value, msg.TxID, true)
+		if err != nil {
+			s.replyError(msg, from, 400, "Bad Request", key)
+			return
+		}
+		peers = append(peers, peer.IP.String())
+	}
+	if len(peers) == 0 {
+		s.replyError(msg, from, 400, "Bad Request", key)
+		return
+	}
+	for _, ip := range peers {
+		a.perms[ip] = time.Now().Add(permissionLifetime)
+	}
+	s.reply(&stunMessage{Type: typePermissionSuccess, TxID: msg.TxID}, from, key)
+}
+
+// handleSend forwards a client's Send indication out of its relayed
+// address. Indications are unauthenticated (there is no response to
+// carry a challenge), so the allocation's 5-tuple and the permission
+// list are what stop this from being an open relay.
+func (s *relayServer) handleSend(msg *stunMessage, from *net.UDPAddr) {
+	peerAttr, ok1 := msg.get(attrXORPeerAddress)
+	data, ok2 := msg.get(attrData)
+	if !ok1 || !ok2 {
+		return
+	}
+	peer, err := decodeAddress(peerAttr, msg.TxID, true)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	a, ok := s.allocs[from.String()]
+	permitted := ok && time.Now().Before(a.perms[peer.IP.String()])
+	s.mu.Unlock()
+	if permitted {
+		a.relay.WriteToUDP(data, peer)
+	}
+}
+
+// relayToClient wraps every permitted datagram arriving at a relayed
+// address in a Data indication for its client.
+func (s *relayServer) relayToClient(a *allocation) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, peer, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			return // closed by release
+		}
+		s.mu.Lock()
+		permitted := time.Now().Before(a.perms[peer.IP.String()])
+		s.mu.Unlock()
+		if !permitted {
+			continue
+		}
+
+		txID, err := newTransactionID()
+		if err != nil {
+			continue
+		}
+		ind := &stunMessage{Type: typeDataIndication, TxID: txID}
+		ind.add(attrXORPeerAddress, encodeAddress(peer, txID, true))
+		ind.add(attrData, append([]byte(nil), buf[:n]...))
+		s.conn.WriteToUDP(ind.encode(true), a.client)
+	}
+}
+
+// release must be called with s.mu held.
+func (s *relayServer) release(a *allocation) {
+	delete(s.allocs, a.client.String())
+	a.relay.Close()
+	fmt.Printf("relay: released %s for %s\n", a.relay.LocalAddr(), a.client)
+}
+
+// sweep releases expired allocations and forgets expired permissions.
+func (s *relayServer) sweep(interval time.Duration) {
+	for range time.Tick(interval) {
+		now := time.Now()
+		s.mu.Lock()
+		for _, a := range s.allocs {
+			if now.After(a.expires) {
+				s.release(a)
+				continue
+			}
+			for ip, exp := range a.perms {
+				if now.After(exp) {
+					delete(a.perms, ip)
+				}
+			}
+		}
+		s.mu.Unlock()
+	}
+}
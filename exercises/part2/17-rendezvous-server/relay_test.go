@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// symmetricNAT simulates the kind of NAT hole punching can't get
+// through. Every new destination gets its own outside port (a fresh
+// loopback socket), and each port only accepts packets from the exact
+// address it was opened toward. The port the rendezvous server sees
+// is therefore useless to the other peer.
+type symmetricNAT struct {
+	mu       sync.Mutex
+	mappings map[string]*net.UDPConn // destination -> outside socket
+	inbox    chan natPacket
+	deadline time.Time
+	closed   chan struct{}
+}
+
+type natPacket struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+func newSymmetricNAT() *symmetricNAT {
+	return &symmetricNAT{
+		mappings: make(map[string]*net.UDPConn),
+		inbox:    make(chan natPacket, 64),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (n *symmetricNAT) WriteTo(b []byte, addr net.Addr) (int, error) {
+	dst := addr.(*net.UDPAddr)
+	n.mu.Lock()
+	outside, ok := n.mappings[dst.String()]
+	if !ok {
+		var err error
+		outside, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			n.mu.Unlock()
+			return 0, err
+		}
+		n.mappings[dst.String()] = outside
+		go n.filter(outside, dst)
+	}
+	n.mu.Unlock()
+	return outside.WriteToUDP(b, dst)
+}
+
+// filter forwards inbound packets on one mapping, dropping anything
+// not from the address the mapping was created for.
+func (n *symmetricNAT) filter(outside *net.UDPConn, dst *net.UDPAddr) {
+	buf := make([]byte, 64*1024)
+	for {
+		size, from, err := outside.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if from.String() != dst.String() {
+			continue
+		}
+		select {
+		case n.inbox <- natPacket{append([]byte(nil), buf[:size]...), from}:
+		case <-n.closed:
+			return
+		}
+	}
+}
+
+func (n *symmetricNAT) ReadFrom(b []byte) (int, net.Addr, error) {
+	n.mu.Lock()
+	deadline := n.deadline
+	n.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case p := <-n.inbox:
+		return copy(b, p.data), p.from, nil
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	case <-n.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (n *symmetricNAT) SetReadDeadline(t time.Time) error {
+	n.mu.Lock()
+	n.deadline = t
+	n.mu.Unlock()
+	return nil
+}
+
+func (n *symmetricNAT) Close() error {
+	close(n.closed)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, c := range n.mappings {
+		c.Close()
+	}
+	return nil
+}
+
+func (n *symmetricNAT) LocalAddr() net.Addr                { return &net.UDPAddr{} }
+func (n *symmetricNAT) SetDeadline(t time.Time) error      { return n.SetReadDeadline(t) }
+func (n *symmetricNAT) SetWriteDeadline(t time.Time) error { return nil }
+
+// testClient is a bare-bones TURN client speaking through any
+// net.PacketConn, so it can sit behind a symmetricNAT.
+type testClient struct {
+	t      *testing.T
+	conn   net.PacketConn
+	server *net.UDPAddr
+	user   string
+	pass   string
+	realm  string
+	nonce  string
+}
+
+// exchange sends msg (signed when the client has learned the realm)
+// and returns the response with the same transaction ID.
+func (c *testClient) exchange(msg *stunMessage) *stunMessage {
+	c.t.Helper()
+	var packet []byte
+	if c.realm != "" {
+		msg.add(attrUsername, []byte(c.user))
+		msg.add(attrRealm, []byte(c.realm))
+		msg.add(attrNonce, []byte(c.nonce))
+		packet = msg.encodeSigned(longTermKey(c.user, c.realm, c.pass))
+	} else {
+		packet = msg.encode(true)
+	}
+	if _, err := c.conn.WriteTo(packet, c.server); err != nil {
+		c.t.Fatal(err)
+	}
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer c.conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			c.t.Fatalf("no response to %#04x: %v", msg.Type, err)
+		}
+		resp, err := parseSTUN(append([]byte(nil), buf[:n]...))
+		if err == nil && resp.TxID == msg.TxID {
+			return resp
+		}
+	}
+}
+
+// request runs one authenticated request, answering the initial 401
+// challenge, and returns the final response.
+func (c *testClient) request(typ uint16, attrs func(txID [12]byte) []stunAttr) *stunMessage {
+	c.t.Helper()
+	for attempt := 0; attempt < 2; attempt++ {
+		txID, _ := newTransactionID()
+		resp := c.exchange(&stunMessage{Type: typ, TxID: txID, Attrs: attrs(txID)})
+		if resp.errorCode() != 401 || c.realm != "" {
+			return resp
+		}
+		realm, _ := resp.get(attrRealm)
+		nonce, _ := resp.get(attrNonce)
+		c.realm, c.nonce = string(realm), string(nonce)
+	}
+	c.t.Fatal("unreachable")
+	return nil
+}
+
+func (c *testClient) allocate() *net.UDPAddr {
+	c.t.Helper()
+	resp := c.request(typeAllocateRequest, func([12]byte) []stunAttr {
+		return []stunAttr{{Type: attrRequestedTransport, Value: []byte{protocolUDP, 0, 0, 0}}}
+	})
+	if resp.Type != typeAllocateSuccess {
+		c.t.Fatalf("allocate failed with %d", resp.errorCode())
+	}
+	v, _ := resp.get(attrXORRelayedAddress)
+	relayed, err := decodeAddress(v, resp.TxID, true)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return relayed
+}
+
+func (c *testClient) permit(peer *net.UDPAddr) {
+	c.t.Helper()
+	resp := c.request(typePermissionRequest, func(txID [12]byte) []stunAttr {
+		return []stunAttr{{Type: attrXORPeerAddress, Value: encodeAddress(peer, txID, true)}}
+	})
+	if resp.Type != typePermissionSuccess {
+		c.t.Fatalf("permission failed with %d", resp.errorCode())
+	}
+}
+
+func (c *testClient) refresh(lifetime uint32) *stunMessage {
+	c.t.Helper()
+	return c.request(typeRefreshRequest, func([12]byte) []stunAttr {
+		return []stunAttr{{Type: attrLifetime, Value: binary.BigEndian.AppendUint32(nil, lifetime)}}
+	})
+}
+
+func (c *testClient) send(peer *net.UDPAddr, data []byte) {
+	txID, _ := newTransactionID()
+	ind := &stunMessage{Type: typeSendIndication, TxID: txID}
+	ind.add(attrXORPeerAddress, encodeAddress(peer, txID, true))
+	ind.add(attrData, data)
+	if _, err := c.conn.WriteTo(ind.encode(true), c.server); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// receive waits for a Data indication and unwraps it.
+func (c *testClient) receive(timeout time.Duration) (*net.UDPAddr, []byte, bool) {
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			return nil, nil, false
+		}
+		msg, err := parseSTUN(append([]byte(nil), buf[:n]...))
+		if err != nil || msg.Type != typeDataIndication {
+			continue
+		}
+		peerAttr, _ := msg.get(attrXORPeerAddress)
+		data, _ := msg.get(attrData)
+		peer, err := decodeAddress(peerAttr, msg.TxID, true)
+		if err != nil {
+			continue
+		}
+		return peer, data, true
+	}
+}
+
+func listenLoopback(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func startTestRelay(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	conn := listenLoopback(t)
+	relay, err := newRelayServer(conn, "test", net.IPv4(127, 0, 0, 1).To4(), testUsers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go relay.serve()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func startTestRendezvous(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	conn := listenLoopback(t)
+	go newRendezvous(testUsers).serve(conn)
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func natClient(t *testing.T, server *net.UDPAddr, user, pass string) *testClient {
+	nat := newSymmetricNAT()
+	t.Cleanup(func() { nat.Close() })
+	return &testClient{t: t, conn: nat, server: server, user: user, pass: pass}
+}
+
+func TestRelayFallbackBetweenSymmetricNATs(t *testing.T) {
+	rendezvousAddr := startTestRendezvous(t)
+	relayAddr := startTestRelay(t)
+
+	alice := natClient(t, relayAddr, "alice", "secret")
+	bob := natClient(t, relayAddr, "bob", "hunter2")
+
+	// Direct attempt: each side learns the other's mapping toward the
+	// rendezvous server, but that mapping only accepts packets from
+	// the rendezvous server, so the punch never lands.
+	alice.conn.WriteTo([]byte(joinMsg(t, "alice", "s1", 2, "-")), rendezvousAddr)
+	bob.conn.WriteTo([]byte(joinMsg(t, "bob", "s1", 2, "-")), rendezvousAddr)
+	bobPublic := readPeers(t, alice.conn, "alice")["bob"][0]
+	alicePublic := readPeers(t, bob.conn, "bob")["alice"][0]
+	for i := 0; i < 3; i++ {
+		alice.conn.WriteTo([]byte("ping"), bobPublic)
+		bob.conn.WriteTo([]byte("ping"), alicePublic)
+	}
+	bob.conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, _, err := bob.conn.ReadFrom(make([]byte, 64)); err == nil {
+		t.Fatal("punch got through a symmetric NAT; the simulation is broken")
+	}
+
+	// Relay fallback, as the hole-punching peer does it: allocate,
+	// register the relayed address with the rendezvous server through
+	// the relay, then talk via Send and Data indications.
+	aliceRelayed := alice.allocate()
+	bobRelayed := bob.allocate()
+	for _, c := range []*testClient{alice, bob} {
+		c.permit(rendezvousAddr)
+		c.send(rendezvousAddr, []byte(joinMsg(t, c.user, "s1/relay", 2, "-")))
+	}
+	for _, c := range []*testClient{alice, bob} {
+		var peers map[string][]*net.UDPAddr
+		for peers == nil {
+			from, data, ok := c.receive(2 * time.Second)
+			if !ok || from.String() != rendezvousAddr.String() {
+				t.Fatalf("%s: no relayed rendezvous reply", c.user)
+			}
+			kind, p := parseReply(t, c.user, string(data))
+			if kind == "PEERS" {
+				peers = p
+			}
+		}
+		other, want := "bob", bobRelayed
+		if c == bob {
+			other, want = "alice", aliceRelayed
+		}
+		if got := peers[other]; len(got) != 1 || got[0].String() != want.String() {
+			t.Fatalf("%s: rendezvous reported %v, want %s", c.user, got, want)
+		}
+		c.permit(want)
+	}
+
+	alice.send(bobRelayed, []byte("hello bob"))
+	from, data, ok := bob.receive(2 * time.Second)
+	if !ok || string(data) != "hello bob" || from.String() != aliceRelayed.String() {
+		t.Fatalf("bob got %q from %v, ok=%v", data, from, ok)
+	}
+	bob.send(aliceRelayed, []byte("hello alice"))
+	if _, data, ok := alice.receive(2 * time.Second); !ok || string(data) != "hello alice" {
+		t.Fatalf("alice got %q, ok=%v", data, ok)
+	}
+}
+
+func TestRelayRejectsBadCredentials(t *testing.T) {
+	relayAddr := startTestRelay(t)
+	c := &testClient{t: t, conn: listenLoopback(t), server: relayAddr, user: "alice", pass: "wrong"}
+
+	txID, _ := newTransactionID()
+	resp := c.exchange(&stunMessage{Type: typeAllocateRequest, TxID: txID})
+	if resp.errorCode() != 401 {
+		t.Fatalf("unauthenticated allocate: got %d, want 401", resp.errorCode())
+	}
+	if _, ok := resp.get(attrNonce); !ok {
+		t.Fatal("401 carries no NONCE")
+	}
+
+	resp = c.request(typeAllocateRequest, func([12]byte) []stunAttr {
+		return []stunAttr{{Type: attrRequestedTransport, Value: []byte{protocolUDP, 0, 0, 0}}}
+	})
+	if resp.errorCode() != 401 {
+		t.Fatalf("wrong password: got %d, want 401", resp.errorCode())
+	}
+}
+
+func TestRelayEnforcesPermissions(t *testing.T) {
+	relayAddr := startTestRelay(t)
+	c := &testClient{t: t, conn: listenLoopback(t), server: relayAddr, user: "alice", pass: "secret"}
+	c.allocate()
+
+	target := listenLoopback(t)
+	targetAddr := target.LocalAddr().(*net.UDPAddr)
+	buf := make([]byte, 64)
+
+	c.send(targetAddr, []byte("denied"))
+	target.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, _, err := target.ReadFromUDP(buf); err == nil {
+		t.Fatal("relay forwarded a Send without a permission")
+	}
+
+	c.permit(targetAddr)
+	c.send(targetAddr, []byte("allowed"))
+	target.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := target.ReadFromUDP(buf)
+	if err != nil || !bytes.Equal(buf[:n], []byte("allowed")) {
+		t.Fatalf("permitted Send: got %q, %v", buf[:n], err)
+	}
+}
+
+func TestRelayRefreshZeroReleases(t *testing.T) {
+	relayAddr := startTestRelay(t)
+	c := &testClient{t: t, conn: listenLoopback(t), server: relayAddr, user: "bob", pass: "hunter2"}
+	c.allocate()
+
+	if resp := c.refresh(600); resp.Type != typeRefreshSuccess {
+		t.Fatalf("refresh failed with %d", resp.errorCode())
+	}
+	if resp := c.refresh(0); resp.Type != typeRefreshSuccess {
+		t.Fatalf("release failed with %d", resp.errorCode())
+	}
+	if resp := c.refresh(600); resp.errorCode() != 437 {
+		t.Fatalf("refresh after release: got %d, want 437", resp.errorCode())
+	}
+}
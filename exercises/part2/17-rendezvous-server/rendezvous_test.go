@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testUsers = map[string]string{
+	"alice": "secret",
+	"bob":   "hunter2",
+	"carol": "correct horse",
+	"dave":  "battery staple",
+}
+
+// joinMsg builds a signed JOIN the way 17-udp-hole-punching does.
+func joinMsg(t *testing.T, user, room string, size int, candidates string) string {
+	t.Helper()
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatal(err)
+	}
+	line := fmt.Sprintf("JOIN %s %s %d %d %s %s",
+		room, user, size, time.Now().Unix(), hex.EncodeToString(nonce), candidates)
+	return signLine(testUsers[user], line)
+}
+
+// parseReply checks a reply's signature (ERR aside) and returns its
+// kind and, for PEERS, the member candidates.
+func parseReply(t *testing.T, user, msg string) (string, map[string][]*net.UDPAddr) {
+	t.Helper()
+	if strings.HasPrefix(msg, "ERR ") {
+		return "ERR", nil
+	}
+	line, ok := verifyLine(testUsers[user], msg)
+	if !ok {
+		t.Fatalf("%s: bad signature on %q", user, msg)
+	}
+	fields := strings.Fields(line)
+	if fields[0] != "PEERS" {
+		return fields[0], nil
+	}
+	peers := make(map[string][]*net.UDPAddr)
+	for _, f := range fields[3:] {
+		name, list, _ := strings.Cut(f, "=")
+		for _, c := range strings.Split(list, ",") {
+			addr, err := net.ResolveUDPAddr("udp", c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			peers[name] = append(peers[name], addr)
+		}
+	}
+	return "PEERS", peers
+}
+
+func readReply(t *testing.T, conn net.PacketConn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, 1500)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal("no rendezvous reply:", err)
+	}
+	return string(buf[:n])
+}
+
+// readPeers skips WAIT replies until the room's PEERS list arrives.
+func readPeers(t *testing.T, conn net.PacketConn, user string) map[string][]*net.UDPAddr {
+	t.Helper()
+	for {
+		msg := readReply(t, conn)
+		kind, peers := parseReply(t, user, msg)
+		switch kind {
+		case "PEERS":
+			return peers
+		case "ERR":
+			t.Fatalf("%s: %s", user, msg)
+		}
+	}
+}
+
+func TestRoomOfThreeLearnsEveryCandidate(t *testing.T) {
+	server := startTestRendezvous(t)
+	conns := map[string]*net.UDPConn{}
+	for _, user := range []string{"alice", "bob", "carol"} {
+		conns[user] = listenLoopback(t)
+	}
+
+	// alice also reports an IPv6 host candidate.
+	conns["alice"].WriteToUDP([]byte(joinMsg(t, "alice", "r3", 3, "[2001:db8::1]:4000,10.0.0.5:4000")), server)
+	if kind, _ := parseReply(t, "alice", readReply(t, conns["alice"])); kind != "WAIT" {
+		t.Fatalf("first member got %s, want WAIT", kind)
+	}
+	conns["bob"].WriteToUDP([]byte(joinMsg(t, "bob", "r3", 3, "-")), server)
+	conns["carol"].WriteToUDP([]byte(joinMsg(t, "carol", "r3", 3, "-")), server)
+
+	for user, conn := range conns {
+		peers := readPeers(t, conn, user)
+		if len(peers) != 2 {
+			t.Fatalf("%s learned %d peers, want 2", user, len(peers))
+		}
+		for other, c := range conns {
+			if other == user {
+				continue
+			}
+			got := peers[other]
+			if len(got) == 0 || got[0].String() != c.LocalAddr().String() {
+				t.Fatalf("%s: %s's first candidate is %v, want its reflexive %s", user, other, got, c.LocalAddr())
+			}
+		}
+		if user != "alice" {
+			a := peers["alice"]
+			if len(a) != 3 || a[1].String() != "[2001:db8::1]:4000" {
+				t.Fatalf("%s: alice's candidates are %v", user, a)
+			}
+		}
+	}
+
+	// A fourth member is turned away explicitly.
+	dave := listenLoopback(t)
+	dave.WriteToUDP([]byte(joinMsg(t, "dave", "r3", 3, "-")), server)
+	if msg := readReply(t, dave); !strings.HasPrefix(msg, "ERR 403") {
+		t.Fatalf("fourth member got %q, want ERR 403", msg)
+	}
+}
+
+func TestRejectsForgedAndReplayedRegistrations(t *testing.T) {
+	server := startTestRendezvous(t)
+	conn := listenLoopback(t)
+
+	// Signed with the wrong secret.
+	forged := signLine("guess", fmt.Sprintf("JOIN r alice 2 %d 0123456789abcdef -", time.Now().Unix()))
+	conn.WriteToUDP([]byte(forged), server)
+	if msg := readReply(t, conn); !strings.HasPrefix(msg, "ERR 401") {
+		t.Fatalf("forged registration got %q, want ERR 401", msg)
+	}
+
+	// Unknown user.
+	conn.WriteToUDP([]byte(signLine("x", "JOIN r mallory 2 0 0123456789abcdef -")), server)
+	if msg := readReply(t, conn); !strings.HasPrefix(msg, "ERR 401") {
+		t.Fatalf("unknown user got %q, want ERR 401", msg)
+	}
+
+	// Valid once, rejected when replayed.
+	join := joinMsg(t, "alice", "r", 2, "-")
+	conn.WriteToUDP([]byte(join), server)
+	if kind, _ := parseReply(t, "alice", readReply(t, conn)); kind != "WAIT" {
+		t.Fatalf("registration got %s, want WAIT", kind)
+	}
+	attacker := listenLoopback(t)
+	attacker.WriteToUDP([]byte(join), server)
+	if msg := readReply(t, attacker); !strings.HasPrefix(msg, "ERR 409") {
+		t.Fatalf("replay got %q, want ERR 409", msg)
+	}
+
+	// Stale timestamp.
+	stale := signLine(testUsers["bob"], fmt.Sprintf("JOIN r bob 2 %d fedcba9876543210 -",
+		time.Now().Add(-time.Hour).Unix()))
+	conn.WriteToUDP([]byte(stale), server)
+	if msg := readReply(t, conn); !strings.HasPrefix(msg, "ERR 408") {
+		t.Fatalf("stale registration got %q, want ERR 408", msg)
+	}
+
+	// Size disagreeing with the room's.
+	conn.WriteToUDP([]byte(joinMsg(t, "bob", "r", 3, "-")), server)
+	if msg := readReply(t, conn); !strings.HasPrefix(msg, "ERR 409") {
+		t.Fatalf("size mismatch got %q, want ERR 409", msg)
+	}
+}
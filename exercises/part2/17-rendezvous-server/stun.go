@@ -0,0 +1,307 @@
+package main
+
+// A minimal RFC 5389 STUN message codec, copied from 17-stun-server so
+// each exercise stays a self-contained program, and extended here with
+// MESSAGE-INTEGRITY for the relay's authenticated requests (see
+// relay.go). Every STUN message is a 20-byte header followed by
+// type-length-value attributes, each padded to a multiple of 4 bytes:
+//
+//	 0                   1                   2                   3
+//	|0 0|   message type (14 bits) |        message length         |
+//	|                   magic cookie (0x2112A442)                   |
+//	|                  transaction ID (96 bits)                     |
+//	|  attributes...                                                |
+//
+// The magic cookie and the two zero bits let a server share a port
+// with other protocols and still tell STUN packets apart.
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+)
+
+const (
+	stunHeaderSize  = 20
+	stunMagicCookie = 0x2112A442
+
+	// fingerprintXOR is XORed into the CRC-32 so the FINGERPRINT of a
+	// STUN message never collides with a CRC another protocol might
+	// carry in the same position.
+	fingerprintXOR = 0x5354554e
+)
+
+// Message types: method Binding (0x001) combined with the class bits.
+const (
+	typeBindingRequest    uint16 = 0x0001
+	typeBindingIndication uint16 = 0x0011
+	typeBindingSuccess    uint16 = 0x0101
+	typeBindingError      uint16 = 0x0111
+)
+
+// Attribute types. Those below 0x8000 are "comprehension-required":
+// a server that doesn't understand one must reject the request.
+const (
+	attrMappedAddress     uint16 = 0x0001
+	attrUsername          uint16 = 0x0006
+	attrMessageIntegrity  uint16 = 0x0008
+	attrErrorCode         uint16 = 0x0009
+	attrUnknownAttributes uint16 = 0x000A
+	attrRealm             uint16 = 0x0014
+	attrNonce             uint16 = 0x0015
+	attrXORMappedAddress  uint16 = 0x0020
+	attrSoftware          uint16 = 0x8022
+	attrFingerprint       uint16 = 0x8028
+)
+
+var (
+	errNotSTUN        = errors.New("not a STUN message")
+	errBadFingerprint = errors.New("STUN fingerprint mismatch")
+)
+
+type stunAttr struct {
+	Type  uint16
+	Value []byte
+}
+
+type stunMessage struct {
+	Type  uint16
+	TxID  [12]byte
+	Attrs []stunAttr
+
+	// Set by parseSTUN so verifyIntegrity can recompute the HMAC over
+	// the exact bytes that were received.
+	raw             []byte
+	integrityOffset int
+}
+
+func newTransactionID() ([12]byte, error) {
+	var id [12]byte
+	_, err := rand.Read(id[:])
+	return id, err
+}
+
+func (m *stunMessage) add(typ uint16, value []byte) {
+	m.Attrs = append(m.Attrs, stunAttr{Type: typ, Value: value})
+}
+
+func (m *stunMessage) get(typ uint16) ([]byte, bool) {
+	for _, a := range m.Attrs {
+		if a.Type == typ {
+			return a.Value, true
+		}
+	}
+	return nil, false
+}
+
+// encode serialises m, appending a FINGERPRINT attribute last when
+// fingerprint is true.
+func (m *stunMessage) encode(fingerprint bool) []byte {
+	return m.marshal(nil, fingerprint)
+}
+
+// encodeSigned serialises m followed by MESSAGE-INTEGRITY, an
+// HMAC-SHA1 under key (see longTermKey), and FINGERPRINT.
+func (m *stunMessage) encodeSigned(key []byte) []byte {
+	return m.marshal(key, true)
+}
+
+func (m *stunMessage) marshal(key []byte, fingerprint bool) []byte {
+	b := make([]byte, stunHeaderSize, 128)
+	binary.BigEndian.PutUint16(b[0:], m.Type)
+	binary.BigEndian.PutUint32(b[4:], stunMagicCookie)
+	copy(b[8:], m.TxID[:])
+	for _, a := range m.Attrs {
+		b = appendAttr(b, a.Type, a.Value)
+	}
+	if key != nil {
+		// Like the fingerprint below, the HMAC covers everything before
+		// the attribute, with the header length already counting it.
+		binary.BigEndian.PutUint16(b[2:], uint16(len(b)-stunHeaderSize+24))
+		mac := hmac.New(sha1.New, key)
+		mac.Write(b)
+		b = appendAttr(b, attrMessageIntegrity, mac.Sum(nil))
+	}
+	if fingerprint {
+		// The CRC covers everything before the attribute, but with the
+		// header length already counting the attribute itself.
+		binary.BigEndian.PutUint16(b[2:], uint16(len(b)-stunHeaderSize+8))
+		crc := crc32.ChecksumIEEE(b) ^ fingerprintXOR
+		b = appendAttr(b, attrFingerprint, binary.BigEndian.AppendUint32(nil, crc))
+	}
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)-stunHeaderSize))
+	return b
+}
+
+func appendAttr(b []byte, typ uint16, value []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// isSTUN is a cheap check for demultiplexing: the two top bits of a
+// STUN message are zero and bytes 4-7 hold the magic cookie.
+func isSTUN(b []byte) bool {
+	return len(b) >= stunHeaderSize && b[0]&0xC0 == 0 &&
+		binary.BigEndian.Uint32(b[4:]) == stunMagicCookie
+}
+
+// parseSTUN decodes and validates a STUN message, verifying the
+// FINGERPRINT attribute if one is present.
+func parseSTUN(b []byte) (*stunMessage, error) {
+	if !isSTUN(b) {
+		return nil, errNotSTUN
+	}
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if length%4 != 0 || stunHeaderSize+length != len(b) {
+		return nil, fmt.Errorf("%w: bad length %d", errNotSTUN, length)
+	}
+
+	m := &stunMessage{Type: binary.BigEndian.Uint16(b[0:]), raw: b}
+	copy(m.TxID[:], b[8:20])
+
+	for off := stunHeaderSize; off < len(b); {
+		if off+4 > len(b) {
+			return nil, fmt.Errorf("%w: truncated attribute header", errNotSTUN)
+		}
+		typ := binary.BigEndian.Uint16(b[off:])
+		alen := int(binary.BigEndian.Uint16(b[off+2:]))
+		if off+4+alen > len(b) {
+			return nil, fmt.Errorf("%w: truncated attribute %#04x", errNotSTUN, typ)
+		}
+		value := b[off+4 : off+4+alen]
+
+		if typ == attrFingerprint {
+			// FINGERPRINT must be the last attribute; it covers
+			// everything before it.
+			if alen != 4 || off+8 != len(b) {
+				return nil, fmt.Errorf("%w: misplaced FINGERPRINT", errNotSTUN)
+			}
+			if crc32.ChecksumIEEE(b[:off])^fingerprintXOR != binary.BigEndian.Uint32(value) {
+				return nil, errBadFingerprint
+			}
+		}
+		if typ == attrMessageIntegrity && m.integrityOffset == 0 {
+			m.integrityOffset = off
+		}
+		if m.integrityOffset != 0 && off > m.integrityOffset && typ != attrFingerprint {
+			// Only FINGERPRINT may follow MESSAGE-INTEGRITY; anything
+			// else is unauthenticated and must be ignored.
+			off += 4 + (alen+3)&^3
+			continue
+		}
+		m.Attrs = append(m.Attrs, stunAttr{Type: typ, Value: value})
+		off += 4 + (alen+3)&^3
+	}
+	return m, nil
+}
+
+// encodeAddress builds a MAPPED-ADDRESS value, or an
+// XOR-MAPPED-ADDRESS value when xor is true. XORing the address with
+// the magic cookie (and transaction ID for IPv6) stops misbehaving
+// NATs from "helpfully" rewriting an IP they spot in the payload.
+func encodeAddress(addr *net.UDPAddr, txID [12]byte, xor bool) []byte {
+	family, ip := byte(0x01), addr.IP.To4()
+	if ip == nil {
+		family, ip = 0x02, addr.IP.To16()
+	}
+	v := make([]byte, 4+len(ip))
+	v[1] = family
+	port := uint16(addr.Port)
+	if xor {
+		port ^= stunMagicCookie >> 16
+	}
+	binary.BigEndian.PutUint16(v[2:], port)
+	copy(v[4:], ip)
+	if xor {
+		xorIP(v[4:], txID)
+	}
+	return v
+}
+
+// decodeAddress is the inverse of encodeAddress.
+func decodeAddress(v []byte, txID [12]byte, xor bool) (*net.UDPAddr, error) {
+	if len(v) < 4 {
+		return nil, errors.New("short address attribute")
+	}
+	var ip net.IP
+	switch v[1] {
+	case 0x01:
+		if len(v) != 8 {
+			return nil, errors.New("bad IPv4 address attribute")
+		}
+		ip = make(net.IP, 4)
+	case 0x02:
+		if len(v) != 20 {
+			return nil, errors.New("bad IPv6 address attribute")
+		}
+		ip = make(net.IP, 16)
+	default:
+		return nil, fmt.Errorf("unknown address family %d", v[1])
+	}
+	copy(ip, v[4:])
+	port := binary.BigEndian.Uint16(v[2:])
+	if xor {
+		port ^= stunMagicCookie >> 16
+		xorIP(ip, txID)
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func xorIP(ip []byte, txID [12]byte) {
+	var key [16]byte
+	binary.BigEndian.PutUint32(key[:], stunMagicCookie)
+	copy(key[4:], txID[:])
+	for i := range ip {
+		ip[i] ^= key[i]
+	}
+}
+
+// longTermKey derives the HMAC key for the long-term credential
+// mechanism (RFC 5389 §15.4): MD5(username ":" realm ":" password).
+func longTermKey(username, realm, password string) []byte {
+	sum := md5.Sum([]byte(username + ":" + realm + ":" + password))
+	return sum[:]
+}
+
+// verifyIntegrity checks the MESSAGE-INTEGRITY of a parsed message
+// against key.
+func (m *stunMessage) verifyIntegrity(key []byte) bool {
+	off := m.integrityOffset
+	if off == 0 || off+24 > len(m.raw) {
+		return false
+	}
+	// Recompute over a copy whose length field ends right after the
+	// integrity attribute, as it was when the sender signed it.
+	signed := append([]byte(nil), m.raw[:off]...)
+	binary.BigEndian.PutUint16(signed[2:], uint16(off-stunHeaderSize+24))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(signed)
+	return hmac.Equal(mac.Sum(nil), m.raw[off+4:off+24])
+}
+
+// errorCode extracts the numeric code from an ERROR-CODE attribute.
+func (m *stunMessage) errorCode() int {
+	v, ok := m.get(attrErrorCode)
+	if !ok || len(v) < 4 {
+		return 0
+	}
+	return int(v[2]&0x7)*100 + int(v[3])
+}
+
+// encodeErrorCode builds an ERROR-CODE value: the class (hundreds
+// digit) and number are stored separately, followed by a reason.
+func encodeErrorCode(code int, reason string) []byte {
+	v := []byte{0, 0, byte(code / 100), byte(code % 100)}
+	return append(v, reason...)
+}
@@ -0,0 +1,204 @@
+// STUN Server Example
+// Answers RFC 5389 Binding requests with the source address the
+// request arrived from — the client's public, NAT-mapped ("server
+// reflexive") address. 17-udp-hole-punching uses this to learn its own
+// mapping before it starts punching. See stun.go for the wire format.
+//
+// With -alt it also listens on a second IP and port and supports RFC
+// 5780 NAT behaviour discovery: clients can ask for the response to
+// come from the other IP and/or port, which is how
+// 17-udp-hole-punching -classify tells the NAT types apart. On one
+// machine, a second loopback address works: -addr 127.0.0.1:3478
+// -alt 127.0.0.2:3479.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+const software = "networking-with-go stun"
+
+// server answers on up to four sockets: every combination of the
+// primary and alternate IP with the primary and alternate port.
+// Without -alt only conns[0][0] exists.
+type server struct {
+	conns [2][2]*net.UDPConn // [ip][port]
+}
+
+func (s *server) hasAlt() bool { return s.conns[1][1] != nil }
+
+// handle builds the reply to one datagram received on conns[ip][port].
+// It returns the reply, the socket to send it from and its
+// destination, or a nil reply when nothing should be sent back.
+func (s *server) handle(packet []byte, from *net.UDPAddr, ip, port int) ([]byte, *net.UDPConn, *net.UDPAddr) {
+	req, err := parseSTUN(packet)
+	if err != nil {
+		// Not STUN, truncated, or a bad fingerprint: RFC 5389 says to
+		// drop it silently rather than answer garbage.
+		return nil, nil, nil
+	}
+	if req.Type != typeBindingRequest {
+		// Indications never get a response, and we don't implement
+		// any other method.
+		return nil, nil, nil
+	}
+
+	resp := &stunMessage{TxID: req.TxID}
+	in := s.conns[ip][port]
+
+	// Reject comprehension-required attributes we don't understand,
+	// listing them so the client knows what to drop. CHANGE-REQUEST
+	// only makes sense with an alternate address; RFC 5780 has a
+	// server without one reject it the same way.
+	var unknown []byte
+	for _, a := range req.Attrs {
+		known := a.Type == attrResponsePort || (a.Type == attrChangeRequest && s.hasAlt())
+		if a.Type < 0x8000 && !known {
+			unknown = append(unknown, byte(a.Type>>8), byte(a.Type))
+		}
+	}
+	if len(unknown) > 0 {
+		resp.Type = typeBindingError
+		resp.add(attrErrorCode, encodeErrorCode(420, "Unknown Attribute"))
+		resp.add(attrUnknownAttributes, unknown)
+		resp.add(attrSoftware, []byte(software))
+		return resp.encode(true), in, from
+	}
+
+	// Pick the socket to answer from.
+	outIP, outPort := ip, port
+	if v, ok := req.get(attrChangeRequest); ok {
+		if len(v) != 4 {
+			return s.badRequest(resp), in, from
+		}
+		if v[3]&changeIP != 0 {
+			outIP ^= 1
+		}
+		if v[3]&changePort != 0 {
+			outPort ^= 1
+		}
+	}
+	out := s.conns[outIP][outPort]
+
+	// RESPONSE-PORT sends the answer to a different port on the
+	// client's IP, which lets a client probe whether one of its
+	// mappings is still alive from another socket.
+	to := from
+	if v, ok := req.get(attrResponsePort); ok {
+		if len(v) != 4 {
+			return s.badRequest(resp), in, from
+		}
+		to = &net.UDPAddr{IP: from.IP, Port: int(v[0])<<8 | int(v[1])}
+	}
+
+	resp.Type = typeBindingSuccess
+	resp.add(attrXORMappedAddress, encodeAddress(from, req.TxID, true))
+	// Plain MAPPED-ADDRESS too, for pre-RFC 5389 (RFC 3489) clients.
+	resp.add(attrMappedAddress, encodeAddress(from, req.TxID, false))
+	if s.hasAlt() {
+		// Where the response comes from, and the address differing in
+		// both IP and port from the one the request reached, so the
+		// client knows where to send its follow-up tests.
+		resp.add(attrResponseOrigin, encodeAddress(out.LocalAddr().(*net.UDPAddr), req.TxID, false))
+		other := s.conns[ip^1][port^1].LocalAddr().(*net.UDPAddr)
+		resp.add(attrOtherAddress, encodeAddress(other, req.TxID, false))
+	}
+	resp.add(attrSoftware, []byte(software))
+	return resp.encode(true), out, to
+}
+
+func (s *server) badRequest(resp *stunMessage) []byte {
+	resp.Type = typeBindingError
+	resp.add(attrErrorCode, encodeErrorCode(400, "Bad Request"))
+	resp.add(attrSoftware, []byte(software))
+	return resp.encode(true)
+}
+
+func (s *server) serve(ip, port int) {
+	conn := s.conns[ip][port]
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		reply, out, to := s.handle(buf[:n], from, ip, port)
+		if reply == nil {
+			continue
+		}
+		if _, err := out.WriteToUDP(reply, to); err != nil {
+			fmt.Println("reply to", to, "failed:", err)
+		}
+	}
+}
+
+// listen opens the server's sockets. With an alternate address both
+// addresses need an explicit IP: the whole point is that the client
+// can tell them apart.
+func listen(addr, alt string) (*server, error) {
+	primary, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &server{}
+	if alt == "" {
+		s.conns[0][0], err = net.ListenUDP("udp", primary)
+		return s, err
+	}
+
+	secondary, err := net.ResolveUDPAddr("udp", alt)
+	if err != nil {
+		return nil, err
+	}
+	if primary.IP == nil || secondary.IP == nil || primary.IP.Equal(secondary.IP) || primary.Port == secondary.Port {
+		return nil, errors.New("-addr and -alt need two different IPs and two different ports")
+	}
+	ips := [2]net.IP{primary.IP, secondary.IP}
+	ports := [2]int{primary.Port, secondary.Port}
+	for i := range ips {
+		for p := range ports {
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ips[i], Port: ports[p]})
+			if err != nil {
+				return nil, err
+			}
+			s.conns[i][p] = conn
+		}
+	}
+	return s, nil
+}
+
+func main() {
+	addr := flag.String("addr", ":3478", "UDP listen address")
+	alt := flag.String("alt", "", "alternate ip:port for RFC 5780 NAT behaviour discovery")
+	flag.Parse()
+
+	s, err := listen(*addr, *alt)
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+
+	var wg sync.WaitGroup
+	for ip := range s.conns {
+		for port := range s.conns[ip] {
+			if s.conns[ip][port] == nil {
+				continue
+			}
+			fmt.Println("STUN server listening on", s.conns[ip][port].LocalAddr())
+			wg.Add(1)
+			go func(ip, port int) {
+				defer wg.Done()
+				s.serve(ip, port)
+			}(ip, port)
+		}
+	}
+	wg.Wait()
+}
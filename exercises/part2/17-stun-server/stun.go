@@ -0,0 +1,245 @@
+package main
+
+// A minimal RFC 5389 STUN message codec. Every STUN message is a
+// 20-byte header followed by type-length-value attributes, each
+// padded to a multiple of 4 bytes:
+//
+//	 0                   1                   2                   3
+//	|0 0|   message type (14 bits) |        message length         |
+//	|                   magic cookie (0x2112A442)                   |
+//	|                  transaction ID (96 bits)                     |
+//	|  attributes...                                                |
+//
+// The magic cookie and the two zero bits let a server share a port
+// with other protocols and still tell STUN packets apart.
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+)
+
+const (
+	stunHeaderSize  = 20
+	stunMagicCookie = 0x2112A442
+
+	// fingerprintXOR is XORed into the CRC-32 so the FINGERPRINT of a
+	// STUN message never collides with a CRC another protocol might
+	// carry in the same position.
+	fingerprintXOR = 0x5354554e
+)
+
+// Message types: method Binding (0x001) combined with the class bits.
+const (
+	typeBindingRequest    uint16 = 0x0001
+	typeBindingIndication uint16 = 0x0011
+	typeBindingSuccess    uint16 = 0x0101
+	typeBindingError      uint16 = 0x0111
+)
+
+// Attribute types. Those below 0x8000 are "comprehension-required":
+// a server that doesn't understand one must reject the request.
+const (
+	attrMappedAddress     uint16 = 0x0001
+	attrChangeRequest     uint16 = 0x0003
+	attrErrorCode         uint16 = 0x0009
+	attrUnknownAttributes uint16 = 0x000A
+	attrXORMappedAddress  uint16 = 0x0020
+	attrResponsePort      uint16 = 0x0027
+	attrSoftware          uint16 = 0x8022
+	attrFingerprint       uint16 = 0x8028
+	attrResponseOrigin    uint16 = 0x802B
+	attrOtherAddress      uint16 = 0x802C
+)
+
+// CHANGE-REQUEST flags (RFC 5780): ask the server to answer from its
+// alternate IP, its alternate port, or both.
+const (
+	changeIP   = 0x04
+	changePort = 0x02
+)
+
+var (
+	errNotSTUN        = errors.New("not a STUN message")
+	errBadFingerprint = errors.New("STUN fingerprint mismatch")
+)
+
+type stunAttr struct {
+	Type  uint16
+	Value []byte
+}
+
+type stunMessage struct {
+	Type  uint16
+	TxID  [12]byte
+	Attrs []stunAttr
+}
+
+func newTransactionID() ([12]byte, error) {
+	var id [12]byte
+	_, err := rand.Read(id[:])
+	return id, err
+}
+
+func (m *stunMessage) add(typ uint16, value []byte) {
+	m.Attrs = append(m.Attrs, stunAttr{Type: typ, Value: value})
+}
+
+func (m *stunMessage) get(typ uint16) ([]byte, bool) {
+	for _, a := range m.Attrs {
+		if a.Type == typ {
+			return a.Value, true
+		}
+	}
+	return nil, false
+}
+
+// encode serialises m, appending a FINGERPRINT attribute last when
+// fingerprint is true.
+func (m *stunMessage) encode(fingerprint bool) []byte {
+	b := make([]byte, stunHeaderSize, 128)
+	binary.BigEndian.PutUint16(b[0:], m.Type)
+	binary.BigEndian.PutUint32(b[4:], stunMagicCookie)
+	copy(b[8:], m.TxID[:])
+	for _, a := range m.Attrs {
+		b = appendAttr(b, a.Type, a.Value)
+	}
+	if fingerprint {
+		// The CRC covers everything before the attribute, but with the
+		// header length already counting the attribute itself.
+		binary.BigEndian.PutUint16(b[2:], uint16(len(b)-stunHeaderSize+8))
+		crc := crc32.ChecksumIEEE(b) ^ fingerprintXOR
+		b = appendAttr(b, attrFingerprint, binary.BigEndian.AppendUint32(nil, crc))
+	}
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)-stunHeaderSize))
+	return b
+}
+
+func appendAttr(b []byte, typ uint16, value []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// isSTUN is a cheap check for demultiplexing: the two top bits of a
+// STUN message are zero and bytes 4-7 hold the magic cookie.
+func isSTUN(b []byte) bool {
+	return len(b) >= stunHeaderSize && b[0]&0xC0 == 0 &&
+		binary.BigEndian.Uint32(b[4:]) == stunMagicCookie
+}
+
+// parseSTUN decodes and validates a STUN message, verifying the
+// FINGERPRINT attribute if one is present.
+func parseSTUN(b []byte) (*stunMessage, error) {
+	if !isSTUN(b) {
+		return nil, errNotSTUN
+	}
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if length%4 != 0 || stunHeaderSize+length != len(b) {
+		return nil, fmt.Errorf("%w: bad length %d", errNotSTUN, length)
+	}
+
+	m := &stunMessage{Type: binary.BigEndian.Uint16(b[0:])}
+	copy(m.TxID[:], b[8:20])
+
+	for off := stunHeaderSize; off < len(b); {
+		if off+4 > len(b) {
+			return nil, fmt.Errorf("%w: truncated attribute header", errNotSTUN)
+		}
+		typ := binary.BigEndian.Uint16(b[off:])
+		alen := int(binary.BigEndian.Uint16(b[off+2:]))
+		if off+4+alen > len(b) {
+			return nil, fmt.Errorf("%w: truncated attribute %#04x", errNotSTUN, typ)
+		}
+		value := b[off+4 : off+4+alen]
+
+		if typ == attrFingerprint {
+			// FINGERPRINT must be the last attribute; it covers
+			// everything before it.
+			if alen != 4 || off+8 != len(b) {
+				return nil, fmt.Errorf("%w: misplaced FINGERPRINT", errNotSTUN)
+			}
+			if crc32.ChecksumIEEE(b[:off])^fingerprintXOR != binary.BigEndian.Uint32(value) {
+				return nil, errBadFingerprint
+			}
+		}
+		m.Attrs = append(m.Attrs, stunAttr{Type: typ, Value: value})
+		off += 4 + (alen+3)&^3
+	}
+	return m, nil
+}
+
+// encodeAddress builds a MAPPED-ADDRESS value, or an
+// XOR-MAPPED-ADDRESS value when xor is true. XORing the address with
+// the magic cookie (and transaction ID for IPv6) stops misbehaving
+// NATs from "helpfully" rewriting an IP they spot in the payload.
+func encodeAddress(addr *net.UDPAddr, txID [12]byte, xor bool) []byte {
+	family, ip := byte(0x01), addr.IP.To4()
+	if ip == nil {
+		family, ip = 0x02, addr.IP.To16()
+	}
+	v := make([]byte, 4+len(ip))
+	v[1] = family
+	port := uint16(addr.Port)
+	if xor {
+		port ^= stunMagicCookie >> 16
+	}
+	binary.BigEndian.PutUint16(v[2:], port)
+	copy(v[4:], ip)
+	if xor {
+		xorIP(v[4:], txID)
+	}
+	return v
+}
+
+// decodeAddress is the inverse of encodeAddress.
+func decodeAddress(v []byte, txID [12]byte, xor bool) (*net.UDPAddr, error) {
+	if len(v) < 4 {
+		return nil, errors.New("short address attribute")
+	}
+	var ip net.IP
+	switch v[1] {
+	case 0x01:
+		if len(v) != 8 {
+			return nil, errors.New("bad IPv4 address attribute")
+		}
+		ip = make(net.IP, 4)
+	case 0x02:
+		if len(v) != 20 {
+			return nil, errors.New("bad IPv6 address attribute")
+		}
+		ip = make(net.IP, 16)
+	default:
+		return nil, fmt.Errorf("unknown address family %d", v[1])
+	}
+	copy(ip, v[4:])
+	port := binary.BigEndian.Uint16(v[2:])
+	if xor {
+		port ^= stunMagicCookie >> 16
+		xorIP(ip, txID)
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func xorIP(ip []byte, txID [12]byte) {
+	var key [16]byte
+	binary.BigEndian.PutUint32(key[:], stunMagicCookie)
+	copy(key[4:], txID[:])
+	for i := range ip {
+		ip[i] ^= key[i]
+	}
+}
+
+// encodeErrorCode builds an ERROR-CODE value: the class (hundreds
+// digit) and number are stored separately, followed by a reason.
+func encodeErrorCode(code int, reason string) []byte {
+	v := []byte{0, 0, byte(code / 100), byte(code % 100)}
+	return append(v, reason...)
+}
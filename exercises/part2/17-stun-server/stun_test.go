@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// The test vectors from RFC 5769, written out as in the RFC.
+var (
+	rfc5769Request = mustHex(`
+		00 01 00 58 21 12 a4 42 b7 e7 a7 01 bc 34 d6 86 fa 87 df ae
+		80 22 00 10 53 54 55 4e 20 74 65 73 74 20 63 6c 69 65 6e 74
+		00 24 00 04 6e 00 01 ff
+		80 29 00 08 93 2f f9 b1 51 26 3b 36
+		00 06 00 09 65 76 74 6a 3a 68 36 76 59 20 20 20
+		00 08 00 14 9a ea a7 0c bf d8 cb 56 78 1e f2 b5 b2 d3 f2 49 c1 b5 71 a2
+		80 28 00 04 e5 7a 3b cf`)
+	rfc5769IPv4Response = mustHex(`
+		01 01 00 3c 21 12 a4 42 b7 e7 a7 01 bc 34 d6 86 fa 87 df ae
+		80 22 00 0b 74 65 73 74 20 76 65 63 74 6f 72 20
+		00 20 00 08 00 01 a1 47 e1 12 a6 43
+		00 08 00 14 2b 91 f5 99 fd 9e 90 c3 8c 74 89 f9 2a f9 ba 53 f0 6b e7 d7
+		80 28 00 04 c0 7d 4c 96`)
+	rfc5769IPv6Response = mustHex(`
+		01 01 00 48 21 12 a4 42 b7 e7 a7 01 bc 34 d6 86 fa 87 df ae
+		80 22 00 0b 74 65 73 74 20 76 65 63 74 6f 72 20
+		00 20 00 14 00 02 a1 47 01 13 a9 fa a5 d3 f1 79 bc 25 f4 b5 be d2 b9 d9
+		00 08 00 14 a3 82 95 4e 4b e6 7b f1 17 84 c9 7c 82 92 c2 75 bf e3 ed 41
+		80 28 00 04 c8 fb 0b 4c`)
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestRFC5769(t *testing.T) {
+	t.Run("request", func(t *testing.T) {
+		m, err := parseSTUN(rfc5769Request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Type != typeBindingRequest {
+			t.Errorf("type %#04x", m.Type)
+		}
+		if v, _ := m.get(attrSoftware); string(v) != "STUN test client" {
+			t.Errorf("SOFTWARE %q", v)
+		}
+		if v, _ := m.get(0x0006); string(v) != "evtj:h6vY" {
+			t.Errorf("USERNAME %q", v)
+		}
+	})
+
+	for _, tt := range []struct {
+		name   string
+		packet []byte
+		want   string
+	}{
+		{"IPv4 response", rfc5769IPv4Response, "192.0.2.1:32853"},
+		{"IPv6 response", rfc5769IPv6Response, "[2001:db8:1234:5678:11:2233:4455:6677]:32853"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := parseSTUN(tt.packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Type != typeBindingSuccess {
+				t.Errorf("type %#04x", m.Type)
+			}
+			if v, _ := m.get(attrSoftware); string(v) != "test vector" {
+				t.Errorf("SOFTWARE %q", v)
+			}
+			v, ok := m.get(attrXORMappedAddress)
+			if !ok {
+				t.Fatal("no XOR-MAPPED-ADDRESS")
+			}
+			addr, err := decodeAddress(v, m.TxID, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr.String() != tt.want {
+				t.Errorf("XOR-MAPPED-ADDRESS %s, want %s", addr, tt.want)
+			}
+			// Our encoder produces the same attribute value.
+			if got := encodeAddress(addr, m.TxID, true); !bytes.Equal(got, v) {
+				t.Errorf("re-encoded %x, want %x", got, v)
+			}
+		})
+	}
+
+	t.Run("corrupted", func(t *testing.T) {
+		for _, i := range []int{9, 30, len(rfc5769IPv4Response) - 1} {
+			b := append([]byte(nil), rfc5769IPv4Response...)
+			b[i] ^= 0x01
+			if _, err := parseSTUN(b); !errors.Is(err, errBadFingerprint) {
+				t.Errorf("flipped byte %d: %v, want errBadFingerprint", i, err)
+			}
+		}
+	})
+}
+
+func TestRoundTrip(t *testing.T) {
+	txID, err := newTransactionID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v4 := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7).To4(), Port: 54321}
+	v6 := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 3478}
+	m := &stunMessage{Type: typeBindingSuccess, TxID: txID}
+	m.add(attrXORMappedAddress, encodeAddress(v4, txID, true))
+	m.add(attrMappedAddress, encodeAddress(v6, txID, false))
+	m.add(attrSoftware, []byte("odd length")) // padded on the wire
+	m.add(attrErrorCode, encodeErrorCode(420, "Unknown Attribute"))
+
+	for _, fingerprint := range []bool{false, true} {
+		b := m.encode(fingerprint)
+		if len(b)%4 != 0 || !isSTUN(b) {
+			t.Fatalf("fingerprint=%v: encoded %d bytes, isSTUN %v", fingerprint, len(b), isSTUN(b))
+		}
+		got, err := parseSTUN(b)
+		if err != nil {
+			t.Fatalf("fingerprint=%v: %v", fingerprint, err)
+		}
+		if got.Type != m.Type || got.TxID != txID {
+			t.Errorf("header %#04x %x", got.Type, got.TxID)
+		}
+		wantAttrs := len(m.Attrs)
+		if fingerprint {
+			wantAttrs++
+		}
+		if len(got.Attrs) != wantAttrs {
+			t.Fatalf("fingerprint=%v: %d attributes, want %d", fingerprint, len(got.Attrs), wantAttrs)
+		}
+		xv, _ := got.get(attrXORMappedAddress)
+		if a, err := decodeAddress(xv, txID, true); err != nil || a.String() != v4.String() {
+			t.Errorf("XOR-MAPPED-ADDRESS %v, %v", a, err)
+		}
+		mv, _ := got.get(attrMappedAddress)
+		if a, err := decodeAddress(mv, txID, false); err != nil || a.String() != v6.String() {
+			t.Errorf("MAPPED-ADDRESS %v, %v", a, err)
+		}
+		if sv, _ := got.get(attrSoftware); string(sv) != "odd length" {
+			t.Errorf("SOFTWARE %q", sv)
+		}
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	good := (&stunMessage{Type: typeBindingRequest}).encode(true)
+	tests := map[string][]byte{
+		"short":           good[:12],
+		"top bits set":    append([]byte{0xC0}, good[1:]...),
+		"no magic cookie": append(append([]byte(nil), good[:4]...), append([]byte{0, 0, 0, 0}, good[8:]...)...),
+		"length mismatch": append(append([]byte(nil), good...), 0, 0, 0, 0),
+		"attribute overrun": append(append([]byte{0, 1, 0, 4}, good[4:20]...),
+			0x80, 0x22, 0x00, 0x08),
+		"fingerprint not last": (&stunMessage{Type: typeBindingRequest, Attrs: []stunAttr{
+			{attrFingerprint, []byte{0, 0, 0, 0}}, {attrSoftware, []byte("x")},
+		}}).encode(false),
+	}
+	for name, b := range tests {
+		if _, err := parseSTUN(b); err == nil {
+			t.Errorf("%s: parsed", name)
+		}
+	}
+	if _, err := decodeAddress([]byte{0, 3, 0, 0, 1, 2, 3, 4}, [12]byte{}, false); err == nil {
+		t.Error("decoded an unknown address family")
+	}
+}
+
+func TestHandleBinding(t *testing.T) {
+	s := &server{}
+	from := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 4).To4(), Port: 40000}
+	txID, _ := newTransactionID()
+	req := &stunMessage{Type: typeBindingRequest, TxID: txID}
+
+	reply, _, to := s.handle(req.encode(true), from, 0, 0)
+	if to != from {
+		t.Errorf("reply sent to %v", to)
+	}
+	resp, err := parseSTUN(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Type != typeBindingSuccess || resp.TxID != txID {
+		t.Fatalf("reply %#04x %x", resp.Type, resp.TxID)
+	}
+	v, _ := resp.get(attrXORMappedAddress)
+	if addr, err := decodeAddress(v, txID, true); err != nil || addr.String() != from.String() {
+		t.Errorf("XOR-MAPPED-ADDRESS %v, %v", addr, err)
+	}
+
+	// Without an alternate address CHANGE-REQUEST is an unknown
+	// comprehension-required attribute.
+	req.add(attrChangeRequest, []byte{0, 0, 0, changeIP})
+	reply, _, _ = s.handle(req.encode(false), from, 0, 0)
+	if resp, err := parseSTUN(reply); err != nil || resp.Type != typeBindingError {
+		t.Fatalf("CHANGE-REQUEST without -alt: %v, %v", resp, err)
+	} else if v, _ := resp.get(attrUnknownAttributes); !bytes.Equal(v, []byte{0, 3}) {
+		t.Errorf("UNKNOWN-ATTRIBUTES %x", v)
+	}
+
+	if reply, _, _ := s.handle([]byte("not stun at all, just some bytes"), from, 0, 0); reply != nil {
+		t.Error("answered a non-STUN packet")
+	}
+}
@@ -1,23 +1,63 @@
 // UDP Hole Punching Example
-// Registers with the rendezvous server under a shared session ID,
-// then punches a hole through its own NAT toward the other peer's
-// reported public address — run with the session ID as argv[1].
+// Learns its own public address from a STUN server (see stun.go and
+// 17-stun-server), joins a room on the rendezvous server with a signed
+// registration (see rendezvous.go), then punches holes through its own
+// NAT toward every candidate address of every other member (see
+// punch.go) — run with the room name as the only argument. Members it hasn't reached after
+// -punch-timeout are reached through the TURN-style relay in
+// 17-rendezvous-server instead, when -relay is set (see turn.go).
+// Once connected, -forward and -expose tunnel TCP connections to a
+// peer over a reliable stream (see rudp.go and tunnel.go).
 package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 )
 
 func main() {
-	session := os.Args[1] // both peers must use the same session ID
+	rendezvous := flag.String("rendezvous", "rendezvous.example.com:9400", "rendezvous server address")
+	stunServer := flag.String("stun", "rendezvous.example.com:3478", "STUN server address (empty to skip)")
+	user := flag.String("user", "", "username to register as")
+	secretFile := flag.String("secret-file", "", "file holding the secret the rendezvous server has for -user")
+	roomSize := flag.Int("room-size", 2, "number of members the room waits for")
+	wait := flag.Duration("wait", time.Minute, "how long to wait for the room to fill")
+	punchTimeout := flag.Duration("punch-timeout", 15*time.Second, "how long to try hole punching before falling back to the relay")
+	relay := flag.String("relay", "", "relay server address (empty disables the fallback)")
+	relayUser := flag.String("relay-user", "", "relay username")
+	relayPassFile := flag.String("relay-pass-file", "", "file holding the relay password")
+	classify := flag.Bool("classify", false, "classify our NAT against -stun (which must run with -alt) and exit")
+	probeLifetime := flag.Duration("probe-lifetime", 0, "with -classify, also probe idle mapping lifetimes up to this long")
+	forwardAddr := flag.String("forward", "", "listen for TCP connections here and tunnel them to a peer")
+	forwardTo := flag.String("forward-to", "", "peer to tunnel -forward connections to (default: the only other member)")
+	expose := flag.String("expose", "", "TCP address to connect streams from peers to (empty refuses them)")
+	flag.Parse()
 
-	rendezvousAddr, err := net.ResolveUDPAddr(
-		"udp", "rendezvous.example.com:9400")
+	if *classify {
+		if err := runClassify(*stunServer, *probeLifetime); err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.NArg() != 1 {
+		fmt.Println("usage: 17-udp-hole-punching [flags] <room>")
+		os.Exit(1)
+	}
+	room := flag.Arg(0) // every member must use the same room name and size
+	id, err := loadIdentity(*user, *secretFile)
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+
+	rendezvousAddr, err := net.ResolveUDPAddr("udp", *rendezvous)
 	if err != nil {
 		panic(err)
 	}
@@ -27,70 +67,84 @@ func main() {
 	}
 	defer conn.Close()
 
+	// Ask STUN which public address our socket maps to. It must be the
+	// same socket we punch from: the NAT mapping belongs to this local
+	// port, and a second socket would get a different one.
+	candidates := hostCandidates(conn)
+	if *stunServer != "" {
+		reflexive, err := discoverReflexive(conn, *stunServer)
+		if err != nil {
+			fmt.Println("STUN discovery failed, continuing without it:", err)
+		} else {
+			candidates = withReflexive(reflexive, candidates)
+		}
+	}
+
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
 
-	// Register with the rendezvous server.
-	if _, err := conn.WriteToUDP([]byte(session), rendezvousAddr); err != nil {
-		panic(err)
-	}
-
-	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
-	buf := make([]byte, 64)
-	n, _, err := conn.ReadFromUDP(buf)
+	l := &link{conn: conn}
+	rooms, err := register(l, false, rendezvousAddr, id,
+		map[string]int{room: *roomSize}, candidates, *wait)
 	if err != nil {
-		panic(fmt.Errorf("no reply from rendezvous server: %w", err))
+		fmt.Println("error:", err)
+		os.Exit(1)
 	}
-	peerAddr, err := net.ResolveUDPAddr("udp", string(buf[:n]))
-	if err != nil {
-		panic(err)
+	peers := rooms[room]
+	for _, p := range peers {
+		fmt.Printf("%s: %s\n", p.user, formatCandidates(p.candidates))
 	}
-	fmt.Println("peer public address:", peerAddr)
 
-	// connected signals the punch goroutine to stop once we've heard
-	// back from the peer at least once — the hole is open, and from
-	// here on application traffic itself keeps the NAT mapping alive.
-	connected := make(chan struct{})
+	routes := punch(ctx, l, id.user, peers, *punchTimeout)
+	var unreached []roomPeer
+	for _, p := range peers {
+		if _, ok := routes[p.user]; !ok {
+			unreached = append(unreached, p)
+		}
+	}
+	if ctx.Err() != nil {
+		fmt.Println("shutting down")
+		return
+	}
 
-	// Punch: send directly to the peer's public address. The first few
-	// packets may be dropped by the peer's NAT before its own outbound
-	// packets have opened a matching hole — that's expected and why
-	// both sides keep sending on a short interval.
-	go func() {
-		ticker := time.NewTicker(500 * time.Millisecond)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-connected:
-				return
-			case <-ticker.C:
-				_, err := conn.WriteToUDP([]byte("ping"), peerAddr)
-				if err != nil {
-					fmt.Println("punch send failed:", err)
-				}
+	if len(unreached) > 0 {
+		names := make([]string, len(unreached))
+		for i, p := range unreached {
+			names[i] = p.user
+		}
+		if *relay == "" {
+			fmt.Println("hole punching to", strings.Join(names, ", "), "failed after", *punchTimeout,
+				"and no -relay is configured")
+			fmt.Println("run with -classify to see how your NAT behaves")
+			if len(routes) == 0 {
+				os.Exit(1)
 			}
+		} else {
+			fmt.Println("hole punching to", strings.Join(names, ", "), "failed, falling back to the relay")
+			if err := relayFallback(l, *relay, *relayUser, *relayPassFile, rendezvousAddr, id, room, unreached, routes); err != nil {
+				fmt.Println("error:", err)
+				os.Exit(1)
+			}
+			defer l.relay.refresh(0) // release the allocation on the way out
 		}
-	}()
+	}
 
-	announced := false
-	for {
-		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-		n, from, err := conn.ReadFromUDP(buf)
-		if err != nil {
-			select {
-			case <-ctx.Done():
-				fmt.Println("shutting down")
-				return
-			default:
-				continue // still waiting for the hole to open
-			}
+	streams := newStreamTable(l, exposeTo(*expose))
+	if *forwardAddr != "" {
+		target := *forwardTo
+		if target == "" && len(peers) == 1 {
+			target = peers[0].user
+		}
+		r, ok := routes[target]
+		if !ok {
+			fmt.Println("error: -forward-to must name a reachable member of the room")
+			os.Exit(1)
 		}
-		if !announced {
-			close(connected)
-			announced = true
+		if err := forward(ctx, *forwardAddr, streams, target, r); err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
 		}
-		fmt.Printf("received %q from %s\n", buf[:n], from)
 	}
+
+	chat(ctx, l, id.user, routes, streams)
 }
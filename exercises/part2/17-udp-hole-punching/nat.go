@@ -0,0 +1,365 @@
+package main
+
+// NAT behaviour discovery (RFC 5780), run with -classify against a
+// STUN server started with -alt. The old "full cone / restricted /
+// symmetric" labels conflate two independent properties, so RFC 5780
+// measures them separately:
+//
+//   - mapping: does the NAT reuse our public address for every
+//     destination, or hand out a new one per destination IP (or
+//     IP and port)? Hole punching depends on this — the address the
+//     rendezvous server saw must be the one the peer can reach.
+//   - filtering: which outside hosts may send to an existing mapping?
+//
+// Both are found by sending Binding requests to the server's other
+// IP and port, or asking it (with CHANGE-REQUEST) to answer from
+// them.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	attrChangeRequest  uint16 = 0x0003
+	attrResponsePort   uint16 = 0x0027
+	attrResponseOrigin uint16 = 0x802B
+	attrOtherAddress   uint16 = 0x802C
+
+	changeIP   = 0x04
+	changePort = 0x02
+)
+
+// filterTimeout bounds the tests where silence is a valid answer. It's
+// a variable so tests against a loopback server can shorten it.
+var filterTimeout = 3 * time.Second
+
+type natBehaviour int
+
+const (
+	endpointIndependent natBehaviour = iota
+	addressDependent
+	addressAndPortDependent
+)
+
+func (b natBehaviour) String() string {
+	switch b {
+	case endpointIndependent:
+		return "endpoint-independent"
+	case addressDependent:
+		return "address-dependent"
+	default:
+		return "address-and-port-dependent"
+	}
+}
+
+type natReport struct {
+	local     *net.UDPAddr
+	mapped    *net.UDPAddr
+	behindNAT bool
+	mapping   natBehaviour
+	filtering natBehaviour
+	hairpin   bool
+}
+
+// natType gives the classic name for the combination, which is still
+// what most documentation talks about.
+func (r *natReport) natType() string {
+	switch {
+	case !r.behindNAT && r.filtering == endpointIndependent:
+		return "open internet (no NAT, no filtering)"
+	case !r.behindNAT:
+		return "no NAT, but a filtering firewall"
+	case r.mapping != endpointIndependent:
+		return "symmetric NAT"
+	case r.filtering == endpointIndependent:
+		return "full-cone NAT"
+	case r.filtering == addressDependent:
+		return "restricted-cone NAT"
+	default:
+		return "port-restricted-cone NAT"
+	}
+}
+
+// p2pVerdict says whether hole punching is likely to work from here.
+func (r *natReport) p2pVerdict() string {
+	if r.mapping == endpointIndependent {
+		return "likely: the address the rendezvous server sees is the one peers can punch to"
+	}
+	return "unlikely unless the other peer has no NAT or a full-cone NAT: " +
+		"our public port changes per destination, so expect the relay fallback"
+}
+
+// runClassify is -classify: it reports how the NAT in front of us
+// behaves toward server, and optionally how long its idle mappings
+// last.
+func runClassify(server string, probeLifetime time.Duration) error {
+	serverAddr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: 0})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	report, err := classifyNAT(conn, serverAddr)
+	if err != nil {
+		return err
+	}
+	printNATReport(report)
+
+	if probeLifetime > 0 {
+		fmt.Println("probing idle mapping lifetime (this takes a while)...")
+		alive, expired, err := probeMappingLifetime(serverAddr, probeLifetime)
+		if err != nil {
+			return err
+		}
+		switch {
+		case expired == 0:
+			fmt.Printf("mapping lifetime: at least %s\n", alive)
+		case alive == 0:
+			fmt.Printf("mapping lifetime: under %s; keepalives must be very frequent\n", expired)
+		default:
+			fmt.Printf("mapping lifetime: between %s and %s; send keepalives more often than %s\n", alive, expired, alive)
+		}
+	}
+	return nil
+}
+
+// classifyNAT runs the RFC 5780 mapping, filtering and hairpinning
+// tests from conn against server.
+func classifyNAT(conn *net.UDPConn, server *net.UDPAddr) (*natReport, error) {
+	// Test I: an ordinary binding, which also tells us the server's
+	// alternate address.
+	resp, err := binding(conn, server, 0, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	mapped, err := mappedAddress(resp)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := resp.get(attrOtherAddress)
+	if !ok {
+		return nil, errors.New("server sent no OTHER-ADDRESS; start 17-stun-server with -alt")
+	}
+	other, err := decodeAddress(v, resp.TxID, false)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &natReport{
+		local:  conn.LocalAddr().(*net.UDPAddr),
+		mapped: mapped,
+	}
+	r.behindNAT = !isLocalAddr(mapped, r.local.Port)
+
+	// The filtering tests run first, while conn has only talked to the
+	// server's primary address. The mapping tests send to the other IP
+	// and port, which opens the NAT's filter to exactly the addresses
+	// the filtering tests ask to be answered from.
+	r.filtering = filteringBehaviour(conn, server)
+	if r.behindNAT {
+		if r.mapping, err = mappingBehaviour(conn, server, other, mapped); err != nil {
+			return nil, err
+		}
+		r.hairpin = hairpinning(conn, mapped)
+	}
+	return r, nil
+}
+
+// filteringBehaviour asks the server to answer from its other IP and
+// port (test II), then from its other port only (test III). Getting
+// the first answer means anyone may send to our mapping.
+func filteringBehaviour(conn *net.UDPConn, server *net.UDPAddr) natBehaviour {
+	if _, err := binding(conn, server, changeIP|changePort, filterTimeout); err == nil {
+		return endpointIndependent
+	}
+	if _, err := binding(conn, server, changePort, filterTimeout); err == nil {
+		return addressDependent
+	}
+	return addressAndPortDependent
+}
+
+// mappingBehaviour compares the mapping toward the server's primary
+// address with those toward its other IP (test II) and its other IP
+// and port (test III).
+func mappingBehaviour(conn *net.UDPConn, server, other, mapped *net.UDPAddr) (natBehaviour, error) {
+	resp, err := binding(conn, &net.UDPAddr{IP: other.IP, Port: server.Port}, 0, 5*time.Second)
+	if err != nil {
+		return 0, fmt.Errorf("mapping test II: %w", err)
+	}
+	mapped2, err := mappedAddress(resp)
+	if err != nil {
+		return 0, err
+	}
+	if mapped2.String() == mapped.String() {
+		return endpointIndependent, nil
+	}
+
+	resp, err = binding(conn, other, 0, 5*time.Second)
+	if err != nil {
+		return 0, fmt.Errorf("mapping test III: %w", err)
+	}
+	mapped3, err := mappedAddress(resp)
+	if err != nil {
+		return 0, err
+	}
+	if mapped3.String() == mapped2.String() {
+		return addressDependent, nil
+	}
+	return addressAndPortDependent, nil
+}
+
+// hairpinning sends a request to our own public address and reports
+// whether the NAT loops it back to us. Without hairpinning, two peers
+// behind the same NAT can't reach each other via their public
+// addresses.
+func hairpinning(conn *net.UDPConn, mapped *net.UDPAddr) bool {
+	txID, err := newTransactionID()
+	if err != nil {
+		return false
+	}
+	req := &stunMessage{Type: typeBindingRequest, TxID: txID}
+	if _, err := conn.WriteToUDP(req.encode(true), mapped); err != nil {
+		return false
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	conn.SetReadDeadline(time.Now().Add(filterTimeout))
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return false
+		}
+		msg, err := parseSTUN(buf[:n])
+		if err == nil && msg.TxID == txID && msg.Type == typeBindingRequest {
+			return true
+		}
+	}
+}
+
+// binding sends a Binding request with an optional CHANGE-REQUEST.
+func binding(conn *net.UDPConn, server *net.UDPAddr, change byte, timeout time.Duration) (*stunMessage, error) {
+	txID, err := newTransactionID()
+	if err != nil {
+		return nil, err
+	}
+	req := &stunMessage{Type: typeBindingRequest, TxID: txID}
+	if change != 0 {
+		req.add(attrChangeRequest, []byte{0, 0, 0, change})
+	}
+	resp, _, err := stunRoundTrip(conn, server, req, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Type != typeBindingSuccess {
+		return nil, fmt.Errorf("STUN error %d", resp.errorCode())
+	}
+	return resp, nil
+}
+
+// isLocalAddr reports whether addr is one of this host's own
+// addresses on port: the server saw us unmodified, so there is no
+// NAT in the way.
+func isLocalAddr(addr *net.UDPAddr, port int) bool {
+	if addr.Port != port {
+		return false
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// probeMappingLifetime estimates how long the NAT keeps an idle
+// mapping. For growing idle periods it creates a mapping from one
+// socket, waits, then asks the server — from a second socket, via
+// RESPONSE-PORT — to answer to the first socket's public port. The
+// answer arriving means the mapping survived. It returns the longest
+// idle period that survived and the first that didn't (zero if none
+// failed up to max).
+func probeMappingLifetime(server *net.UDPAddr, max time.Duration) (alive, expired time.Duration, err error) {
+	for idle := 5 * time.Second; idle <= max; idle *= 2 {
+		ok, err := mappingSurvives(server, idle)
+		if err != nil {
+			return alive, 0, err
+		}
+		if !ok {
+			fmt.Printf("  idle %s: expired\n", idle)
+			return alive, idle, nil
+		}
+		fmt.Printf("  idle %s: alive\n", idle)
+		alive = idle
+	}
+	return alive, 0, nil
+}
+
+func mappingSurvives(server *net.UDPAddr, idle time.Duration) (bool, error) {
+	a, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return false, err
+	}
+	defer a.Close()
+	b, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return false, err
+	}
+	defer b.Close()
+
+	mapped, err := stunBinding(a, server, 5*time.Second)
+	if err != nil {
+		return false, err
+	}
+	time.Sleep(idle)
+
+	txID, err := newTransactionID()
+	if err != nil {
+		return false, err
+	}
+	req := &stunMessage{Type: typeBindingRequest, TxID: txID}
+	req.add(attrResponsePort, []byte{byte(mapped.Port >> 8), byte(mapped.Port), 0, 0})
+	packet := req.encode(true)
+
+	buf := make([]byte, 1500)
+	for attempt := 0; attempt < 3; attempt++ {
+		if _, err := b.WriteToUDP(packet, server); err != nil {
+			return false, err
+		}
+		a.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			n, _, err := a.ReadFromUDP(buf)
+			if err != nil {
+				break // retransmit
+			}
+			if resp, err := parseSTUN(buf[:n]); err == nil && resp.TxID == txID {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func printNATReport(r *natReport) {
+	fmt.Println("local address:  ", r.local)
+	fmt.Println("public address: ", r.mapped)
+	if r.behindNAT {
+		fmt.Println("mapping:        ", r.mapping)
+		fmt.Println("hairpinning:    ", r.hairpin)
+	} else {
+		fmt.Println("mapping:         none (not behind a NAT)")
+	}
+	fmt.Println("filtering:      ", r.filtering)
+	fmt.Println("NAT type:       ", r.natType())
+	fmt.Println("direct P2P:     ", r.p2pVerdict())
+}
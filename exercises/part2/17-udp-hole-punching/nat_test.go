@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// natServer is an RFC 5780 STUN responder on two loopback IPs and two
+// ports, with a NAT simulated at its edge: it reports the public
+// address a NAT with the given mapping behaviour would have given the
+// client, and drops replies the NAT's filtering would have dropped.
+// A real NAT decides both from the packets the client has sent out,
+// which the server sees all of.
+type natServer struct {
+	conns     [2][2]*net.UDPConn // [ip][port]
+	nat       bool
+	mapping   natBehaviour
+	filtering natBehaviour
+
+	mu   sync.Mutex
+	sent map[string]bool // destination IPs and IP:ports the client has sent to
+}
+
+func startNATServer(t *testing.T, nat bool, mapping, filtering natBehaviour) *natServer {
+	t.Helper()
+	s := &natServer{nat: nat, mapping: mapping, filtering: filtering, sent: make(map[string]bool)}
+	ips := [2]net.IP{net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)}
+	for i := range ips {
+		for p := range s.conns[i] {
+			port := 0
+			if i == 1 {
+				// The other IP uses the same two ports as the primary.
+				port = s.conns[0][p].LocalAddr().(*net.UDPAddr).Port
+			}
+			conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ips[i], Port: port})
+			if err != nil {
+				t.Skipf("needs a second loopback address: %v", err)
+			}
+			t.Cleanup(func() { conn.Close() })
+			s.conns[i][p] = conn
+		}
+	}
+	for i := range s.conns {
+		for p := range s.conns[i] {
+			go s.serve(i, p)
+		}
+	}
+	return s
+}
+
+func (s *natServer) addr(ip, port int) *net.UDPAddr {
+	return s.conns[ip][port].LocalAddr().(*net.UDPAddr)
+}
+
+func (s *natServer) serve(ip, port int) {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := s.conns[ip][port].ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req, err := parseSTUN(buf[:n])
+		if err != nil || req.Type != typeBindingRequest {
+			continue
+		}
+		s.mu.Lock()
+		s.sent[s.addr(ip, port).IP.String()] = true
+		s.sent[s.addr(ip, port).String()] = true
+		s.mu.Unlock()
+
+		outIP, outPort := ip, port
+		if v, ok := req.get(attrChangeRequest); ok && len(v) == 4 {
+			if v[3]&changeIP != 0 {
+				outIP ^= 1
+			}
+			if v[3]&changePort != 0 {
+				outPort ^= 1
+			}
+		}
+		if !s.passes(s.addr(outIP, outPort)) {
+			continue
+		}
+		resp := &stunMessage{Type: typeBindingSuccess, TxID: req.TxID}
+		resp.add(attrXORMappedAddress, encodeAddress(s.mapped(from, ip, port), req.TxID, true))
+		resp.add(attrOtherAddress, encodeAddress(s.addr(ip^1, port^1), req.TxID, false))
+		s.conns[outIP][outPort].WriteToUDP(resp.encode(true), from)
+	}
+}
+
+// mapped is the client's public address toward conns[ip][port]: its
+// own address without a NAT, otherwise a port on 127.0.0.3 chosen by
+// the mapping behaviour.
+func (s *natServer) mapped(from *net.UDPAddr, ip, port int) *net.UDPAddr {
+	if !s.nat {
+		return from
+	}
+	public := 40000
+	switch s.mapping {
+	case addressDependent:
+		public += ip
+	case addressAndPortDependent:
+		public += 2*ip + port
+	}
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: public}
+}
+
+// passes reports whether the NAT lets a packet from src in.
+func (s *natServer) passes(src *net.UDPAddr) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case !s.nat, s.filtering == endpointIndependent:
+		return true
+	case s.filtering == addressDependent:
+		return s.sent[src.IP.String()]
+	default:
+		return s.sent[src.String()]
+	}
+}
+
+func TestClassifyNAT(t *testing.T) {
+	saved := filterTimeout
+	filterTimeout = 300 * time.Millisecond
+	defer func() { filterTimeout = saved }()
+
+	tests := []struct {
+		name      string
+		nat       bool
+		mapping   natBehaviour
+		filtering natBehaviour
+		natType   string
+	}{
+		{"no NAT", false, endpointIndependent, endpointIndependent, "open internet (no NAT, no filtering)"},
+		{"full cone", true, endpointIndependent, endpointIndependent, "full-cone NAT"},
+		{"restricted cone", true, endpointIndependent, addressDependent, "restricted-cone NAT"},
+		{"port-restricted cone", true, endpointIndependent, addressAndPortDependent, "port-restricted-cone NAT"},
+		{"address-dependent mapping", true, addressDependent, addressDependent, "symmetric NAT"},
+		{"symmetric", true, addressAndPortDependent, addressAndPortDependent, "symmetric NAT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startNATServer(t, tt.nat, tt.mapping, tt.filtering)
+			conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			r, err := classifyNAT(conn, s.addr(0, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.behindNAT != tt.nat {
+				t.Errorf("behind NAT: %v, want %v", r.behindNAT, tt.nat)
+			}
+			if tt.nat && r.mapping != tt.mapping {
+				t.Errorf("mapping %s, want %s", r.mapping, tt.mapping)
+			}
+			if r.filtering != tt.filtering {
+				t.Errorf("filtering %s, want %s", r.filtering, tt.filtering)
+			}
+			if r.natType() != tt.natType {
+				t.Errorf("NAT type %q, want %q", r.natType(), tt.natType)
+			}
+		})
+	}
+}
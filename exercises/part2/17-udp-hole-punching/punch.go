@@ -0,0 +1,176 @@
+package main
+
+// The peer side once the room is known: punch sends to every candidate
+// until each peer answers, and chat then keeps the paths open and
+// hands datagrams to whoever they're for — pings and pongs printed,
+// stream segments to the stream table (see rudp.go). Peers reached
+// through the relay (see turn.go) share the same socket, their
+// datagrams wrapped in TURN indications.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// link is our one UDP socket, over which we talk to some peers
+// directly and, once the relay is in use, to others wrapped in TURN
+// indications.
+type link struct {
+	conn  *net.UDPConn
+	relay *turnClient // nil until relayFallback runs
+}
+
+// route is how to reach one peer.
+type route struct {
+	addr    *net.UDPAddr // direct address, or the peer's relayed address
+	relayed bool
+}
+
+func (l *link) send(to *net.UDPAddr, viaRelay bool, b []byte) error {
+	if viaRelay {
+		return l.relay.send(to, b)
+	}
+	_, err := l.conn.WriteToUDP(b, to)
+	return err
+}
+
+// recv returns the next application datagram before deadline,
+// unwrapping Data indications from the relay and dropping other STUN
+// traffic (stray responses, retransmissions).
+func (l *link) recv(buf []byte, deadline time.Time) (data []byte, from *net.UDPAddr, relayed bool, err error) {
+	defer l.conn.SetReadDeadline(time.Time{})
+	l.conn.SetReadDeadline(deadline)
+	for {
+		n, addr, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if !isSTUN(buf[:n]) {
+			return buf[:n], addr, false, nil
+		}
+		if l.relay != nil && addr.String() == l.relay.server.String() {
+			if peer, data, ok := parseDataIndication(buf[:n]); ok {
+				return data, peer, true, nil
+			}
+		}
+	}
+}
+
+// punch sends to every candidate of every peer until each has
+// answered or timeout runs out. The first few packets may be dropped
+// by a peer's NAT before its own outbound packets have opened a
+// matching hole — that's expected and why everyone keeps sending on a
+// short interval. It returns the route to each peer it reached.
+func punch(ctx context.Context, l *link, self string, peers []roomPeer, timeout time.Duration) map[string]route {
+	routes := make(map[string]route)
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1500)
+	for len(routes) < len(peers) && time.Now().Before(deadline) && ctx.Err() == nil {
+		for _, p := range peers {
+			if _, ok := routes[p.user]; ok {
+				continue
+			}
+			for _, c := range p.candidates {
+				// A failed send (an IPv6 candidate without IPv6
+				// connectivity, say) only rules out that candidate.
+				l.send(c, false, []byte("ping "+self))
+			}
+		}
+		wait := time.Now().Add(500 * time.Millisecond)
+		for {
+			data, from, _, err := l.recv(buf, wait)
+			if err != nil {
+				break
+			}
+			// A reply may come from an address the rendezvous server
+			// never saw (a peer-reflexive address); the name inside
+			// the message, not the address, says who it is.
+			user, ok := answer(l, self, data, route{addr: from})
+			if ok && isMember(peers, user) {
+				if _, known := routes[user]; !known {
+					fmt.Println("direct path to", user, "via", from)
+				}
+				routes[user] = route{addr: from}
+			}
+		}
+	}
+	return routes
+}
+
+func isMember(peers []roomPeer, user string) bool {
+	for _, p := range peers {
+		if p.user == user {
+			return true
+		}
+	}
+	return false
+}
+
+// answer prints a datagram from a peer and replies to pings, so each
+// side sees traffic flowing both ways. It returns the sender's name.
+func answer(l *link, self string, msg []byte, r route) (string, bool) {
+	kind, user, ok := peerMessage(msg)
+	if !ok {
+		return "", false
+	}
+	fmt.Printf("received %q from %s\n", msg, r.addr)
+	if kind == "ping" {
+		l.send(r.addr, r.relayed, []byte("pong "+self))
+	}
+	return user, true
+}
+
+// chat runs once every peer has a route. Direct paths stay open on
+// their own traffic; until we've heard from a relayed peer we keep
+// pinging it, and the relay's allocation and permissions are
+// refreshed as they near expiry. Stream segments are handed to
+// streams.
+func chat(ctx context.Context, l *link, self string, routes map[string]route, streams *streamTable) {
+	heard := make(map[string]bool)
+	for user, r := range routes {
+		heard[user] = !r.relayed
+	}
+	buf := make([]byte, 64*1024)
+	for ctx.Err() == nil {
+		for user, r := range routes {
+			if !heard[user] {
+				l.send(r.addr, true, []byte("ping "+self))
+			}
+		}
+		if l.relay != nil {
+			if err := l.relay.keepAlive(); err != nil {
+				fmt.Println("relay refresh failed:", err)
+			}
+		}
+
+		data, from, relayed, err := l.recv(buf, time.Now().Add(time.Second))
+		if err != nil {
+			continue
+		}
+		r := route{addr: from, relayed: relayed}
+		if isSegment(data) {
+			if user, ok := routeOwner(routes, r); ok {
+				streams.dispatch(user, r, data)
+			}
+			continue
+		}
+		if user, ok := answer(l, self, data, r); ok {
+			heard[user] = true
+		}
+	}
+	fmt.Println("shutting down")
+}
+
+// routeOwner finds the peer a datagram arriving over r came from.
+// Stream segments carry no name, so unlike pings they're only
+// accepted from an established route.
+func routeOwner(routes map[string]route, r route) (string, bool) {
+	for user, known := range routes {
+		if known.relayed == r.relayed && known.addr.String() == r.addr.String() {
+			return user, true
+		}
+	}
+	return "", false
+}
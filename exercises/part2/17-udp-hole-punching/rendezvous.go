@@ -0,0 +1,242 @@
+package main
+
+// The client half of the rendezvous protocol; see
+// 17-rendezvous-server/protocol.go for the wire format. signLine and
+// verifyLine are copies of the server's.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// identity is who we register as: a username and the secret the
+// rendezvous server shares with it.
+type identity struct {
+	user   string
+	secret string
+}
+
+func loadIdentity(user, secretFile string) (identity, error) {
+	if user == "" || secretFile == "" {
+		return identity{}, errors.New("-user and -secret-file are required")
+	}
+	secret, err := os.ReadFile(secretFile)
+	if err != nil {
+		return identity{}, err
+	}
+	return identity{user: user, secret: strings.TrimSpace(string(secret))}, nil
+}
+
+// roomPeer is another member of our room and every address it might
+// be reachable on, most promising first.
+type roomPeer struct {
+	user       string
+	candidates []*net.UDPAddr
+}
+
+// signLine appends an HMAC-SHA256 of line, keyed with secret.
+func signLine(secret, line string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(line))
+	return line + " " + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyLine checks and strips the MAC signLine appended.
+func verifyLine(secret, msg string) (string, bool) {
+	i := strings.LastIndexByte(msg, ' ')
+	if i < 0 {
+		return "", false
+	}
+	line := msg[:i]
+	return line, hmac.Equal([]byte(signLine(secret, line)), []byte(msg))
+}
+
+// joinLine builds a signed JOIN, returning it and its nonce.
+func joinLine(id identity, room string, size int, candidates []*net.UDPAddr) (string, string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	nonce := hex.EncodeToString(b)
+	cands := "-"
+	if len(candidates) > 0 {
+		s := make([]string, len(candidates))
+		for i, c := range candidates {
+			s[i] = c.String()
+		}
+		cands = strings.Join(s, ",")
+	}
+	line := fmt.Sprintf("JOIN %s %s %d %d %s %s", room, id.user, size, time.Now().Unix(), nonce, cands)
+	return signLine(id.secret, line), nonce, nil
+}
+
+// hostCandidates lists our socket's port on every usable local
+// address, IPv4 and IPv6. Peers on the same LAN (or host) reach each
+// other through these without involving the NAT at all.
+func hostCandidates(conn *net.UDPConn) []*net.UDPAddr {
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var out []*net.UDPAddr
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() || ipnet.IP.IsMulticast() {
+			continue
+		}
+		out = append(out, &net.UDPAddr{IP: ipnet.IP, Port: port})
+		if len(out) == 7 { // the server adds our reflexive address as the 8th
+			break
+		}
+	}
+	return out
+}
+
+// withReflexive puts the server-reflexive address STUN reported ahead
+// of the host candidates, keeping the list to seven. The rendezvous
+// server's view of us usually matches it, but behind a NAT whose
+// mapping depends on the destination the two differ, and a peer may
+// get through on either.
+func withReflexive(reflexive *net.UDPAddr, host []*net.UDPAddr) []*net.UDPAddr {
+	out := []*net.UDPAddr{reflexive}
+	for _, c := range host {
+		if len(out) == 7 {
+			break
+		}
+		if c.String() != reflexive.String() { // no NAT in the way
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// register joins each of rooms (name -> size) and waits until every
+// one has filled, returning the other members of each. JOINs are
+// re-sent every two seconds until the room fills: that covers lost
+// packets and keeps our NAT mapping toward the server alive. Joining
+// all rooms at once matters for the relay's pair rooms — waiting on
+// them one at a time could deadlock three peers each waiting for the
+// next.
+func register(l *link, viaRelay bool, server *net.UDPAddr, id identity,
+	rooms map[string]int, candidates []*net.UDPAddr, wait time.Duration,
+) (map[string][]roomPeer, error) {
+	nonces := make(map[string]bool) // every nonce we sent; replies echo one
+	result := make(map[string][]roomPeer)
+	waiting := make(map[string]string) // room -> members joined, as last reported
+	deadline := time.Now().Add(wait)
+	buf := make([]byte, 64*1024)
+
+	for len(result) < len(rooms) {
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("rooms not complete after %s", wait)
+		}
+		for room, size := range rooms {
+			if _, done := result[room]; done {
+				continue
+			}
+			join, nonce, err := joinLine(id, room, size, candidates)
+			if err != nil {
+				return nil, err
+			}
+			nonces[nonce] = true
+			if err := l.send(server, viaRelay, []byte(join)); err != nil {
+				return nil, err
+			}
+		}
+
+		resend := time.Now().Add(2 * time.Second)
+		for time.Now().Before(resend) && len(result) < len(rooms) {
+			data, from, relayed, err := l.recv(buf, resend)
+			if err != nil {
+				break
+			}
+			if relayed != viaRelay || from.String() != server.String() {
+				continue
+			}
+			msg := string(data)
+			if strings.HasPrefix(msg, "ERR ") {
+				return nil, fmt.Errorf("rendezvous server: %s", strings.TrimPrefix(msg, "ERR "))
+			}
+			line, ok := verifyLine(id.secret, msg)
+			if !ok {
+				continue // forged, or for an earlier run
+			}
+			fields := strings.Fields(line)
+			if len(fields) < 3 || rooms[fields[1]] == 0 || !nonces[fields[2]] {
+				continue
+			}
+			switch fields[0] {
+			case "WAIT":
+				if len(fields) == 5 && waiting[fields[1]] != fields[3] {
+					waiting[fields[1]] = fields[3]
+					fmt.Printf("room %s: %s of %s members joined\n", fields[1], fields[3], fields[4])
+				}
+			case "PEERS":
+				peers, err := parsePeers(fields[3:])
+				if err != nil {
+					return nil, err
+				}
+				result[fields[1]] = peers
+			}
+		}
+	}
+	return result, nil
+}
+
+func parsePeers(fields []string) ([]roomPeer, error) {
+	var peers []roomPeer
+	for _, f := range fields {
+		user, list, ok := strings.Cut(f, "=")
+		if !ok {
+			return nil, fmt.Errorf("bad PEERS entry %q", f)
+		}
+		p := roomPeer{user: user}
+		for _, c := range strings.Split(list, ",") {
+			ap, err := netip.ParseAddrPort(c)
+			if err != nil {
+				return nil, fmt.Errorf("bad candidate %q", c)
+			}
+			p.candidates = append(p.candidates, net.UDPAddrFromAddrPort(ap))
+		}
+		peers = append(peers, p)
+	}
+	return peers, nil
+}
+
+// relayRoom names the two-member room two peers use to swap relayed
+// addresses. Both sides must derive the same name, so the users are
+// sorted.
+func relayRoom(room, a, b string) string {
+	users := []string{a, b}
+	sort.Strings(users)
+	return room + "/relay/" + users[0] + "+" + users[1]
+}
+
+// peerMessage parses the "ping <user>" / "pong <user>" datagrams peers
+// exchange.
+func peerMessage(b []byte) (kind, user string, ok bool) {
+	kind, user, ok = strings.Cut(string(b), " ")
+	if !ok || (kind != "ping" && kind != "pong") || user == "" {
+		return "", "", false
+	}
+	return kind, user, true
+}
+
+func formatCandidates(addrs []*net.UDPAddr) string {
+	s := make([]string, len(addrs))
+	for i, a := range addrs {
+		s[i] = a.String()
+	}
+	return strings.Join(s, ", ")
+}
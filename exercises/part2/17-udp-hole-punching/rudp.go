@@ -0,0 +1,623 @@
+package main
+
+// A small reliable, ordered byte stream over the punched (or relayed)
+// UDP path, exposed as a net.Conn so ordinary stream protocols can run
+// peer to peer. It borrows TCP's core ideas in miniature:
+//
+//   - every data segment has a sequence number; the receiver answers
+//     with a cumulative ACK (the next sequence it expects) and buffers
+//     out-of-order segments until the gap fills;
+//   - unacknowledged segments are retransmitted after an RTO computed
+//     from measured round trips (RFC 6298, with Karn's rule), or as
+//     soon as three duplicate ACKs say one was lost;
+//   - the receiver advertises how many more segments it can buffer,
+//     and the sender never has more than that in flight;
+//   - keepalives flow while the stream is idle, holding the NAT
+//     mapping open and detecting a peer that has gone away.
+//
+// Each segment starts with a 16-byte header:
+//
+//	magic(1) type(1) stream(4) seq(4) ack(4) window(2)
+//
+// In an ACK, seq instead echoes the data segment that prompted it, so
+// the sender can time that one segment's round trip even when the
+// cumulative ack doesn't move — the job TCP's timestamp option does.
+// ACKs prompted by nothing in particular echo rcvNxt-1, which is
+// already acknowledged.
+//
+// The magic byte has its top two bits set, so segments can never be
+// mistaken for STUN (top bits zero) or the peers' "ping" text.
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	rudpMagic      = 0xD7
+	rudpHeaderSize = 16
+	// rudpMaxPayload keeps a segment, plus TURN framing when relayed,
+	// under the 1280-byte IPv6 minimum MTU so it is never fragmented.
+	rudpMaxPayload = 1200 - rudpHeaderSize
+
+	segData      = 1
+	segAck       = 2
+	segFin       = 3
+	segKeepalive = 4
+
+	// rudpWindow is how many segments a receiver buffers.
+	rudpWindow = 256
+
+	initialRTO        = time.Second
+	minRTO            = 200 * time.Millisecond
+	maxRTO            = 10 * time.Second
+	keepaliveInterval = 5 * time.Second
+	idleTimeout       = 30 * time.Second
+	lingerTimeout     = 10 * time.Second
+	dupAckThreshold   = 3
+)
+
+var errPeerTimeout = errors.New("peer stopped responding")
+
+type segment struct {
+	typ     byte
+	stream  uint32
+	seq     uint32
+	ack     uint32
+	window  uint16
+	payload []byte
+}
+
+func (s *segment) marshal() []byte {
+	b := make([]byte, rudpHeaderSize, rudpHeaderSize+len(s.payload))
+	b[0] = rudpMagic
+	b[1] = s.typ
+	binary.BigEndian.PutUint32(b[2:], s.stream)
+	binary.BigEndian.PutUint32(b[6:], s.seq)
+	binary.BigEndian.PutUint32(b[10:], s.ack)
+	binary.BigEndian.PutUint16(b[14:], s.window)
+	return append(b, s.payload...)
+}
+
+func isSegment(b []byte) bool {
+	return len(b) >= rudpHeaderSize && b[0] == rudpMagic
+}
+
+func parseSegment(b []byte) (*segment, bool) {
+	if !isSegment(b) || b[1] < segData || b[1] > segKeepalive {
+		return nil, false
+	}
+	return &segment{
+		typ:     b[1],
+		stream:  binary.BigEndian.Uint32(b[2:]),
+		seq:     binary.BigEndian.Uint32(b[6:]),
+		ack:     binary.BigEndian.Uint32(b[10:]),
+		window:  binary.BigEndian.Uint16(b[14:]),
+		payload: append([]byte(nil), b[rudpHeaderSize:]...),
+	}, true
+}
+
+// seqLess compares sequence numbers so that wrap-around past 2^32
+// still orders correctly, the same trick TCP uses.
+func seqLess(a, b uint32) bool { return int32(a-b) < 0 }
+
+type outSegment struct {
+	seq           uint32
+	fin           bool
+	data          []byte
+	sent          time.Time
+	retransmitted bool
+}
+
+// streamConn is one reliable stream to one peer. Incoming segments are
+// handed to it with deliver by whoever reads the UDP socket.
+type streamConn struct {
+	id      uint32
+	send    func([]byte) error
+	local   net.Addr
+	remote  net.Addr
+	onClose func() // removes the stream from its table
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// Sender state.
+	sndNxt       uint32
+	inflight     []*outSegment
+	peerWindow   int
+	srtt, rttvar time.Duration
+	rto          time.Duration
+	retransmitAt time.Time
+	lastAck      uint32
+	dupAcks      int
+	// recoverUntil is sndNxt when a loss was detected; until it is
+	// acknowledged we are repairing holes (see processAck).
+	recovering   bool
+	recoverUntil uint32
+	writeClosed  bool // CloseWrite called: FIN queued
+	finAcked     bool
+
+	// Receiver state.
+	rcvNxt    uint32
+	pending   map[uint32]*segment // out of order, waiting for a gap to fill
+	readBuf   []byte
+	peerFin   bool // the peer's FIN has been received in order
+	advertWnd int
+
+	lastRecv      time.Time
+	lastSend      time.Time
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readClosed    bool
+	err           error // fatal: reported by every later call
+}
+
+func newStreamConn(id uint32, send func([]byte) error, local, remote net.Addr) *streamConn {
+	c := &streamConn{
+		id:         id,
+		send:       send,
+		local:      local,
+		remote:     remote,
+		peerWindow: rudpWindow,
+		rto:        initialRTO,
+		pending:    make(map[uint32]*segment),
+		advertWnd:  rudpWindow,
+		lastRecv:   time.Now(),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	go c.timerLoop()
+	return c
+}
+
+// window is how many segments past rcvNxt we can accept: the buffer
+// size less whatever the application hasn't read yet. Out-of-order
+// segments sit inside the window, so they don't shrink it. Must hold
+// c.mu.
+func (c *streamConn) window() int {
+	unread := (len(c.readBuf) + rudpMaxPayload - 1) / rudpMaxPayload
+	return max(rudpWindow-unread, 0)
+}
+
+// transmit sends a segment carrying our current ACK and window. Must
+// hold c.mu.
+func (c *streamConn) transmit(typ byte, seq uint32, payload []byte) {
+	c.advertWnd = c.window()
+	s := &segment{typ: typ, stream: c.id, seq: seq, ack: c.rcvNxt,
+		window: uint16(c.advertWnd), payload: payload}
+	c.send(s.marshal())
+	c.lastSend = time.Now()
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	written := 0
+	for len(b) > 0 {
+		if err := c.waitToSend(); err != nil {
+			return written, err
+		}
+		n := min(len(b), rudpMaxPayload)
+		seg := &outSegment{seq: c.sndNxt, data: append([]byte(nil), b[:n]...)}
+		c.queue(seg)
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// waitToSend blocks until the next sequence number falls inside the
+// window the peer last advertised. Must hold c.mu.
+func (c *streamConn) waitToSend() error {
+	for {
+		switch {
+		case c.err != nil:
+			return c.err
+		case c.writeClosed:
+			return net.ErrClosed
+		case !c.writeDeadline.IsZero() && time.Now().After(c.writeDeadline):
+			return os.ErrDeadlineExceeded
+		case seqLess(c.sndNxt, c.lastAck+uint32(c.peerWindow)):
+			return nil
+		}
+		c.cond.Wait()
+	}
+}
+
+// queue sends a new segment and tracks it until acknowledged. Must
+// hold c.mu.
+func (c *streamConn) queue(seg *outSegment) {
+	c.sndNxt++
+	seg.sent = time.Now()
+	if len(c.inflight) == 0 {
+		c.retransmitAt = seg.sent.Add(c.rto)
+	}
+	c.inflight = append(c.inflight, seg)
+	typ := byte(segData)
+	if seg.fin {
+		typ = segFin
+	}
+	c.transmit(typ, seg.seq, seg.data)
+}
+
+func (c *streamConn) retransmit(seg *outSegment) {
+	seg.retransmitted = true
+	typ := byte(segData)
+	if seg.fin {
+		typ = segFin
+	}
+	c.transmit(typ, seg.seq, seg.data)
+}
+
+// CloseWrite queues a FIN behind everything written so far. Once the
+// peer has read it all, its Read returns io.EOF; our Read keeps
+// working, like a TCP half-close.
+func (c *streamConn) CloseWrite() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.writeClosed {
+		return nil
+	}
+	if err := c.waitToSend(); err != nil {
+		return err
+	}
+	c.writeClosed = true
+	c.queue(&outSegment{seq: c.sndNxt, fin: true})
+	c.cond.Broadcast()
+	return nil
+}
+
+// Close half-closes the stream, waits (up to lingerTimeout) for the
+// FIN to be acknowledged, and stops reads. The stream lingers in the
+// background until the peer closes too, so it can still acknowledge
+// the peer's remaining data and FIN.
+func (c *streamConn) Close() error {
+	c.CloseWrite() // an error means the stream is already dead
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	deadline := time.Now().Add(lingerTimeout)
+	for !c.finAcked && c.err == nil && time.Now().Before(deadline) {
+		c.cond.Wait()
+	}
+	c.readClosed = true
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.readClosed {
+		return 0, net.ErrClosed
+	}
+	for len(c.readBuf) == 0 {
+		switch {
+		case c.peerFin:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		case !c.readDeadline.IsZero() && time.Now().After(c.readDeadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	// If we had told the sender our buffer was (nearly) full, tell it
+	// there's room again rather than waiting for its next probe.
+	if c.advertWnd < rudpWindow/4 && c.window() >= rudpWindow/4 {
+		c.transmit(segAck, c.rcvNxt-1, nil)
+	}
+	return n, nil
+}
+
+// deliver processes one segment from the peer.
+func (c *streamConn) deliver(s *segment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.lastRecv = time.Now()
+	c.processAck(s)
+
+	switch s.typ {
+	case segKeepalive:
+		c.transmit(segAck, c.rcvNxt-1, nil)
+	case segData, segFin:
+		c.receive(s)
+		// Always acknowledge, even duplicates: our earlier ACK may
+		// have been the packet that got lost.
+		c.transmit(segAck, s.seq, nil)
+	}
+	c.cond.Broadcast()
+}
+
+// processAck drops acknowledged segments, samples the round trip and
+// spots losses from duplicate ACKs. Must hold c.mu.
+func (c *streamConn) processAck(s *segment) {
+	if seqLess(s.ack, c.lastAck) {
+		return // reordered: an older ACK, and an older window
+	}
+	windowChanged := c.peerWindow != int(s.window)
+	c.peerWindow = int(s.window)
+	if s.typ == segAck && len(c.inflight) > 0 {
+		// Karn's rule: if the echoed segment was retransmitted, the
+		// ACK could be for either copy, so it can't be timed.
+		if i := int(s.seq - c.inflight[0].seq); i >= 0 && i < len(c.inflight) && !c.inflight[i].retransmitted {
+			c.updateRTO(time.Since(c.inflight[i].sent))
+		}
+	}
+	acked := 0
+	for acked < len(c.inflight) && seqLess(c.inflight[acked].seq, s.ack) {
+		if c.inflight[acked].fin {
+			c.finAcked = true
+		}
+		acked++
+	}
+	c.lastAck = s.ack
+	if acked > 0 {
+		c.inflight = c.inflight[acked:]
+		c.dupAcks = 0
+		c.retransmitAt = time.Now().Add(c.rto)
+		if c.recovering && seqLess(s.ack, c.recoverUntil) && len(c.inflight) > 0 {
+			// A partial ACK (NewReno, RFC 6582): the hole we repaired
+			// is filled but the next is exposed. Repair it now
+			// instead of waiting for another timeout.
+			c.retransmit(c.inflight[0])
+		} else {
+			c.recovering = false
+		}
+		return
+	}
+	// As in TCP, an ACK that reopens the window isn't a duplicate.
+	if s.typ == segAck && !windowChanged && len(c.inflight) > 0 {
+		c.dupAcks++
+		if c.dupAcks == dupAckThreshold {
+			// Fast retransmit: three ACKs for the same point mean
+			// later segments are arriving but this one isn't.
+			c.startRecovery()
+		}
+	}
+}
+
+// startRecovery resends the oldest unacknowledged segment and repairs
+// any further holes as partial ACKs reveal them. Must hold c.mu.
+func (c *streamConn) startRecovery() {
+	c.recovering = true
+	c.recoverUntil = c.sndNxt
+	c.retransmit(c.inflight[0])
+}
+
+// updateRTO applies RFC 6298's smoothing. Must hold c.mu.
+func (c *streamConn) updateRTO(sample time.Duration) {
+	if c.srtt == 0 {
+		c.srtt = sample
+		c.rttvar = sample / 2
+	} else {
+		delta := c.srtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttvar = (3*c.rttvar + delta) / 4
+		c.srtt = (7*c.srtt + sample) / 8
+	}
+	c.rto = min(max(c.srtt+4*c.rttvar, minRTO), maxRTO)
+}
+
+// receive buffers a data or FIN segment and moves whatever is now in
+// order into the read buffer. Must hold c.mu.
+func (c *streamConn) receive(s *segment) {
+	if seqLess(s.seq, c.rcvNxt) || !seqLess(s.seq, c.rcvNxt+uint32(c.window())) {
+		return // duplicate, or beyond the window we advertised
+	}
+	c.pending[s.seq] = s
+	for {
+		next, ok := c.pending[c.rcvNxt]
+		if !ok {
+			return
+		}
+		delete(c.pending, c.rcvNxt)
+		c.rcvNxt++
+		if next.typ == segFin {
+			c.peerFin = true
+			return
+		}
+		c.readBuf = append(c.readBuf, next.payload...)
+	}
+}
+
+// timerLoop drives retransmission, keepalives and the idle timeout.
+func (c *streamConn) timerLoop() {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	var closedAt time.Time
+	for range ticker.C {
+		c.mu.Lock()
+		now := time.Now()
+		if c.err != nil {
+			c.mu.Unlock()
+			return
+		}
+		if now.Sub(c.lastRecv) > idleTimeout {
+			c.mu.Unlock()
+			c.fail(errPeerTimeout)
+			return
+		}
+		if c.readClosed && closedAt.IsZero() {
+			closedAt = now
+		}
+		// Both directions finished, or we gave up waiting for the peer
+		// after our own Close: the stream is done.
+		if (c.finAcked && c.peerFin) || (!closedAt.IsZero() && now.Sub(closedAt) > lingerTimeout) {
+			c.mu.Unlock()
+			c.fail(net.ErrClosed)
+			return
+		}
+
+		if len(c.inflight) > 0 && now.After(c.retransmitAt) {
+			// Only the oldest segment is resent; the back-off doubles
+			// the RTO until an ACK proves the path works again.
+			c.startRecovery()
+			c.rto = min(c.rto*2, maxRTO)
+			c.retransmitAt = now.Add(c.rto)
+		} else if now.Sub(c.lastSend) > keepaliveInterval ||
+			(c.peerWindow == 0 && now.Sub(c.lastSend) > c.rto) {
+			// Also probes a closed window, whose reopening ACK might
+			// have been lost.
+			c.transmit(segKeepalive, c.sndNxt, nil)
+		}
+		// Wake waiters so they notice expired deadlines.
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	}
+}
+
+// fail records a fatal error, wakes everyone, and unregisters the
+// stream.
+func (c *streamConn) fail(err error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.err = err
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	if c.onClose != nil {
+		c.onClose()
+	}
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.local }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	return nil
+}
+
+// streamKey identifies a stream: ids are picked at random by whichever
+// side opens it, so they only need to be unique per peer.
+type streamKey struct {
+	user string
+	id   uint32
+}
+
+// streamTable routes incoming segments to their streams and creates a
+// stream when a peer opens one.
+type streamTable struct {
+	l        *link
+	onAccept func(user string, c *streamConn)
+
+	mu      sync.Mutex
+	streams map[streamKey]*streamConn
+	// finished remembers recently closed streams, so a late
+	// retransmission of their first segment isn't taken for a new one.
+	finished map[streamKey]time.Time
+}
+
+func newStreamTable(l *link, onAccept func(user string, c *streamConn)) *streamTable {
+	return &streamTable{
+		l:        l,
+		onAccept: onAccept,
+		streams:  make(map[streamKey]*streamConn),
+		finished: make(map[streamKey]time.Time),
+	}
+}
+
+// add creates and registers a stream to user over r. Must hold t.mu.
+func (t *streamTable) add(key streamKey, r route) *streamConn {
+	c := newStreamConn(key.id, func(b []byte) error {
+		return t.l.send(r.addr, r.relayed, b)
+	}, t.l.conn.LocalAddr(), r.addr)
+	c.onClose = func() {
+		t.mu.Lock()
+		delete(t.streams, key)
+		t.finished[key] = time.Now()
+		t.mu.Unlock()
+	}
+	t.streams[key] = c
+	return c
+}
+
+// open starts a new stream to user. An empty segment 0 announces it
+// straight away, so the peer can accept it before we have anything to
+// write — protocols where the server speaks first need that.
+func (t *streamTable) open(user string, r route) (*streamConn, error) {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	key := streamKey{user: user, id: binary.BigEndian.Uint32(b[:])}
+	t.mu.Lock()
+	if _, taken := t.streams[key]; taken {
+		t.mu.Unlock()
+		return nil, errors.New("stream id collision, try again")
+	}
+	c := t.add(key, r)
+	t.mu.Unlock()
+
+	c.mu.Lock()
+	c.queue(&outSegment{seq: c.sndNxt})
+	c.mu.Unlock()
+	return c, nil
+}
+
+// dispatch hands a segment from user, arriving over r, to its stream.
+func (t *streamTable) dispatch(user string, r route, b []byte) {
+	s, ok := parseSegment(b)
+	if !ok {
+		return
+	}
+	key := streamKey{user: user, id: s.stream}
+	t.mu.Lock()
+	for k, at := range t.finished {
+		if time.Since(at) > 2*lingerTimeout {
+			delete(t.finished, k)
+		}
+	}
+	c, known := t.streams[key]
+	_, done := t.finished[key]
+	var accepted *streamConn
+	if !known && !done && s.typ == segData && s.seq == 0 {
+		c = t.add(key, r)
+		accepted = c
+	}
+	t.mu.Unlock()
+
+	if c == nil {
+		if done && s.typ == segFin {
+			// We finished and forgot the stream, so our ACK of the
+			// peer's FIN must have been lost; acknowledge it again.
+			ack := &segment{typ: segAck, stream: s.stream, seq: s.ack, ack: s.seq + 1, window: rudpWindow}
+			t.l.send(r.addr, r.relayed, ack.marshal())
+		}
+		return
+	}
+	c.deliver(s)
+	if accepted != nil {
+		go t.onAccept(user, accepted)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	mrand "math/rand"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyPair connects two streams through a path that drops a share of
+// segments and delays the rest by a random few milliseconds, which
+// also reorders them.
+func lossyPair(t *testing.T, loss float64) (a, b *streamConn) {
+	t.Helper()
+	var mu sync.Mutex
+	rng := mrand.New(mrand.NewSource(1))
+	path := func(to **streamConn) func([]byte) error {
+		return func(p []byte) error {
+			mu.Lock()
+			drop := rng.Float64() < loss
+			delay := time.Duration(rng.Intn(20)) * time.Millisecond
+			mu.Unlock()
+			if drop {
+				return nil
+			}
+			s, ok := parseSegment(p)
+			if !ok {
+				t.Errorf("unparseable segment % x", p)
+				return nil
+			}
+			time.AfterFunc(delay, func() { (*to).deliver(s) })
+			return nil
+		}
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	a = newStreamConn(7, path(&b), addr, addr)
+	b = newStreamConn(7, path(&a), addr, addr)
+	t.Cleanup(func() {
+		a.fail(net.ErrClosed)
+		b.fail(net.ErrClosed)
+	})
+	return a, b
+}
+
+func TestStreamSurvivesLossAndReordering(t *testing.T) {
+	a, b := lossyPair(t, 0.1)
+	want := make([]byte, 1<<20)
+	rand.Read(want)
+
+	// Both directions at once, each ending in a half-close.
+	var got, back []byte
+	var gotErr, backErr error
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		got, gotErr = io.ReadAll(b)
+	}()
+	go func() {
+		defer wg.Done()
+		back, backErr = io.ReadAll(a)
+	}()
+	go func() {
+		defer wg.Done()
+		b.Write(want[:4096])
+		b.CloseWrite()
+	}()
+
+	if _, err := a.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if gotErr != nil || !bytes.Equal(got, want) {
+		t.Fatalf("received %d of %d bytes: %v", len(got), len(want), gotErr)
+	}
+	if backErr != nil || !bytes.Equal(back, want[:4096]) {
+		t.Fatalf("reverse direction: %d bytes, %v", len(back), backErr)
+	}
+}
+
+func TestStreamFlowControlBlocksWriter(t *testing.T) {
+	a, b := lossyPair(t, 0)
+
+	// b never reads, so once its window fills a's writes must stall
+	// rather than buffer without limit.
+	a.SetWriteDeadline(time.Now().Add(time.Second))
+	n, err := a.Write(make([]byte, 2*rudpWindow*rudpMaxPayload))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("write returned %v, want a deadline error", err)
+	}
+	if n > rudpWindow*rudpMaxPayload {
+		t.Fatalf("wrote %d bytes past a %d-segment window", n, rudpWindow)
+	}
+
+	// Reading everything reopens the window and the rest goes through.
+	a.SetWriteDeadline(time.Time{})
+	go func() {
+		a.Write(make([]byte, rudpMaxPayload))
+		a.CloseWrite()
+	}()
+	got, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != n+rudpMaxPayload {
+		t.Fatalf("read %d bytes, want %d", len(got), n+rudpMaxPayload)
+	}
+}
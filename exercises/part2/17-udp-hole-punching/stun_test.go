@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"net"
+	"strings"
+	"testing"
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// The RFC 5769 test vectors that carry MESSAGE-INTEGRITY. The first
+// three use the short-term credential the RFC gives, whose key is the
+// password itself; the last uses a long-term credential.
+func TestRFC5769Integrity(t *testing.T) {
+	shortTerm := []byte("VOkJxbRl1RmTxUk/WvJxBt")
+	tests := []struct {
+		name   string
+		packet []byte
+		key    []byte
+	}{
+		{"request", mustHex(`
+			00 01 00 58 21 12 a4 42 b7 e7 a7 01 bc 34 d6 86 fa 87 df ae
+			80 22 00 10 53 54 55 4e 20 74 65 73 74 20 63 6c 69 65 6e 74
+			00 24 00 04 6e 00 01 ff
+			80 29 00 08 93 2f f9 b1 51 26 3b 36
+			00 06 00 09 65 76 74 6a 3a 68 36 76 59 20 20 20
+			00 08 00 14 9a ea a7 0c bf d8 cb 56 78 1e f2 b5 b2 d3 f2 49 c1 b5 71 a2
+			80 28 00 04 e5 7a 3b cf`), shortTerm},
+		{"IPv4 response", mustHex(`
+			01 01 00 3c 21 12 a4 42 b7 e7 a7 01 bc 34 d6 86 fa 87 df ae
+			80 22 00 0b 74 65 73 74 20 76 65 63 74 6f 72 20
+			00 20 00 08 00 01 a1 47 e1 12 a6 43
+			00 08 00 14 2b 91 f5 99 fd 9e 90 c3 8c 74 89 f9 2a f9 ba 53 f0 6b e7 d7
+			80 28 00 04 c0 7d 4c 96`), shortTerm},
+		{"IPv6 response", mustHex(`
+			01 01 00 48 21 12 a4 42 b7 e7 a7 01 bc 34 d6 86 fa 87 df ae
+			80 22 00 0b 74 65 73 74 20 76 65 63 74 6f 72 20
+			00 20 00 14 00 02 a1 47 01 13 a9 fa a5 d3 f1 79 bc 25 f4 b5 be d2 b9 d9
+			00 08 00 14 a3 82 95 4e 4b e6 7b f1 17 84 c9 7c 82 92 c2 75 bf e3 ed 41
+			80 28 00 04 c8 fb 0b 4c`), shortTerm},
+		// USERNAME "マトリックス", REALM "example.org", and the
+		// password after SASLprep, "TheMatrIX".
+		{"long-term request", mustHex(`
+			00 01 00 60 21 12 a4 42 78 ad 34 33 c6 ad 72 c0 29 da 41 2e
+			00 06 00 12 e3 83 9e e3 83 88 e3 83 aa e3 83 83 e3 82 af e3 82 b9 00 00
+			00 15 00 1c 66 2f 2f 34 39 39 6b 39 35 34 64 36 4f 4c 33 34 6f 4c 39 46 53 54 76 79 36 34 73 41
+			00 14 00 0b 65 78 61 6d 70 6c 65 2e 6f 72 67 00
+			00 08 00 14 f6 70 24 65 6d d6 4a 3e 02 b8 e0 71 2e 85 c9 a2 8c a8 96 66`),
+			longTermKey("マトリックス", "example.org", "TheMatrIX")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := parseSTUN(tt.packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !m.verifyIntegrity(tt.key) {
+				t.Error("MESSAGE-INTEGRITY doesn't verify")
+			}
+			if m.verifyIntegrity([]byte("wrong password")) {
+				t.Error("MESSAGE-INTEGRITY verifies under the wrong key")
+			}
+		})
+	}
+}
+
+func TestSignedRoundTrip(t *testing.T) {
+	txID, _ := newTransactionID()
+	key := longTermKey("alice", "relay", "secret")
+	m := &stunMessage{Type: typeAllocateRequest, TxID: txID}
+	m.add(attrSoftware, []byte("three")) // odd length, padded
+	b := m.encodeSigned(key)
+
+	got, err := parseSTUN(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.verifyIntegrity(key) {
+		t.Error("own signature doesn't verify")
+	}
+	if got.verifyIntegrity(longTermKey("alice", "relay", "guess")) {
+		t.Error("verifies under the wrong password")
+	}
+	if v, _ := got.get(attrSoftware); string(v) != "three" {
+		t.Errorf("SOFTWARE %q", v)
+	}
+
+	// A tampered attribute fails integrity even with the fingerprint
+	// fixed up to match.
+	tampered := append([]byte(nil), b...)
+	tampered[stunHeaderSize+4] = 'T'
+	off := len(tampered) - 8
+	binary.BigEndian.PutUint32(tampered[off+4:], crc32.ChecksumIEEE(tampered[:off])^fingerprintXOR)
+	forged, err := parseSTUN(tampered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forged.verifyIntegrity(key) {
+		t.Error("a tampered message verifies")
+	}
+
+	// Unsigned messages never verify.
+	plain, _ := parseSTUN(m.encode(true))
+	if plain.verifyIntegrity(key) {
+		t.Error("an unsigned message verifies")
+	}
+}
+
+// The address STUN reports becomes our first candidate, ahead of the
+// host addresses.
+func TestReflexiveCandidate(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	public := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 9).To4(), Port: 40000}
+	go func() {
+		buf := make([]byte, 1500)
+		n, from, err := server.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req, err := parseSTUN(buf[:n])
+		if err != nil {
+			return
+		}
+		// Pretend a NAT rewrote the source address.
+		resp := &stunMessage{Type: typeBindingSuccess, TxID: req.TxID}
+		resp.add(attrXORMappedAddress, encodeAddress(public, req.TxID, true))
+		server.WriteToUDP(resp.encode(true), from)
+	}()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reflexive, err := discoverReflexive(conn, server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflexive.String() != public.String() {
+		t.Fatalf("reflexive address %s, want %s", reflexive, public)
+	}
+
+	host := []*net.UDPAddr{conn.LocalAddr().(*net.UDPAddr)}
+	for i := 0; i < 8; i++ {
+		host = append(host, &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 5000})
+	}
+	got := withReflexive(reflexive, host)
+	if len(got) != 7 || got[0] != reflexive || got[1] != host[0] {
+		t.Errorf("candidates %v", got)
+	}
+	// No NAT: the reflexive address is a host address and isn't repeated.
+	if got := withReflexive(host[0], host[:2]); len(got) != 2 {
+		t.Errorf("candidates %v", got)
+	}
+}
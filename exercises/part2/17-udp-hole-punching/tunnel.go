@@ -0,0 +1,96 @@
+package main
+
+// Carries TCP connections over reliable streams (see rudp.go), so any
+// TCP protocol can run between peers: -forward listens locally and
+// opens a stream to a peer per connection; -expose, on the peer,
+// dials a local service for every stream that arrives. For example, to
+// run the file transfer of chapter 14 peer to peer, start its server on
+// bob's machine and:
+//
+//	bob$   17-udp-hole-punching -expose 127.0.0.1:9100 ... room
+//	alice$ 17-udp-hole-punching -forward 127.0.0.1:9000 ... room
+//	alice$ 14-tcp-file-transfer-client -addr 127.0.0.1:9000 ...
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+)
+
+// forward accepts TCP connections on addr until ctx ends, bridging
+// each over a new stream to user.
+func forward(ctx context.Context, addr string, streams *streamTable, user string, r route) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	fmt.Println("forwarding", ln.Addr(), "to", user)
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				s, err := streams.open(user, r)
+				if err != nil {
+					fmt.Println("error:", err)
+					conn.Close()
+					return
+				}
+				fmt.Println("tunnelling", conn.RemoteAddr(), "to", user)
+				bridge(conn, s)
+			}(conn)
+		}
+	}()
+	return nil
+}
+
+// exposeTo returns the handler for streams peers open: each is bridged
+// to a new TCP connection to target, or refused if target is empty.
+func exposeTo(target string) func(user string, s *streamConn) {
+	return func(user string, s *streamConn) {
+		if target == "" {
+			fmt.Println("refusing stream from", user, "(no -expose)")
+			s.Close()
+			return
+		}
+		conn, err := net.Dial("tcp", target)
+		if err != nil {
+			fmt.Println("error:", err)
+			s.Close()
+			return
+		}
+		fmt.Println("tunnelling stream from", user, "to", target)
+		bridge(conn, s)
+	}
+}
+
+// bridge copies both ways until both sides are done. A clean EOF is
+// passed on as a half-close, so protocols that signal "end of request"
+// by shutting down their write side still work; an error tears the
+// whole connection down.
+func bridge(conn net.Conn, s *streamConn) {
+	done := make(chan struct{})
+	go func() {
+		if _, err := io.Copy(s, conn); err != nil {
+			s.Close()
+		} else {
+			s.CloseWrite()
+		}
+		close(done)
+	}()
+	if _, err := io.Copy(conn, s); err != nil {
+		conn.Close() // unblocks the copy above
+	} else if tc, ok := conn.(*net.TCPConn); ok {
+		tc.CloseWrite()
+	}
+	<-done
+	conn.Close()
+	s.Close()
+}
@@ -0,0 +1,278 @@
+package main
+
+// A client for the TURN-style relay in 17-rendezvous-server/relay.go,
+// used when hole punching times out (see relayFallback). It allocates
+// a relayed address, grants peers permission to reach it, and wraps
+// application data in Send indications; the relay hands back whatever
+// peers send to the relayed address as Data indications.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	typeAllocateRequest   uint16 = 0x0003
+	typeRefreshRequest    uint16 = 0x0004
+	typePermissionRequest uint16 = 0x0008
+	typeSendIndication    uint16 = 0x0016
+	typeDataIndication    uint16 = 0x0017
+
+	attrLifetime           uint16 = 0x000D
+	attrXORPeerAddress     uint16 = 0x0012
+	attrData               uint16 = 0x0013
+	attrXORRelayedAddress  uint16 = 0x0016
+	attrRequestedTransport uint16 = 0x0019
+
+	protocolUDP = 17
+)
+
+type turnClient struct {
+	conn     *net.UDPConn
+	server   *net.UDPAddr
+	username string
+	password string
+
+	// Learned from the server's first 401 challenge.
+	realm string
+	nonce string
+	key   []byte
+
+	relayed  *net.UDPAddr
+	lifetime time.Duration
+
+	// For keepAlive: when to next refresh the allocation and the
+	// permissions, and which peers hold one.
+	refreshAt time.Time
+	permitAt  time.Time
+	permitted []*net.UDPAddr
+}
+
+// request sends an authenticated request and returns the success
+// response. attrs builds the request's attributes for a given
+// transaction ID, since XOR-encoded addresses depend on it. The first
+// attempt goes out unsigned; the server answers 401 with its realm
+// and a nonce, and we retry signed. A 438 (stale nonce) is retried
+// the same way with the fresh nonce it carries.
+func (c *turnClient) request(typ uint16, attrs func(txID [12]byte) []stunAttr) (*stunMessage, error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		txID, err := newTransactionID()
+		if err != nil {
+			return nil, err
+		}
+		req := &stunMessage{Type: typ, TxID: txID, Attrs: attrs(txID)}
+		var packet []byte
+		if c.key != nil {
+			req.add(attrUsername, []byte(c.username))
+			req.add(attrRealm, []byte(c.realm))
+			req.add(attrNonce, []byte(c.nonce))
+			packet = req.encodeSigned(c.key)
+		} else {
+			packet = req.encode(true)
+		}
+
+		resp, _, err := stunExchange(c.conn, c.server, packet, txID, 5*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Type == typ|0x0100 {
+			if c.key != nil && !resp.verifyIntegrity(c.key) {
+				return nil, errors.New("relay response failed integrity check")
+			}
+			return resp, nil
+		}
+
+		switch code := resp.errorCode(); code {
+		case 401, 438:
+			realm, _ := resp.get(attrRealm)
+			nonce, _ := resp.get(attrNonce)
+			if code == 401 && c.key != nil {
+				// We already signed with the server's realm and nonce:
+				// the credentials themselves are wrong.
+				return nil, errors.New("relay rejected our credentials")
+			}
+			c.realm, c.nonce = string(realm), string(nonce)
+			c.key = longTermKey(c.username, c.realm, c.password)
+		default:
+			return nil, fmt.Errorf("relay error %d", code)
+		}
+	}
+	return nil, errors.New("relay authentication did not converge")
+}
+
+// allocate asks the relay for a relayed address.
+func (c *turnClient) allocate() error {
+	resp, err := c.request(typeAllocateRequest, func([12]byte) []stunAttr {
+		return []stunAttr{{Type: attrRequestedTransport, Value: []byte{protocolUDP, 0, 0, 0}}}
+	})
+	if err != nil {
+		return err
+	}
+	v, ok := resp.get(attrXORRelayedAddress)
+	if !ok {
+		return errors.New("allocate response has no relayed address")
+	}
+	if c.relayed, err = decodeAddress(v, resp.TxID, true); err != nil {
+		return err
+	}
+	c.lifetime = 10 * time.Minute
+	if v, ok := resp.get(attrLifetime); ok && len(v) == 4 {
+		c.lifetime = time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+	}
+	c.refreshAt = time.Now().Add(c.lifetime / 2)
+	return nil
+}
+
+// refresh extends the allocation; a lifetime of zero releases it.
+func (c *turnClient) refresh(lifetime time.Duration) error {
+	_, err := c.request(typeRefreshRequest, func([12]byte) []stunAttr {
+		v := binary.BigEndian.AppendUint32(nil, uint32(lifetime/time.Second))
+		return []stunAttr{{Type: attrLifetime, Value: v}}
+	})
+	return err
+}
+
+// permit lets traffic from peer's IP reach our relayed address. The
+// relay forgets permissions after five minutes, so callers refresh
+// them periodically.
+func (c *turnClient) permit(peer *net.UDPAddr) error {
+	_, err := c.request(typePermissionRequest, func(txID [12]byte) []stunAttr {
+		return []stunAttr{{Type: attrXORPeerAddress, Value: encodeAddress(peer, txID, true)}}
+	})
+	if err != nil {
+		return err
+	}
+	c.permitAt = time.Now().Add(4 * time.Minute)
+	for _, p := range c.permitted {
+		if p.IP.Equal(peer.IP) {
+			return nil
+		}
+	}
+	c.permitted = append(c.permitted, peer)
+	return nil
+}
+
+// keepAlive refreshes the allocation at half its lifetime and the
+// permissions a minute before the relay would forget them. Call it
+// regularly from the read loop.
+func (c *turnClient) keepAlive() error {
+	now := time.Now()
+	if now.After(c.refreshAt) {
+		if err := c.refresh(c.lifetime); err != nil {
+			return err
+		}
+		c.refreshAt = now.Add(c.lifetime / 2)
+	}
+	if now.After(c.permitAt) {
+		for _, p := range c.permitted {
+			if err := c.permit(p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// send relays data to peer through our allocation.
+func (c *turnClient) send(peer *net.UDPAddr, data []byte) error {
+	txID, err := newTransactionID()
+	if err != nil {
+		return err
+	}
+	ind := &stunMessage{Type: typeSendIndication, TxID: txID}
+	ind.add(attrXORPeerAddress, encodeAddress(peer, txID, true))
+	ind.add(attrData, data)
+	_, err = c.conn.WriteToUDP(ind.encode(true), c.server)
+	return err
+}
+
+// parseDataIndication unwraps a Data indication from the relay,
+// returning the peer it came from and its payload.
+func parseDataIndication(packet []byte) (*net.UDPAddr, []byte, bool) {
+	msg, err := parseSTUN(packet)
+	if err != nil || msg.Type != typeDataIndication {
+		return nil, nil, false
+	}
+	peerAttr, ok1 := msg.get(attrXORPeerAddress)
+	data, ok2 := msg.get(attrData)
+	if !ok1 || !ok2 {
+		return nil, nil, false
+	}
+	peer, err := decodeAddress(peerAttr, msg.TxID, true)
+	if err != nil {
+		return nil, nil, false
+	}
+	return peer, data, true
+}
+
+// newTurnClient prepares a client for the relay at server, sharing
+// conn, with the password read from passFile.
+func newTurnClient(conn *net.UDPConn, server, user, passFile string) (*turnClient, error) {
+	addr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	if user == "" || passFile == "" {
+		return nil, errors.New("-relay needs -relay-user and -relay-pass-file")
+	}
+	pass, err := os.ReadFile(passFile)
+	if err != nil {
+		return nil, err
+	}
+	return &turnClient{
+		conn:     conn,
+		server:   addr,
+		username: user,
+		password: strings.TrimSpace(string(pass)),
+	}, nil
+}
+
+// relayFallback allocates a relayed address and swaps relayed
+// addresses with each unreached peer through a two-member room of its
+// own (see relayRoom). The JOINs go out through the relay, so the
+// rendezvous server sees — and hands the other peer — our relayed
+// address rather than our NAT's. The routes are added to routes.
+func relayFallback(l *link, relay, user, passFile string, rendezvous *net.UDPAddr,
+	id identity, room string, unreached []roomPeer, routes map[string]route,
+) error {
+	client, err := newTurnClient(l.conn, relay, user, passFile)
+	if err != nil {
+		return err
+	}
+	if err := client.allocate(); err != nil {
+		return fmt.Errorf("relay allocation: %w", err)
+	}
+	l.relay = client
+	fmt.Println("relayed address:", client.relayed)
+
+	if err := client.permit(rendezvous); err != nil {
+		return fmt.Errorf("relay permission: %w", err)
+	}
+	pairs := make(map[string]int)
+	for _, p := range unreached {
+		pairs[relayRoom(room, id.user, p.user)] = 2
+	}
+	rooms, err := register(l, true, rendezvous, id, pairs, nil, time.Minute)
+	if err != nil {
+		return err
+	}
+	for _, members := range rooms {
+		for _, p := range members {
+			if len(p.candidates) == 0 {
+				continue
+			}
+			peer := p.candidates[0]
+			fmt.Println(p.user, "relayed address:", peer)
+			if err := client.permit(peer); err != nil {
+				return fmt.Errorf("relay permission: %w", err)
+			}
+			routes[p.user] = route{addr: peer, relayed: true}
+		}
+	}
+	return nil
+}
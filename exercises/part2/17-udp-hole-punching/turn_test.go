@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startRendezvousServer builds and runs ../17-rendezvous-server with
+// its relay on loopback, returning the rendezvous and relay addresses.
+// It's a separate program, so this is the only way to drive the real
+// relay from here.
+func startRendezvousServer(t *testing.T, users, relayUsers string) (rendezvous, relay *net.UDPAddr) {
+	t.Helper()
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("needs the go tool to build 17-rendezvous-server")
+	}
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "rendezvous-server")
+	build := exec.Command("go", "build", "-o", bin, ".")
+	build.Dir = "../17-rendezvous-server"
+	build.Env = append(os.Environ(), "GO111MODULE=off")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("building the rendezvous server: %v\n%s", err, out)
+	}
+	usersFile := filepath.Join(dir, "users")
+	relayFile := filepath.Join(dir, "relay-users")
+	os.WriteFile(usersFile, []byte(users), 0o600)
+	os.WriteFile(relayFile, []byte(relayUsers), 0o600)
+
+	cmd := exec.Command(bin, "-addr", "127.0.0.1:0", "-relay", "127.0.0.1:0",
+		"-relay-ip", "127.0.0.1", "-users", usersFile, "-relay-users", relayFile)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	// The server prints where it listens, rendezvous first.
+	lines := bufio.NewScanner(stdout)
+	for rendezvous == nil || relay == nil {
+		if !lines.Scan() {
+			t.Fatal("rendezvous server exited before it was listening")
+		}
+		line := lines.Text()
+		var addr string
+		switch {
+		case strings.HasPrefix(line, "rendezvous server listening on "):
+			addr = strings.TrimPrefix(line, "rendezvous server listening on ")
+		case strings.HasPrefix(line, "relay listening on "):
+			addr, _, _ = strings.Cut(strings.TrimPrefix(line, "relay listening on "), ",")
+		default:
+			continue
+		}
+		a, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rendezvous == nil {
+			rendezvous = a
+		} else {
+			relay = a
+		}
+	}
+	go func() {
+		for lines.Scan() {
+		}
+	}()
+	return rendezvous, relay
+}
+
+// symmetricNAT sits between one peer and one destination. The peer
+// sends to inside, and the NAT forwards from outside, a port of its
+// own; only packets from the destination are let back in. Nobody but
+// that destination can reach the peer, which is exactly the case hole
+// punching can't solve.
+type symmetricNAT struct {
+	inside, outside *net.UDPConn
+}
+
+func newSymmetricNAT(t *testing.T, dst *net.UDPAddr) *symmetricNAT {
+	t.Helper()
+	n := &symmetricNAT{inside: listenLoopback(t), outside: listenLoopback(t)}
+	var mu sync.Mutex
+	var peer *net.UDPAddr
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			size, from, err := n.inside.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			peer = from
+			mu.Unlock()
+			n.outside.WriteToUDP(buf[:size], dst)
+		}
+	}()
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			size, from, err := n.outside.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			to := peer
+			mu.Unlock()
+			if from.String() == dst.String() && to != nil {
+				n.inside.WriteToUDP(buf[:size], to)
+			}
+		}
+	}()
+	return n
+}
+
+func listenLoopback(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// TestRelayFallback runs relayFallback for two peers, each behind a
+// symmetric NAT, against the relay in 17-rendezvous-server: the
+// allocation, permissions, the relayed registration and the Send and
+// Data indications all go through the real client and server.
+func TestRelayFallback(t *testing.T) {
+	rendezvousAddr, relayAddr := startRendezvousServer(t,
+		"alice:alice-secret\nbob:bob-secret\n", "alice:alice-pass\nbob:bob-pass\n")
+	passDir := t.TempDir()
+
+	type peer struct {
+		id     identity
+		l      *link
+		nat    *symmetricNAT
+		routes map[string]route
+	}
+	var peers []*peer
+	for _, user := range []string{"alice", "bob"} {
+		os.WriteFile(filepath.Join(passDir, user), []byte(user+"-pass\n"), 0o600)
+		peers = append(peers, &peer{
+			id:     identity{user: user, secret: user + "-secret"},
+			l:      &link{conn: listenLoopback(t)},
+			nat:    newSymmetricNAT(t, relayAddr),
+			routes: make(map[string]route),
+		})
+	}
+	alice, bob := peers[0], peers[1]
+
+	// Both fall back at once, as two peers whose punches failed would.
+	errs := make(chan error, 2)
+	for i, p := range peers {
+		other := peers[1-i]
+		go func() {
+			errs <- relayFallback(p.l, p.nat.inside.LocalAddr().String(), p.id.user,
+				filepath.Join(passDir, p.id.user), rendezvousAddr, p.id, "room",
+				[]roomPeer{{user: other.id.user}}, p.routes)
+		}()
+	}
+	for range peers {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, p := range peers {
+		other := peers[1-i]
+		r, ok := p.routes[other.id.user]
+		if !ok || !r.relayed || r.addr.String() != other.l.relay.relayed.String() {
+			t.Fatalf("%s's route to %s: %+v, want relayed via %s", p.id.user, other.id.user, r, other.l.relay.relayed)
+		}
+	}
+
+	// Data flows both ways through the relay.
+	buf := make([]byte, 1500)
+	exchange := func(from, to *peer, msg string) {
+		t.Helper()
+		if err := from.l.send(from.routes[to.id.user].addr, true, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		data, src, relayed, err := to.l.recv(buf, time.Now().Add(2*time.Second))
+		if err != nil || string(data) != msg || !relayed || src.String() != from.l.relay.relayed.String() {
+			t.Fatalf("%s got %q from %v (relayed %v), %v", to.id.user, data, src, relayed, err)
+		}
+	}
+	exchange(alice, bob, "hello bob")
+	exchange(bob, alice, "hello alice")
+
+	// A packet sent straight to alice's NAT mapping, the address the
+	// relay sees, is dropped: that's why the relay was needed.
+	bob.l.conn.WriteToUDP([]byte("ping bob"), alice.nat.outside.LocalAddr().(*net.UDPAddr))
+	if data, _, _, err := alice.l.recv(buf, time.Now().Add(200*time.Millisecond)); err == nil {
+		t.Fatalf("a direct packet got through the NAT: %q", data)
+	}
+
+	// Refreshing the allocation and permissions keeps working, and a
+	// zero-lifetime refresh releases the allocation.
+	alice.l.relay.refreshAt, alice.l.relay.permitAt = time.Time{}, time.Time{}
+	if err := alice.l.relay.keepAlive(); err != nil {
+		t.Fatalf("keepAlive: %v", err)
+	}
+	exchange(bob, alice, "still there")
+	if err := alice.l.relay.refresh(0); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	bob.l.send(bob.routes["alice"].addr, true, []byte("gone"))
+	if data, _, _, err := alice.l.recv(buf, time.Now().Add(300*time.Millisecond)); err == nil {
+		t.Errorf("released allocation still delivered %q", data)
+	}
+}